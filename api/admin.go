@@ -73,11 +73,15 @@ func (a *Api) forceDocumentProcessing(c echo.Context) error {
 	// In addition, step can be configured. Possible steps are:
 	// * 1. 'hash' (calculate document hash)
 	// * 2. 'thumbnail' (create document thumbnail)
-	// * 3. 'content' (extract content with suitable tool)
-	// * 4. 'rules' (run metadata-rules)
-	// * 5. 'fts' (index document in full-text-search engine)
+	// * 3. 'barcodes' (decode barcodes and qr codes)
+	// * 4. 'content' (extract content with suitable tool)
+	// * 5. 'properties' (extract file properties: pdf info or exif data)
+	// * 6. 'fields' (extract invoice fields: amount, due date, iban etc.)
+	// * 7. 'duplicates' (find near-duplicate documents)
+	// * 8. 'rules' (run metadata-rules)
+	// * 9. 'fts' (index document in full-text-search engine)
 	//
-	// Steps are in order. Supplying e.g. 'content' will result in executing steps 3, 4 and 5.
+	// Steps are in order. Supplying e.g. 'content' will result in executing steps 4, 5, 6, 7, 8 and 9.
 	// Empty body will result in all documents being processed from step 1.
 	// Depending on document content, processing on document takes anywhere from a second to minutes.
 	// Consumes:
@@ -101,8 +105,16 @@ func (a *Api) forceDocumentProcessing(c echo.Context) error {
 		step = models.ProcessHash
 	case "thumbnail":
 		step = models.ProcessThumbnail
+	case "barcodes":
+		step = models.ProcessBarcodes
 	case "content":
 		step = models.ProcessParseContent
+	case "properties":
+		step = models.ProcessProperties
+	case "fields":
+		step = models.ProcessFields
+	case "duplicates":
+		step = models.ProcessDuplicates
 	case "rules":
 		step = models.ProcessRules
 	case "fts":
@@ -537,6 +549,7 @@ func (a *Api) adminRestoreDeletedDocument(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	a.runTriggeredRules(document.UserId, []string{docId}, models.RuleTriggerRestore)
 
 	doc, err := a.db.DocumentStore.GetDocument(0, docId)
 	err = a.search.IndexDocuments(&[]models.Document{*doc}, doc.UserId)
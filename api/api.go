@@ -80,7 +80,7 @@ func NewApi(database *storage.Database) (*Api, error) {
 		return api, err
 	}
 
-	api.cron, err = process.NewCron(database)
+	api.cron, err = process.NewCron(database, api.search)
 	if err != nil {
 		return api, err
 	}
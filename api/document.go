@@ -57,9 +57,17 @@ type DocumentResponse struct {
 	Type        string            `json:"type"`
 	Size        int64             `json:"size"`
 	PrettySize  string            `json:"pretty_size"`
+	Source      string            `json:"source"`
+	NeedsReview bool              `json:"needs_review"`
 	Status      string            `json:"status"`
 	Metadata    []models.Metadata `json:"metadata"`
 	Tags        []models.Tag      `json:"tags"`
+	// Properties are extracted from the file, e.g. pdf info or exif data.
+	Properties []models.DocumentProperty `json:"properties"`
+	// Barcodes are decoded from document pages.
+	Barcodes []models.DocumentBarcode `json:"barcodes"`
+	// Fields are structured fields extracted from content, e.g. invoice amount and due date.
+	Fields []models.DocumentField `json:"fields"`
 }
 
 func responseFromDocument(doc *models.Document) *DocumentResponse {
@@ -78,8 +86,13 @@ func responseFromDocument(doc *models.Document) *DocumentResponse {
 		Type:        doc.GetType(),
 		Size:        doc.Size,
 		PrettySize:  doc.GetSize(),
+		Source:      string(doc.Source),
+		NeedsReview: doc.NeedsReview,
 		Metadata:    doc.Metadata,
 		Tags:        doc.Tags,
+		Properties:  doc.Properties,
+		Barcodes:    doc.Barcodes,
+		Fields:      doc.Fields,
 	}
 	if doc.DeletedAt.Valid {
 		resp.DeletedAt = doc.DeletedAt.Time.Unix() * 1000
@@ -103,6 +116,7 @@ type DocumentUpdateRequest struct {
 	Filename    string            `json:"filename" valid:"optional"`
 	Date        int64             `json:"date" valid:"optional,range(0|4106139691000)"` // year 2200 in ms
 	Metadata    []MetadataRequest `json:"metadata" valid:"-"`
+	NeedsReview *bool             `json:"needs_review" valid:"-"`
 }
 
 func (a *Api) getDocuments(c echo.Context) error {
@@ -220,6 +234,24 @@ func (a *Api) getDocument(c echo.Context) error {
 	}
 	doc.Tags = *tags
 
+	properties, err := a.db.DocumentStore.GetDocumentProperties(id)
+	if err != nil {
+		return err
+	}
+	doc.Properties = *properties
+
+	barcodes, err := a.db.DocumentStore.GetDocumentBarcodes(id)
+	if err != nil {
+		return err
+	}
+	doc.Barcodes = *barcodes
+
+	fields, err := a.db.DocumentStore.GetDocumentFields(id)
+	if err != nil {
+		return err
+	}
+	doc.Fields = *fields
+
 	respDoc := responseFromDocument(doc)
 	respDoc.Status = status
 
@@ -396,6 +428,7 @@ func (a *Api) uploadFile(c echo.Context) error {
 		Mimetype: mimetype,
 		Size:     header.Size,
 		Date:     time.Now(),
+		Source:   models.DocumentSourceUpload,
 	}
 
 	if !process.MimeTypeIsSupported(mimetype, header.Filename) {
@@ -558,6 +591,9 @@ func (a *Api) updateDocument(c echo.Context) error {
 	doc.Name = dto.Name
 	doc.Description = dto.Description
 	doc.Filename = dto.Filename
+	if dto.NeedsReview != nil {
+		doc.NeedsReview = *dto.NeedsReview
+	}
 	metadata := make([]models.Metadata, len(dto.Metadata))
 
 	for i, v := range dto.Metadata {
@@ -567,6 +603,15 @@ func (a *Api) updateDocument(c echo.Context) error {
 		}
 	}
 
+	originalMetadata, err := a.db.MetadataStore.GetDocumentMetadata(ctx.UserId, doc.Id)
+	if err != nil {
+		return err
+	}
+	err = a.db.MetadataStore.CheckDocumentMetadata(ctx.UserId, doc.Id, *originalMetadata, metadata)
+	if err != nil {
+		return err
+	}
+
 	doc.Update()
 	doc.Metadata = metadata
 
@@ -580,6 +625,27 @@ func (a *Api) updateDocument(c echo.Context) error {
 		return err
 	}
 
+	triggers := []models.RuleTrigger{models.RuleTriggerDocumentUpdate}
+	if len(models.MetadataDiff(doc.Id, ctx.UserId, originalMetadata, &metadata)) > 0 {
+		triggers = append(triggers, models.RuleTriggerMetadataEdit)
+		// user edited metadata and kept the values that classifier added
+		err = a.db.MetadataStore.ConfirmAutomaticSuggestions(ctx.UserId, doc.Id)
+		if err != nil {
+			logrus.Errorf("confirm metadata suggestions of document %s: %v", doc.Id, err)
+		}
+	}
+	if a.runTriggeredRules(ctx.UserId, []string{doc.Id}, triggers...) {
+		doc, err = a.db.DocumentStore.GetDocument(ctx.UserId, id)
+		if err != nil {
+			return err
+		}
+		updatedMetadata, err := a.db.MetadataStore.GetDocumentMetadata(ctx.UserId, id)
+		if err != nil {
+			return err
+		}
+		doc.Metadata = *updatedMetadata
+	}
+
 	logrus.Debugf("document updated, force fts update")
 	err = a.db.JobStore.ForceProcessing(ctx.UserId, doc.Id, models.ProcessFts)
 	if err != nil {
@@ -732,6 +798,8 @@ type BulkEditDocumentsRequest struct {
 	Documents      []string              `json:"documents" valid:"required"`
 	AddMetadata    MetadataUpdateRequest `json:"add_metadata" valid:"-"`
 	RemoveMetadata MetadataUpdateRequest `json:"remove_metadata" valid:"-"`
+	AddTags        []int                 `json:"add_tags" valid:"-"`
+	RemoveTags     []int                 `json:"remove_tags" valid:"-"`
 }
 
 func (a *Api) bulkEditDocuments(c echo.Context) error {
@@ -754,14 +822,16 @@ func (a *Api) bulkEditDocuments(c echo.Context) error {
 		return err
 	}
 
-	if len(dto.RemoveMetadata.Metadata) == 0 && len(dto.AddMetadata.Metadata) == 0 {
+	if len(dto.RemoveMetadata.Metadata) == 0 && len(dto.AddMetadata.Metadata) == 0 &&
+		len(dto.AddTags) == 0 && len(dto.RemoveTags) == 0 {
 		userErr := errors.ErrAlreadyExists
 		userErr.ErrMsg = "no documents modified"
 		return userErr
 	}
 	opOk := false
-	defer logCrudDocument(ctx.UserId, "bulk edit", &opOk, "documents: %v, add metadata: %d, remove metadata: %d",
-		len(dto.Documents), len(dto.AddMetadata.Metadata), len(dto.RemoveMetadata.Metadata))
+	defer logCrudDocument(ctx.UserId, "bulk edit", &opOk,
+		"documents: %v, add metadata: %d, remove metadata: %d, add tags: %v, remove tags: %v",
+		len(dto.Documents), len(dto.AddMetadata.Metadata), len(dto.RemoveMetadata.Metadata), dto.AddTags, dto.RemoveTags)
 
 	owns, err := a.db.DocumentStore.UserOwnsDocuments(ctx.UserId, dto.Documents)
 	if err != nil {
@@ -771,39 +841,32 @@ func (a *Api) bulkEditDocuments(c echo.Context) error {
 		return respForbiddenV2()
 	}
 
-	if len(dto.AddMetadata.Metadata) > 0 {
-		addMetadata := dto.AddMetadata.toMetadataArray()
-		keys := dto.AddMetadata.UniqueKeys()
-		ok, err := a.db.MetadataStore.UserHasKeys(ctx.UserId, keys)
+	edit := storage.DocumentsEdit{AddTags: dto.AddTags, RemoveTags: dto.RemoveTags}
+	for _, metadata := range []MetadataUpdateRequest{dto.AddMetadata, dto.RemoveMetadata} {
+		if len(metadata.Metadata) == 0 {
+			continue
+		}
+		ok, err := a.db.MetadataStore.UserHasKeys(ctx.UserId, metadata.UniqueKeys())
 		if err != nil {
 			return fmt.Errorf("check user owns keys: %v", err)
 		}
 		if !ok {
 			return respForbiddenV2()
 		}
-
-		err = a.db.MetadataStore.UpsertDocumentMetadata(ctx.UserId, dto.Documents, addMetadata)
-		if err != nil {
-			return err
-		}
+	}
+	if len(dto.AddMetadata.Metadata) > 0 {
+		edit.AddMetadata = dto.AddMetadata.toMetadataArray()
 	}
 	if len(dto.RemoveMetadata.Metadata) > 0 {
-		removeMetadata := dto.RemoveMetadata.toMetadataArray()
-		keys := dto.RemoveMetadata.UniqueKeys()
-		ok, err := a.db.MetadataStore.UserHasKeys(ctx.UserId, keys)
-		if err != nil {
-			return fmt.Errorf("check user owns keys: %v", err)
-		}
-		if !ok {
-			return respForbiddenV2()
-		}
-
-		err = a.db.MetadataStore.DeleteDocumentsMetadata(ctx.UserId, dto.Documents, removeMetadata)
-		if err != nil {
-			return err
-		}
+		edit.RemoveMetadata = dto.RemoveMetadata.toMetadataArray()
+	}
+	err = a.db.MetadataStore.BulkEditDocuments(ctx.UserId, dto.Documents, edit)
+	if err != nil {
+		return err
 	}
 
+	a.runTriggeredRules(ctx.UserId, dto.Documents, models.RuleTriggerMetadataEdit)
+
 	// need to reindex
 	err = a.db.JobStore.AddDocuments(ctx.UserId, dto.Documents, models.ProcessFts)
 	if err != nil {
@@ -917,6 +980,7 @@ func (a *Api) restoreDeletedDocument(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	a.runTriggeredRules(ctx.UserId, []string{docId}, models.RuleTriggerRestore)
 
 	doc, err := a.db.DocumentStore.GetDocument(0, docId)
 	err = a.search.IndexDocuments(&[]models.Document{*doc}, doc.UserId)
@@ -0,0 +1,196 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// DocumentDuplicateResponse is a pair of documents that are likely duplicates.
+type DocumentDuplicateResponse struct {
+	// swagger:strfmt uuid
+	DocumentId   string `json:"document_id"`
+	DocumentName string `json:"document_name"`
+	// swagger:strfmt uuid
+	DuplicateId   string `json:"duplicate_id"`
+	DuplicateName string `json:"duplicate_name"`
+	// Similarity of content between 0 and 1, null if content is not available for both documents.
+	ContentSimilarity *float64 `json:"content_similarity"`
+	// Similarity of thumbnails between 0 and 1, null if thumbnail is not available for both documents.
+	ImageSimilarity *float64 `json:"image_similarity"`
+	CreatedAt       int64    `json:"created_at"`
+}
+
+func responseFromDuplicate(duplicate *models.DocumentDuplicate) *DocumentDuplicateResponse {
+	nullFloat := func(value sql.NullFloat64) *float64 {
+		if !value.Valid {
+			return nil
+		}
+		return &value.Float64
+	}
+	return &DocumentDuplicateResponse{
+		DocumentId:        duplicate.DocumentId,
+		DocumentName:      duplicate.DocumentName,
+		DuplicateId:       duplicate.DuplicateId,
+		DuplicateName:     duplicate.DuplicateName,
+		ContentSimilarity: nullFloat(duplicate.ContentSimilarity),
+		ImageSimilarity:   nullFloat(duplicate.ImageSimilarity),
+		CreatedAt:         duplicate.CreatedAt.Unix() * 1000,
+	}
+}
+
+func (a *Api) getDocumentDuplicates(c echo.Context) error {
+	// swagger:route GET /api/v1/documents/{id}/duplicates Documents GetDocumentDuplicates
+	// Get documents that are likely duplicates of the document
+	// Responses:
+	//   200: DocumentDuplicateResponse
+	//   401: RespForbidden
+	//   403: RespNotFound
+	//   500: RespInternalError
+
+	ctx := c.(UserContext)
+	id := bindPathId(c)
+	opOk := false
+	defer logCrudDocument(ctx.UserId, "get duplicates", &opOk, "document: %s", id)
+
+	owns, err := a.db.DocumentStore.UserOwnsDocument(id, ctx.UserId)
+	if err != nil {
+		return err
+	}
+	if !owns {
+		return echo.NewHTTPError(http.StatusForbidden, "forbidden")
+	}
+
+	duplicates, err := a.db.DocumentStore.GetDocumentDuplicates(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
+	resp := make([]*DocumentDuplicateResponse, len(*duplicates))
+	for i, v := range *duplicates {
+		resp[i] = responseFromDuplicate(&v)
+	}
+	opOk = true
+	return resourceList(c, resp, len(resp))
+}
+
+func (a *Api) getUserDuplicates(c echo.Context) error {
+	// swagger:route GET /api/v1/documents/duplicates Documents GetUserDuplicates
+	// Get all documents that are likely duplicates
+	// Responses:
+	//   200: DocumentDuplicateResponse
+	//   401: RespForbidden
+	//   500: RespInternalError
+
+	ctx := c.(UserContext)
+	paging, err := bindPaging(c)
+	if err != nil {
+		return err
+	}
+	opOk := false
+	defer logCrudDocument(ctx.UserId, "get duplicates report", &opOk, "")
+
+	duplicates, count, err := a.db.DocumentStore.GetUserDuplicates(ctx.UserId, paging)
+	if err != nil {
+		return err
+	}
+	resp := make([]*DocumentDuplicateResponse, len(*duplicates))
+	for i, v := range *duplicates {
+		resp[i] = responseFromDuplicate(&v)
+	}
+	opOk = true
+	return resourceList(c, resp, count)
+}
+
+// ResolveDuplicateRequest resolves a pair of duplicate documents.
+// Action 'merge' keeps the document, copies metadata from the duplicate and moves the duplicate to trash bin.
+// Action 'ignore' marks documents as not being duplicates.
+type ResolveDuplicateRequest struct {
+	Action string `json:"action" valid:"in(merge|ignore),required"`
+}
+
+func (a *Api) resolveDocumentDuplicate(c echo.Context) error {
+	// swagger:route POST /api/v1/documents/{id}/duplicates/{duplicate_id} Documents ResolveDocumentDuplicate
+	// Merge or ignore duplicate document
+	// Responses:
+	//   200: RespOk
+	//   400: RespBadRequest
+	//   401: RespForbidden
+	//   403: RespNotFound
+	//   500: RespInternalError
+
+	ctx := c.(UserContext)
+	id := bindPathId(c)
+	duplicateId := c.Param("duplicate_id")
+
+	dto := &ResolveDuplicateRequest{}
+	err := unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+
+	opOk := false
+	defer logCrudDocument(ctx.UserId, "resolve duplicate", &opOk, "document: %s, duplicate: %s, action: %s",
+		id, duplicateId, dto.Action)
+
+	if id == duplicateId {
+		e := errors.ErrInvalid
+		e.ErrMsg = "document cannot be a duplicate of itself"
+		return e
+	}
+	owns, err := a.db.DocumentStore.UserOwnsDocuments(ctx.UserId, []string{id, duplicateId})
+	if err != nil {
+		return err
+	}
+	if !owns {
+		return respForbiddenV2()
+	}
+
+	if dto.Action == "ignore" {
+		err = a.db.DocumentStore.IgnoreDuplicate(ctx.UserId, id, duplicateId)
+		if err != nil {
+			return err
+		}
+		opOk = true
+		return c.JSON(http.StatusOK, nil)
+	}
+
+	err = a.db.DocumentStore.MergeDuplicate(ctx.UserId, id, duplicateId)
+	if err != nil {
+		return err
+	}
+	err = a.search.DeleteDocument(duplicateId, ctx.UserId)
+	if err != nil {
+		logrus.Errorf("delete merged duplicate from search index: %v", err)
+	}
+
+	// metadata may have changed, need to reindex
+	err = a.db.JobStore.AddDocuments(ctx.UserId, []string{id}, models.ProcessFts)
+	if err != nil && !errors.Is(err, errors.ErrAlreadyExists) {
+		return err
+	}
+	a.process.PullDocumentsToProcess()
+	opOk = true
+	return c.JSON(http.StatusOK, nil)
+}
@@ -1,7 +1,10 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/labstack/echo/v4"
+	"tryffel.net/go/virtualpaper/models"
 )
 
 func (a *Api) GetJob(c echo.Context) error {
@@ -18,3 +21,69 @@ func (a *Api) GetJob(c echo.Context) error {
 
 	return resourceList(c, jobs, len(*jobs))
 }
+
+// BulkOperationResponse is the status and progress of a bulk operation.
+type BulkOperationResponse struct {
+	Id        int    `json:"id"`
+	Operation string `json:"operation"`
+	RuleId    int    `json:"rule_id"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Processed int    `json:"processed"`
+	Matched   int    `json:"matched"`
+	Changed   int    `json:"changed"`
+	Failed    int    `json:"failed"`
+	// Progress is the share of processed documents, from 0 to 1.
+	Progress  float64 `json:"progress"`
+	Message   string  `json:"message"`
+	CreatedAt int64   `json:"created_at"`
+	StartedAt int64   `json:"started_at"`
+	StoppedAt int64   `json:"stopped_at"`
+}
+
+func responseFromBulkOperation(op *models.BulkOperation) *BulkOperationResponse {
+	resp := &BulkOperationResponse{
+		Id:        op.Id,
+		Operation: op.Operation,
+		RuleId:    int(op.RuleId),
+		Status:    string(op.Status),
+		Total:     op.Total,
+		Processed: op.Processed,
+		Matched:   op.Matched,
+		Changed:   op.Changed,
+		Failed:    op.Failed,
+		Progress:  1,
+		Message:   op.Message,
+		CreatedAt: op.CreatedAt.Unix() * 1000,
+	}
+	if op.Total > 0 {
+		resp.Progress = float64(op.Processed) / float64(op.Total)
+	}
+	if op.StartedAt.Valid {
+		resp.StartedAt = op.StartedAt.Time.Unix() * 1000
+	}
+	if op.StoppedAt.Valid {
+		resp.StoppedAt = op.StoppedAt.Time.Unix() * 1000
+	}
+	return resp
+}
+
+func (a *Api) getBulkOperation(c echo.Context) error {
+	// swagger:route GET /api/v1/processing/operations/{id} Processing GetBulkOperation
+	// Get bulk operation status and progress
+	// responses:
+	//   200: BulkOperationResponse
+	//   401: RespForbidden
+	//   404: RespNotFound
+	ctx := c.(UserContext)
+	id, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+
+	op, err := a.db.JobStore.GetBulkOperation(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, responseFromBulkOperation(op))
+}
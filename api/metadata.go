@@ -37,6 +37,30 @@ type MetadataRequest struct {
 type MetadataKeyRequest struct {
 	Key     string `json:"key" valid:"required,metadata,stringlength(1|30)"`
 	Comment string `json:"comment" valid:"maxstringlength(1000),optional"`
+	// ValueType is one of 'text' (default), 'integer', 'decimal', 'date' or 'boolean'.
+	// When updating, empty type does not change the type.
+	ValueType string `json:"value_type" valid:"in(text|integer|decimal|date|boolean),optional"`
+	// SingleValue allows only one value of the key per document.
+	// When updating, constraints that are not set are not changed.
+	SingleValue *bool `json:"single_value" valid:"-"`
+	// RequiredWhenKeyId makes the key required in documents that have the key,
+	// and if RequiredWhenValueId is set, the value of the key. Changing the key clears the value, if value is not set.
+	RequiredWhenKeyId   *int `json:"required_when_key_id" valid:"-"`
+	RequiredWhenValueId *int `json:"required_when_value_id" valid:"-"`
+}
+
+// applyConstraints sets the constraints that the request contains to the key.
+func (r *MetadataKeyRequest) applyConstraints(key *models.MetadataKey) {
+	if r.SingleValue != nil {
+		key.SingleValue = *r.SingleValue
+	}
+	if r.RequiredWhenKeyId != nil {
+		key.RequiredWhenKeyId = models.IntId(*r.RequiredWhenKeyId)
+		key.RequiredWhenValueId = 0
+	}
+	if r.RequiredWhenValueId != nil {
+		key.RequiredWhenValueId = models.IntId(*r.RequiredWhenValueId)
+	}
 }
 
 type MetadataValueRequest struct {
@@ -49,6 +73,11 @@ type MetadataValueRequest struct {
 	// validate MatchType when creating, allowing default to be empty string
 	MatchType   string `json:"match_type" valid:"in(regex|exact),optional"`
 	MatchFilter string `json:"match_filter" valid:"maxstringlength(100),optional"`
+	// ParentId is the optional parent value within the same key.
+	ParentId int `json:"parent_id" valid:"-"`
+	// Aliases are other names of the value used in matching and search.
+	// When updating, aliases are not changed if field is omitted.
+	Aliases []string `json:"aliases" valid:"-"`
 }
 
 type MetadataUpdateRequest struct {
@@ -187,13 +216,13 @@ func (a *Api) getMetadataKeyValues(c echo.Context) error {
 		caseInsensitive = sort[0].CaseInsensitive
 	}
 
-	keys, err := a.db.MetadataStore.GetValues(ctx.UserId, key,
+	// paging applies to the top level values
+	values, total, err := a.db.MetadataStore.GetValueTree(ctx.UserId, key,
 		storage.NewSortKey(sortfield, "value", sortOrder, caseInsensitive), paging)
 	if err != nil {
 		return err
 	}
-
-	return resourceList(c, keys, len(*keys))
+	return resourceList(c, values, total)
 }
 
 func (a *Api) updateDocumentMetadata(c echo.Context) error {
@@ -218,6 +247,7 @@ func (a *Api) updateDocumentMetadata(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	a.runTriggeredRules(ctx.UserId, []string{documentId}, models.RuleTriggerMetadataEdit)
 	opOk = true
 	return c.String(http.StatusOK, "")
 }
@@ -243,7 +273,9 @@ func (a *Api) addMetadataKey(c echo.Context) error {
 		Key:       dto.Key,
 		CreatedAt: time.Now(),
 		Comment:   dto.Comment,
+		ValueType: models.MetadataValueType(dto.ValueType),
 	}
+	dto.applyConstraints(key)
 
 	err = a.db.MetadataStore.CreateKey(ctx.UserId, key)
 	if err != nil {
@@ -284,6 +316,8 @@ func (a *Api) addMetadataValue(c echo.Context) error {
 		MatchDocuments: dto.MatchDocuments,
 		MatchType:      models.MetadataRuleType(dto.MatchType),
 		MatchFilter:    dto.MatchFilter,
+		ParentId:       models.IntId(dto.ParentId),
+		Aliases:        dto.Aliases,
 	}
 
 	if value.MatchType == "" {
@@ -338,6 +372,8 @@ func (a *Api) updateMetadataValue(c echo.Context) error {
 		MatchDocuments: dto.MatchDocuments,
 		MatchType:      models.MetadataRuleType(dto.MatchType),
 		MatchFilter:    dto.MatchFilter,
+		ParentId:       models.IntId(dto.ParentId),
+		Aliases:        dto.Aliases,
 	}
 	ownerShip, err := a.db.MetadataStore.UserHasKeyValue(ctx.UserId, keyId, valueId)
 	if err != nil {
@@ -355,7 +391,7 @@ func (a *Api) updateMetadataValue(c echo.Context) error {
 		return err
 	}
 
-	err = a.db.JobStore.AddDocumentsByMetadata(ctx.UserId, keyId, valueId, models.ProcessFts)
+	err = a.reindexValueHierarchy(ctx.UserId, keyId, valueId)
 	if err != nil {
 		return err
 	} else {
@@ -364,6 +400,22 @@ func (a *Api) updateMetadataValue(c echo.Context) error {
 	}
 }
 
+// reindexValueHierarchy adds documents that have the value or any of its descendants to be indexed,
+// since paths of the descendants contain the value.
+func (a *Api) reindexValueHierarchy(userId, keyId, valueId int) error {
+	descendants, err := a.db.MetadataStore.GetValueDescendants(userId, valueId)
+	if err != nil {
+		return err
+	}
+	for _, id := range append([]int{valueId}, descendants...) {
+		err = a.db.JobStore.AddDocumentsByMetadata(userId, keyId, id, models.ProcessFts)
+		if err != nil && !errors.Is(err, errors.ErrAlreadyExists) {
+			return err
+		}
+	}
+	return nil
+}
+
 func (a *Api) updateMetadataKey(c echo.Context) error {
 	// swagger:route PUT /api/v1/metadata/keys/{id} Metadata UpdateMetadataKeyValues
 	// Update metadata key
@@ -386,22 +438,22 @@ func (a *Api) updateMetadataKey(c echo.Context) error {
 	opOk := false
 	defer logCrudMetadata(ctx.UserId, "update key", &opOk, "key: %d", keyId)
 
-	ownerShip, err := a.db.MetadataStore.UserHasKey(ctx.UserId, keyId)
+	current, err := a.db.MetadataStore.GetKey(ctx.UserId, keyId)
 	if err != nil {
 		return err
 	}
 
-	if !ownerShip {
-		err := errors.ErrRecordNotFound
-		return err
-	}
-
 	key := &models.MetadataKey{
-		Id:      keyId,
-		UserId:  ctx.UserId,
-		Key:     dto.Key,
-		Comment: dto.Comment,
+		Id:                  keyId,
+		UserId:              ctx.UserId,
+		Key:                 dto.Key,
+		Comment:             dto.Comment,
+		ValueType:           models.MetadataValueType(dto.ValueType),
+		SingleValue:         current.SingleValue,
+		RequiredWhenKeyId:   current.RequiredWhenKeyId,
+		RequiredWhenValueId: current.RequiredWhenValueId,
 	}
+	dto.applyConstraints(key)
 
 	// rest should be enclosed in a transaction
 	err = a.db.MetadataStore.UpdateKey(key)
@@ -418,6 +470,107 @@ func (a *Api) updateMetadataKey(c echo.Context) error {
 	}
 }
 
+type MetadataMergeRequest struct {
+	// Sources are the values or keys that are merged into the target and deleted.
+	Sources []int `json:"sources" valid:"required"`
+	Target  int   `json:"target" valid:"required"`
+	// Preview returns the changes without saving them.
+	Preview bool `json:"preview" valid:"-"`
+}
+
+func (a *Api) mergeMetadataValues(c echo.Context) error {
+	// swagger:route POST /api/v1/metadata/keys/{id}/values/merge Metadata MergeMetadataValues
+	// Merge metadata values into target value
+	// Documents and rules that use the source values are changed to use the target value,
+	// and source values are deleted.
+	// Responses:
+	//  200: MetadataMergeResponse
+
+	ctx := c.(UserContext)
+	keyId, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+
+	dto := &MetadataMergeRequest{}
+	err = unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "merge values", &opOk, "key: %d, values: %v -> %d, preview: %t",
+		keyId, dto.Sources, dto.Target, dto.Preview)
+
+	result, err := a.db.MetadataStore.MergeValues(ctx.UserId, keyId, dto.Sources, dto.Target, dto.Preview)
+	if err != nil {
+		return err
+	}
+	if !result.Preview {
+		// children of the source values are now below the target
+		err = a.reindexValueHierarchy(ctx.UserId, keyId, dto.Target)
+		if err != nil {
+			return err
+		}
+		a.process.PullDocumentsToProcess()
+	}
+	opOk = true
+	return resourceList(c, result, 1)
+}
+
+func (a *Api) mergeMetadataKeys(c echo.Context) error {
+	// swagger:route POST /api/v1/metadata/keys/merge Metadata MergeMetadataKeys
+	// Merge metadata keys into target key
+	// Values of the source keys are moved to the target key, or merged into values with the same name.
+	// Documents and rules that use the source keys are changed to use the target key, and source keys are deleted.
+	// Responses:
+	//  200: MetadataMergeResponse
+
+	ctx := c.(UserContext)
+	dto := &MetadataMergeRequest{}
+	err := unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "merge keys", &opOk, "keys: %v -> %d, preview: %t",
+		dto.Sources, dto.Target, dto.Preview)
+
+	result, err := a.db.MetadataStore.MergeKeys(ctx.UserId, dto.Sources, dto.Target, dto.Preview)
+	if err != nil {
+		return err
+	}
+	if !result.Preview {
+		err = a.reindexDocuments(ctx.UserId, result.DocumentIds)
+		if err != nil {
+			return err
+		}
+	}
+	opOk = true
+	return resourceList(c, result, 1)
+}
+
+func (a *Api) getMetadataViolations(c echo.Context) error {
+	// swagger:route GET /api/v1/metadata/violations Metadata GetMetadataViolations
+	// Get documents that violate metadata key constraints
+	// Lists documents that have multiple values of a single-valued key,
+	// or that are missing a key that their other metadata requires.
+	// Responses:
+	//  200: MetadataViolationsResponse
+	ctx := c.(UserContext)
+	paging, err := bindPaging(c)
+	if err != nil {
+		return err
+	}
+
+	violations, total, err := a.db.MetadataStore.GetMetadataViolations(ctx.UserId, paging)
+	if err != nil {
+		return err
+	}
+	return resourceList(c, violations, total)
+}
+
 func (a *Api) deleteMetadataKey(c echo.Context) error {
 	// swagger:route DELETE /api/v1/metadata/keys/{id} Metadata DeleteMetadataKey
 	// Delete metadata key and all its values
@@ -489,7 +642,7 @@ func (a *Api) deleteMetadataValue(c echo.Context) error {
 	}
 
 	// need to add processing when the metadata still exists
-	err = a.db.JobStore.AddDocumentsByMetadata(ctx.UserId, keyId, valueId, models.ProcessFts)
+	err = a.reindexValueHierarchy(ctx.UserId, keyId, valueId)
 	if err != nil {
 		return err
 	}
@@ -30,10 +30,6 @@ func (api *Api) addRoutesV2() {
 	api.privateRouter = api.apiRouter.Group("/v1", api.authorizeUserV2())
 	api.adminRouter = api.privateRouter.Group("/admin", api.AuthorizeAdminV2())
 
-	//a.oldPrivateRouter.HandleFunc("/tags/{id}", a.getTag).Methods(http.MethodGet)
-	//a.oldPrivateRouter.HandleFunc("/tags", a.createTag).Methods(http.MethodPost)
-	//a.oldPrivateRouter.HandleFunc("/tags/create", a.createTag).Methods(http.MethodPost)
-
 	api.publicRouter.StaticFS("/", static())
 	api.publicRouter.GET("/api/v1/swagger.json", serverSwaggerDoc)
 	api.publicRouter.GET("/api/v1/version", api.getVersionV2)
@@ -59,6 +55,7 @@ func (api *Api) addRoutesV2() {
 	api.privateRouter.POST("/documents", api.uploadFile)
 	api.privateRouter.GET("/documents", api.getDocuments).Name = "get-documents"
 	api.privateRouter.GET("/documents/deleted", api.getDeletedDocuments).Name = "get-deleted-documents"
+	api.privateRouter.GET("/documents/duplicates", api.getUserDuplicates)
 	api.privateRouter.GET("/documents/:id", api.getDocument).Name = "get-document"
 	api.privateRouter.PUT("/documents/:id", api.updateDocument)
 	api.privateRouter.DELETE("/documents/:id", api.deleteDocument)
@@ -72,8 +69,13 @@ func (api *Api) addRoutesV2() {
 	api.privateRouter.POST("/documents/:id/metadata", api.updateDocumentMetadata)
 	api.privateRouter.POST("/documents/:id/process", api.requestDocumentProcessing)
 	api.privateRouter.PUT("/documents/:id/linked-documents", api.updateLinkedDocuments)
+	api.privateRouter.PUT("/documents/:id/tags", api.updateDocumentTags)
 	api.privateRouter.GET("/documents/:id/history", api.getDocumentHistory)
+	api.privateRouter.GET("/documents/:id/rules-log", api.getDocumentRulesLog)
 	api.privateRouter.GET("/documents/:id/jobs", api.getDocumentLogs)
+	api.privateRouter.GET("/documents/:id/duplicates", api.getDocumentDuplicates)
+	api.privateRouter.POST("/documents/:id/duplicates/:duplicate_id", api.resolveDocumentDuplicate)
+	api.privateRouter.GET("/documents/:id/suggestions", api.getDocumentMetadataSuggestions)
 
 	api.privateRouter.POST("/documents/bulkEdit", api.bulkEditDocuments)
 
@@ -81,24 +83,43 @@ func (api *Api) addRoutesV2() {
 
 	api.privateRouter.GET("/jobs", api.GetJob)
 	api.privateRouter.GET("/tags", api.getTags)
+	api.privateRouter.POST("/tags", api.createTag)
+	api.privateRouter.GET("/tags/:id", api.getTag)
+	api.privateRouter.PUT("/tags/:id", api.updateTag)
+	api.privateRouter.DELETE("/tags/:id", api.deleteTag)
 
 	api.privateRouter.GET("/metadata/keys", api.getMetadataKeys)
 	api.privateRouter.POST("/metadata/keys", api.addMetadataKey)
+	api.privateRouter.POST("/metadata/keys/merge", api.mergeMetadataKeys)
+	api.privateRouter.GET("/metadata/violations", api.getMetadataViolations)
+	api.privateRouter.GET("/metadata/classifier", api.getMetadataClassifier)
+	api.privateRouter.POST("/metadata/classifier/train", api.trainMetadataClassifier)
+	api.privateRouter.GET("/metadata/suggestions", api.getMetadataSuggestions)
+	api.privateRouter.POST("/metadata/suggestions/:id/accept", api.acceptMetadataSuggestion)
+	api.privateRouter.POST("/metadata/suggestions/:id/reject", api.rejectMetadataSuggestion)
 	api.privateRouter.PUT("/metadata/keys/:id", api.updateMetadataKey)
 	api.privateRouter.GET("/metadata/keys/:id", api.getMetadataKey)
 	api.privateRouter.GET("/metadata/keys/:id/values", api.getMetadataKeyValues)
 	api.privateRouter.POST("/metadata/keys/:id/values", api.addMetadataValue)
+	api.privateRouter.POST("/metadata/keys/:id/values/merge", api.mergeMetadataValues)
 	api.privateRouter.DELETE("/metadata/keys/:id", api.deleteMetadataKey)
 	api.privateRouter.PUT("/metadata/keys/:keyId/values/:valueId", api.updateMetadataValue)
 	api.privateRouter.DELETE("/metadata/keys/:keyId/values/:valueId", api.deleteMetadataValue)
 
 	api.privateRouter.GET("/processing/rules", api.getUserRules)
 	api.privateRouter.PUT("/processing/rules/reorder", api.reorderRules)
+	api.privateRouter.GET("/processing/rules/export", api.exportRules)
+	api.privateRouter.GET("/processing/rules/report", api.getRulesReport)
+	api.privateRouter.POST("/processing/rules/import", api.importRules)
+	api.privateRouter.POST("/processing/rules/test/batch", api.testNewRuleBatch)
 	api.privateRouter.POST("/processing/rules", api.addUserRule)
 	api.privateRouter.GET("/processing/rules/:id", api.getUserRule)
 	api.privateRouter.PUT("/processing/rules/:id", api.updateUserRule)
 	api.privateRouter.DELETE("/processing/rules/:id", api.deleteUserRule)
 	api.privateRouter.PUT("/processing/rules/:id/test", api.testRule)
+	api.privateRouter.POST("/processing/rules/:id/test/batch", api.testRuleBatch)
+	api.privateRouter.POST("/processing/rules/:id/apply", api.applyRule)
+	api.privateRouter.GET("/processing/operations/:id", api.getBulkOperation)
 
 	api.privateRouter.GET("/preferences/user", api.getUserPreferences).Name = "get-user-preferences"
 	api.privateRouter.PUT("/preferences/user", api.updateUserPreferences)
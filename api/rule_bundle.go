@@ -0,0 +1,117 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/process"
+)
+
+// maximum size of imported rule bundle.
+const maxRuleBundleSize = 5 * 1024 * 1024
+
+func (a *Api) exportRules(c echo.Context) error {
+	// swagger:route GET /api/v1/processing/rules/export Processing ExportRules
+	// Export rules and the metadata they use as a bundle.
+	// Query parameters: format=json|yaml, metadata=all to include all metadata keys and values.
+	// responses:
+	//   200: RuleBundle
+	ctx := c.(UserContext)
+	format := strings.ToLower(c.QueryParam("format"))
+	if format == "" {
+		format = "json"
+	}
+	allMetadata := c.QueryParam("metadata") == "all"
+
+	opOk := false
+	defer func() {
+		logCrudRule(ctx.UserId, "export", &opOk, "format: %s", format)
+	}()
+
+	bundle, err := process.ExportRules(a.db, ctx.UserId, allMetadata)
+	if err != nil {
+		return err
+	}
+	data, err := models.MarshalRuleBundle(bundle, format)
+	if err != nil {
+		return err
+	}
+
+	contentType := echo.MIMEApplicationJSONCharsetUTF8
+	if format != "json" {
+		format = "yaml"
+		contentType = "application/yaml"
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=virtualpaper-rules.%s", format))
+	opOk = true
+	return c.Blob(http.StatusOK, contentType, data)
+}
+
+func (a *Api) importRules(c echo.Context) error {
+	// swagger:route POST /api/v1/processing/rules/import Processing ImportRules
+	// Import rules and metadata from a json or yaml bundle.
+	// Query parameter mode=skip|overwrite|rename defines how to handle rules that already exist, default is skip.
+	// responses:
+	//   200: process.RuleImportResult
+	ctx := c.(UserContext)
+	mode := models.RuleImportMode(strings.ToLower(c.QueryParam("mode")))
+	if mode == "" {
+		mode = models.RuleImportSkip
+	}
+
+	opOk := false
+	defer func() {
+		logCrudRule(ctx.UserId, "import", &opOk, "mode: %s", mode)
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(c.Request().Body, maxRuleBundleSize+1))
+	if err != nil {
+		e := errors.ErrInvalid
+		e.ErrMsg = "read body"
+		e.Err = err
+		return e
+	}
+	if len(data) > maxRuleBundleSize {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("bundle too large, max %d bytes", maxRuleBundleSize)
+		return e
+	}
+	bundle, err := models.UnmarshalRuleBundle(data)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("User %d imports %d rules and %d metadata keys, mode %s", ctx.UserId, len(bundle.Rules),
+		len(bundle.Metadata), mode)
+	result, err := process.ImportRules(a.db, ctx.UserId, bundle, mode)
+	if err != nil {
+		return err
+	}
+	opOk = true
+	return c.JSON(http.StatusOK, result)
+}
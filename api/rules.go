@@ -22,12 +22,16 @@ import (
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"strings"
+	"time"
 	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/dateparse"
 	"tryffel.net/go/virtualpaper/errors"
 
 	"github.com/sirupsen/logrus"
 	"tryffel.net/go/virtualpaper/models"
 	"tryffel.net/go/virtualpaper/process"
+	"tryffel.net/go/virtualpaper/storage"
 )
 
 type Rule struct {
@@ -37,13 +41,27 @@ type Rule struct {
 	Enabled     bool   `json:"enabled" valid:"-"`
 	Order       int    `json:"order" valid:"-"`
 	Mode        string `json:"mode" valid:"-"`
+	Version     int    `json:"version" valid:"-"`
+	Trigger     string `json:"trigger" valid:"-"`
 	CreatedAt   int64  `json:"created_at" valid:"-"`
 	UpdatedAt   int64  `json:"updated_at" valid:"-"`
 
+	Statistics *RuleStatistics `json:"statistics" valid:"-"`
+
 	Conditions []RuleCondition `json:"conditions" valid:"-"`
 	Actions    []RuleAction    `json:"actions" valid:"-"`
 }
 
+// RuleStatistics are counted since the rule was created or last edited. Timestamps are unix epoch in milliseconds.
+type RuleStatistics struct {
+	Evaluations   int    `json:"evaluations"`
+	Matches       int    `json:"matches"`
+	LastMatchedAt *int64 `json:"last_matched_at"`
+	LastError     string `json:"last_error"`
+	LastErrorAt   *int64 `json:"last_error_at"`
+	ResetAt       int64  `json:"reset_at"`
+}
+
 type RuleCondition struct {
 	Id              int             `json:"id" valid:"-"`
 	RuleId          int             `json:"rule_id" valid:"-"`
@@ -55,6 +73,16 @@ type RuleCondition struct {
 	Value           string          `json:"value" valid:"-"`
 	DateFmt         string          `json:"date_fmt" valid:"-"`
 	Metadata        models.Metadata `json:"metadata" valid:"-"`
+	TagId           int             `json:"tag_id" valid:"-"`
+	TagName         string          `json:"tag_name" valid:"-"`
+	PropertyKey     string          `json:"property_key" valid:"-"`
+	FieldName       string          `json:"field_name" valid:"-"`
+	// MatchMode of text conditions: '', 'exact', 'case_insensitive', 'fuzzy', 'token_set' or 'ocr'.
+	MatchMode          string  `json:"match_mode" valid:"-"`
+	MatchMaxDistance   int     `json:"match_max_distance" valid:"-"`
+	MatchMinSimilarity float64 `json:"match_min_similarity" valid:"-"`
+	// Conditions of the group, if condition type is one of 'group_and', 'group_or' or 'group_not'.
+	Conditions []RuleCondition `json:"conditions" valid:"-"`
 }
 
 type RuleAction struct {
@@ -65,6 +93,14 @@ type RuleAction struct {
 	Action      string          `json:"action" valid:"-"`
 	Value       string          `json:"value" valid:"-"`
 	Metadata    models.Metadata `json:"metadata" valid:"-"`
+	TagId       int             `json:"tag_id" valid:"-"`
+	TagName     string          `json:"tag_name" valid:"-"`
+	// TextSource is the document text to extract metadata from: 'name', 'description', 'content'
+	// or 'barcode'.
+	TextSource         string `json:"text_source" valid:"-"`
+	TrimValue          bool   `json:"trim_value" valid:"-"`
+	ValueCase          string `json:"value_case" valid:"-"`
+	CollapseWhitespace bool   `json:"collapse_whitespace" valid:"-"`
 }
 
 type RuleTest struct {
@@ -79,6 +115,12 @@ func (r *RuleAction) ToAction() *models.RuleAction {
 		Value:         r.Value,
 		MetadataKey:   models.IntId(r.Metadata.KeyId),
 		MetadataValue: models.IntId(r.Metadata.ValueId),
+		TagId:         models.IntId(r.TagId),
+
+		TextSource:         models.RuleTextSource(r.TextSource),
+		TrimValue:          r.TrimValue,
+		ValueCase:          models.RuleValueCase(r.ValueCase),
+		CollapseWhitespace: r.CollapseWhitespace,
 	}
 }
 
@@ -96,11 +138,17 @@ func actionToResp(action *models.RuleAction) RuleAction {
 			ValueId: int(action.MetadataValue),
 			Value:   action.MetadataValueName.String(),
 		},
+		TagId:              int(action.TagId),
+		TagName:            action.TagName.String(),
+		TextSource:         string(action.TextSource),
+		TrimValue:          action.TrimValue,
+		ValueCase:          string(action.ValueCase),
+		CollapseWhitespace: action.CollapseWhitespace,
 	}
 }
 
 func (r *RuleCondition) ToCondition() *models.RuleCondition {
-	return &models.RuleCondition{
+	condition := &models.RuleCondition{
 		Enabled:         r.Enabled,
 		CaseInsensitive: r.CaseInsensitive,
 		Inverted:        r.Inverted,
@@ -110,11 +158,30 @@ func (r *RuleCondition) ToCondition() *models.RuleCondition {
 		DateFmt:         r.DateFmt,
 		MetadataKey:     models.IntId(r.Metadata.KeyId),
 		MetadataValue:   models.IntId(r.Metadata.ValueId),
-	}
+		TagId:           models.IntId(r.TagId),
+		PropertyKey:     r.PropertyKey,
+		FieldName:       r.FieldName,
+
+		MatchMode:          models.RuleMatchMode(r.MatchMode),
+		MatchMaxDistance:   r.MatchMaxDistance,
+		MatchMinSimilarity: r.MatchMinSimilarity,
+	}
+	switch condition.ConditionType {
+	case models.RuleConditionMimetypeIs, models.RuleConditionSizeMoreThan, models.RuleConditionSizeLessThan,
+		models.RuleConditionPagesIs, models.RuleConditionPagesMoreThan, models.RuleConditionPagesLessThan,
+		models.RuleConditionSourceIs, models.RuleConditionAgeMoreThan, models.RuleConditionAgeLessThan,
+		models.RuleConditionMetadataValueMoreThan, models.RuleConditionMetadataValueLessThan:
+		// values are not matched as text
+		condition.Value = strings.TrimSpace(condition.Value)
+	}
+	for _, v := range r.Conditions {
+		condition.Conditions = append(condition.Conditions, v.ToCondition())
+	}
+	return condition
 }
 
 func conditionToResp(cond *models.RuleCondition) RuleCondition {
-	return RuleCondition{
+	resp := RuleCondition{
 		Id:              cond.Id,
 		RuleId:          cond.RuleId,
 		Enabled:         cond.Enabled,
@@ -124,6 +191,14 @@ func conditionToResp(cond *models.RuleCondition) RuleCondition {
 		IsRegex:         cond.IsRegex,
 		Value:           cond.Value,
 		DateFmt:         cond.DateFmt,
+		TagId:           int(cond.TagId),
+		TagName:         cond.TagName.String(),
+		PropertyKey:     cond.PropertyKey,
+		FieldName:       cond.FieldName,
+
+		MatchMode:          string(cond.MatchMode),
+		MatchMaxDistance:   cond.MatchMaxDistance,
+		MatchMinSimilarity: cond.MatchMinSimilarity,
 
 		Metadata: models.Metadata{
 			KeyId:   int(cond.MetadataKey),
@@ -131,7 +206,12 @@ func conditionToResp(cond *models.RuleCondition) RuleCondition {
 			ValueId: int(cond.MetadataValue),
 			Value:   cond.MetadataValueName.String(),
 		},
+		Conditions: make([]RuleCondition, len(cond.Conditions)),
 	}
+	for i, v := range cond.Conditions {
+		resp.Conditions[i] = conditionToResp(v)
+	}
+	return resp
 }
 
 func ruleToResp(rule *models.Rule) *Rule {
@@ -142,8 +222,18 @@ func ruleToResp(rule *models.Rule) *Rule {
 		Enabled:     rule.Enabled,
 		Order:       rule.Order,
 		Mode:        rule.Mode.String(),
+		Version:     rule.Version,
+		Trigger:     string(rule.Trigger),
 		CreatedAt:   rule.CreatedAt.Unix() * 1000,
 		UpdatedAt:   rule.UpdatedAt.Unix() * 1000,
+		Statistics: &RuleStatistics{
+			Evaluations:   rule.Evaluations,
+			Matches:       rule.Matches,
+			LastMatchedAt: nullTimeToMs(rule.LastMatchedAt),
+			LastError:     rule.LastError,
+			LastErrorAt:   nullTimeToMs(rule.LastErrorAt),
+			ResetAt:       rule.StatsResetAt.Unix() * 1000,
+		},
 	}
 
 	resp.Conditions = make([]RuleCondition, len(rule.Conditions))
@@ -165,12 +255,18 @@ func (r *Rule) ToRule() (*models.Rule, error) {
 		return nil, err
 	}
 
+	trigger := models.RuleTrigger(r.Trigger)
+	if trigger == "" {
+		trigger = models.RuleTriggerProcessing
+	}
+
 	rule := &models.Rule{
 		Name:        r.Name,
 		Description: r.Description,
 		Enabled:     r.Enabled,
 		Order:       r.Order,
 		Mode:        mode,
+		Trigger:     trigger,
 		Conditions:  make([]*models.RuleCondition, len(r.Conditions)),
 		Actions:     make([]*models.RuleAction, len(r.Actions)),
 	}
@@ -228,9 +324,53 @@ func (a *Api) addUserRule(c echo.Context) error {
 	return c.JSON(http.StatusOK, ruleToResp(rule))
 }
 
+// runTriggeredRules runs user rules that have any of the triggers on the documents. Errors are only logged,
+// since the event that triggered the rules has already succeeded. Returns true if rules changed any document.
+func (a *Api) runTriggeredRules(userId int, documents []string, triggers ...models.RuleTrigger) bool {
+	changed, err := process.RunTriggeredRules(a.db, a.search, userId, documents, triggers...)
+	if err != nil {
+		logrus.Errorf("run rules %v for user %d: %v", triggers, userId, err)
+	}
+	if len(changed) > 0 {
+		a.process.PullDocumentsToProcess()
+	}
+	return len(changed) > 0
+}
+
+func (a *Api) getDocumentRulesLog(c echo.Context) error {
+	// swagger:route GET /api/v1/documents/:id/rules-log Documents GetDocumentRulesLog
+	// Get the log of processing rules executed on the document, latest first.
+	// Responses:
+	//   200: RespOk
+	//   401: RespForbidden
+	//   403: RespNotFound
+	//   500: RespInternalError
+
+	ctx := c.(UserContext)
+	id := c.Param("id")
+	paging, err := bindPaging(c)
+	if err != nil {
+		return err
+	}
+
+	owns, err := a.db.DocumentStore.UserOwnsDocument(id, ctx.UserId)
+	if err != nil {
+		return err
+	}
+	if !owns {
+		return respForbiddenV2()
+	}
+
+	executions, total, err := a.db.RuleStore.GetDocumentRuleExecutions(id, paging)
+	if err != nil {
+		return err
+	}
+	return resourceList(c, executions, total)
+}
+
 func (a *Api) getUserRules(c echo.Context) error {
 	// swagger:route GET /api/v1/processing/rules Processing GetRules
-	// Get processing rules
+	// Get processing rules. Rules can be sorted by e.g. matches, evaluations or last_matched_at.
 	// responses:
 	//   200: ProcessingRuleResponse
 
@@ -240,7 +380,16 @@ func (a *Api) getUserRules(c echo.Context) error {
 		return err
 	}
 
-	rules, total, err := a.db.RuleStore.GetUserRules(ctx.UserId, paging)
+	sort, err := getSortParams(c.Request(), &models.Rule{})
+	if err != nil {
+		return err
+	}
+	sortKey := storage.SortKey{}
+	if len(sort) > 0 {
+		sortKey = sort[0]
+	}
+
+	rules, total, err := a.db.RuleStore.GetUserRules(ctx.UserId, sortKey, paging)
 	if err != nil {
 		return err
 	}
@@ -252,6 +401,52 @@ func (a *Api) getUserRules(c echo.Context) error {
 	return resourceList(c, processingRules, total)
 }
 
+type ruleReportParams struct {
+	Days           int `query:"days"`
+	MinEvaluations int `query:"min_evaluations"`
+}
+
+type RuleReportResponse struct {
+	Days           int     `json:"days"`
+	MinEvaluations int     `json:"min_evaluations"`
+	NotMatched     []*Rule `json:"not_matched"`
+	AlwaysMatched  []*Rule `json:"always_matched"`
+}
+
+func (a *Api) getRulesReport(c echo.Context) error {
+	// swagger:route GET /api/v1/processing/rules/report Processing GetRulesReport
+	// Get rules that have not matched any document in given days and rules that always match.
+	// responses:
+	//   200: RuleReportResponse
+	ctx := c.(UserContext)
+	params := &ruleReportParams{Days: 30, MinEvaluations: 10}
+	err := (&echo.DefaultBinder{}).BindQueryParams(c, params)
+	if err != nil || params.Days < 1 || params.MinEvaluations < 1 {
+		e := errors.ErrInvalid
+		e.ErrMsg = "days and min_evaluations must be numeric and > 0"
+		return e
+	}
+
+	rules, err := a.db.RuleStore.GetAllUserRules(ctx.UserId)
+	if err != nil {
+		return err
+	}
+	report := models.NewRuleStatisticsReport(rules, time.Now(), params.Days, params.MinEvaluations)
+	resp := &RuleReportResponse{
+		Days:           report.Days,
+		MinEvaluations: report.MinEvaluations,
+		NotMatched:     make([]*Rule, len(report.NotMatched)),
+		AlwaysMatched:  make([]*Rule, len(report.AlwaysMatched)),
+	}
+	for i, v := range report.NotMatched {
+		resp.NotMatched[i] = ruleToResp(v)
+	}
+	for i, v := range report.AlwaysMatched {
+		resp.AlwaysMatched[i] = ruleToResp(v)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
 func (a *Api) getUserRule(c echo.Context) error {
 	// swagger:route GET /api/v1/processing/rules/{id} Processing GetRule
 	// Get processing rule by id
@@ -357,19 +552,21 @@ func (a *Api) testRule(c echo.Context) error {
 		return err
 	}
 
-	doc, err := a.db.DocumentStore.GetDocument(ctx.UserId, processingRule.DocumentId)
+	doc, err := process.LoadRuleDocument(a.db, ctx.UserId, processingRule.DocumentId)
 	if err != nil {
 		return err
 	}
+	logrus.Infof("User %d tests processing rule %d on document %s", ctx.UserId, id, processingRule.DocumentId)
 
-	metadata, err := a.db.MetadataStore.GetDocumentMetadata(ctx.UserId, processingRule.DocumentId)
+	dateOptions, err := a.db.UserStore.GetDateOptions(ctx.UserId)
 	if err != nil {
-		return err
+		logrus.Errorf("get date preferences for user %d: %v", ctx.UserId, err)
 	}
-	doc.Metadata = *metadata
-	logrus.Infof("User %d tests processing rule %d on document %s", ctx.UserId, id, processingRule.DocumentId)
 
 	processRule := process.NewDocumentRule(doc, rule)
+	processRule.DateParser = dateparse.NewParser(dateOptions)
+	processRule.Metadata = a.db.MetadataStore
+	processRule.Search = a.search
 	status := processRule.MatchTest()
 
 	logrus.Infof("processing rule test finished: %v", status.Match)
@@ -414,3 +611,289 @@ func (a *Api) reorderRules(c echo.Context) error {
 	out := map[string]interface{}{"id": "rules"}
 	return c.JSON(200, out)
 }
+
+// maximum number of documents to apply rule to at once.
+const maxApplyRuleDocuments = 10000
+
+type ApplyRuleRequest struct {
+	// Query selects documents with the same syntax as document search. Either query or documents is required.
+	Query     string   `json:"query" valid:"-"`
+	Documents []string `json:"documents" valid:"-"`
+	// DryRun only returns the changes without saving them.
+	DryRun bool `json:"dry_run" valid:"-"`
+}
+
+type ApplyRuleResponse struct {
+	DryRun bool `json:"dry_run"`
+	// Total number of selected documents.
+	Total int `json:"total"`
+	// Matched and Changed are the number of previewed documents that matched the rule and would be changed.
+	Matched int `json:"matched"`
+	Changed int `json:"changed"`
+	// Results contain preview of the changes for max 500 documents when running in dry-run mode.
+	Results []*process.RuleApplyResult `json:"results"`
+	// Operation tracks the progress when changes are applied.
+	Operation *BulkOperationResponse `json:"operation"`
+}
+
+func (a *Api) applyRule(c echo.Context) error {
+	// swagger:route POST /api/v1/processing/rules/{id}/apply Processing ApplyRule
+	// Apply rule to existing documents
+	// responses:
+	//   200: ApplyRuleResponse
+	//   400: RespBadRequest
+	//   401: RespForbidden
+	//   404: RespNotFound
+	//   500: RespInternalError
+
+	ctx := c.(UserContext)
+	id, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+
+	dto := &ApplyRuleRequest{}
+	err = unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+
+	if (dto.Query == "") == (len(dto.Documents) == 0) {
+		e := errors.ErrInvalid
+		e.ErrMsg = "either query or documents is required"
+		return e
+	}
+
+	opOk := false
+	documents := dto.Documents
+	defer func() {
+		logCrudRule(ctx.UserId, "apply", &opOk, "rule: %d, documents: %d, dry run: %t", id, len(documents), dto.DryRun)
+	}()
+
+	rule, err := a.db.RuleStore.GetUserRule(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
+
+	if dto.Query != "" {
+		documents, err = a.searchDocumentIds(ctx.UserId, dto.Query, maxApplyRuleDocuments)
+		if err != nil {
+			return err
+		}
+	} else {
+		if len(documents) > maxApplyRuleDocuments {
+			e := errors.ErrInvalid
+			e.ErrMsg = fmt.Sprintf("max %d documents allowed", maxApplyRuleDocuments)
+			return e
+		}
+		owns, err := a.db.DocumentStore.UserOwnsDocuments(ctx.UserId, documents)
+		if err != nil {
+			return err
+		}
+		if !owns {
+			return respForbiddenV2()
+		}
+	}
+
+	resp := &ApplyRuleResponse{
+		DryRun:  dto.DryRun,
+		Total:   len(documents),
+		Results: []*process.RuleApplyResult{},
+	}
+
+	if dto.DryRun {
+		preview := documents
+		if len(preview) > config.MaxRows {
+			preview = preview[:config.MaxRows]
+		}
+		resp.Results = process.DryRunRule(a.db, a.search, ctx.UserId, rule, preview)
+		for _, v := range resp.Results {
+			if v.Matched {
+				resp.Matched += 1
+			}
+			if len(v.Changes) > 0 {
+				resp.Changed += 1
+			}
+		}
+	} else if len(documents) > 0 {
+		op, err := a.process.ApplyRule(ctx.UserId, rule, documents)
+		if err != nil {
+			return err
+		}
+		resp.Operation = responseFromBulkOperation(op)
+	}
+	opOk = true
+	return c.JSON(http.StatusOK, resp)
+}
+
+// maximum number of documents to test rule against at once.
+const maxTestRuleDocuments = 100
+
+type TestRuleBatchRequest struct {
+	// Rule is the edited version of the rule. If empty, the saved rule is tested.
+	// Rule is required when testing a rule that has not been saved.
+	Rule *Rule `json:"rule" valid:"-"`
+	// Documents to test with. Either documents, query or last is required.
+	Documents []string `json:"documents" valid:"-"`
+	// Query selects first max 100 documents with the same syntax as document search.
+	Query string `json:"query" valid:"-"`
+	// Last selects the latest n documents.
+	Last int `json:"last" valid:"-"`
+}
+
+func (a *Api) testRuleBatch(c echo.Context) error {
+	// swagger:route POST /api/v1/processing/rules/{id}/test/batch Processing TestRuleBatch
+	// Test rule against multiple documents. If rule is given in the request, the edited rule is tested
+	// and compared to the saved rule.
+	// responses:
+	//   200: process.RuleBatchTestResult
+	//   400: RespBadRequest
+	//   401: RespForbidden
+	//   404: RespNotFound
+	//   500: RespInternalError
+
+	ctx := c.(UserContext)
+	id, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+
+	dto := &TestRuleBatchRequest{}
+	err = unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+
+	saved, err := a.db.RuleStore.GetUserRule(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
+	return a.runRuleBatchTest(c, ctx.UserId, dto, saved)
+}
+
+func (a *Api) testNewRuleBatch(c echo.Context) error {
+	// swagger:route POST /api/v1/processing/rules/test/batch Processing TestNewRuleBatch
+	// Test rule that has not been saved against multiple documents. Rule is required in the request.
+	// responses:
+	//   200: process.RuleBatchTestResult
+	//   400: RespBadRequest
+	//   401: RespForbidden
+	//   500: RespInternalError
+
+	ctx := c.(UserContext)
+	dto := &TestRuleBatchRequest{}
+	err := unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+	if dto.Rule == nil {
+		e := errors.ErrInvalid
+		e.ErrMsg = "rule is required"
+		return e
+	}
+	return a.runRuleBatchTest(c, ctx.UserId, dto, nil)
+}
+
+// runRuleBatchTest tests the rule of the request, or the saved rule if request does not have a rule.
+// If both are given, results are compared to the saved rule.
+func (a *Api) runRuleBatchTest(c echo.Context, userId int, dto *TestRuleBatchRequest, saved *models.Rule) error {
+	selected := 0
+	for _, v := range []bool{len(dto.Documents) > 0, dto.Query != "", dto.Last > 0} {
+		if v {
+			selected += 1
+		}
+	}
+	if selected != 1 {
+		e := errors.ErrInvalid
+		e.ErrMsg = "one of documents, query or last is required"
+		return e
+	}
+	if len(dto.Documents) > maxTestRuleDocuments || dto.Last > maxTestRuleDocuments {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("max %d documents allowed", maxTestRuleDocuments)
+		return e
+	}
+
+	opOk := false
+	documents := dto.Documents
+	ruleId := 0
+	if saved != nil {
+		ruleId = saved.Id
+	}
+	defer func() {
+		logCrudRule(userId, "test batch", &opOk, "rule: %d, documents: %d, edited: %t", ruleId, len(documents), dto.Rule != nil)
+	}()
+
+	rule := saved
+	if dto.Rule != nil {
+		var err error
+		rule, err = dto.Rule.ToRule()
+		if err != nil {
+			return err
+		}
+		rule.Id = ruleId
+		rule.UserId = userId
+		err = a.db.RuleStore.ValidateRule(userId, rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dto.Query != "" {
+		paging := storage.Paging{Offset: 0, Limit: maxTestRuleDocuments}
+		docs, _, err := a.search.SearchDocuments(userId, dto.Query, storage.SortKey{}, paging)
+		if err != nil {
+			return err
+		}
+		documents = make([]string, len(docs))
+		for i, v := range docs {
+			documents[i] = v.Id
+		}
+	} else if dto.Last > 0 {
+		var err error
+		documents, err = a.db.DocumentStore.GetLatestDocumentIds(userId, dto.Last)
+		if err != nil {
+			return err
+		}
+	} else {
+		owns, err := a.db.DocumentStore.UserOwnsDocuments(userId, documents)
+		if err != nil {
+			return err
+		}
+		if !owns {
+			return respForbiddenV2()
+		}
+	}
+
+	var compareTo *models.Rule
+	if dto.Rule != nil {
+		compareTo = saved
+	}
+	result := process.BatchTestRule(a.db, a.search, userId, rule, compareTo, documents)
+	opOk = true
+	return c.JSON(http.StatusOK, result)
+}
+
+// searchDocumentIds returns ids of all documents that match the search query.
+func (a *Api) searchDocumentIds(userId int, query string, limit int) ([]string, error) {
+	ids := make([]string, 0, config.MaxRows)
+	paging := storage.Paging{Offset: 0, Limit: config.MaxRows}
+	for {
+		docs, total, err := a.search.SearchDocuments(userId, query, storage.SortKey{}, paging)
+		if err != nil {
+			return nil, err
+		}
+		if total > limit {
+			e := errors.ErrInvalid
+			e.ErrMsg = fmt.Sprintf("query matches %d documents, max %d allowed", total, limit)
+			return nil, e
+		}
+		for _, v := range docs {
+			ids = append(ids, v.Id)
+		}
+		if len(docs) < paging.Limit || len(ids) >= total {
+			return ids, nil
+		}
+		paging.Offset += paging.Limit
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"github.com/labstack/echo/v4"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/process"
+)
+
+// MetadataClassifierResponse describes the trained metadata classifier of the user.
+type MetadataClassifierResponse struct {
+	// Documents is the number of documents the classifier was trained with.
+	Documents int `json:"documents"`
+	// Keys is the number of metadata keys the classifier suggests values for.
+	Keys      int   `json:"keys"`
+	TrainedAt int64 `json:"trained_at"`
+}
+
+func responseFromClassifier(classifier *models.MetadataClassifier) *MetadataClassifierResponse {
+	return &MetadataClassifierResponse{
+		Documents: classifier.Documents,
+		Keys:      classifier.Keys,
+		TrainedAt: classifier.TrainedAt.Unix() * 1000,
+	}
+}
+
+func (a *Api) getMetadataClassifier(c echo.Context) error {
+	// swagger:route GET /api/v1/metadata/classifier Metadata GetMetadataClassifier
+	// Get metadata classifier of the user
+	// Responses:
+	//   200: MetadataClassifierResponse
+	//   404: RespNotFound
+
+	ctx := c.(UserContext)
+	classifier, err := a.db.MetadataStore.GetMetadataClassifier(ctx.UserId)
+	if err != nil {
+		return err
+	}
+	return resourceList(c, responseFromClassifier(classifier), 1)
+}
+
+func (a *Api) trainMetadataClassifier(c echo.Context) error {
+	// swagger:route POST /api/v1/metadata/classifier/train Metadata TrainMetadataClassifier
+	// Train metadata classifier from documents that have metadata
+	// Classifier is also trained periodically. Documents that are processed after training get suggestions
+	// from the new classifier.
+	// Responses:
+	//   200: MetadataClassifierResponse
+	//   400: RespBadRequest
+
+	ctx := c.(UserContext)
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "train classifier", &opOk, "")
+
+	classifier, err := process.TrainMetadataClassifier(a.db, ctx.UserId)
+	if err != nil {
+		return err
+	}
+	opOk = true
+	return resourceList(c, responseFromClassifier(classifier), 1)
+}
+
+func (a *Api) getMetadataSuggestions(c echo.Context) error {
+	// swagger:route GET /api/v1/metadata/suggestions Metadata GetMetadataSuggestions
+	// Get pending metadata suggestions of all documents
+	// Suggestions are ordered by confidence.
+	// Responses:
+	//   200: MetadataSuggestionResponse
+
+	ctx := c.(UserContext)
+	paging, err := bindPaging(c)
+	if err != nil {
+		return err
+	}
+	suggestions, count, err := a.db.MetadataStore.GetMetadataSuggestions(ctx.UserId, "", paging)
+	if err != nil {
+		return err
+	}
+	return resourceList(c, suggestions, count)
+}
+
+func (a *Api) getDocumentMetadataSuggestions(c echo.Context) error {
+	// swagger:route GET /api/v1/documents/{id}/suggestions Documents GetDocumentMetadataSuggestions
+	// Get pending metadata suggestions of the document
+	// Responses:
+	//   200: MetadataSuggestionResponse
+	//   403: RespForbidden
+
+	ctx := c.(UserContext)
+	id := bindPathId(c)
+	paging, err := bindPaging(c)
+	if err != nil {
+		return err
+	}
+	owns, err := a.db.DocumentStore.UserOwnsDocument(id, ctx.UserId)
+	if err != nil {
+		return err
+	}
+	if !owns {
+		return respForbiddenV2()
+	}
+
+	suggestions, count, err := a.db.MetadataStore.GetMetadataSuggestions(ctx.UserId, id, paging)
+	if err != nil {
+		return err
+	}
+	return resourceList(c, suggestions, count)
+}
+
+func (a *Api) acceptMetadataSuggestion(c echo.Context) error {
+	// swagger:route POST /api/v1/metadata/suggestions/{id}/accept Metadata AcceptMetadataSuggestion
+	// Accept metadata suggestion
+	// Adds the suggested value to the document. Single-valued keys replace the existing value.
+	// Responses:
+	//   200: MetadataSuggestionResponse
+	//   400: RespBadRequest
+	//   404: RespNotFound
+
+	ctx := c.(UserContext)
+	id, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "accept suggestion", &opOk, "suggestion: %d", id)
+
+	suggestion, err := a.db.MetadataStore.AcceptMetadataSuggestion(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
+	a.runTriggeredRules(ctx.UserId, []string{suggestion.DocumentId}, models.RuleTriggerMetadataEdit)
+
+	err = a.db.JobStore.AddDocuments(ctx.UserId, []string{suggestion.DocumentId}, models.ProcessFts)
+	if err != nil && !errors.Is(err, errors.ErrAlreadyExists) {
+		return err
+	}
+	a.process.PullDocumentsToProcess()
+	opOk = true
+	return resourceList(c, suggestion, 1)
+}
+
+func (a *Api) rejectMetadataSuggestion(c echo.Context) error {
+	// swagger:route POST /api/v1/metadata/suggestions/{id}/reject Metadata RejectMetadataSuggestion
+	// Reject metadata suggestion
+	// Value is not suggested for the document again.
+	// Responses:
+	//   200: MetadataSuggestionResponse
+	//   400: RespBadRequest
+	//   404: RespNotFound
+
+	ctx := c.(UserContext)
+	id, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "reject suggestion", &opOk, "suggestion: %d", id)
+
+	suggestion, err := a.db.MetadataStore.RejectMetadataSuggestion(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
+	opOk = true
+	return resourceList(c, suggestion, 1)
+}
@@ -19,16 +19,28 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
 )
 
 type TagRequest struct {
-	Key     string `valid:"required" json:"key"`
+	Key     string `valid:"required,metadata,stringlength(1|30)" json:"key"`
 	Comment string `valid:"-" json:"comment"`
 }
 
+type DocumentTagsRequest struct {
+	Tags []int `valid:"-" json:"tags"`
+}
+
 func (a *Api) getTags(c echo.Context) error {
+	// swagger:route GET /api/v1/tags Tags GetTags
+	// Get tags
+	// Responses:
+	//   200: RespOk
 	ctx := c.(UserContext)
 	paging, err := bindPaging(c)
 	if err != nil {
@@ -43,6 +55,11 @@ func (a *Api) getTags(c echo.Context) error {
 }
 
 func (a *Api) getTag(c echo.Context) error {
+	// swagger:route GET /api/v1/tags/{id} Tags GetTag
+	// Get tag
+	// Responses:
+	//   200: RespOk
+	//   404: RespNotFound
 	ctx := c.(UserContext)
 	id, err := bindPathIdInt(c)
 	if err != nil {
@@ -57,6 +74,11 @@ func (a *Api) getTag(c echo.Context) error {
 }
 
 func (a *Api) createTag(c echo.Context) error {
+	// swagger:route POST /api/v1/tags Tags CreateTag
+	// Create tag
+	// Responses:
+	//   200: RespOk
+	//   400: RespBadRequest
 	ctx := c.(UserContext)
 	dto := &TagRequest{}
 	err := unMarshalBody(c.Request(), dto)
@@ -64,6 +86,9 @@ func (a *Api) createTag(c echo.Context) error {
 		return err
 	}
 
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "create tag", &opOk, "")
+
 	tag := &models.Tag{
 		Key:     dto.Key,
 		Comment: dto.Comment,
@@ -73,6 +98,146 @@ func (a *Api) createTag(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	opOk = true
+	return resourceList(c, tag, 1)
+}
+
+func (a *Api) updateTag(c echo.Context) error {
+	// swagger:route PUT /api/v1/tags/{id} Tags UpdateTag
+	// Rename tag or update its comment
+	// Documents that have the tag are reindexed.
+	// Responses:
+	//   200: RespOk
+	//   400: RespBadRequest
+	//   404: RespNotFound
+	ctx := c.(UserContext)
+	id, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+
+	dto := &TagRequest{}
+	err = unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "update tag", &opOk, "tag: %d", id)
+
+	original, err := a.db.MetadataStore.GetTag(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
 
+	tag := &models.Tag{
+		Id:      id,
+		Key:     dto.Key,
+		Comment: dto.Comment,
+	}
+	err = a.db.MetadataStore.UpdateTag(ctx.UserId, tag)
+	if err != nil {
+		return err
+	}
+
+	if original.Key != tag.Key {
+		documents, err := a.db.MetadataStore.GetTagDocumentIds(ctx.UserId, id)
+		if err != nil {
+			return err
+		}
+		err = a.reindexDocuments(ctx.UserId, documents)
+		if err != nil {
+			return err
+		}
+	}
+	opOk = true
 	return resourceList(c, tag, 1)
 }
+
+func (a *Api) deleteTag(c echo.Context) error {
+	// swagger:route DELETE /api/v1/tags/{id} Tags DeleteTag
+	// Delete tag
+	// Tag is removed from all documents. Tag that is used by rules cannot be deleted.
+	// Responses:
+	//   200: RespOk
+	//   400: RespBadRequest
+	//   404: RespNotFound
+	ctx := c.(UserContext)
+	id, err := bindPathIdInt(c)
+	if err != nil {
+		return err
+	}
+
+	opOk := false
+	defer logCrudMetadata(ctx.UserId, "delete tag", &opOk, "tag: %d", id)
+
+	documents, err := a.db.MetadataStore.DeleteTag(ctx.UserId, id)
+	if err != nil {
+		return err
+	}
+	err = a.reindexDocuments(ctx.UserId, documents)
+	if err != nil {
+		logrus.Errorf("reindex documents after deleting tag %d: %v", id, err)
+	}
+	opOk = true
+	return c.String(http.StatusOK, "ok")
+}
+
+func (a *Api) updateDocumentTags(c echo.Context) error {
+	// swagger:route PUT /api/v1/documents/{id}/tags Documents UpdateDocumentTags
+	// Set document tags
+	// Replaces the tags of the document with given tags.
+	// Responses:
+	//   200: RespOk
+	//   404: RespNotFound
+	ctx := c.(UserContext)
+	documentId := bindPathId(c)
+
+	dto := &DocumentTagsRequest{}
+	err := unMarshalBody(c.Request(), dto)
+	if err != nil {
+		return err
+	}
+
+	opOk := false
+	defer logCrudDocument(ctx.UserId, "update tags", &opOk, "document: %s, tags: %v", documentId, dto.Tags)
+
+	owns, err := a.db.DocumentStore.UserOwnsDocument(documentId, ctx.UserId)
+	if err != nil {
+		return err
+	}
+	if !owns {
+		return respForbiddenV2()
+	}
+
+	err = a.db.MetadataStore.UpdateDocumentTags(ctx.UserId, documentId, dto.Tags)
+	if err != nil {
+		return err
+	}
+	a.runTriggeredRules(ctx.UserId, []string{documentId}, models.RuleTriggerMetadataEdit)
+
+	err = a.reindexDocuments(ctx.UserId, []string{documentId})
+	if err != nil {
+		return err
+	}
+
+	tags, err := a.db.MetadataStore.GetDocumentTags(ctx.UserId, documentId)
+	if err != nil {
+		return err
+	}
+	opOk = true
+	return resourceList(c, tags, len(*tags))
+}
+
+// reindexDocuments adds documents to the search indexing queue.
+func (a *Api) reindexDocuments(userId int, documents []string) error {
+	if len(documents) == 0 {
+		return nil
+	}
+	err := a.db.JobStore.AddDocuments(userId, documents, models.ProcessFts)
+	if err != nil && !errors.Is(err, errors.ErrAlreadyExists) {
+		return err
+	}
+	a.process.PullDocumentsToProcess()
+	return nil
+}
@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"tryffel.net/go/virtualpaper/dateparse"
+	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
 )
 
@@ -39,6 +41,8 @@ type UserPreferences struct {
 	IsAdmin             bool       `json:"is_admin"`
 	StopWords           []string   `json:"stop_words"`
 	Synonyms            [][]string `json:"synonyms"`
+	DateOrder           string     `json:"date_order"`
+	DateLanguages       []string   `json:"date_languages"`
 }
 
 func (u *UserPreferences) copyUser(userPref *models.UserPreferences) {
@@ -53,6 +57,8 @@ func (u *UserPreferences) copyUser(userPref *models.UserPreferences) {
 	u.IsAdmin = userPref.IsAdmin
 	u.StopWords = userPref.StopWords
 	u.Synonyms = userPref.Synonyms
+	u.DateOrder = string(userPref.DateOptions().Order)
+	u.DateLanguages = userPref.DateOptions().Languages
 }
 
 func (a *Api) getUserPreferences(c echo.Context) error {
@@ -101,6 +107,26 @@ type ReqUserPreferences struct {
 	StopWords []string   `json:"stop_words" valid:"optional"`
 	Synonyms  [][]string `json:"synonyms" valid:"optional"`
 	Email     string     `json:"email" valid:"email,optional"`
+	// DateOrder is the order of numeric dates: 'dmy', 'mdy' or 'ymd'.
+	DateOrder string `json:"date_order" valid:"optional"`
+	// DateLanguages are languages for month names: 'en', 'fi', 'de' or 'sv'.
+	DateLanguages []string `json:"date_languages" valid:"optional"`
+}
+
+func (r *ReqUserPreferences) validateDates() error {
+	if r.DateOrder != "" && !dateparse.Order(r.DateOrder).Valid() {
+		e := errors.ErrInvalid
+		e.ErrMsg = "invalid date order: " + r.DateOrder
+		return e
+	}
+	for _, v := range r.DateLanguages {
+		if !dateparse.ValidLanguage(v) {
+			e := errors.ErrInvalid
+			e.ErrMsg = "unsupported date language: " + v
+			return e
+		}
+	}
+	return nil
 }
 
 func (a *Api) updateUserPreferences(c echo.Context) error {
@@ -118,6 +144,7 @@ func (a *Api) updateUserPreferences(c echo.Context) error {
 	}
 	attributeChanged := false
 	searchParamsChanged := false
+	datesChanged := false
 	if len(dto.StopWords) > 0 || len(dto.Synonyms) > 0 {
 		searchParamsChanged = true
 		err = a.db.UserStore.UpdatePreferences(ctx.UserId, dto.StopWords, dto.Synonyms)
@@ -130,6 +157,27 @@ func (a *Api) updateUserPreferences(c echo.Context) error {
 			return err
 		}
 	}
+	if dto.DateOrder != "" || len(dto.DateLanguages) > 0 {
+		err = dto.validateDates()
+		if err != nil {
+			return err
+		}
+		order, languages, err := a.db.UserStore.GetDatePreferences(ctx.UserId)
+		if err != nil {
+			return err
+		}
+		if dto.DateOrder != "" {
+			order = dto.DateOrder
+		}
+		if len(dto.DateLanguages) > 0 {
+			languages = dto.DateLanguages
+		}
+		err = a.db.UserStore.UpdateDatePreferences(ctx.UserId, order, languages)
+		if err != nil {
+			return err
+		}
+		datesChanged = true
+	}
 	if dto.Email != "" {
 		user.Email = dto.Email
 		attributeChanged = true
@@ -143,7 +191,7 @@ func (a *Api) updateUserPreferences(c echo.Context) error {
 		}
 	}
 
-	if !attributeChanged && !searchParamsChanged {
+	if !attributeChanged && !searchParamsChanged && !datesChanged {
 		return c.String(http.StatusNotModified, "")
 	}
 	return a.getUserPreferences(c)
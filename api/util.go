@@ -19,6 +19,7 @@
 package api
 
 import (
+	"database/sql"
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"strings"
@@ -119,3 +120,12 @@ type UserContext struct {
 	User     *models.User
 	TokenKey string
 }
+
+// nullTimeToMs returns time as unix epoch in milliseconds, or nil if time is not set.
+func nullTimeToMs(t sql.NullTime) *int64 {
+	if !t.Valid {
+		return nil
+	}
+	ms := t.Time.Unix() * 1000
+	return &ms
+}
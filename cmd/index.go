@@ -60,6 +60,15 @@ var indexCmd = &cobra.Command{
 				continue
 			}
 
+			for i, doc := range *docs {
+				fields, err := db.DocumentStore.GetDocumentFields(doc.Id)
+				if err != nil {
+					logrus.Warningf("get document fields: %v", err)
+					continue
+				}
+				(*docs)[i].Fields = *fields
+			}
+
 			logrus.Infof("index %d documents for useer %s", len(*docs), v.Name)
 			err = engine.IndexDocuments(docs, v.Id)
 			if err != nil {
@@ -0,0 +1,147 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/process"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+var exportRulesCmd = &cobra.Command{
+	Use:   "export-rules",
+	Short: "Export rules and metadata of user",
+	Long: "Export rules of the user and the metadata keys and values that rules use as a json or yaml bundle. " +
+		"Bundle is written to stdout unless --file is set.",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, user := initRulesCmd()
+		defer db.Close()
+		defer config.DeinitLogging()
+
+		bundle, err := process.ExportRules(db, user.Id, rulesAllMetadata)
+		if err != nil {
+			logrus.Fatalf("export rules: %v", err)
+		}
+		data, err := models.MarshalRuleBundle(bundle, rulesFormat)
+		if err != nil {
+			logrus.Fatalf("encode bundle: %v", err)
+		}
+
+		if rulesFile == "" || rulesFile == "-" {
+			fmt.Println(string(data))
+			return
+		}
+		err = os.WriteFile(rulesFile, data, 0600)
+		if err != nil {
+			logrus.Fatalf("write file: %v", err)
+		}
+		logrus.Infof("Exported %d rules and %d metadata keys to %s", len(bundle.Rules), len(bundle.Metadata), rulesFile)
+	},
+}
+
+var importRulesCmd = &cobra.Command{
+	Use:   "import-rules",
+	Short: "Import rules and metadata for user",
+	Long: "Import rules and metadata keys and values from a json or yaml bundle. Bundle is read from stdin " +
+		"unless --file is set. Mode defines how to handle rules with existing names: skip, overwrite or rename.",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, user := initRulesCmd()
+		defer db.Close()
+		defer config.DeinitLogging()
+
+		var data []byte
+		var err error
+		if rulesFile == "" || rulesFile == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(rulesFile)
+		}
+		if err != nil {
+			logrus.Fatalf("read bundle: %v", err)
+		}
+		bundle, err := models.UnmarshalRuleBundle(data)
+		if err != nil {
+			logrus.Fatalf("%v", err)
+		}
+
+		result, err := process.ImportRules(db, user.Id, bundle, models.RuleImportMode(rulesImportMode))
+		if err != nil {
+			logrus.Fatalf("import rules: %v", err)
+		}
+		for _, v := range result.Rules {
+			if v.ImportedName != v.Name {
+				logrus.Infof("rule '%s' %s as '%s' (id %d)", v.Name, v.Status, v.ImportedName, v.RuleId)
+			} else {
+				logrus.Infof("rule '%s' %s (id %d)", v.Name, v.Status, v.RuleId)
+			}
+		}
+		logrus.Infof("Rules: %d created, %d updated, %d skipped. Metadata keys: %d created, %d updated. "+
+			"Metadata values: %d created, %d updated.", result.RulesCreated, result.RulesUpdated, result.RulesSkipped,
+			result.KeysCreated, result.KeysUpdated, result.ValuesCreated, result.ValuesUpdated)
+	},
+}
+
+// initRulesCmd loads config, connects to database and returns the user given with --username.
+func initRulesCmd() (*storage.Database, *models.User) {
+	initConfig()
+	err := config.InitLogging()
+	if err != nil {
+		logrus.Fatalf("init log: %v", err)
+	}
+	if rulesUser == "" {
+		logrus.Fatalf("username is required")
+	}
+	db, err := storage.NewDatabase(config.C.Database)
+	if err != nil {
+		logrus.Fatalf("Connect to database: %v", err)
+	}
+	user, err := db.UserStore.GetUserByName(rulesUser)
+	if err != nil {
+		logrus.Fatalf("user not found: %v", err)
+	}
+	return db, user
+}
+
+var rulesUser = ""
+var rulesFile = ""
+var rulesFormat = ""
+var rulesImportMode = ""
+var rulesAllMetadata = false
+
+func init() {
+	manageCmd.AddCommand(exportRulesCmd)
+	manageCmd.AddCommand(importRulesCmd)
+
+	for _, c := range []*cobra.Command{exportRulesCmd, importRulesCmd} {
+		c.PersistentFlags().StringVarP(&rulesUser, "username", "U", "", "Username")
+		c.PersistentFlags().StringVarP(&rulesFile, "file", "f", "", "Bundle file")
+	}
+	exportRulesCmd.PersistentFlags().StringVar(&rulesFormat, "format", "yaml", "Bundle format, json or yaml")
+	exportRulesCmd.PersistentFlags().BoolVar(&rulesAllMetadata, "all-metadata", false,
+		"Export all metadata keys and values, not only the ones that rules use")
+	importRulesCmd.PersistentFlags().StringVarP(&rulesImportMode, "mode", "m", string(models.RuleImportSkip),
+		"What to do with existing rules: skip, overwrite or rename")
+}
@@ -67,9 +67,30 @@ type Processing struct {
 	MaxWorkers   int
 	OcrLanguages []string
 	PdfToTextBin string
+	PdfInfoBin   string
 	PandocBin    string
 	ImagickBin   string
 	TesseractBin string
+	ZbarImgBin   string
+
+	// BarcodeSeparator is a barcode payload that marks a separator page in batch-scanned pdf files.
+	// Pdf files are split into separate documents at each separator page. Empty value disables splitting.
+	BarcodeSeparator string
+
+	// FieldLocales are locales used for extracting invoice fields from content, e.g. ["en", "fi"].
+	// Supported locales are en, fi, de and sv.
+	FieldLocales []string
+	// FieldPatterns are additional regular expressions for each field, e.g. {"reference": ["Ref\\.\\s*(\\d+)"]}.
+	// Each pattern must have exactly one capture group that contains the value.
+	FieldPatterns map[string][]string
+
+	// ClassifierDisabled disables suggesting metadata with the classifier.
+	ClassifierDisabled bool
+	// ClassifierApplyThreshold is the minimum confidence for applying suggested metadata automatically.
+	// Value above 1 disables applying suggestions automatically.
+	ClassifierApplyThreshold float64
+	// ClassifierSuggestThreshold is the minimum confidence for storing suggested metadata for user to review.
+	ClassifierSuggestThreshold float64
 
 	// application directories. Stored by default in ./media/{previews, documents}.
 	PreviewsDir  string
@@ -118,6 +139,10 @@ type Logging struct {
 type CronJobs struct {
 	Disabled                  bool
 	DocumentsTrashbinDuration time.Duration
+	// RulesSchedule is the cron schedule for running rules with trigger 'schedule'.
+	RulesSchedule string
+	// ClassifierSchedule is the cron schedule for training metadata classifiers.
+	ClassifierSchedule string
 }
 
 // ConfigFromViper initializes Config.C, reads all config values from viper and stores them to Config.C.
@@ -151,9 +176,19 @@ func ConfigFromViper() error {
 			MaxWorkers:   viper.GetInt("processing.max_workers"),
 			OcrLanguages: viper.GetStringSlice("processing.ocr_languages"),
 			PdfToTextBin: viper.GetString("processing.pdftotext_bin"),
+			PdfInfoBin:   viper.GetString("processing.pdfinfo_bin"),
 			PandocBin:    viper.GetString("processing.pandoc_bin"),
 			ImagickBin:   viper.GetString("processing.imagick_bin"),
 			TesseractBin: viper.GetString("processing.tesseract_bin"),
+			ZbarImgBin:   viper.GetString("processing.zbarimg_bin"),
+
+			BarcodeSeparator: viper.GetString("processing.barcode_separator"),
+			FieldLocales:     viper.GetStringSlice("processing.field_locales"),
+			FieldPatterns:    viper.GetStringMapStringSlice("processing.field_patterns"),
+
+			ClassifierDisabled:         viper.GetBool("processing.classifier_disabled"),
+			ClassifierApplyThreshold:   viper.GetFloat64("processing.classifier_apply_threshold"),
+			ClassifierSuggestThreshold: viper.GetFloat64("processing.classifier_suggest_threshold"),
 		},
 		Meilisearch: Meilisearch{
 			Url:    viper.GetString("meilisearch.url"),
@@ -180,6 +215,8 @@ func ConfigFromViper() error {
 		CronJobs: CronJobs{
 			Disabled:                  viper.GetBool("cronjobs.disabled"),
 			DocumentsTrashbinDuration: viper.GetDuration("cronjobs.documents_trashbin_cleanup_duration"),
+			RulesSchedule:             viper.GetString("cronjobs.rules_schedule"),
+			ClassifierSchedule:        viper.GetString("cronjobs.classifier_schedule"),
 		},
 	}
 
@@ -218,12 +255,21 @@ func InitConfig() error {
 		C.Api.TokenExpire = time.Second * time.Duration(C.Api.TokenExpireSec)
 	}
 
+	if C.Processing.PdfInfoBin == "" && C.Processing.PdfToTextBin != "" {
+		// pdfinfo is shipped with pdftotext in poppler-utils
+		C.Processing.PdfInfoBin = path.Join(path.Dir(C.Processing.PdfToTextBin), "pdfinfo")
+	}
+
 	if len(C.Processing.OcrLanguages) == 0 {
 		C.Processing.OcrLanguages = []string{"eng"}
 		viper.Set("processing.ocr_languages", C.Processing.OcrLanguages)
 		changed = true
 	}
 
+	if len(C.Processing.FieldLocales) == 0 {
+		C.Processing.FieldLocales = []string{"en"}
+	}
+
 	if !path.IsAbs(C.Processing.DataDir) {
 		curDir, err := os.Getwd()
 		if err != nil {
@@ -0,0 +1,461 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dateparse parses dates from free text and search queries. It understands numeric formats,
+// month names and abbreviations in several languages, ordinal days, two-digit years, ISO weeks
+// and relative keywords (today, yesterday etc.).
+package dateparse
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Order is the order of day, month and year in numeric dates, e.g. 'dmy' for 31.01.2023.
+type Order string
+
+const (
+	OrderDayMonthYear Order = "dmy"
+	OrderMonthDayYear Order = "mdy"
+	OrderYearMonthDay Order = "ymd"
+)
+
+// Valid returns true if order is known.
+func (o Order) Valid() bool {
+	return o == OrderDayMonthYear || o == OrderMonthDayYear || o == OrderYearMonthDay
+}
+
+// Options configure the parser.
+type Options struct {
+	// Order resolves ambiguous numeric dates, e.g. 01/02/2023.
+	Order Order
+	// Languages to recognize month names in: en, fi, de, sv.
+	Languages []string
+}
+
+// DefaultOptions returns day-month-year order and english month names.
+func DefaultOptions() Options {
+	return Options{
+		Order:     OrderDayMonthYear,
+		Languages: []string{"en"},
+	}
+}
+
+// Languages are the supported languages for month names.
+var Languages = []string{"en", "fi", "de", "sv"}
+
+// month names and abbreviations per language, in lowercase.
+var monthNames = map[string]map[string]time.Month{
+	"en": {
+		"january": 1, "jan": 1, "february": 2, "feb": 2, "march": 3, "mar": 3, "april": 4, "apr": 4, "may": 5,
+		"june": 6, "jun": 6, "july": 7, "jul": 7, "august": 8, "aug": 8, "september": 9, "sep": 9, "sept": 9,
+		"october": 10, "oct": 10, "november": 11, "nov": 11, "december": 12, "dec": 12,
+	},
+	// finnish month names are inflected, e.g. 'maaliskuuta'. Names are stored as stems, see Parser.month.
+	"fi": {
+		"tammi": 1, "helmi": 2, "maalis": 3, "huhti": 4, "touko": 5, "kesä": 6, "heinä": 7, "elo": 8,
+		"syys": 9, "loka": 10, "marras": 11, "joulu": 12,
+	},
+	"de": {
+		"januar": 1, "jänner": 1, "jan": 1, "februar": 2, "feb": 2, "märz": 3, "maerz": 3, "mär": 3, "mrz": 3,
+		"april": 4, "apr": 4, "mai": 5, "juni": 6, "jun": 6, "juli": 7, "jul": 7, "august": 8, "aug": 8,
+		"september": 9, "sep": 9, "sept": 9, "oktober": 10, "okt": 10, "november": 11, "nov": 11,
+		"dezember": 12, "dez": 12,
+	},
+	"sv": {
+		"januari": 1, "jan": 1, "februari": 2, "feb": 2, "mars": 3, "mar": 3, "april": 4, "apr": 4, "maj": 5,
+		"juni": 6, "jun": 6, "juli": 7, "jul": 7, "augusti": 8, "aug": 8, "september": 9, "sep": 9, "sept": 9,
+		"oktober": 10, "okt": 10, "november": 11, "nov": 11, "december": 12, "dec": 12,
+	},
+}
+
+// finnish month suffixes, longest first.
+var finnishMonthSuffixes = []string{"kuuta", "kuussa", "kuun", "kuu", "k"}
+
+// words that may appear between date parts, e.g. '3rd of March'.
+var fillerWords = map[string]bool{"of": true, "the": true, "den": true, "der": true, "am": true, "on": true}
+
+var (
+	isoWeekRe  = regexp.MustCompile(`^(\d{4})-?w(\d{1,2})(?:-?([1-7]))?$`)
+	numericRe  = regexp.MustCompile(`^(\d{1,4})[./-](\d{1,2})[./-](\d{1,4})$`)
+	compactRe  = regexp.MustCompile(`^(\d{4})(\d{2})(\d{2})$`)
+	yearRe     = regexp.MustCompile(`^(\d{4})$`)
+	yearMonRe  = regexp.MustCompile(`^(\d{4})[-/](\d{1,2})$`)
+	relativeRe = regexp.MustCompile(`^(\d{1,3})([dwmy])$`)
+	partRe     = regexp.MustCompile(`(\d+)(?:st|nd|rd|th|:a|:e|\.)?|(\p{L}+)`)
+	spaceRe    = regexp.MustCompile(`\s+`)
+
+	// candidates for dates in free text.
+	findRes = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\b\d{4}-?w\d{1,2}(?:-?[1-7])?\b`),
+		regexp.MustCompile(`\b\d{1,4}[./-]\d{1,2}[./-]\d{1,4}\b`),
+		regexp.MustCompile(`(?i)\b\d{1,2}(?:st|nd|rd|th|:a|:e|\.)?\s+(?:of\s+)?\p{L}{3,12}\.?,?\s+\d{2,4}\b`),
+		regexp.MustCompile(`(?i)\b\p{L}{3,12}\.?\s+\d{1,2}(?:st|nd|rd|th)?,?\s+\d{4}\b`),
+	}
+)
+
+// Parser parses dates with configured options.
+type Parser struct {
+	order   Order
+	finnish bool
+	months  map[string]time.Month
+}
+
+// NewParser creates a new parser. Unknown languages are ignored. If there are no valid languages,
+// english is used.
+func NewParser(opts Options) *Parser {
+	p := &Parser{
+		order:  opts.Order,
+		months: map[string]time.Month{},
+	}
+	if !p.order.Valid() {
+		p.order = OrderDayMonthYear
+	}
+	for _, lang := range opts.Languages {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		names, ok := monthNames[lang]
+		if !ok {
+			continue
+		}
+		if lang == "fi" {
+			p.finnish = true
+		}
+		for name, month := range names {
+			p.months[name] = month
+		}
+	}
+	if len(p.months) == 0 {
+		for name, month := range monthNames["en"] {
+			p.months[name] = month
+		}
+	}
+	return p
+}
+
+// ValidLanguage returns true if language is supported.
+func ValidLanguage(lang string) bool {
+	_, ok := monthNames[lang]
+	return ok
+}
+
+// Match is a date found from text.
+type Match struct {
+	Text string
+	Date time.Time
+}
+
+// FindAll returns all dates found in text in the order they appear.
+func (p *Parser) FindAll(text string) []Match {
+	type candidate struct {
+		start, end int
+		match      Match
+	}
+	candidates := make([]candidate, 0, 10)
+	for _, re := range findRes {
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			date, ok := p.Parse(text[loc[0]:loc[1]])
+			if ok {
+				candidates = append(candidates, candidate{loc[0], loc[1], Match{Text: text[loc[0]:loc[1]], Date: date}})
+			}
+		}
+	}
+	// prefer the longest of overlapping matches
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].start == candidates[j].start {
+			return candidates[i].end > candidates[j].end
+		}
+		return candidates[i].start < candidates[j].start
+	})
+	matches := make([]Match, 0, len(candidates))
+	end := -1
+	for _, v := range candidates {
+		if v.start < end {
+			continue
+		}
+		matches = append(matches, v.match)
+		end = v.end
+	}
+	return matches
+}
+
+// Parse parses single date, e.g. '2023-01-31', '31.1.2023', '1/31/23', 'March 3rd, 2023', '3. März 2023',
+// '15. maaliskuuta 2023' or ISO week '2023-W05-2'. Returned date is at midnight in UTC.
+func (p *Parser) Parse(text string) (time.Time, bool) {
+	text = normalize(text)
+	if text == "" {
+		return time.Time{}, false
+	}
+
+	if match := isoWeekRe.FindStringSubmatch(text); match != nil {
+		year, _ := strconv.Atoi(match[1])
+		week, _ := strconv.Atoi(match[2])
+		weekday := 1
+		if match[3] != "" {
+			weekday, _ = strconv.Atoi(match[3])
+		}
+		start, ok := isoWeekStart(year, week)
+		if !ok {
+			return time.Time{}, false
+		}
+		return start.AddDate(0, 0, weekday-1), true
+	}
+
+	if match := compactRe.FindStringSubmatch(text); match != nil {
+		return newDate(atoi(match[1]), atoi(match[2]), atoi(match[3]))
+	}
+
+	if match := numericRe.FindStringSubmatch(text); match != nil {
+		return p.parseNumeric(match[1], match[2], match[3])
+	}
+
+	year, month, day, ok := p.parseText(text)
+	if !ok || day == 0 {
+		return time.Time{}, false
+	}
+	return newDate(year, int(month), day)
+}
+
+// ParseRange parses a date range that text represents. Start is inclusive and end is exclusive.
+// E.g. '2023' is the whole year, '2023-02' and 'march 2023' are months, '2023-w05' is a week and
+// any date that Parse accepts is a single day. Relative keywords 'today', 'yesterday' and 'tomorrow'
+// are single days. Keywords 'week', 'month' and 'year' as well as '7d', '2w', '3m' and '1y'
+// are periods that end today (excluding today).
+func (p *Parser) ParseRange(text string, now time.Time) (time.Time, time.Time, bool) {
+	text = normalize(text)
+	today := midnight(now)
+
+	switch text {
+	case "":
+		return time.Time{}, time.Time{}, false
+	case "today":
+		return today, today.AddDate(0, 0, 1), true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), today, true
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), today.AddDate(0, 0, 2), true
+	case "week":
+		return today.AddDate(0, 0, -7), today, true
+	case "month":
+		return today.AddDate(0, -1, 0), today, true
+	case "year":
+		return today.AddDate(-1, 0, 0), today, true
+	}
+
+	if match := relativeRe.FindStringSubmatch(text); match != nil {
+		n := atoi(match[1])
+		switch match[2] {
+		case "d":
+			return today.AddDate(0, 0, -n), today, true
+		case "w":
+			return today.AddDate(0, 0, -7*n), today, true
+		case "m":
+			return today.AddDate(0, -n, 0), today, true
+		default:
+			return today.AddDate(-n, 0, 0), today, true
+		}
+	}
+
+	if match := yearRe.FindStringSubmatch(text); match != nil {
+		start, ok := newDate(atoi(match[1]), 1, 1)
+		return start, start.AddDate(1, 0, 0), ok
+	}
+
+	if match := yearMonRe.FindStringSubmatch(text); match != nil {
+		start, ok := newDate(atoi(match[1]), atoi(match[2]), 1)
+		return start, start.AddDate(0, 1, 0), ok
+	}
+
+	if match := isoWeekRe.FindStringSubmatch(text); match != nil && match[3] == "" {
+		start, ok := isoWeekStart(atoi(match[1]), atoi(match[2]))
+		return start, start.AddDate(0, 0, 7), ok
+	}
+
+	if date, ok := p.Parse(text); ok {
+		return date, date.AddDate(0, 0, 1), true
+	}
+
+	// month name and year, e.g. 'march 2023'
+	year, month, day, ok := p.parseText(text)
+	if ok && day == 0 {
+		start, ok := newDate(year, int(month), 1)
+		return start, start.AddDate(0, 1, 0), ok
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// RelativeDay returns midnight of the day for keywords 'today', 'yesterday' and 'tomorrow'.
+func RelativeDay(text string, now time.Time) (time.Time, bool) {
+	today := midnight(now)
+	switch normalize(text) {
+	case "today":
+		return today, true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), true
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (p *Parser) parseNumeric(first, second, third string) (time.Time, bool) {
+	if len(first) == 4 {
+		return newDate(atoi(first), atoi(second), atoi(third))
+	}
+	if len(third) != 4 && len(third) != 2 {
+		return time.Time{}, false
+	}
+
+	a, b := atoi(first), atoi(second)
+	year := expandYear(atoi(third), len(third))
+	switch p.order {
+	case OrderYearMonthDay:
+		if len(first) != 2 {
+			return time.Time{}, false
+		}
+		return newDate(expandYear(a, 2), b, atoi(third))
+	case OrderMonthDayYear:
+		if a > 12 && b <= 12 {
+			// unambiguous: day first
+			return newDate(year, b, a)
+		}
+		return newDate(year, a, b)
+	default:
+		if b > 12 && a <= 12 {
+			// unambiguous: month first
+			return newDate(year, a, b)
+		}
+		return newDate(year, b, a)
+	}
+}
+
+// parseText parses dates that have month name. Day is 0 if text has only month and year.
+func (p *Parser) parseText(text string) (int, time.Month, int, bool) {
+	var year, day int
+	var month time.Month
+	for _, part := range partRe.FindAllStringSubmatch(text, -1) {
+		if part[2] != "" {
+			word := part[2]
+			if fillerWords[word] {
+				continue
+			}
+			m, ok := p.month(word)
+			if !ok || month != 0 {
+				return 0, 0, 0, false
+			}
+			month = m
+			continue
+		}
+
+		digits := part[1]
+		n := atoi(digits)
+		ordinal := len(part[0]) > len(digits)
+		switch {
+		case len(digits) == 4:
+			if year != 0 {
+				return 0, 0, 0, false
+			}
+			year = n
+		case day == 0 && n >= 1 && n <= 31 && (month == 0 || ordinal || year == 0):
+			day = n
+		case year == 0 && len(digits) == 2:
+			year = expandYear(n, 2)
+		default:
+			return 0, 0, 0, false
+		}
+	}
+	if month == 0 || year == 0 {
+		return 0, 0, 0, false
+	}
+	return year, month, day, true
+}
+
+// month returns month for name or abbreviation.
+func (p *Parser) month(word string) (time.Month, bool) {
+	if m, ok := p.months[word]; ok {
+		return m, true
+	}
+	if p.finnish {
+		for _, suffix := range finnishMonthSuffixes {
+			if strings.HasSuffix(word, suffix) {
+				if m, ok := p.months[strings.TrimSuffix(word, suffix)]; ok {
+					return m, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// isoWeekStart returns monday of the ISO week.
+func isoWeekStart(year, week int) (time.Time, bool) {
+	if week < 1 || week > 53 {
+		return time.Time{}, false
+	}
+	// January 4th is always in week 1.
+	jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)
+	offset := int(jan4.Weekday()+6) % 7
+	start := jan4.AddDate(0, 0, -offset+(week-1)*7)
+	if y, w := start.ISOWeek(); y != year || w != week {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// expandYear converts two-digit year to full year. Years up to 20 years in the future are in this century.
+func expandYear(year, digits int) int {
+	if digits != 2 {
+		return year
+	}
+	year += 2000
+	if year > time.Now().Year()+20 {
+		year -= 100
+	}
+	return year
+}
+
+// newDate returns date, if it is valid, e.g. 31.2. is not valid.
+func newDate(year, month, day int) (time.Time, bool) {
+	if year < 1000 || month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Day() != day {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+func normalize(text string) string {
+	text = strings.ToLower(strings.TrimSpace(text))
+	text = strings.Trim(text, ",;()")
+	return spaceRe.ReplaceAllString(text, " ")
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func atoi(text string) int {
+	n, _ := strconv.Atoi(text)
+	return n
+}
@@ -0,0 +1,116 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dateparse
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(year, month, day int) time.Time {
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParser_Parse(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		text   string
+		want   time.Time
+		wantOk bool
+	}{
+		{"iso", DefaultOptions(), "2023-01-31", date(2023, 1, 31), true},
+		{"compact", DefaultOptions(), "20230131", date(2023, 1, 31), true},
+		{"day first", DefaultOptions(), "02.03.2023", date(2023, 3, 2), true},
+		{"month first", Options{Order: OrderMonthDayYear}, "02/03/2023", date(2023, 2, 3), true},
+		{"unambiguous month first", DefaultOptions(), "12/31/2023", date(2023, 12, 31), true},
+		{"two-digit year", DefaultOptions(), "31.1.23", date(2023, 1, 31), true},
+		{"two-digit year in past century", DefaultOptions(), "31.1.85", date(1985, 1, 31), true},
+		{"year first two-digit", Options{Order: OrderYearMonthDay}, "23/01/31", date(2023, 1, 31), true},
+		{"invalid day", DefaultOptions(), "31.02.2023", time.Time{}, false},
+		{"english", DefaultOptions(), "March 3rd, 2023", date(2023, 3, 3), true},
+		{"english ordinal of", DefaultOptions(), "the 21st of Sept 2022", date(2022, 9, 21), true},
+		{"english abbreviation", DefaultOptions(), "3 Jan. 23", date(2023, 1, 3), true},
+		{"finnish", Options{Languages: []string{"fi"}}, "15. maaliskuuta 2023", date(2023, 3, 15), true},
+		{"finnish nominative", Options{Languages: []string{"fi"}}, "1 kesäkuu 2021", date(2021, 6, 1), true},
+		{"german", Options{Languages: []string{"de"}}, "3. März 2023", date(2023, 3, 3), true},
+		{"swedish ordinal", Options{Languages: []string{"sv"}}, "1:a maj 2020", date(2020, 5, 1), true},
+		{"language not enabled", DefaultOptions(), "3. März 2023", time.Time{}, false},
+		{"iso week", DefaultOptions(), "2023-W05", date(2023, 1, 30), true},
+		{"iso week day", DefaultOptions(), "2021W01-5", date(2021, 1, 8), true},
+		{"invalid iso week", DefaultOptions(), "2021-W54", time.Time{}, false},
+		{"month only", DefaultOptions(), "March 2023", time.Time{}, false},
+		{"not a date", DefaultOptions(), "invoice", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := NewParser(tt.opts).Parse(tt.text)
+			if ok != tt.wantOk || !got.Equal(tt.want) {
+				t.Errorf("Parse() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestParser_ParseRange(t *testing.T) {
+	now := time.Date(2023, 5, 17, 13, 0, 0, 0, time.UTC)
+	tests := []struct {
+		text      string
+		wantStart time.Time
+		wantEnd   time.Time
+		wantOk    bool
+	}{
+		{"2022", date(2022, 1, 1), date(2023, 1, 1), true},
+		{"2022-6", date(2022, 6, 1), date(2022, 7, 1), true},
+		{"june 2022", date(2022, 6, 1), date(2022, 7, 1), true},
+		{"2023-w05", date(2023, 1, 30), date(2023, 2, 6), true},
+		{"2022-06-15", date(2022, 6, 15), date(2022, 6, 16), true},
+		{"15 june 2022", date(2022, 6, 15), date(2022, 6, 16), true},
+		{"today", date(2023, 5, 17), date(2023, 5, 18), true},
+		{"yesterday", date(2023, 5, 16), date(2023, 5, 17), true},
+		{"week", date(2023, 5, 10), date(2023, 5, 17), true},
+		{"2w", date(2023, 5, 3), date(2023, 5, 17), true},
+		{"3m", date(2023, 2, 17), date(2023, 5, 17), true},
+		{"asdf", time.Time{}, time.Time{}, false},
+	}
+	parser := NewParser(DefaultOptions())
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			start, end, ok := parser.ParseRange(tt.text, now)
+			if ok != tt.wantOk || !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("ParseRange() = %v, %v, %v, want %v, %v, %v", start, end, ok, tt.wantStart, tt.wantEnd, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestParser_FindAll(t *testing.T) {
+	text := `Invoice 10 items 2023-01-05
+Delivered on March 3rd, 2023. Due date: 31.03.2023, order 12.34.`
+	want := []Match{
+		{Text: "2023-01-05", Date: date(2023, 1, 5)},
+		{Text: "March 3rd, 2023", Date: date(2023, 3, 3)},
+		{Text: "31.03.2023", Date: date(2023, 3, 31)},
+	}
+	got := NewParser(DefaultOptions()).FindAll(text)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAll() = %v, want %v", got, want)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-uuid"
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 	"tryffel.net/go/virtualpaper/config"
 )
@@ -35,22 +36,48 @@ import (
 // Document represents single file and data related to it.
 type Document struct {
 	Timestamp
-	Id          string    `db:"id"`
-	UserId      int       `db:"user_id"`
-	Name        string    `db:"name"`
-	Description string    `db:"description"`
-	Content     string    `db:"content"`
-	Filename    string    `db:"filename"`
-	Hash        string    `db:"hash"`
-	Mimetype    string    `db:"mimetype"`
-	Size        int64     `db:"size"`
-	Date        time.Time `db:"date"`
+	Id          string         `db:"id"`
+	UserId      int            `db:"user_id"`
+	Name        string         `db:"name"`
+	Description string         `db:"description"`
+	Content     string         `db:"content"`
+	Filename    string         `db:"filename"`
+	Hash        string         `db:"hash"`
+	Mimetype    string         `db:"mimetype"`
+	Size        int64          `db:"size"`
+	Date        time.Time      `db:"date"`
+	Source      DocumentSource `db:"source"`
+	NeedsReview bool           `db:"needs_review"`
 	Metadata    []Metadata
 	Tags        []Tag
+	Properties  []DocumentProperty
+	Barcodes    []DocumentBarcode
+	Fields      []DocumentField
 
 	DeletedAt sql.NullTime `db:"deleted_at"`
 }
 
+// DocumentSource tells how the document was added.
+type DocumentSource string
+
+const (
+	// DocumentSourceUnknown is the source of documents added before sources were recorded.
+	DocumentSourceUnknown DocumentSource = ""
+	// DocumentSourceUpload is a document uploaded with the api.
+	DocumentSourceUpload DocumentSource = "upload"
+	// DocumentSourceInputDir is a document imported from the input directory.
+	DocumentSourceInputDir DocumentSource = "input_dir"
+	// DocumentSourceSplit is a document split from another document.
+	DocumentSourceSplit DocumentSource = "split"
+)
+
+var AllDocumentSources = []DocumentSource{
+	DocumentSourceUnknown,
+	DocumentSourceUpload,
+	DocumentSourceInputDir,
+	DocumentSourceSplit,
+}
+
 // Init initializes new document. It ensures document has valid uuid assigned to it.
 func (d *Document) Init() {
 	if d.Id == "" {
@@ -142,6 +169,9 @@ type Metadata struct {
 	Key     string `db:"key" json:"key"`
 	ValueId int    `db:"value_id" json:"value_id"`
 	Value   string `db:"value" json:"value"`
+	// ValueType and the typed value are only loaded with document metadata.
+	ValueType MetadataValueType `db:"value_type" json:"-"`
+	MetadataTypedValue
 }
 
 type MetadataKey struct {
@@ -150,6 +180,14 @@ type MetadataKey struct {
 	Key       string    `db:"key" json:"key"`
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 	Comment   string    `db:"comment" json:"comment"`
+	// ValueType of the values, text by default.
+	ValueType MetadataValueType `db:"value_type" json:"value_type"`
+	// SingleValue allows only one value of the key per document.
+	SingleValue bool `db:"single_value" json:"single_value"`
+	// RequiredWhenKeyId makes the key required in documents that have the given key,
+	// and if RequiredWhenValueId is set, the given value of the key.
+	RequiredWhenKeyId   IntId `db:"required_when_key_id" json:"required_when_key_id"`
+	RequiredWhenValueId IntId `db:"required_when_value_id" json:"required_when_value_id"`
 }
 
 func MetadataDiff(id string, userId int, original, updated *[]Metadata) []DocumentHistory {
@@ -169,15 +207,18 @@ func MetadataDiff(id string, userId int, original, updated *[]Metadata) []Docume
 		return history
 	}
 
-	oldMetadata := map[string]Metadata{}
-	newMetadata := map[string]Metadata{}
+	oldMetadata := map[string]bool{}
+	newMetadata := map[string]bool{}
+	metadataId := func(m Metadata) string {
+		return fmt.Sprintf("%d-%d", m.KeyId, m.ValueId)
+	}
 
 	for _, v := range *original {
-		oldMetadata[fmt.Sprintf("%d-%d", v.KeyId, v.ValueId)] = v
+		oldMetadata[metadataId(v)] = true
 	}
 
 	for _, v := range *updated {
-		newMetadata[fmt.Sprintf("%d-%d", v.KeyId, v.ValueId)] = v
+		newMetadata[metadataId(v)] = true
 	}
 
 	formatMetadata := func(m Metadata) string {
@@ -193,15 +234,23 @@ func MetadataDiff(id string, userId int, original, updated *[]Metadata) []Docume
 		return string(bytes)
 	}
 
-	for keyValue, oldVal := range oldMetadata {
-		if _, found := newMetadata[keyValue]; !found {
-			addHistoryItem(DocumentHistoryActionMetadataRemove, formatMetadata(oldVal), "")
+	// iterate slices instead of maps to keep the order of history items stable:
+	// removed metadata first, then added metadata, both in their original order.
+	removed := map[string]bool{}
+	for _, v := range *original {
+		id := metadataId(v)
+		if !newMetadata[id] && !removed[id] {
+			removed[id] = true
+			addHistoryItem(DocumentHistoryActionMetadataRemove, formatMetadata(v), "")
 		}
 	}
 
-	for keyValue, newVal := range newMetadata {
-		if _, found := oldMetadata[keyValue]; !found {
-			addHistoryItem(DocumentHistoryActionMetadataAdd, "", formatMetadata(newVal))
+	added := map[string]bool{}
+	for _, v := range *updated {
+		id := metadataId(v)
+		if !oldMetadata[id] && !added[id] {
+			added[id] = true
+			addHistoryItem(DocumentHistoryActionMetadataAdd, "", formatMetadata(v))
 		}
 	}
 	return history
@@ -220,7 +269,7 @@ type MetadataKeyAnnotated struct {
 func (m *MetadataKey) Update() {}
 
 func (m *MetadataKey) FilterAttributes() []string {
-	return []string{"id", "key", "created_at", "comment", "documents_count"}
+	return []string{"id", "key", "created_at", "comment", "documents_count", "value_type"}
 }
 
 func (m *MetadataKey) SortNoCase() []string {
@@ -245,13 +294,23 @@ type MetadataValue struct {
 	MatchDocuments bool             `db:"match_documents" json:"match_documents"`
 	MatchType      MetadataRuleType `db:"match_type" json:"match_type"`
 	MatchFilter    string           `db:"match_filter" json:"match_filter"`
+
+	// ParentId is the parent value within the same key, 0 if value is at the top level.
+	ParentId IntId `db:"parent_id" json:"parent_id"`
+	// Path is the value with its ancestors, e.g. 'Renovation/Kitchen'.
+	Path     string           `db:"-" json:"path,omitempty"`
+	Children []*MetadataValue `db:"-" json:"children,omitempty"`
+	// Aliases are other names of the value that are used in matching and search, e.g. 'acme' for 'ACME Oy'.
+	Aliases pq.StringArray `db:"aliases" json:"aliases"`
+
+	MetadataTypedValue
 }
 
 func (m *MetadataValue) Update() {}
 
 func (m *MetadataValue) FilterAttributes() []string {
 	return []string{"id", "key", "value", "created_at", "comment", "documents_count",
-		"match_documents", "match_type", "match_filter"}
+		"match_documents", "match_type", "match_filter", "parent_id"}
 }
 
 func (m *MetadataValue) SortAttributes() []string {
@@ -270,6 +329,8 @@ type DocumentHistory struct {
 	NewValue   string    `db:"new_value" json:"new_value"`
 	UserId     int       `db:"user_id" json:"user_id"`
 	User       string    `db:"user" json:"user"`
+	RuleId     IntId     `db:"rule_id" json:"rule_id"`
+	RuleName   string    `db:"rule_name" json:"rule_name"`
 	CreatedAt  time.Time `db:"created_at" json:"created_at"`
 }
 
@@ -302,8 +363,15 @@ const (
 	DocumentHistoryActionContent        = "content"
 	DocumentHistoryActionMetadataRemove = "remove metadata"
 	DocumentHistoryActionMetadataAdd    = "add metadata"
+	DocumentHistoryActionTagRemove      = "remove tag"
+	DocumentHistoryActionTagAdd         = "add tag"
 	DocumentHistoryActionDelete         = "delete"
 	DocumentHistoryActionRestore        = "restore"
+	DocumentHistoryActionMergeDuplicate = "merge duplicate"
+	DocumentHistoryActionNeedsReview    = "needs review"
+	DocumentHistoryActionLinkDocuments  = "link documents"
+	DocumentHistoryActionNotify         = "notify"
+	DocumentHistoryActionStopRules      = "stop rules"
 )
 
 // Diffs returns a list of DocumentHistory items from d -> newDocument.
@@ -340,6 +408,9 @@ func (d *Document) Diff(newDocument *Document, userId int) ([]DocumentHistory, e
 	if d.Content != d2.Content {
 		addHistoryItem(DocumentHistoryActionContent, d.Content, d2.Content)
 	}
+	if d.NeedsReview != d2.NeedsReview {
+		addHistoryItem(DocumentHistoryActionNeedsReview, strconv.FormatBool(d.NeedsReview), strconv.FormatBool(d2.NeedsReview))
+	}
 	return history, nil
 }
 
@@ -349,3 +420,99 @@ type LinkedDocument struct {
 	DocumentName string    `json:"name"`
 	CreatedAt    time.Time `json:"created_at"`
 }
+
+// DocumentProperty is a raw property extracted from the document file, e.g. pdf info or exif data.
+type DocumentProperty struct {
+	DocumentId string `db:"document_id" json:"-"`
+	Key        string `db:"key" json:"key"`
+	Value      string `db:"value" json:"value"`
+	// Source is the tool that extracted the property: 'pdfinfo' or 'exif'.
+	Source string `db:"source" json:"source"`
+}
+
+// GetProperty returns property value by case-insensitive key and true if property exists.
+func (d *Document) GetProperty(key string) (string, bool) {
+	for _, v := range d.Properties {
+		if strings.EqualFold(v.Key, key) {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+// DocumentBarcode is a barcode or qr code decoded from document page.
+type DocumentBarcode struct {
+	DocumentId string `db:"document_id" json:"-"`
+	// Page number, starting from 1.
+	Page int `db:"page" json:"page"`
+	// Type is the barcode symbology, e.g. 'QR-Code' or 'EAN-13'.
+	Type    string `db:"type" json:"type"`
+	Payload string `db:"payload" json:"payload"`
+}
+
+// Structured fields that are extracted from document content.
+const (
+	DocumentFieldAmount    = "amount"
+	DocumentFieldCurrency  = "currency"
+	DocumentFieldIban      = "iban"
+	DocumentFieldReference = "reference"
+	DocumentFieldDueDate   = "due_date"
+	DocumentFieldVatId     = "vat_id"
+)
+
+var AllDocumentFields = []string{
+	DocumentFieldAmount,
+	DocumentFieldCurrency,
+	DocumentFieldIban,
+	DocumentFieldReference,
+	DocumentFieldDueDate,
+	DocumentFieldVatId,
+}
+
+// DocumentField is a structured field extracted from document content, e.g. invoice total amount.
+type DocumentField struct {
+	DocumentId string `db:"document_id" json:"-"`
+	Name       string `db:"name" json:"name"`
+	// Value is normalized: amount is formatted as '1234.50', due_date as '2006-01-02',
+	// iban and vat_id without whitespace.
+	Value string `db:"value" json:"value"`
+	// Confidence is between 0 and 1.
+	Confidence float64 `db:"confidence" json:"confidence"`
+}
+
+// GetField returns field by name and true if field exists.
+func (d *Document) GetField(name string) (DocumentField, bool) {
+	for _, v := range d.Fields {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return DocumentField{}, false
+}
+
+// DocumentFingerprint contains hashes that are used to find near-duplicate documents.
+type DocumentFingerprint struct {
+	DocumentId string `db:"document_id"`
+	// ContentHash is a simhash of document content.
+	ContentHash sql.NullInt64 `db:"content_hash"`
+	// ImageHash is a difference hash of document thumbnail.
+	ImageHash sql.NullInt64 `db:"image_hash"`
+}
+
+const (
+	DocumentDuplicatePending = "pending"
+	DocumentDuplicateIgnored = "ignored"
+)
+
+// DocumentDuplicate is a pair of documents that are likely duplicates of each other.
+type DocumentDuplicate struct {
+	DocumentId    string `db:"document_id"`
+	DocumentName  string `db:"document_name"`
+	DuplicateId   string `db:"duplicate_id"`
+	DuplicateName string `db:"duplicate_name"`
+	// Similarities are between 0 and 1, null if not available for both documents.
+	ContentSimilarity sql.NullFloat64 `db:"content_similarity"`
+	ImageSimilarity   sql.NullFloat64 `db:"image_similarity"`
+	Status            string          `db:"status"`
+	CreatedAt         time.Time       `db:"created_at"`
+}
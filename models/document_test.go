@@ -21,6 +21,7 @@ package models
 import (
 	"github.com/stretchr/testify/assert"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -168,6 +169,24 @@ func TestDocument_Metadata_Diff(t *testing.T) {
 				{DocumentId: docId, UserId: userId, Action: "add metadata", OldValue: "", NewValue: `{"key_id":10,"value_id":22}`},
 			},
 		},
+		{
+			name: "add multiple metadata",
+			fields: fields{
+				Metadata: []Metadata{},
+			},
+			args: args{metadata: []Metadata{
+				{KeyId: 5, ValueId: 1},
+				{KeyId: 3, ValueId: 9},
+				{KeyId: 4, ValueId: 2},
+				{KeyId: 3, ValueId: 9},
+			}},
+			wantErr: false,
+			want: []DocumentHistory{
+				{DocumentId: docId, UserId: userId, Action: "add metadata", OldValue: "", NewValue: `{"key_id":5,"value_id":1}`},
+				{DocumentId: docId, UserId: userId, Action: "add metadata", OldValue: "", NewValue: `{"key_id":3,"value_id":9}`},
+				{DocumentId: docId, UserId: userId, Action: "add metadata", OldValue: "", NewValue: `{"key_id":4,"value_id":2}`},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -176,3 +195,207 @@ func TestDocument_Metadata_Diff(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMetadataValue(t *testing.T) {
+	tests := []struct {
+		valueType MetadataValueType
+		value     string
+		want      string
+		wantErr   bool
+	}{
+		{MetadataValueText, " Some text ", " Some text ", false},
+		{MetadataValueInteger, "1 200", "1200", false},
+		{MetadataValueInteger, "12.5", "12.5", true},
+		{MetadataValueDecimal, "120,50", "120.5", false},
+		{MetadataValueDecimal, "-0.25", "-0.25", false},
+		{MetadataValueDecimal, "abc", "abc", true},
+		{MetadataValueDate, "2025-01-31", "2025-01-31", false},
+		{MetadataValueDate, "31.1.2025", "31.1.2025", true},
+		{MetadataValueBoolean, "Yes", "true", false},
+		{MetadataValueBoolean, "0", "false", false},
+		{MetadataValueBoolean, "maybe", "maybe", true},
+		{"unknown", "1", "1", true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.valueType)+" "+tt.value, func(t *testing.T) {
+			got, typed, err := ParseMetadataValue(tt.valueType, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseMetadataValue() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseMetadataValue() = %v, want %v", got, tt.want)
+			}
+			if tt.wantErr {
+				return
+			}
+			_, isNumber := typed.Number()
+			if isNumber != tt.valueType.Comparable() {
+				t.Errorf("ParseMetadataValue() typed value is number = %v, want %v", isNumber, tt.valueType.Comparable())
+			}
+		})
+	}
+}
+
+func TestBuildMetadataValueTree(t *testing.T) {
+	values := []*MetadataValue{
+		{Id: 1, Value: "Renovation"},
+		{Id: 2, Value: "Bathroom", ParentId: 1},
+		{Id: 3, Value: "Kitchen", ParentId: 1},
+		{Id: 4, Value: "Sink", ParentId: 3},
+		{Id: 5, Value: "Orphan", ParentId: 10},
+		{Id: 6, Value: "Cycle", ParentId: 7},
+		{Id: 7, Value: "Loop", ParentId: 6},
+	}
+	roots := BuildMetadataValueTree(values)
+	if len(roots) != 2 || roots[0].Id != 1 || roots[1].Id != 5 {
+		t.Fatalf("BuildMetadataValueTree() roots = %v", roots)
+	}
+	if len(roots[0].Children) != 2 || roots[0].Children[1].Id != 3 {
+		t.Fatalf("BuildMetadataValueTree() children = %v", roots[0].Children)
+	}
+	if path := roots[0].Children[1].Children[0].Path; path != "Renovation/Kitchen/Sink" {
+		t.Errorf("BuildMetadataValueTree() path = %s, want Renovation/Kitchen/Sink", path)
+	}
+
+	paths := MetadataValueAncestorPaths([]MetadataValue{*values[0], *values[2], *values[3], *values[5], *values[6]})
+	if !reflect.DeepEqual(paths[4], []string{"Renovation", "Renovation/Kitchen", "Renovation/Kitchen/Sink"}) {
+		t.Errorf("MetadataValueAncestorPaths() = %v", paths[4])
+	}
+	if len(paths[6]) != 2 {
+		t.Errorf("MetadataValueAncestorPaths() with cycle = %v", paths[6])
+	}
+}
+
+func TestNormalizeMetadataAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases []string
+		want    []string
+		wantErr bool
+	}{
+		{"trim", []string{" acme ", "acme ltd"}, []string{"acme", "acme ltd"}, false},
+		{"empty list", []string{}, []string{}, false},
+		{"same as value", []string{"ACME oy"}, nil, true},
+		{"duplicate", []string{"acme", "Acme"}, nil, true},
+		{"empty alias", []string{" "}, nil, true},
+		{"invalid character", []string{"acme:ltd"}, nil, true},
+		{"too long", []string{strings.Repeat("a", 31)}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeMetadataAliases("ACME Oy", tt.aliases)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NormalizeMetadataAliases() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NormalizeMetadataAliases() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMetadataViolations(t *testing.T) {
+	keys := []MetadataKey{
+		{Id: 1, Key: "type"},
+		{Id: 2, Key: "year", SingleValue: true},
+		{Id: 3, Key: "customer", RequiredWhenKeyId: 1, RequiredWhenValueId: 10},
+		{Id: 4, Key: "category", RequiredWhenKeyId: 2},
+	}
+	tests := []struct {
+		name     string
+		original []Metadata
+		updated  []Metadata
+		want     []MetadataViolationType
+	}{
+		{"no metadata", nil, nil, []MetadataViolationType{}},
+		{"multiple values", nil, []Metadata{{KeyId: 2, ValueId: 20}, {KeyId: 2, ValueId: 21}, {KeyId: 4, ValueId: 40}},
+			[]MetadataViolationType{MetadataViolationMultipleValues}},
+		{"required by value", nil, []Metadata{{KeyId: 1, ValueId: 10}},
+			[]MetadataViolationType{MetadataViolationMissingKey}},
+		{"other value", nil, []Metadata{{KeyId: 1, ValueId: 11}}, []MetadataViolationType{}},
+		{"required by key", nil, []Metadata{{KeyId: 2, ValueId: 20}},
+			[]MetadataViolationType{MetadataViolationMissingKey}},
+		{"required key exists", nil, []Metadata{{KeyId: 1, ValueId: 10}, {KeyId: 3, ValueId: 30}},
+			[]MetadataViolationType{}},
+		{"existing violation", []Metadata{{KeyId: 1, ValueId: 10}},
+			[]Metadata{{KeyId: 1, ValueId: 10}, {KeyId: 2, ValueId: 20}, {KeyId: 4, ValueId: 40}},
+			[]MetadataViolationType{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]MetadataViolationType, 0)
+			for _, v := range NewMetadataViolations(keys, tt.original, tt.updated) {
+				got = append(got, v.Violation)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewMetadataViolations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySingleValueKeys(t *testing.T) {
+	keys := []MetadataKey{{Id: 1, SingleValue: true}, {Id: 2}}
+	metadata := []Metadata{{KeyId: 1, ValueId: 10}, {KeyId: 2, ValueId: 20}}
+	added := []Metadata{{KeyId: 1, ValueId: 11}, {KeyId: 2, ValueId: 20}, {KeyId: 2, ValueId: 21}}
+	want := []Metadata{{KeyId: 2, ValueId: 20}, {KeyId: 1, ValueId: 11}, {KeyId: 2, ValueId: 21}}
+	if got := ApplySingleValueKeys(keys, metadata, added); !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplySingleValueKeys() = %v, want %v", got, want)
+	}
+}
+
+func TestMergeableMetadata(t *testing.T) {
+	keys := []MetadataKey{{Id: 1, SingleValue: true}, {Id: 2}, {Id: 3, SingleValue: true}}
+	metadata := []Metadata{{KeyId: 1, ValueId: 10}, {KeyId: 2, ValueId: 20}}
+	other := []Metadata{{KeyId: 1, ValueId: 11}, {KeyId: 2, ValueId: 21}, {KeyId: 3, ValueId: 30}, {KeyId: 3, ValueId: 31}}
+	want := []Metadata{{KeyId: 2, ValueId: 21}, {KeyId: 3, ValueId: 30}}
+	if got := MergeableMetadata(keys, metadata, other); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeableMetadata() = %v, want %v", got, want)
+	}
+}
+
+func TestMetadataValueIsDescendant(t *testing.T) {
+	// 1 -> 2 -> 3 -> 4, 5 is at top level
+	parents := map[int]int{2: 1, 3: 2, 4: 3}
+	tests := []struct {
+		name     string
+		value    int
+		ancestor int
+		want     bool
+	}{
+		{"child", 2, 1, true},
+		{"grandchild", 3, 1, true},
+		{"deep descendant", 4, 2, true},
+		{"parent", 1, 2, false},
+		{"self", 2, 2, false},
+		{"other tree", 5, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MetadataValueIsDescendant(parents, tt.value, tt.ancestor); got != tt.want {
+				t.Errorf("MetadataValueIsDescendant() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// cycle does not loop forever
+	if MetadataValueIsDescendant(map[int]int{1: 2, 2: 1}, 1, 3) {
+		t.Errorf("MetadataValueIsDescendant() with cycle = true, want false")
+	}
+}
+
+func TestTagDiff(t *testing.T) {
+	docId := "1234"
+	userId := 10
+	original := []Tag{{Id: 1, Key: "bills"}, {Id: 2, Key: "to do"}}
+	updated := []Tag{{Id: 2, Key: "to do"}, {Id: 3, Key: "paid"}, {Id: 3, Key: "paid"}}
+
+	want := []DocumentHistory{
+		{DocumentId: docId, UserId: userId, Action: "remove tag", OldValue: `{"tag_id":1,"key":"bills"}`},
+		{DocumentId: docId, UserId: userId, Action: "add tag", NewValue: `{"tag_id":3,"key":"paid"}`},
+	}
+	assert.Equal(t, want, TagDiff(docId, userId, original, updated))
+	assert.Equal(t, []DocumentHistory{}, TagDiff(docId, userId, original, original))
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"database/sql"
 	"database/sql/driver"
 	"fmt"
 	"time"
@@ -91,10 +92,18 @@ const (
 
 	ProcessHash ProcessStep = 1
 
-	ProcessThumbnail    ProcessStep = 2
-	ProcessParseContent ProcessStep = 3
-	ProcessRules        ProcessStep = 4
-	ProcessFts          ProcessStep = 5
+	ProcessThumbnail ProcessStep = 2
+	// ProcessBarcodes decodes barcodes and qr codes from document pages.
+	ProcessBarcodes     ProcessStep = 3
+	ProcessParseContent ProcessStep = 4
+	// ProcessProperties extracts file properties, e.g. pdf info and exif data.
+	ProcessProperties ProcessStep = 5
+	// ProcessFields extracts structured fields, e.g. invoice amount, from content.
+	ProcessFields ProcessStep = 6
+	// ProcessDuplicates calculates content and thumbnail fingerprints and finds near-duplicate documents.
+	ProcessDuplicates ProcessStep = 7
+	ProcessRules      ProcessStep = 8
+	ProcessFts        ProcessStep = 9
 )
 
 const (
@@ -107,7 +116,7 @@ const (
 )
 
 // ProcessStepsAll is a list of default steps to run for new document.
-var ProcessStepsAll = []ProcessStep{ProcessHash, ProcessThumbnail, ProcessParseContent, ProcessRules, ProcessFts}
+var ProcessStepsAll = []ProcessStep{ProcessHash, ProcessThumbnail, ProcessBarcodes, ProcessParseContent, ProcessProperties, ProcessFields, ProcessDuplicates, ProcessRules, ProcessFts}
 
 func (ps *ProcessStep) Value() (driver.Value, error) {
 	return int(*ps), nil
@@ -140,10 +149,18 @@ func (ps ProcessStep) String() string {
 	case 2:
 		return "thumbnail"
 	case 3:
-		return "parsecontent"
+		return "barcodes"
 	case 4:
-		return "rules"
+		return "parsecontent"
 	case 5:
+		return "properties"
+	case 6:
+		return "fields"
+	case 7:
+		return "duplicates"
+	case 8:
+		return "rules"
+	case 9:
 		return "fts"
 	default:
 		return fmt.Sprintf("unknkown step: %d", ps)
@@ -157,3 +174,39 @@ type ProcessItem struct {
 	Step       ProcessStep `db:"step"`
 	CreatedAt  time.Time   `db:"created_at"`
 }
+
+type BulkOperationStatus string
+
+const (
+	BulkOperationPending  BulkOperationStatus = "pending"
+	BulkOperationRunning  BulkOperationStatus = "running"
+	BulkOperationFinished BulkOperationStatus = "finished"
+	BulkOperationFailed   BulkOperationStatus = "failed"
+)
+
+const (
+	// BulkOperationApplyRule runs a processing rule on existing documents.
+	BulkOperationApplyRule = "apply rule"
+)
+
+// BulkOperation tracks the progress of an operation that modifies multiple documents in the background.
+type BulkOperation struct {
+	Id        int                 `db:"id"`
+	UserId    int                 `db:"user_id"`
+	Operation string              `db:"operation"`
+	RuleId    IntId               `db:"rule_id"`
+	Status    BulkOperationStatus `db:"status"`
+	// Total number of documents in the operation.
+	Total     int `db:"total"`
+	Processed int `db:"processed"`
+	// Matched is the number of documents that matched the rule.
+	Matched int `db:"matched"`
+	// Changed is the number of documents that were modified.
+	Changed int    `db:"changed"`
+	Failed  int    `db:"failed"`
+	Message string `db:"message"`
+
+	CreatedAt time.Time    `db:"created_at"`
+	StartedAt sql.NullTime `db:"started_at"`
+	StoppedAt sql.NullTime `db:"stopped_at"`
+}
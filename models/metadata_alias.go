@@ -0,0 +1,59 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"tryffel.net/go/virtualpaper/errors"
+)
+
+// MaxMetadataAliases is the maximum number of aliases a metadata value can have.
+const MaxMetadataAliases = 20
+
+// NormalizeMetadataAliases trims aliases and validates them. Aliases follow the same rules as values,
+// and they must be unique and differ from the value itself, ignoring case.
+func NormalizeMetadataAliases(value string, aliases []string) ([]string, error) {
+	e := errors.ErrInvalid
+	if len(aliases) > MaxMetadataAliases {
+		e.ErrMsg = fmt.Sprintf("value can have at most %d aliases", MaxMetadataAliases)
+		return nil, e
+	}
+	normalized := make([]string, 0, len(aliases))
+	seen := map[string]bool{strings.ToLower(value): true}
+	for _, v := range aliases {
+		alias := strings.TrimSpace(v)
+		if alias == "" || len([]rune(alias)) > 30 {
+			e.ErrMsg = fmt.Sprintf("alias '%s' must be 1-30 characters long", v)
+			return nil, e
+		}
+		if strings.ContainsAny(alias, ":;\n") {
+			e.ErrMsg = fmt.Sprintf("alias '%s' cannot contain ':', ';' or newline", alias)
+			return nil, e
+		}
+		if seen[strings.ToLower(alias)] {
+			e.ErrMsg = fmt.Sprintf("duplicate alias: '%s'", alias)
+			return nil, e
+		}
+		seen[strings.ToLower(alias)] = true
+		normalized = append(normalized, alias)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MetadataViolationType is the constraint of a metadata key that document violates.
+type MetadataViolationType string
+
+const (
+	// MetadataViolationMultipleValues means document has multiple values of a single-valued key.
+	MetadataViolationMultipleValues MetadataViolationType = "multiple_values"
+	// MetadataViolationMissingKey means document does not have a key that is required by its other metadata.
+	MetadataViolationMissingKey MetadataViolationType = "missing_required_key"
+)
+
+// MetadataConstraintViolation is a document that violates the constraints of a metadata key.
+type MetadataConstraintViolation struct {
+	DocumentId   string                `db:"document_id" json:"document_id"`
+	DocumentName string                `db:"document_name" json:"document_name"`
+	KeyId        int                   `db:"key_id" json:"key_id"`
+	Key          string                `db:"key" json:"key"`
+	Violation    MetadataViolationType `db:"violation" json:"violation"`
+}
+
+func (v MetadataConstraintViolation) String() string {
+	if v.Violation == MetadataViolationMultipleValues {
+		return fmt.Sprintf("key '%s' can only have one value", v.Key)
+	}
+	return fmt.Sprintf("key '%s' is required", v.Key)
+}
+
+// CheckMetadataConstraints returns the constraints of the keys that the metadata of a document violates.
+// Violations are sorted by key id.
+func CheckMetadataConstraints(keys []MetadataKey, metadata []Metadata) []MetadataConstraintViolation {
+	keyValues := make(map[int]map[int]bool, len(metadata))
+	for _, v := range metadata {
+		if keyValues[v.KeyId] == nil {
+			keyValues[v.KeyId] = make(map[int]bool)
+		}
+		keyValues[v.KeyId][v.ValueId] = true
+	}
+
+	violations := make([]MetadataConstraintViolation, 0)
+	for _, key := range keys {
+		if key.SingleValue && len(keyValues[key.Id]) > 1 {
+			violations = append(violations, MetadataConstraintViolation{
+				KeyId: key.Id, Key: key.Key, Violation: MetadataViolationMultipleValues})
+		}
+		if key.RequiredWhenKeyId == 0 || len(keyValues[key.Id]) > 0 {
+			continue
+		}
+		required := keyValues[int(key.RequiredWhenKeyId)]
+		if len(required) > 0 && (key.RequiredWhenValueId == 0 || required[int(key.RequiredWhenValueId)]) {
+			violations = append(violations, MetadataConstraintViolation{
+				KeyId: key.Id, Key: key.Key, Violation: MetadataViolationMissingKey})
+		}
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].KeyId < violations[j].KeyId
+	})
+	return violations
+}
+
+// NewMetadataViolations returns violations of the updated metadata that original metadata does not have.
+// Documents that already violate the constraints can be edited as long as the edit does not add violations.
+func NewMetadataViolations(keys []MetadataKey, original, updated []Metadata) []MetadataConstraintViolation {
+	existing := make(map[string]bool)
+	for _, v := range CheckMetadataConstraints(keys, original) {
+		existing[fmt.Sprintf("%d-%s", v.KeyId, v.Violation)] = true
+	}
+	violations := make([]MetadataConstraintViolation, 0)
+	for _, v := range CheckMetadataConstraints(keys, updated) {
+		if !existing[fmt.Sprintf("%d-%s", v.KeyId, v.Violation)] {
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// ApplySingleValueKeys returns metadata with added metadata, where added values of single-valued keys
+// replace existing values of the key.
+func ApplySingleValueKeys(keys []MetadataKey, metadata, added []Metadata) []Metadata {
+	single := make(map[int]bool)
+	for _, v := range keys {
+		if v.SingleValue {
+			single[v.Id] = true
+		}
+	}
+	replaced := make(map[int]bool)
+	for _, v := range added {
+		if single[v.KeyId] {
+			replaced[v.KeyId] = true
+		}
+	}
+
+	result := make([]Metadata, 0, len(metadata)+len(added))
+	exists := make(map[string]bool)
+	for _, v := range metadata {
+		if !replaced[v.KeyId] {
+			result = append(result, v)
+			exists[fmt.Sprintf("%d-%d", v.KeyId, v.ValueId)] = true
+		}
+	}
+	for _, v := range added {
+		id := fmt.Sprintf("%d-%d", v.KeyId, v.ValueId)
+		if !exists[id] {
+			result = append(result, v)
+			exists[id] = true
+		}
+	}
+	return result
+}
+
+// MergeableMetadata returns values of other that can be merged into metadata. Single-valued keys
+// that already have a value in metadata keep it, and only the first value of other is merged
+// for the rest of the single-valued keys.
+func MergeableMetadata(keys []MetadataKey, metadata, other []Metadata) []Metadata {
+	single := make(map[int]bool)
+	for _, v := range keys {
+		if v.SingleValue {
+			single[v.Id] = true
+		}
+	}
+	hasValue := make(map[int]bool)
+	for _, v := range metadata {
+		hasValue[v.KeyId] = true
+	}
+
+	result := make([]Metadata, 0, len(other))
+	for _, v := range other {
+		if single[v.KeyId] {
+			if hasValue[v.KeyId] {
+				continue
+			}
+			hasValue[v.KeyId] = true
+		}
+		result = append(result, v)
+	}
+	return result
+}
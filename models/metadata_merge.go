@@ -0,0 +1,38 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+// MetadataMergeResult is the result of merging metadata values or keys. In preview, counts are
+// what the merge would change, and nothing is saved.
+type MetadataMergeResult struct {
+	Preview bool `json:"preview"`
+	// Documents is the number of documents whose metadata changes.
+	Documents int `json:"documents"`
+	// DocumentMetadata is the number of document key-value pairs moved to the target.
+	DocumentMetadata int `json:"document_metadata"`
+	RuleConditions   int `json:"rule_conditions"`
+	RuleActions      int `json:"rule_actions"`
+	// DeletedValues is the number of source values that were merged into the target values and deleted.
+	DeletedValues int `json:"deleted_values"`
+	// MovedValues is the number of values moved to the target key when merging keys.
+	MovedValues int `json:"moved_values"`
+	DeletedKeys int `json:"deleted_keys"`
+	// DocumentIds are the affected documents.
+	DocumentIds []string `json:"-"`
+}
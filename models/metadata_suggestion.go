@@ -0,0 +1,72 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	MetadataSuggestionPending  = "pending"
+	MetadataSuggestionAccepted = "accepted"
+	MetadataSuggestionRejected = "rejected"
+)
+
+// MetadataSuggestion is a metadata value that the classifier suggests for the document.
+type MetadataSuggestion struct {
+	Id           int    `db:"id" json:"id"`
+	DocumentId   string `db:"document_id" json:"document_id"`
+	DocumentName string `db:"document_name" json:"document_name"`
+	KeyId        int    `db:"key_id" json:"key_id"`
+	Key          string `db:"key" json:"key"`
+	ValueId      int    `db:"value_id" json:"value_id"`
+	Value        string `db:"value" json:"value"`
+	// Confidence of the classifier between 0 and 1.
+	Confidence float64 `db:"confidence" json:"confidence"`
+	Status     string  `db:"status" json:"status"`
+	// Automatic is set when the suggestion was applied to the document without user accepting it.
+	Automatic bool      `db:"automatic" json:"automatic"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// MetadataClassifier is a trained classifier of a user. Model is the serialized classifier.
+type MetadataClassifier struct {
+	UserId int    `db:"user_id"`
+	Model  string `db:"model"`
+	// Documents is the number of documents the classifier was trained with.
+	Documents int `db:"documents"`
+	// Keys is the number of metadata keys the classifier predicts.
+	Keys      int       `db:"keys"`
+	TrainedAt time.Time `db:"trained_at"`
+}
+
+// ClassifierDocument is a labelled document used for training the classifier.
+// KeyIds and ValueIds are the metadata of the document in the same order.
+// ExcludedKeyIds are keys that the document is not used for, because their values are not confirmed.
+type ClassifierDocument struct {
+	Id             string        `db:"id"`
+	Name           string        `db:"name"`
+	Content        string        `db:"content"`
+	KeyIds         pq.Int64Array `db:"key_ids"`
+	ValueIds       pq.Int64Array `db:"value_ids"`
+	ExcludedKeyIds pq.Int64Array `db:"excluded_key_ids"`
+}
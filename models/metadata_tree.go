@@ -0,0 +1,102 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import "strings"
+
+const (
+	// MetadataPathSeparator separates the value from its ancestors in the path of a value.
+	MetadataPathSeparator = "/"
+	// MaxMetadataValueDepth is the maximum number of levels in a metadata value hierarchy.
+	MaxMetadataValueDepth = 10
+)
+
+// BuildMetadataValueTree sets the path and children of the values and returns the top level values.
+// Values whose parent is not in values are returned at the top level. Order of values is preserved.
+func BuildMetadataValueTree(values []*MetadataValue) []*MetadataValue {
+	byId := make(map[int]*MetadataValue, len(values))
+	for _, v := range values {
+		v.Children = nil
+		byId[v.Id] = v
+	}
+
+	roots := make([]*MetadataValue, 0)
+	for _, v := range values {
+		parent, ok := byId[int(v.ParentId)]
+		if v.ParentId == 0 || !ok || parent == v {
+			roots = append(roots, v)
+			continue
+		}
+		parent.Children = append(parent.Children, v)
+	}
+
+	var setPath func(value *MetadataValue, path string, depth int)
+	setPath = func(value *MetadataValue, path string, depth int) {
+		value.Path = path
+		if depth >= MaxMetadataValueDepth {
+			value.Children = nil
+			return
+		}
+		for _, child := range value.Children {
+			setPath(child, path+MetadataPathSeparator+child.Value, depth+1)
+		}
+	}
+	for _, v := range roots {
+		setPath(v, v.Value, 1)
+	}
+	return roots
+}
+
+// MetadataValueAncestorPaths returns the path of each value and the paths of its ancestors,
+// keyed by value id, e.g. 'Kitchen' -> ['Renovation', 'Renovation/Kitchen'].
+func MetadataValueAncestorPaths(values []MetadataValue) map[int][]string {
+	byId := make(map[int]*MetadataValue, len(values))
+	for i := range values {
+		byId[values[i].Id] = &values[i]
+	}
+
+	paths := make(map[int][]string, len(values))
+	for _, v := range values {
+		names := []string{v.Value}
+		parent := byId[int(v.ParentId)]
+		for parent != nil && len(names) < MaxMetadataValueDepth && parent.Id != v.Id {
+			names = append([]string{parent.Value}, names...)
+			parent = byId[int(parent.ParentId)]
+		}
+		ancestors := make([]string, len(names))
+		for i := range names {
+			ancestors[i] = strings.Join(names[:i+1], MetadataPathSeparator)
+		}
+		paths[v.Id] = ancestors
+	}
+	return paths
+}
+
+// MetadataValueIsDescendant returns true if value is below ancestor in the value hierarchy.
+// Parents maps value id to its parent id, top level values have no parent.
+func MetadataValueIsDescendant(parents map[int]int, value, ancestor int) bool {
+	parent := parents[value]
+	for depth := 0; parent != 0 && depth < MaxMetadataValueDepth; depth++ {
+		if parent == ancestor {
+			return true
+		}
+		parent = parents[parent]
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"tryffel.net/go/virtualpaper/errors"
+)
+
+// MetadataValueType is the type of the values of a metadata key.
+type MetadataValueType string
+
+const (
+	MetadataValueText MetadataValueType = "text"
+	// MetadataValueInteger is a whole number, e.g. '2023'.
+	MetadataValueInteger MetadataValueType = "integer"
+	// MetadataValueDecimal is a decimal number or an amount of money, e.g. '120.50'.
+	MetadataValueDecimal MetadataValueType = "decimal"
+	// MetadataValueDate is a date formatted as '2006-01-02'.
+	MetadataValueDate MetadataValueType = "date"
+	// MetadataValueBoolean is either 'true' or 'false'.
+	MetadataValueBoolean MetadataValueType = "boolean"
+)
+
+var AllMetadataValueTypes = []MetadataValueType{
+	MetadataValueText,
+	MetadataValueInteger,
+	MetadataValueDecimal,
+	MetadataValueDate,
+	MetadataValueBoolean,
+}
+
+func (t MetadataValueType) Valid() bool {
+	for _, v := range AllMetadataValueTypes {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Comparable returns true if values of the type can be compared with less than and more than.
+func (t MetadataValueType) Comparable() bool {
+	return t == MetadataValueInteger || t == MetadataValueDecimal || t == MetadataValueDate
+}
+
+// MetadataTypedValue is the value of a typed metadata key in its native type.
+// Only the field of the key type is set.
+type MetadataTypedValue struct {
+	ValueInt     sql.NullInt64   `db:"value_int" json:"-"`
+	ValueDecimal sql.NullFloat64 `db:"value_decimal" json:"-"`
+	ValueDate    sql.NullTime    `db:"value_date" json:"-"`
+	ValueBool    sql.NullBool    `db:"value_bool" json:"-"`
+}
+
+// Number returns the value as a number that can be compared and indexed. Dates are returned as unix timestamps.
+// Returns false if value is not a number or a date.
+func (v MetadataTypedValue) Number() (float64, bool) {
+	switch {
+	case v.ValueInt.Valid:
+		return float64(v.ValueInt.Int64), true
+	case v.ValueDecimal.Valid:
+		return v.ValueDecimal.Float64, true
+	case v.ValueDate.Valid:
+		return float64(v.ValueDate.Time.Unix()), true
+	}
+	return 0, false
+}
+
+var decimalSeparatorRe = regexp.MustCompile(`^-?\d+,\d+$`)
+
+// ParseMetadataValue validates the value for the type and returns the value formatted in a normalized way,
+// e.g. '1 200,50' -> '1200.5', and the typed value. Text values are returned as is.
+func ParseMetadataValue(valueType MetadataValueType, value string) (string, MetadataTypedValue, error) {
+	typed := MetadataTypedValue{}
+	e := errors.ErrInvalid
+	trimmed := strings.TrimSpace(value)
+
+	switch valueType {
+	case MetadataValueText, "":
+		return value, typed, nil
+	case MetadataValueInteger:
+		number, err := strconv.ParseInt(strings.ReplaceAll(trimmed, " ", ""), 10, 64)
+		if err != nil {
+			e.ErrMsg = fmt.Sprintf("'%s' is not an integer", value)
+			return value, typed, e
+		}
+		typed.ValueInt = sql.NullInt64{Int64: number, Valid: true}
+		return strconv.FormatInt(number, 10), typed, nil
+	case MetadataValueDecimal:
+		trimmed = strings.ReplaceAll(trimmed, " ", "")
+		if decimalSeparatorRe.MatchString(trimmed) {
+			trimmed = strings.Replace(trimmed, ",", ".", 1)
+		}
+		number, err := strconv.ParseFloat(trimmed, 64)
+		if err != nil {
+			e.ErrMsg = fmt.Sprintf("'%s' is not a decimal number", value)
+			return value, typed, e
+		}
+		typed.ValueDecimal = sql.NullFloat64{Float64: number, Valid: true}
+		return strconv.FormatFloat(number, 'f', -1, 64), typed, nil
+	case MetadataValueDate:
+		date, err := time.Parse("2006-01-02", trimmed)
+		if err != nil {
+			e.ErrMsg = fmt.Sprintf("'%s' is not a date formatted as YYYY-MM-DD", value)
+			return value, typed, e
+		}
+		typed.ValueDate = sql.NullTime{Time: date, Valid: true}
+		return date.Format("2006-01-02"), typed, nil
+	case MetadataValueBoolean:
+		var b bool
+		switch strings.ToLower(trimmed) {
+		case "true", "yes", "1":
+			b = true
+		case "false", "no", "0":
+			b = false
+		default:
+			e.ErrMsg = fmt.Sprintf("'%s' is not a boolean", value)
+			return value, typed, e
+		}
+		typed.ValueBool = sql.NullBool{Bool: b, Valid: true}
+		return strconv.FormatBool(b), typed, nil
+	default:
+		e.ErrMsg = fmt.Sprintf("invalid value type: '%s'", valueType)
+		return value, typed, e
+	}
+}
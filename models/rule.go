@@ -19,9 +19,18 @@
 package models
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
+	"io"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
+	"unicode"
 
 	"tryffel.net/go/virtualpaper/errors"
 )
@@ -68,21 +77,170 @@ type Rule struct {
 	Enabled     bool                   `db:"enabled"`
 	Order       int                    `db:"rule_order"`
 	Mode        RuleConditionMatchType `db:"mode"`
+	// Version is incremented every time the rule is updated.
+	Version int `db:"version"`
+	// Trigger is the event that runs the rule.
+	Trigger RuleTrigger `db:"trigger_type"`
 	Timestamp
+	RuleStatistics
 
 	Conditions []*RuleCondition
 	Actions    []*RuleAction
 }
 
+func (r *Rule) FilterAttributes() []string {
+	return []string{"id", "name", "enabled", "rule_order", "created_at", "updated_at", "evaluations", "matches",
+		"last_matched_at", "last_error_at"}
+}
+
+func (r *Rule) SortAttributes() []string {
+	return r.FilterAttributes()
+}
+
+func (r *Rule) SortNoCase() []string {
+	return []string{"name"}
+}
+
+// RuleStatistics are the counters of rule executions since the rule was created or last edited.
+type RuleStatistics struct {
+	// Evaluations is the number of times the rule was run on a document.
+	Evaluations int `db:"evaluations"`
+	// Matches is the number of times a document matched the rule.
+	Matches       int          `db:"matches"`
+	LastMatchedAt sql.NullTime `db:"last_matched_at"`
+	LastError     string       `db:"last_error"`
+	LastErrorAt   sql.NullTime `db:"last_error_at"`
+	// StatsResetAt is the time counting started.
+	StatsResetAt time.Time `db:"stats_reset_at"`
+}
+
+// RuleStatisticsReport lists rules that might need attention.
+type RuleStatisticsReport struct {
+	Days           int `json:"days"`
+	MinEvaluations int `json:"min_evaluations"`
+	// NotMatched contains enabled rules that have not matched any document in given days.
+	// Only rules with statistics from at least that long are included.
+	NotMatched []*Rule `json:"-"`
+	// AlwaysMatched contains enabled rules that have matched every document they have been evaluated with,
+	// at least MinEvaluations times.
+	AlwaysMatched []*Rule `json:"-"`
+}
+
+// NewRuleStatisticsReport finds rules that have not matched in days and rules that always match.
+func NewRuleStatisticsReport(rules []*Rule, now time.Time, days int, minEvaluations int) *RuleStatisticsReport {
+	report := &RuleStatisticsReport{
+		Days:           days,
+		MinEvaluations: minEvaluations,
+		NotMatched:     []*Rule{},
+		AlwaysMatched:  []*Rule{},
+	}
+	cutoff := now.AddDate(0, 0, -days)
+	for _, v := range rules {
+		if !v.Enabled {
+			continue
+		}
+		if !v.StatsResetAt.After(cutoff) && (!v.LastMatchedAt.Valid || v.LastMatchedAt.Time.Before(cutoff)) {
+			report.NotMatched = append(report.NotMatched, v)
+		}
+		if v.Evaluations >= minEvaluations && v.Evaluations > 0 && v.Matches == v.Evaluations {
+			report.AlwaysMatched = append(report.AlwaysMatched, v)
+		}
+	}
+	return report
+}
+
+// RuleTrigger is the event that runs the rule.
+type RuleTrigger string
+
+const (
+	// RuleTriggerProcessing runs the rule when document is processed.
+	RuleTriggerProcessing RuleTrigger = "processing"
+	// RuleTriggerMetadataEdit runs the rule when user edits document metadata.
+	RuleTriggerMetadataEdit RuleTrigger = "metadata_edit"
+	// RuleTriggerDocumentUpdate runs the rule when user updates the document.
+	RuleTriggerDocumentUpdate RuleTrigger = "document_update"
+	// RuleTriggerRestore runs the rule when document is restored from trash.
+	RuleTriggerRestore RuleTrigger = "restore"
+	// RuleTriggerSchedule runs the rule periodically for all documents.
+	RuleTriggerSchedule RuleTrigger = "schedule"
+	// RuleTriggerManual is used in rule executions when rule is applied manually to existing documents.
+	// It is not a valid trigger for a rule.
+	RuleTriggerManual RuleTrigger = "manual"
+)
+
+func (r RuleTrigger) Valid() bool {
+	switch r {
+	case RuleTriggerProcessing, RuleTriggerMetadataEdit, RuleTriggerDocumentUpdate, RuleTriggerRestore,
+		RuleTriggerSchedule:
+		return true
+	default:
+		return false
+	}
+}
+
+// MaxRuleConditionDepth is the maximum depth of nested condition groups.
+const MaxRuleConditionDepth = 5
+
 func (r *Rule) Validate() error {
-	for i, v := range r.Conditions {
+	// rules created before triggers run when document is processed
+	if r.Trigger == "" {
+		r.Trigger = RuleTriggerProcessing
+	}
+	if !r.Trigger.Valid() {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("invalid trigger: '%s'", r.Trigger)
+		return e
+	}
+	err := validateConditions(r.Conditions, "", 1)
+	if err != nil {
+		return err
+	}
+	for i, v := range r.Actions {
+		err = v.Validate()
+		if err != nil {
+			if isErr, ok := err.(errors.Error); ok {
+				isErr.ErrMsg = fmt.Sprintf("action %d: %s", i+1, isErr.ErrMsg)
+				return isErr
+			}
+			return fmt.Errorf("action %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// validateConditions validates conditions and their children recursively.
+// Conditions are numbered by their position, e.g. 'condition 2.1' is the first child of second condition.
+func validateConditions(conditions []*RuleCondition, prefix string, depth int) error {
+	for i, v := range conditions {
+		number := fmt.Sprintf("%s%d", prefix, i+1)
 		err := v.Validate()
+		if err == nil && v.IsGroup() {
+			if depth >= MaxRuleConditionDepth {
+				e := errors.ErrInvalid
+				e.ErrMsg = fmt.Sprintf("maximum depth of condition groups is %d", MaxRuleConditionDepth)
+				err = e
+			} else if len(v.Conditions) == 0 {
+				e := errors.ErrInvalid
+				e.ErrMsg = "condition group cannot be empty"
+				err = e
+			} else {
+				err = validateConditions(v.Conditions, number+".", depth+1)
+				if err != nil {
+					// error already has condition number
+					return err
+				}
+			}
+		} else if err == nil && len(v.Conditions) > 0 {
+			e := errors.ErrInvalid
+			e.ErrMsg = "only condition groups can have conditions"
+			err = e
+		}
 		if err != nil {
 			if isErr, ok := err.(errors.Error); ok {
-				isErr.ErrMsg = fmt.Sprintf("condition %d: %s", i+1, isErr.ErrMsg)
+				isErr.ErrMsg = fmt.Sprintf("condition %s: %s", number, isErr.ErrMsg)
 				return isErr
 			} else {
-				err = fmt.Errorf("condition %d: %v", i, err)
+				err = fmt.Errorf("condition %s: %v", number, err)
 			}
 			return err
 		}
@@ -90,6 +248,41 @@ func (r *Rule) Validate() error {
 	return nil
 }
 
+// AllConditions returns all conditions of the rule, including conditions in groups,
+// in depth-first order.
+func (r *Rule) AllConditions() []*RuleCondition {
+	all := make([]*RuleCondition, 0, len(r.Conditions))
+	var walk func(conditions []*RuleCondition)
+	walk = func(conditions []*RuleCondition) {
+		for _, v := range conditions {
+			all = append(all, v)
+			walk(v.Conditions)
+		}
+	}
+	walk(r.Conditions)
+	return all
+}
+
+// ConditionTree organizes flat list of conditions into a tree by their parent ids.
+// Conditions without (existing) parent are returned as root conditions. Order of conditions is preserved.
+func ConditionTree(conditions []*RuleCondition) []*RuleCondition {
+	byId := make(map[IntId]*RuleCondition, len(conditions))
+	for _, v := range conditions {
+		v.Conditions = nil
+		byId[IntId(v.Id)] = v
+	}
+	root := make([]*RuleCondition, 0, len(conditions))
+	for _, v := range conditions {
+		parent, ok := byId[v.ParentId]
+		if v.ParentId == 0 || !ok || parent == v {
+			root = append(root, v)
+			continue
+		}
+		parent.Conditions = append(parent.Conditions, v)
+	}
+	return root
+}
+
 type RuleConditionType string
 
 func (r RuleConditionType) String() string {
@@ -118,6 +311,59 @@ const (
 	RuleConditionMetadataCount         RuleConditionType = "metadata_count"
 	RuleConditionMetadataCountLessThan RuleConditionType = "metadata_count_less_than"
 	RuleConditionMetadataCountMoreThan RuleConditionType = "metadata_count_more_than"
+	// Compare value of a typed metadata key, e.g. 'total' more than '100'.
+	// Matches if any value of the key in the document matches.
+	RuleConditionMetadataValueMoreThan RuleConditionType = "metadata_value_more_than"
+	RuleConditionMetadataValueLessThan RuleConditionType = "metadata_value_less_than"
+
+	// RuleConditionHasTag matches if document has the tag.
+	RuleConditionHasTag RuleConditionType = "tag_has"
+
+	RuleConditionPropertyIs       RuleConditionType = "property_is"
+	RuleConditionPropertyStarts   RuleConditionType = "property_starts"
+	RuleConditionPropertyContains RuleConditionType = "property_contains"
+
+	RuleConditionBarcodeMatches RuleConditionType = "barcode_matches"
+
+	RuleConditionFieldExists   RuleConditionType = "field_exists"
+	RuleConditionFieldIs       RuleConditionType = "field_is"
+	RuleConditionFieldContains RuleConditionType = "field_contains"
+	RuleConditionFieldMoreThan RuleConditionType = "field_more_than"
+	RuleConditionFieldLessThan RuleConditionType = "field_less_than"
+
+	RuleConditionFilenameIs       RuleConditionType = "filename_is"
+	RuleConditionFilenameStarts   RuleConditionType = "filename_starts"
+	RuleConditionFilenameContains RuleConditionType = "filename_contains"
+	// RuleConditionFilenameMatches matches filename with glob pattern, e.g. 'IMG_*.jpg'.
+	RuleConditionFilenameMatches RuleConditionType = "filename_matches"
+
+	// RuleConditionMimetypeIs matches mimetype, which can end with wildcard, e.g. 'image/*'.
+	RuleConditionMimetypeIs RuleConditionType = "mimetype_is"
+
+	// Size is given in bytes or with unit, e.g. '10 MB'.
+	RuleConditionSizeMoreThan RuleConditionType = "size_more_than"
+	RuleConditionSizeLessThan RuleConditionType = "size_less_than"
+
+	RuleConditionPagesIs       RuleConditionType = "pages_is"
+	RuleConditionPagesMoreThan RuleConditionType = "pages_more_than"
+	RuleConditionPagesLessThan RuleConditionType = "pages_less_than"
+
+	RuleConditionSourceIs RuleConditionType = "source_is"
+
+	// Age is counted from the document date and given with unit, e.g. '7 years' or '30d'.
+	RuleConditionAgeMoreThan RuleConditionType = "age_more_than"
+	RuleConditionAgeLessThan RuleConditionType = "age_less_than"
+
+	// RuleConditionExpression evaluates the value as an expression against the document,
+	// see RuleExpressionEnv.
+	RuleConditionExpression RuleConditionType = "expression"
+
+	// RuleConditionGroupAnd matches if all conditions in the group match.
+	RuleConditionGroupAnd RuleConditionType = "group_and"
+	// RuleConditionGroupOr matches if any condition in the group matches.
+	RuleConditionGroupOr RuleConditionType = "group_or"
+	// RuleConditionGroupNot matches if none of the conditions in the group match.
+	RuleConditionGroupNot RuleConditionType = "group_not"
 )
 
 var AllConditionTypes = []RuleConditionType{
@@ -142,13 +388,83 @@ var AllConditionTypes = []RuleConditionType{
 	RuleConditionMetadataCount,
 	RuleConditionMetadataCountLessThan,
 	RuleConditionMetadataCountMoreThan,
+	RuleConditionMetadataValueMoreThan,
+	RuleConditionMetadataValueLessThan,
+
+	RuleConditionHasTag,
+
+	RuleConditionPropertyIs,
+	RuleConditionPropertyStarts,
+	RuleConditionPropertyContains,
+
+	RuleConditionBarcodeMatches,
+
+	RuleConditionFieldExists,
+	RuleConditionFieldIs,
+	RuleConditionFieldContains,
+	RuleConditionFieldMoreThan,
+	RuleConditionFieldLessThan,
+
+	RuleConditionFilenameIs,
+	RuleConditionFilenameStarts,
+	RuleConditionFilenameContains,
+	RuleConditionFilenameMatches,
+
+	RuleConditionMimetypeIs,
+
+	RuleConditionSizeMoreThan,
+	RuleConditionSizeLessThan,
+
+	RuleConditionPagesIs,
+	RuleConditionPagesMoreThan,
+	RuleConditionPagesLessThan,
+
+	RuleConditionSourceIs,
+
+	RuleConditionAgeMoreThan,
+	RuleConditionAgeLessThan,
+
+	RuleConditionExpression,
+
+	RuleConditionGroupAnd,
+	RuleConditionGroupOr,
+	RuleConditionGroupNot,
+}
+
+// RuleMatchMode defines how text conditions compare the condition value to the document text.
+type RuleMatchMode string
+
+const (
+	// RuleMatchDefault allows a few typos depending on the length of the value.
+	// It is the mode of conditions created before match modes.
+	RuleMatchDefault RuleMatchMode = ""
+	// RuleMatchExact requires the exact text.
+	RuleMatchExact RuleMatchMode = "exact"
+	// RuleMatchCaseInsensitive requires the exact text, ignoring case.
+	RuleMatchCaseInsensitive RuleMatchMode = "case_insensitive"
+	// RuleMatchFuzzy allows edits up to the max distance, or the min similarity ratio of the value.
+	RuleMatchFuzzy RuleMatchMode = "fuzzy"
+	// RuleMatchTokenSet matches the words of the value regardless of their order.
+	RuleMatchTokenSet RuleMatchMode = "token_set"
+	// RuleMatchOcr treats characters that OCR often confuses as equal: 0/O, 1/l/I and rn/m.
+	RuleMatchOcr RuleMatchMode = "ocr"
+)
+
+func (m RuleMatchMode) Valid() bool {
+	switch m {
+	case RuleMatchDefault, RuleMatchExact, RuleMatchCaseInsensitive, RuleMatchFuzzy, RuleMatchTokenSet, RuleMatchOcr:
+		return true
+	}
+	return false
 }
 
 type RuleCondition struct {
-	Id              int  `db:"id"`
-	RuleId          int  `db:"rule_id"`
-	Enabled         bool `db:"enabled"`
-	CaseInsensitive bool `db:"case_insensitive"`
+	Id     int `db:"id"`
+	RuleId int `db:"rule_id"`
+	// ParentId is the id of the group this condition belongs to, or 0 if condition is at the root of the rule.
+	ParentId        IntId `db:"parent_id"`
+	Enabled         bool  `db:"enabled"`
+	CaseInsensitive bool  `db:"case_insensitive"`
 	// Inverted inverts the match result
 	Inverted      bool              `db:"inverted_match"`
 	ConditionType RuleConditionType `db:"condition_type"`
@@ -164,6 +480,51 @@ type RuleCondition struct {
 	MetadataValue     IntId `db:"metadata_value"`
 	MetadataKeyName   Text  `db:"metadata_key_name"`
 	MetadataValueName Text  `db:"metadata_value_name"`
+
+	// Tag to match
+	TagId   IntId `db:"tag_id"`
+	TagName Text  `db:"tag_name"`
+
+	// PropertyKey is the document property to match, e.g. 'author' or 'exif_make'.
+	PropertyKey string `db:"property_key"`
+
+	// FieldName is the extracted document field to match, e.g. 'amount' or 'due_date'.
+	FieldName string `db:"field_name"`
+
+	// MatchMode defines how text conditions compare the value to the text.
+	MatchMode RuleMatchMode `db:"match_mode"`
+	// MatchMaxDistance is the maximum number of edits in fuzzy mode.
+	MatchMaxDistance int `db:"match_max_distance"`
+	// MatchMinSimilarity is the minimum similarity between 0 and 1 in fuzzy mode, if max distance is not set.
+	MatchMinSimilarity float64 `db:"match_min_similarity"`
+
+	// Conditions are the child conditions, if condition is a group.
+	Conditions []*RuleCondition
+}
+
+// IsTextCondition returns true if condition matches the value as text and supports match modes.
+func (r *RuleCondition) IsTextCondition() bool {
+	switch r.ConditionType {
+	case RuleConditionNameIs, RuleConditionNameStarts, RuleConditionNameContains,
+		RuleConditionDescriptionIs, RuleConditionDescriptionStarts, RuleConditionDescriptionContains,
+		RuleConditionContentIs, RuleConditionContentStarts, RuleConditionContentContains,
+		RuleConditionPropertyIs, RuleConditionPropertyStarts, RuleConditionPropertyContains,
+		RuleConditionFieldIs, RuleConditionFieldContains:
+		return true
+	}
+	return false
+}
+
+// IgnoreCase returns true if text should be matched case-insensitively.
+func (r *RuleCondition) IgnoreCase() bool {
+	return r.CaseInsensitive || r.MatchMode == RuleMatchCaseInsensitive
+}
+
+// IsGroup returns true if condition is a group of other conditions.
+func (r *RuleCondition) IsGroup() bool {
+	return r.ConditionType == RuleConditionGroupAnd ||
+		r.ConditionType == RuleConditionGroupOr ||
+		r.ConditionType == RuleConditionGroupNot
 }
 
 func (r *RuleCondition) Validate() error {
@@ -191,6 +552,12 @@ func (r *RuleCondition) Validate() error {
 		}
 	}
 
+	matchErr := r.validateMatchMode()
+	if matchErr != nil {
+		err.ErrMsg = matchErr.Error()
+		return err
+	}
+
 	condText := r.ConditionType.String()
 	if strings.Contains(condText, "name") ||
 		strings.Contains(condText, "description") ||
@@ -217,20 +584,221 @@ func (r *RuleCondition) Validate() error {
 			return err
 		}
 	}
+	if r.ConditionType == RuleConditionHasTag {
+		if r.TagId == 0 {
+			err.ErrMsg = "must have tag defined"
+			return err
+		}
+	}
+	if r.ConditionType == RuleConditionMetadataValueMoreThan || r.ConditionType == RuleConditionMetadataValueLessThan {
+		if r.MetadataKey == 0 {
+			err.ErrMsg = "must have metadata key defined"
+			return err
+		}
+		if strings.TrimSpace(r.Value) == "" {
+			err.ErrMsg = "matching value is empty"
+			return err
+		}
+	}
 
-	if r.ConditionType == RuleConditionDateIs {
-		if r.DateFmt == "" {
-			err.ErrMsg = "date format (date_fmt) cannot be empty"
+	if strings.HasPrefix(condText, "property") {
+		if r.PropertyKey == "" {
+			err.ErrMsg = "property key cannot be empty"
+			return err
+		}
+		if r.Value == "" {
+			err.ErrMsg = "matching value is empty"
 			return err
 		}
+	}
 
-		if !r.IsRegex {
+	if r.ConditionType == RuleConditionBarcodeMatches {
+		if r.Value == "" {
+			err.ErrMsg = "matching value is empty"
+			return err
+		}
+	}
+
+	if strings.HasPrefix(condText, "field") {
+		validField := false
+		for _, v := range AllDocumentFields {
+			if r.FieldName == v {
+				validField = true
+				break
+			}
+		}
+		if !validField {
+			err.ErrMsg = fmt.Sprintf("invalid field: '%s'", r.FieldName)
+			return err
+		}
+		if r.ConditionType != RuleConditionFieldExists && r.Value == "" {
+			err.ErrMsg = "matching value is empty"
+			return err
+		}
+		if r.ConditionType == RuleConditionFieldMoreThan || r.ConditionType == RuleConditionFieldLessThan {
+			if r.FieldName != DocumentFieldAmount && r.FieldName != DocumentFieldDueDate {
+				err.ErrMsg = "only amount and due_date can be compared"
+				return err
+			}
+		}
+	}
+
+	if r.ConditionType == RuleConditionDateIs {
+		// without regex and date format, dates are detected automatically
+		if r.Value != "" && !r.IsRegex {
 			err.ErrMsg = "regex must be enabled when parsing date"
 		}
 	}
+
+	if r.ConditionType == RuleConditionFilenameMatches {
+		if _, globErr := path.Match(r.Value, ""); globErr != nil {
+			err.ErrMsg = "invalid filename pattern"
+			err.Err = globErr
+			return err
+		}
+	}
+
+	switch r.ConditionType {
+	case RuleConditionMimetypeIs:
+		if r.Value == "" {
+			err.ErrMsg = "matching value is empty"
+			return err
+		}
+	case RuleConditionSizeMoreThan, RuleConditionSizeLessThan:
+		if _, sizeErr := ParseSize(r.Value); sizeErr != nil {
+			err.ErrMsg = sizeErr.Error()
+			return err
+		}
+	case RuleConditionPagesIs, RuleConditionPagesMoreThan, RuleConditionPagesLessThan:
+		if pages, pagesErr := strconv.Atoi(strings.TrimSpace(r.Value)); pagesErr != nil || pages < 0 {
+			err.ErrMsg = fmt.Sprintf("invalid page count: '%s'", r.Value)
+			return err
+		}
+	case RuleConditionSourceIs:
+		if DocumentSource(r.Value) == DocumentSourceUnknown || !isValidSource(DocumentSource(r.Value)) {
+			err.ErrMsg = fmt.Sprintf("invalid source: '%s'", r.Value)
+			return err
+		}
+	case RuleConditionAgeMoreThan, RuleConditionAgeLessThan:
+		if _, ageErr := ParseAge(r.Value); ageErr != nil {
+			err.ErrMsg = ageErr.Error()
+			return err
+		}
+	case RuleConditionExpression:
+		if r.IsRegex {
+			err.ErrMsg = "expression cannot be a regex"
+			return err
+		}
+		if _, exprErr := CompileRuleExpression(r.Value); exprErr != nil {
+			return exprErr
+		}
+	}
 	return nil
 }
 
+func (r *RuleCondition) validateMatchMode() error {
+	if r.MatchMode != RuleMatchDefault {
+		if !r.MatchMode.Valid() {
+			return fmt.Errorf("invalid match mode: '%s'", r.MatchMode)
+		}
+		if !r.IsTextCondition() {
+			return fmt.Errorf("match mode is only supported for text conditions")
+		}
+		if r.IsRegex && r.MatchMode != RuleMatchExact && r.MatchMode != RuleMatchCaseInsensitive {
+			return fmt.Errorf("regex can only be used with exact or case-insensitive match mode")
+		}
+	}
+	if r.MatchMode != RuleMatchFuzzy {
+		if r.MatchMaxDistance != 0 || r.MatchMinSimilarity != 0 {
+			return fmt.Errorf("max distance and min similarity are only used with fuzzy match mode")
+		}
+		return nil
+	}
+	if r.MatchMaxDistance < 0 {
+		return fmt.Errorf("max distance cannot be negative")
+	}
+	if r.MatchMinSimilarity < 0 || r.MatchMinSimilarity > 1 {
+		return fmt.Errorf("min similarity must be between 0 and 1")
+	}
+	if (r.MatchMaxDistance > 0) == (r.MatchMinSimilarity > 0) {
+		return fmt.Errorf("fuzzy match mode requires either max distance or min similarity")
+	}
+	return nil
+}
+
+func isValidSource(source DocumentSource) bool {
+	for _, v := range AllDocumentSources {
+		if v == source {
+			return true
+		}
+	}
+	return false
+}
+
+var sizeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-zA-Z]*)$`)
+
+// ParseSize parses size in bytes, which can have unit, e.g. '10 MB'. Units are powers of 1024.
+func ParseSize(value string) (int64, error) {
+	match := sizeRe.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size: '%s'", value)
+	}
+	size, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: '%s'", value)
+	}
+	switch strings.ToLower(match[2]) {
+	case "", "b":
+	case "k", "kb", "kib":
+		size *= 1024
+	case "m", "mb", "mib":
+		size *= 1024 * 1024
+	case "g", "gb", "gib":
+		size *= 1024 * 1024 * 1024
+	default:
+		return 0, fmt.Errorf("invalid size unit: '%s'", match[2])
+	}
+	return int64(size), nil
+}
+
+// Age is a calendar duration.
+type Age struct {
+	Years  int
+	Months int
+	Days   int
+}
+
+// Before returns the time that is age before t.
+func (a Age) Before(t time.Time) time.Time {
+	return t.AddDate(-a.Years, -a.Months, -a.Days)
+}
+
+var ageRe = regexp.MustCompile(`^(\d+)\s*([a-zA-Z]+)$`)
+
+// ParseAge parses age with unit, e.g. '30d', '2 weeks', '6 months' or '7y'.
+func ParseAge(value string) (Age, error) {
+	match := ageRe.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return Age{}, fmt.Errorf("invalid age: '%s'", value)
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return Age{}, fmt.Errorf("invalid age: '%s'", value)
+	}
+	switch strings.ToLower(match[2]) {
+	case "d", "day", "days":
+		return Age{Days: n}, nil
+	case "w", "week", "weeks":
+		return Age{Days: n * 7}, nil
+	case "m", "month", "months":
+		return Age{Months: n}, nil
+	case "y", "year", "years":
+		return Age{Years: n}, nil
+	default:
+		return Age{}, fmt.Errorf("invalid age unit: '%s'", match[2])
+	}
+}
+
 func (r *RuleCondition) HasMetadata() bool {
 	return r.MetadataKey > 0 && r.MetadataValue > 0
 }
@@ -249,6 +817,21 @@ const (
 	RuleActionAddMetadata       RuleActionType = "metadata_add"
 	RuleActionRemoveMetadata    RuleActionType = "metadata_remove"
 	RuleActionSetDate           RuleActionType = "date_set"
+	RuleActionAddTag            RuleActionType = "tag_add"
+	RuleActionRemoveTag         RuleActionType = "tag_remove"
+	// RuleActionExtractMetadata captures a value with regex and adds it as metadata value to given key.
+	// Metadata value is created if it does not exist.
+	RuleActionExtractMetadata RuleActionType = "metadata_extract"
+	// RuleActionLinkDocuments links the document to documents that match the search query in value.
+	RuleActionLinkDocuments RuleActionType = "documents_link"
+	// RuleActionTrash moves the document to trash.
+	RuleActionTrash RuleActionType = "trash"
+	// RuleActionNeedsReview marks the document as needing review from the user.
+	RuleActionNeedsReview RuleActionType = "needs_review"
+	// RuleActionNotify sends the message in value to the owner of the document.
+	RuleActionNotify RuleActionType = "notify"
+	// RuleActionStopProcessing stops evaluating rest of the rules.
+	RuleActionStopProcessing RuleActionType = "stop_processing"
 )
 
 type RuleAction struct {
@@ -264,6 +847,164 @@ type RuleAction struct {
 	MetadataValue     IntId          `db:"metadata_value"`
 	MetadataKeyName   Text           `db:"metadata_key_name"`
 	MetadataValueName Text           `db:"metadata_value_name"`
+	TagId             IntId          `db:"tag_id"`
+	TagName           Text           `db:"tag_name"`
+
+	// TextSource is the document text to extract metadata from. Defaults to content.
+	TextSource RuleTextSource `db:"text_source"`
+	// TrimValue removes leading and trailing whitespace and punctuation from the extracted value.
+	TrimValue bool `db:"trim_value"`
+	// ValueCase converts the case of the extracted value.
+	ValueCase RuleValueCase `db:"value_case"`
+	// CollapseWhitespace replaces consecutive whitespace characters with single space.
+	CollapseWhitespace bool `db:"collapse_whitespace"`
+}
+
+type RuleTextSource string
+
+const (
+	RuleTextSourceName        RuleTextSource = "name"
+	RuleTextSourceDescription RuleTextSource = "description"
+	RuleTextSourceContent     RuleTextSource = "content"
+	// RuleTextSourceBarcode extracts the value from payloads of the document barcodes.
+	// Value is taken from the first barcode that matches.
+	RuleTextSourceBarcode RuleTextSource = "barcode"
+)
+
+type RuleValueCase string
+
+const (
+	RuleValueCaseKeep  RuleValueCase = ""
+	RuleValueCaseLower RuleValueCase = "lower"
+	RuleValueCaseUpper RuleValueCase = "upper"
+	RuleValueCaseTitle RuleValueCase = "title"
+)
+
+var whitespaceRe = regexp.MustCompile(`\s+`)
+
+// RuleTemplateFuncs are the functions available in templates of name and description actions, e.g.
+// '{{date "2006-01"}} {{meta "company"}} invoice':
+//
+//	date "layout": document date in given Go time layout
+//	filename: original filename of the document
+//	meta "key": values of given metadata key, separated by comma
+//	capture 1, capture "name": value captured by regex conditions, by number or name of the capture group.
+//	  Capture groups are numbered across all matched conditions in the order of evaluation.
+//	pages: number of pages in the document
+//
+// These are placeholders for validating the templates, actual values are provided when running the rule.
+var RuleTemplateFuncs = template.FuncMap{
+	"date":     func(layout string) string { return "" },
+	"filename": func() string { return "" },
+	"meta":     func(key string) string { return "" },
+	"capture":  func(group interface{}) string { return "" },
+	"pages":    func() int { return 0 },
+}
+
+// ValidateTemplate checks that template is valid and uses only the supported functions.
+func ValidateTemplate(text string) error {
+	tmpl, err := template.New("action").Funcs(RuleTemplateFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+	// function arguments are only checked when executing the template
+	return tmpl.Execute(io.Discard, nil)
+}
+
+func (r *RuleAction) Validate() error {
+	err := errors.ErrInvalid
+	switch r.Action {
+	case RuleActionSetName, RuleActionAppendName, RuleActionSetDescription, RuleActionAppendDescription:
+		if templateErr := ValidateTemplate(r.Value); templateErr != nil {
+			err.ErrMsg = fmt.Sprintf("invalid template: %v", templateErr)
+			err.Err = templateErr
+			return err
+		}
+		return nil
+	case RuleActionLinkDocuments, RuleActionNotify:
+		if strings.TrimSpace(r.Value) == "" {
+			if r.Action == RuleActionLinkDocuments {
+				err.ErrMsg = "search query is empty"
+			} else {
+				err.ErrMsg = "message is empty"
+			}
+			return err
+		}
+		if templateErr := ValidateTemplate(r.Value); templateErr != nil {
+			err.ErrMsg = fmt.Sprintf("invalid template: %v", templateErr)
+			err.Err = templateErr
+			return err
+		}
+		return nil
+	case RuleActionAddTag, RuleActionRemoveTag:
+		if r.TagId == 0 {
+			err.ErrMsg = "tag is required"
+			return err
+		}
+		return nil
+	case RuleActionExtractMetadata:
+	default:
+		return nil
+	}
+
+	if r.MetadataKey == 0 {
+		err.ErrMsg = "metadata key is required"
+		return err
+	}
+	if r.MetadataValue != 0 {
+		err.ErrMsg = "metadata value cannot be set when extracting metadata"
+		return err
+	}
+	re, regexErr := regexp.Compile(r.Value)
+	if regexErr != nil {
+		err.ErrMsg = "invalid regex"
+		err.Err = regexErr
+		return err
+	}
+	if re.NumSubexp() == 0 {
+		err.ErrMsg = "regex must have a capture group"
+		return err
+	}
+	switch r.TextSource {
+	case "", RuleTextSourceName, RuleTextSourceDescription, RuleTextSourceContent, RuleTextSourceBarcode:
+	default:
+		err.ErrMsg = fmt.Sprintf("invalid text source: '%s'", r.TextSource)
+		return err
+	}
+	switch r.ValueCase {
+	case RuleValueCaseKeep, RuleValueCaseLower, RuleValueCaseUpper, RuleValueCaseTitle:
+	default:
+		err.ErrMsg = fmt.Sprintf("invalid value case: '%s'", r.ValueCase)
+		return err
+	}
+	return nil
+}
+
+// NormalizeValue applies the normalization options of the action to the extracted value.
+func (r *RuleAction) NormalizeValue(value string) string {
+	if r.CollapseWhitespace {
+		value = whitespaceRe.ReplaceAllString(value, " ")
+	}
+	if r.TrimValue {
+		value = strings.TrimFunc(value, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsPunct(r)
+		})
+	}
+	switch r.ValueCase {
+	case RuleValueCaseLower:
+		value = strings.ToLower(value)
+	case RuleValueCaseUpper:
+		value = strings.ToUpper(value)
+	case RuleValueCaseTitle:
+		runes := []rune(strings.ToLower(value))
+		for i := range runes {
+			if i == 0 || unicode.IsSpace(runes[i-1]) {
+				runes[i] = unicode.ToUpper(runes[i])
+			}
+		}
+		value = string(runes)
+	}
+	return value
 }
 
 type MetadataRuleType string
@@ -272,3 +1013,86 @@ const (
 	MetadataMatchExact MetadataRuleType = "exact"
 	MetadataMatchRegex MetadataRuleType = "regex"
 )
+
+// RuleExecution is the audit record of running a rule on a document.
+type RuleExecution struct {
+	Id         int    `db:"id" json:"id"`
+	DocumentId string `db:"document_id" json:"document_id"`
+	// RuleId is null if the rule has been deleted.
+	RuleId      IntId                `db:"rule_id" json:"rule_id"`
+	RuleName    string               `db:"rule_name" json:"rule_name"`
+	RuleVersion int                  `db:"rule_version" json:"rule_version"`
+	Trigger     RuleTrigger          `db:"trigger_type" json:"trigger"`
+	Matched     bool                 `db:"matched" json:"matched"`
+	Conditions  RuleConditionResults `db:"conditions" json:"conditions"`
+	Actions     RuleActionResults    `db:"actions" json:"actions"`
+	Error       string               `db:"error" json:"error"`
+	CreatedAt   time.Time            `db:"created_at" json:"created_at"`
+}
+
+// RuleConditionResult is the result of evaluating single condition.
+type RuleConditionResult struct {
+	ConditionId   int    `json:"condition_id"`
+	ConditionType string `json:"condition_type"`
+	ParentId      int    `json:"parent_id"`
+	Matched       bool   `json:"matched"`
+	// Skipped is true if condition was not evaluated, e.g. because it's disabled
+	// or rule mode didn't require evaluating it.
+	Skipped bool `json:"skipped"`
+}
+
+// RuleActionChange is a single change an action made to the document.
+type RuleActionChange struct {
+	Action   string `json:"action"`
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+// RuleActionResult is the result of running single action.
+type RuleActionResult struct {
+	ActionId   int                `json:"action_id"`
+	ActionType string             `json:"action_type"`
+	Changes    []RuleActionChange `json:"changes"`
+	Error      string             `json:"error"`
+}
+
+type RuleConditionResults []RuleConditionResult
+
+func (r RuleConditionResults) Value() (driver.Value, error) {
+	return jsonValue(r)
+}
+
+func (r *RuleConditionResults) Scan(src interface{}) error {
+	return jsonScan(src, r)
+}
+
+type RuleActionResults []RuleActionResult
+
+func (r RuleActionResults) Value() (driver.Value, error) {
+	return jsonValue(r)
+}
+
+func (r *RuleActionResults) Scan(src interface{}) error {
+	return jsonScan(src, r)
+}
+
+func jsonValue(data interface{}) (driver.Value, error) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+func jsonScan(src interface{}, data interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(value, data)
+	case string:
+		return json.Unmarshal([]byte(value), data)
+	default:
+		return fmt.Errorf("unknown type: %v", src)
+	}
+}
@@ -0,0 +1,370 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"tryffel.net/go/virtualpaper/errors"
+)
+
+// RuleBundleVersion is the current version of the rule bundle format.
+// Bundles of newer versions cannot be imported.
+const RuleBundleVersion = 1
+
+// RuleBundle is a portable export of rules and the metadata keys, values and tags that rules use.
+// Metadata and tags are referenced by names instead of ids, so that the bundle can be imported
+// for any user.
+type RuleBundle struct {
+	Version    int              `json:"version" yaml:"version"`
+	ExportedAt time.Time        `json:"exported_at" yaml:"exported_at"`
+	Metadata   []RuleBundleKey  `json:"metadata" yaml:"metadata"`
+	Tags       []RuleBundleTag  `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Rules      []RuleBundleRule `json:"rules" yaml:"rules"`
+}
+
+type RuleBundleTag struct {
+	Key     string `json:"key" yaml:"key"`
+	Comment string `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+type RuleBundleKey struct {
+	Key       string            `json:"key" yaml:"key"`
+	Comment   string            `json:"comment,omitempty" yaml:"comment,omitempty"`
+	ValueType MetadataValueType `json:"value_type,omitempty" yaml:"value_type,omitempty"`
+	Values    []RuleBundleValue `json:"values,omitempty" yaml:"values,omitempty"`
+}
+
+type RuleBundleValue struct {
+	Value          string           `json:"value" yaml:"value"`
+	MatchDocuments bool             `json:"match_documents,omitempty" yaml:"match_documents,omitempty"`
+	MatchType      MetadataRuleType `json:"match_type,omitempty" yaml:"match_type,omitempty"`
+	MatchFilter    string           `json:"match_filter,omitempty" yaml:"match_filter,omitempty"`
+}
+
+type RuleBundleRule struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Description string                 `json:"description,omitempty" yaml:"description,omitempty"`
+	Enabled     bool                   `json:"enabled" yaml:"enabled"`
+	Mode        RuleConditionMatchType `json:"mode" yaml:"mode"`
+	Trigger     RuleTrigger            `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	Conditions  []RuleBundleCondition  `json:"conditions" yaml:"conditions"`
+	Actions     []RuleBundleAction     `json:"actions" yaml:"actions"`
+}
+
+type RuleBundleCondition struct {
+	Type            RuleConditionType     `json:"type" yaml:"type"`
+	Enabled         bool                  `json:"enabled" yaml:"enabled"`
+	CaseInsensitive bool                  `json:"case_insensitive,omitempty" yaml:"case_insensitive,omitempty"`
+	Inverted        bool                  `json:"inverted,omitempty" yaml:"inverted,omitempty"`
+	IsRegex         bool                  `json:"is_regex,omitempty" yaml:"is_regex,omitempty"`
+	Value           string                `json:"value,omitempty" yaml:"value,omitempty"`
+	DateFmt         string                `json:"date_fmt,omitempty" yaml:"date_fmt,omitempty"`
+	MetadataKey     string                `json:"metadata_key,omitempty" yaml:"metadata_key,omitempty"`
+	MetadataValue   string                `json:"metadata_value,omitempty" yaml:"metadata_value,omitempty"`
+	Tag             string                `json:"tag,omitempty" yaml:"tag,omitempty"`
+	PropertyKey     string                `json:"property_key,omitempty" yaml:"property_key,omitempty"`
+	FieldName       string                `json:"field_name,omitempty" yaml:"field_name,omitempty"`
+	MatchMode       RuleMatchMode         `json:"match_mode,omitempty" yaml:"match_mode,omitempty"`
+	MaxDistance     int                   `json:"match_max_distance,omitempty" yaml:"match_max_distance,omitempty"`
+	MinSimilarity   float64               `json:"match_min_similarity,omitempty" yaml:"match_min_similarity,omitempty"`
+	Conditions      []RuleBundleCondition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+}
+
+type RuleBundleAction struct {
+	Action             RuleActionType `json:"action" yaml:"action"`
+	Enabled            bool           `json:"enabled" yaml:"enabled"`
+	OnCondition        bool           `json:"on_condition" yaml:"on_condition"`
+	Value              string         `json:"value,omitempty" yaml:"value,omitempty"`
+	MetadataKey        string         `json:"metadata_key,omitempty" yaml:"metadata_key,omitempty"`
+	MetadataValue      string         `json:"metadata_value,omitempty" yaml:"metadata_value,omitempty"`
+	Tag                string         `json:"tag,omitempty" yaml:"tag,omitempty"`
+	TextSource         RuleTextSource `json:"text_source,omitempty" yaml:"text_source,omitempty"`
+	TrimValue          bool           `json:"trim_value,omitempty" yaml:"trim_value,omitempty"`
+	ValueCase          RuleValueCase  `json:"value_case,omitempty" yaml:"value_case,omitempty"`
+	CollapseWhitespace bool           `json:"collapse_whitespace,omitempty" yaml:"collapse_whitespace,omitempty"`
+}
+
+// RuleImportMode defines what to do when imported rule has the same name as an existing rule.
+type RuleImportMode string
+
+const (
+	// RuleImportSkip keeps the existing rule and metadata.
+	RuleImportSkip RuleImportMode = "skip"
+	// RuleImportOverwrite replaces the existing rule and updates existing metadata values.
+	RuleImportOverwrite RuleImportMode = "overwrite"
+	// RuleImportRename imports the rule with a new name, e.g. 'Invoices (2)'.
+	RuleImportRename RuleImportMode = "rename"
+)
+
+func (m RuleImportMode) Valid() bool {
+	return m == RuleImportSkip || m == RuleImportOverwrite || m == RuleImportRename
+}
+
+// MetadataResolver returns the ids of the metadata key and value with given names.
+// Value is empty if only the key is referenced.
+type MetadataResolver func(key, value string) (IntId, IntId, error)
+
+// TagResolver returns the id of the tag with given name.
+type TagResolver func(tag string) (IntId, error)
+
+// NewRuleBundleRule converts the rule into bundle format. Rule metadata names must be loaded.
+func NewRuleBundleRule(rule *Rule) RuleBundleRule {
+	out := RuleBundleRule{
+		Name:        rule.Name,
+		Description: rule.Description,
+		Enabled:     rule.Enabled,
+		Mode:        rule.Mode,
+		Trigger:     rule.Trigger,
+		Conditions:  newRuleBundleConditions(rule.Conditions),
+		Actions:     make([]RuleBundleAction, len(rule.Actions)),
+	}
+	for i, v := range rule.Actions {
+		out.Actions[i] = RuleBundleAction{
+			Action:             v.Action,
+			Enabled:            v.Enabled,
+			OnCondition:        v.OnCondition,
+			Value:              v.Value,
+			MetadataKey:        v.MetadataKeyName.String(),
+			MetadataValue:      v.MetadataValueName.String(),
+			Tag:                v.TagName.String(),
+			TextSource:         v.TextSource,
+			TrimValue:          v.TrimValue,
+			ValueCase:          v.ValueCase,
+			CollapseWhitespace: v.CollapseWhitespace,
+		}
+	}
+	return out
+}
+
+func newRuleBundleConditions(conditions []*RuleCondition) []RuleBundleCondition {
+	out := make([]RuleBundleCondition, len(conditions))
+	for i, v := range conditions {
+		out[i] = RuleBundleCondition{
+			Type:            v.ConditionType,
+			Enabled:         v.Enabled,
+			CaseInsensitive: v.CaseInsensitive,
+			Inverted:        v.Inverted,
+			IsRegex:         v.IsRegex,
+			Value:           v.Value,
+			DateFmt:         v.DateFmt,
+			MetadataKey:     v.MetadataKeyName.String(),
+			MetadataValue:   v.MetadataValueName.String(),
+			Tag:             v.TagName.String(),
+			PropertyKey:     v.PropertyKey,
+			FieldName:       v.FieldName,
+			MatchMode:       v.MatchMode,
+			MaxDistance:     v.MatchMaxDistance,
+			MinSimilarity:   v.MatchMinSimilarity,
+		}
+		if len(v.Conditions) > 0 {
+			out[i].Conditions = newRuleBundleConditions(v.Conditions)
+		}
+	}
+	return out
+}
+
+// ToRule converts the bundle rule into a rule, resolving metadata references with resolve
+// and tag references with resolveTag. Returned rule is validated.
+func (b *RuleBundleRule) ToRule(resolve MetadataResolver, resolveTag TagResolver) (*Rule, error) {
+	if strings.TrimSpace(b.Name) == "" {
+		e := errors.ErrInvalid
+		e.ErrMsg = "rule name is empty"
+		return nil, e
+	}
+	rule := &Rule{
+		Name:        b.Name,
+		Description: b.Description,
+		Enabled:     b.Enabled,
+		Mode:        b.Mode,
+		Trigger:     b.Trigger,
+		Actions:     make([]*RuleAction, len(b.Actions)),
+	}
+	var err error
+	rule.Conditions, err = b.toConditions(b.Conditions, resolve, resolveTag)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range b.Actions {
+		action := &RuleAction{
+			Enabled:            v.Enabled,
+			OnCondition:        v.OnCondition,
+			Action:             v.Action,
+			Value:              v.Value,
+			MetadataKeyName:    Text(v.MetadataKey),
+			MetadataValueName:  Text(v.MetadataValue),
+			TagName:            Text(v.Tag),
+			TextSource:         v.TextSource,
+			TrimValue:          v.TrimValue,
+			ValueCase:          v.ValueCase,
+			CollapseWhitespace: v.CollapseWhitespace,
+		}
+		if v.MetadataKey != "" {
+			action.MetadataKey, action.MetadataValue, err = resolve(v.MetadataKey, v.MetadataValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if v.Tag != "" {
+			action.TagId, err = resolveTag(v.Tag)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rule.Actions[i] = action
+	}
+	err = rule.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (b *RuleBundleRule) toConditions(conditions []RuleBundleCondition, resolve MetadataResolver,
+	resolveTag TagResolver) ([]*RuleCondition, error) {
+	out := make([]*RuleCondition, len(conditions))
+	for i, v := range conditions {
+		condition := &RuleCondition{
+			Enabled:            v.Enabled,
+			CaseInsensitive:    v.CaseInsensitive,
+			Inverted:           v.Inverted,
+			ConditionType:      v.Type,
+			IsRegex:            v.IsRegex,
+			Value:              v.Value,
+			DateFmt:            v.DateFmt,
+			MetadataKeyName:    Text(v.MetadataKey),
+			MetadataValueName:  Text(v.MetadataValue),
+			TagName:            Text(v.Tag),
+			PropertyKey:        v.PropertyKey,
+			FieldName:          v.FieldName,
+			MatchMode:          v.MatchMode,
+			MatchMaxDistance:   v.MaxDistance,
+			MatchMinSimilarity: v.MinSimilarity,
+		}
+		var err error
+		if v.MetadataKey != "" {
+			condition.MetadataKey, condition.MetadataValue, err = resolve(v.MetadataKey, v.MetadataValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if v.Tag != "" {
+			condition.TagId, err = resolveTag(v.Tag)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(v.Conditions) > 0 {
+			condition.Conditions, err = b.toConditions(v.Conditions, resolve, resolveTag)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out[i] = condition
+	}
+	return out, nil
+}
+
+// Validate checks the bundle can be imported.
+func (b *RuleBundle) Validate() error {
+	e := errors.ErrInvalid
+	if b.Version < 1 || b.Version > RuleBundleVersion {
+		e.ErrMsg = fmt.Sprintf("unsupported bundle version: %d", b.Version)
+		return e
+	}
+	keys := make(map[string]bool, len(b.Metadata))
+	for _, v := range b.Metadata {
+		if strings.TrimSpace(v.Key) == "" {
+			e.ErrMsg = "metadata key is empty"
+			return e
+		}
+		if keys[v.Key] {
+			e.ErrMsg = fmt.Sprintf("duplicate metadata key: %s", v.Key)
+			return e
+		}
+		keys[v.Key] = true
+		if v.ValueType != "" && !v.ValueType.Valid() {
+			e.ErrMsg = fmt.Sprintf("metadata key %s has invalid value type: %s", v.Key, v.ValueType)
+			return e
+		}
+		values := make(map[string]bool, len(v.Values))
+		for _, value := range v.Values {
+			if strings.TrimSpace(value.Value) == "" {
+				e.ErrMsg = fmt.Sprintf("metadata key %s has empty value", v.Key)
+				return e
+			}
+			if values[value.Value] {
+				e.ErrMsg = fmt.Sprintf("duplicate value '%s' for metadata key %s", value.Value, v.Key)
+				return e
+			}
+			values[value.Value] = true
+		}
+	}
+	tags := make(map[string]bool, len(b.Tags))
+	for _, v := range b.Tags {
+		if strings.TrimSpace(v.Key) == "" {
+			e.ErrMsg = "tag is empty"
+			return e
+		}
+		if tags[v.Key] {
+			e.ErrMsg = fmt.Sprintf("duplicate tag: %s", v.Key)
+			return e
+		}
+		tags[v.Key] = true
+	}
+	return nil
+}
+
+// MarshalRuleBundle encodes bundle in given format, either 'json' or 'yaml'.
+func MarshalRuleBundle(bundle *RuleBundle, format string) ([]byte, error) {
+	switch format {
+	case "", "json":
+		return json.MarshalIndent(bundle, "", "  ")
+	case "yaml", "yml":
+		return yaml.Marshal(bundle)
+	default:
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("unsupported format: %s", format)
+		return nil, e
+	}
+}
+
+// UnmarshalRuleBundle decodes bundle from either json or yaml.
+func UnmarshalRuleBundle(data []byte) (*RuleBundle, error) {
+	bundle := &RuleBundle{}
+	var err error
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(trimmed, bundle)
+	} else {
+		err = yaml.Unmarshal(trimmed, bundle)
+	}
+	if err != nil {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("invalid bundle: %v", err)
+		e.Err = err
+		return nil, e
+	}
+	return bundle, nil
+}
@@ -0,0 +1,178 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testBundleRule() *Rule {
+	return &Rule{
+		Name:    "invoices",
+		Enabled: true,
+		Mode:    RuleMatchAll,
+		Trigger: RuleTriggerProcessing,
+		Conditions: []*RuleCondition{
+			{Enabled: true, ConditionType: RuleConditionContentContains, Value: "invoice"},
+			{Enabled: true, ConditionType: RuleConditionGroupOr, Conditions: []*RuleCondition{
+				{Enabled: true, ConditionType: RuleConditionMetadataHasKeyValue, MetadataKey: 1, MetadataValue: 2,
+					MetadataKeyName: "category", MetadataValueName: "bills"},
+				{Enabled: true, ConditionType: RuleConditionNameContains, Value: "bill"},
+				{Enabled: true, ConditionType: RuleConditionHasTag, TagId: 6, TagName: "bills"},
+			}},
+		},
+		Actions: []*RuleAction{
+			{Enabled: true, Action: RuleActionAddMetadata, MetadataKey: 3, MetadataValue: 4,
+				MetadataKeyName: "type", MetadataValueName: "invoice"},
+			{Enabled: true, Action: RuleActionExtractMetadata, MetadataKey: 5, MetadataKeyName: "customer",
+				Value: `Customer: (\d+)`, TextSource: RuleTextSourceContent, TrimValue: true},
+			{Enabled: true, Action: RuleActionAddTag, TagId: 7, TagName: "to pay"},
+		},
+	}
+}
+
+func TestRuleBundleRule_ToRule(t *testing.T) {
+	ids := map[string]IntId{"category": 11, "category:bills": 12, "type": 13, "type:invoice": 14, "customer": 15}
+	resolve := func(key, value string) (IntId, IntId, error) {
+		keyId, ok := ids[key]
+		if !ok {
+			return 0, 0, fmt.Errorf("key %s not found", key)
+		}
+		if value == "" {
+			return keyId, 0, nil
+		}
+		valueId, ok := ids[key+":"+value]
+		if !ok {
+			return 0, 0, fmt.Errorf("value %s not found", value)
+		}
+		return keyId, valueId, nil
+	}
+	tags := map[string]IntId{"bills": 16, "to pay": 17}
+	resolveTag := func(tag string) (IntId, error) {
+		id, ok := tags[tag]
+		if !ok {
+			return 0, fmt.Errorf("tag %s not found", tag)
+		}
+		return id, nil
+	}
+
+	bundleRule := NewRuleBundleRule(testBundleRule())
+	if bundleRule.Conditions[1].Conditions[0].MetadataKey != "category" || bundleRule.Actions[1].MetadataValue != "" {
+		t.Fatalf("metadata not referenced by name: %v", bundleRule)
+	}
+
+	rule, err := bundleRule.ToRule(resolve, resolveTag)
+	if err != nil {
+		t.Fatalf("ToRule() error = %v", err)
+	}
+	condition := rule.Conditions[1].Conditions[0]
+	if condition.MetadataKey != 11 || condition.MetadataValue != 12 {
+		t.Errorf("condition metadata = %d:%d, want 11:12", condition.MetadataKey, condition.MetadataValue)
+	}
+	if rule.Actions[0].MetadataKey != 13 || rule.Actions[0].MetadataValue != 14 {
+		t.Errorf("action metadata = %d:%d, want 13:14", rule.Actions[0].MetadataKey, rule.Actions[0].MetadataValue)
+	}
+	if rule.Actions[1].MetadataKey != 15 || !rule.Actions[1].TrimValue {
+		t.Errorf("extract action = %v", rule.Actions[1])
+	}
+	if rule.Conditions[1].Conditions[2].TagId != 16 || rule.Actions[2].TagId != 17 {
+		t.Errorf("tags = %d, %d, want 16, 17", rule.Conditions[1].Conditions[2].TagId, rule.Actions[2].TagId)
+	}
+
+	delete(tags, "to pay")
+	_, err = bundleRule.ToRule(resolve, resolveTag)
+	if err == nil || !strings.Contains(err.Error(), "to pay") {
+		t.Errorf("ToRule() error = %v, want missing tag", err)
+	}
+	tags["to pay"] = 17
+
+	delete(ids, "type:invoice")
+	_, err = bundleRule.ToRule(resolve, resolveTag)
+	if err == nil || !strings.Contains(err.Error(), "invoice") {
+		t.Errorf("ToRule() error = %v, want missing value", err)
+	}
+
+	bundleRule.Name = " "
+	_, err = bundleRule.ToRule(resolve, resolveTag)
+	if err == nil {
+		t.Errorf("no error for empty name")
+	}
+}
+
+func TestMarshalRuleBundle(t *testing.T) {
+	bundle := &RuleBundle{
+		Version: RuleBundleVersion,
+		Metadata: []RuleBundleKey{
+			{Key: "category", Comment: "document category", Values: []RuleBundleValue{{Value: "bills"}}},
+		},
+		Rules: []RuleBundleRule{NewRuleBundleRule(testBundleRule())},
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			data, err := MarshalRuleBundle(bundle, format)
+			if err != nil {
+				t.Fatalf("MarshalRuleBundle() error = %v", err)
+			}
+			got, err := UnmarshalRuleBundle(data)
+			if err != nil {
+				t.Fatalf("UnmarshalRuleBundle() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Rules, bundle.Rules) || !reflect.DeepEqual(got.Metadata, bundle.Metadata) {
+				t.Errorf("UnmarshalRuleBundle() = %v, want %v", got, bundle)
+			}
+			if err = got.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+
+	_, err := MarshalRuleBundle(bundle, "xml")
+	if err == nil {
+		t.Errorf("no error for unsupported format")
+	}
+}
+
+func TestRuleBundle_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		bundle  RuleBundle
+		wantErr string
+	}{
+		{"valid", RuleBundle{Version: 1}, ""},
+		{"no version", RuleBundle{}, "unsupported bundle version"},
+		{"newer version", RuleBundle{Version: RuleBundleVersion + 1}, "unsupported bundle version"},
+		{"duplicate key", RuleBundle{Version: 1, Metadata: []RuleBundleKey{{Key: "a"}, {Key: "a"}}}, "duplicate metadata key"},
+		{"empty value", RuleBundle{Version: 1, Metadata: []RuleBundleKey{{Key: "a", Values: []RuleBundleValue{{Value: ""}}}}}, "empty value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.bundle.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
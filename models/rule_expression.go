@@ -0,0 +1,184 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	"github.com/expr-lang/expr/vm"
+	"tryffel.net/go/virtualpaper/errors"
+)
+
+const (
+	// MaxRuleExpressionLength is the maximum length of an expression condition in characters.
+	MaxRuleExpressionLength = 2000
+	// MaxRuleExpressionNodes is the maximum number of nodes in the syntax tree of an expression.
+	MaxRuleExpressionNodes = 500
+	// MaxRuleExpressionMemory is the maximum size of ranges and repeated strings that an expression
+	// creates, in items and characters.
+	MaxRuleExpressionMemory = 100000
+	// MaxRuleExpressionDuration is the maximum time of evaluating an expression.
+	MaxRuleExpressionDuration = 200 * time.Millisecond
+)
+
+// RuleExpressionEnv is the view of the document that expression conditions are evaluated against, e.g.
+//
+//	content[:200] contains "invoice" && metadata_count < 2
+//	"acme" in metadata["company"] && date > now() - duration("2160h")
+//	"urgent" in tags
+type RuleExpressionEnv struct {
+	Name        string    `expr:"name"`
+	Description string    `expr:"description"`
+	Content     string    `expr:"content"`
+	Filename    string    `expr:"filename"`
+	Mimetype    string    `expr:"mimetype"`
+	Source      string    `expr:"source"`
+	Size        int64     `expr:"size"`
+	Pages       int       `expr:"pages"`
+	Date        time.Time `expr:"date"`
+	CreatedAt   time.Time `expr:"created_at"`
+	// Metadata maps key names to value names.
+	Metadata      map[string][]string `expr:"metadata"`
+	MetadataCount int                 `expr:"metadata_count"`
+	// Tags are the names of document tags.
+	Tags []string `expr:"tags"`
+	// Fields maps extracted field names to their normalized values.
+	Fields map[string]string `expr:"fields"`
+}
+
+// CompileRuleExpression validates the expression and compiles it into a program that returns a boolean.
+// Besides the length and node limits, predicates (e.g. filter or all) cannot be nested or refer
+// to content, and reduce is disabled. This keeps evaluation linear in the size of the document.
+// Ranges and repeat are replaced with functions that fail if the result exceeds MaxRuleExpressionMemory.
+func CompileRuleExpression(expression string) (*vm.Program, error) {
+	e := errors.ErrInvalid
+	if strings.TrimSpace(expression) == "" {
+		e.ErrMsg = "expression is empty"
+		return nil, e
+	}
+	if len([]rune(expression)) > MaxRuleExpressionLength {
+		e.ErrMsg = fmt.Sprintf("expression is too long, max %d characters", MaxRuleExpressionLength)
+		return nil, e
+	}
+
+	tree, err := parser.Parse(expression)
+	if err != nil {
+		e.ErrMsg = fmt.Sprintf("invalid expression: %v", err)
+		e.Err = err
+		return nil, e
+	}
+	counter := &expressionNodeCounter{}
+	ast.Walk(&tree.Node, counter)
+	if counter.nodes > MaxRuleExpressionNodes {
+		e.ErrMsg = fmt.Sprintf("expression is too complex, max %d nodes", MaxRuleExpressionNodes)
+		return nil, e
+	}
+	if counter.nestedPredicate {
+		e.ErrMsg = "predicates cannot be nested"
+		return nil, e
+	}
+	if counter.contentInPredicate {
+		e.ErrMsg = "predicates cannot refer to content"
+		return nil, e
+	}
+	if counter.reduce {
+		e.ErrMsg = "reduce is not supported"
+		return nil, e
+	}
+
+	program, err := expr.Compile(expression, expr.Env(RuleExpressionEnv{}), expr.AsBool(),
+		expr.Function("range", expressionRange, new(func(int, int) []int)),
+		expr.Operator("..", "range"),
+		expr.Function("repeat", expressionRepeat, new(func(string, int) string)))
+	if err != nil {
+		e.ErrMsg = fmt.Sprintf("invalid expression: %v", err)
+		e.Err = err
+		return nil, e
+	}
+	return program, nil
+}
+
+type expressionNodeCounter struct {
+	nodes              int
+	nestedPredicate    bool
+	contentInPredicate bool
+	reduce             bool
+}
+
+func (c *expressionNodeCounter) Visit(node *ast.Node) {
+	c.nodes += 1
+	if builtin, ok := (*node).(*ast.BuiltinNode); ok && builtin.Name == "reduce" {
+		c.reduce = true
+	}
+	closure, ok := (*node).(*ast.ClosureNode)
+	if !ok {
+		return
+	}
+	body := &predicateVisitor{}
+	ast.Walk(&closure.Node, body)
+	c.nestedPredicate = c.nestedPredicate || body.closures > 0
+	c.contentInPredicate = c.contentInPredicate || body.content
+}
+
+// predicateVisitor inspects the body of a predicate.
+type predicateVisitor struct {
+	closures int
+	content  bool
+}
+
+func (p *predicateVisitor) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.ClosureNode:
+		p.closures += 1
+	case *ast.IdentifierNode:
+		if n.Value == "content" {
+			p.content = true
+		}
+	}
+}
+
+// expressionRange returns the integers from min to max like the range operator of expr.
+func expressionRange(params ...any) (any, error) {
+	min, max := params[0].(int), params[1].(int)
+	if max >= min && uint64(max-min) >= MaxRuleExpressionMemory {
+		return nil, fmt.Errorf("range is too large, max %d items", MaxRuleExpressionMemory)
+	}
+	values := make([]int, 0)
+	for i := min; i <= max; i++ {
+		values = append(values, i)
+	}
+	return values, nil
+}
+
+// expressionRepeat repeats the string count times like the repeat builtin of expr.
+func expressionRepeat(params ...any) (any, error) {
+	text, count := params[0].(string), params[1].(int)
+	if count < 0 {
+		return nil, fmt.Errorf("invalid count for repeat: %d", count)
+	}
+	if count > 0 && len(text) > MaxRuleExpressionMemory/count {
+		return nil, fmt.Errorf("repeated string is too long, max %d characters", MaxRuleExpressionMemory)
+	}
+	return strings.Repeat(text, count), nil
+}
@@ -0,0 +1,475 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package models
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRule_Validate(t *testing.T) {
+	nameContains := func() *RuleCondition {
+		return &RuleCondition{Enabled: true, ConditionType: RuleConditionNameContains, Value: "invoice"}
+	}
+	group := func(conditions ...*RuleCondition) *RuleCondition {
+		return &RuleCondition{Enabled: true, ConditionType: RuleConditionGroupAnd, Conditions: conditions}
+	}
+	nested := nameContains()
+	for i := 0; i < MaxRuleConditionDepth; i++ {
+		nested = group(nested)
+	}
+
+	tests := []struct {
+		name       string
+		conditions []*RuleCondition
+		trigger    RuleTrigger
+		wantErr    string
+	}{
+		{
+			name:       "nested group",
+			conditions: []*RuleCondition{nameContains(), group(nameContains(), group(nameContains()))},
+		},
+		{
+			name:       "empty group",
+			conditions: []*RuleCondition{nameContains(), group()},
+			wantErr:    "condition 2: condition group cannot be empty",
+		},
+		{
+			name:       "invalid condition in group",
+			conditions: []*RuleCondition{group(nameContains(), &RuleCondition{ConditionType: "invalid"})},
+			wantErr:    "condition 1.2:",
+		},
+		{
+			name: "children in non-group condition",
+			conditions: []*RuleCondition{func() *RuleCondition {
+				c := nameContains()
+				c.Conditions = []*RuleCondition{nameContains()}
+				return c
+			}()},
+			wantErr: "condition 1: only condition groups can have conditions",
+		},
+		{
+			name:       "too deep",
+			conditions: []*RuleCondition{nested},
+			wantErr:    "maximum depth",
+		},
+		{
+			name:       "scheduled rule",
+			conditions: []*RuleCondition{nameContains()},
+			trigger:    RuleTriggerSchedule,
+		},
+		{
+			name:       "manual trigger",
+			conditions: []*RuleCondition{nameContains()},
+			trigger:    RuleTriggerManual,
+			wantErr:    "invalid trigger: 'manual'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &Rule{Conditions: tt.conditions, Trigger: RuleTriggerProcessing}
+			if tt.trigger != "" {
+				rule.Trigger = tt.trigger
+			}
+			err := rule.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	rule := &Rule{Conditions: []*RuleCondition{nameContains()}}
+	if err := rule.Validate(); err != nil || rule.Trigger != RuleTriggerProcessing {
+		t.Errorf("Validate() with empty trigger = %v, trigger '%s'", err, rule.Trigger)
+	}
+}
+
+func TestConditionTree(t *testing.T) {
+	conditions := []*RuleCondition{
+		{Id: 1, ConditionType: RuleConditionNameContains},
+		{Id: 2, ConditionType: RuleConditionGroupOr},
+		{Id: 3, ParentId: 2, ConditionType: RuleConditionGroupNot},
+		{Id: 4, ParentId: 3, ConditionType: RuleConditionNameContains},
+		{Id: 5, ParentId: 2, ConditionType: RuleConditionNameContains},
+	}
+
+	tree := ConditionTree(conditions)
+	if len(tree) != 2 || tree[0].Id != 1 || tree[1].Id != 2 {
+		t.Fatalf("unexpected root conditions: %v", tree)
+	}
+	if len(tree[1].Conditions) != 2 || tree[1].Conditions[0].Id != 3 || tree[1].Conditions[1].Id != 5 {
+		t.Errorf("unexpected group conditions: %v", tree[1].Conditions)
+	}
+	if len(tree[1].Conditions[0].Conditions) != 1 || tree[1].Conditions[0].Conditions[0].Id != 4 {
+		t.Errorf("unexpected nested group conditions: %v", tree[1].Conditions[0].Conditions)
+	}
+
+	rule := &Rule{Conditions: tree}
+	all := rule.AllConditions()
+	wantIds := []int{1, 2, 3, 4, 5}
+	for i, v := range all {
+		if v.Id != wantIds[i] {
+			t.Errorf("AllConditions()[%d] = %d, want %d", i, v.Id, wantIds[i])
+		}
+	}
+}
+
+func TestRuleAction_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  RuleAction
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			action: RuleAction{Action: RuleActionExtractMetadata, MetadataKey: 1, Value: `Customer: (\d+)`, TextSource: RuleTextSourceContent},
+		},
+		{
+			name:   "barcode source",
+			action: RuleAction{Action: RuleActionExtractMetadata, MetadataKey: 1, Value: `^INV-(\d+)$`, TextSource: RuleTextSourceBarcode},
+		},
+		{
+			name:    "no capture group",
+			action:  RuleAction{Action: RuleActionExtractMetadata, MetadataKey: 1, Value: `Customer: \d+`},
+			wantErr: "capture group",
+		},
+		{
+			name:    "no key",
+			action:  RuleAction{Action: RuleActionExtractMetadata, Value: `Customer: (\d+)`},
+			wantErr: "metadata key is required",
+		},
+		{
+			name:    "invalid source",
+			action:  RuleAction{Action: RuleActionExtractMetadata, MetadataKey: 1, Value: `(\d+)`, TextSource: "filename"},
+			wantErr: "invalid text source",
+		},
+		{
+			name:    "invalid case",
+			action:  RuleAction{Action: RuleActionExtractMetadata, MetadataKey: 1, Value: `(\d+)`, ValueCase: "camel"},
+			wantErr: "invalid value case",
+		},
+		{
+			name:   "link documents",
+			action: RuleAction{Action: RuleActionLinkDocuments, Value: `invoice:{{ capture 1 }}`},
+		},
+		{
+			name:    "link documents without query",
+			action:  RuleAction{Action: RuleActionLinkDocuments, Value: " "},
+			wantErr: "search query is empty",
+		},
+		{
+			name:    "notify without message",
+			action:  RuleAction{Action: RuleActionNotify},
+			wantErr: "message is empty",
+		},
+		{
+			name:    "notify invalid template",
+			action:  RuleAction{Action: RuleActionNotify, Value: "{{ .Name "},
+			wantErr: "invalid template",
+		},
+		{
+			name:   "trash",
+			action: RuleAction{Action: RuleActionTrash},
+		},
+		{
+			name:   "add tag",
+			action: RuleAction{Action: RuleActionAddTag, TagId: 1},
+		},
+		{
+			name:    "remove tag without tag",
+			action:  RuleAction{Action: RuleActionRemoveTag},
+			wantErr: "tag is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.action.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleAction_NormalizeValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		action RuleAction
+		value  string
+		want   string
+	}{
+		{"keep", RuleAction{}, " Acme  Ltd ", " Acme  Ltd "},
+		{"trim", RuleAction{TrimValue: true}, " Acme  Ltd. ", "Acme  Ltd"},
+		{"collapse whitespace", RuleAction{CollapseWhitespace: true}, "Acme \n\t Ltd", "Acme Ltd"},
+		{"lower", RuleAction{ValueCase: RuleValueCaseLower}, "ACME Ltd", "acme ltd"},
+		{"upper", RuleAction{ValueCase: RuleValueCaseUpper}, "acme ltd", "ACME LTD"},
+		{"title", RuleAction{ValueCase: RuleValueCaseTitle, TrimValue: true, CollapseWhitespace: true}, "  ACME   ltd ", "Acme Ltd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.action.NormalizeValue(tt.value); got != tt.want {
+				t.Errorf("NormalizeValue() = '%s', want '%s'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{"plain text", "invoice", false},
+		{"functions", `{{date "2006-01"}} {{meta "company"}} {{capture 1}} {{capture "name"}} {{filename}} {{pages}}`, false},
+		{"unknown function", `{{author}}`, true},
+		{"unclosed action", `{{date "2006"`, true},
+		{"missing argument", `{{date}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTemplate(tt.template); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	rule := &Rule{Actions: []*RuleAction{
+		{Action: RuleActionSetName, Value: "invoice"},
+		{Action: RuleActionAppendDescription, Value: "{{meta}}"},
+	}}
+	err := rule.Validate()
+	if err == nil || !strings.Contains(err.Error(), "action 2: invalid template") {
+		t.Errorf("Validate() error = %v, want invalid template", err)
+	}
+}
+
+func TestRuleExecution_Value(t *testing.T) {
+	actions := RuleActionResults{
+		{ActionId: 1, ActionType: "name_set", Changes: []RuleActionChange{{Action: "rename", OldValue: "a", NewValue: "b"}}},
+	}
+	value, err := actions.Value()
+	if err != nil {
+		t.Fatalf("Value() error = %v", err)
+	}
+
+	scanned := RuleActionResults{}
+	err = scanned.Scan([]byte(value.(string)))
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if !reflect.DeepEqual(scanned, actions) {
+		t.Errorf("Scan() = %v, want %v", scanned, actions)
+	}
+
+	conditions := RuleConditionResults{}
+	err = conditions.Scan(nil)
+	if err != nil || len(conditions) != 0 {
+		t.Errorf("Scan(nil) = %v, %v", conditions, err)
+	}
+	if err = conditions.Scan(1); err == nil {
+		t.Errorf("Scan(int) no error")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"2048", 2048, false},
+		{"10 MB", 10 * 1024 * 1024, false},
+		{"1.5kb", 1536, false},
+		{" 2 GiB ", 2 * 1024 * 1024 * 1024, false},
+		{"10 TB", 0, true},
+		{"-1", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Age
+		wantErr bool
+	}{
+		{"30d", Age{Days: 30}, false},
+		{"2 weeks", Age{Days: 14}, false},
+		{"6 months", Age{Months: 6}, false},
+		{"7Y", Age{Years: 7}, false},
+		{"7", Age{}, true},
+		{"1 decade", Age{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseAge(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseAge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleCondition_ValidateFileConditions(t *testing.T) {
+	tests := []struct {
+		conditionType RuleConditionType
+		value         string
+		wantErr       bool
+	}{
+		{RuleConditionFilenameMatches, "IMG_*.jpg", false},
+		{RuleConditionFilenameMatches, "IMG_[", true},
+		{RuleConditionFilenameIs, "", true},
+		{RuleConditionMimetypeIs, "image/*", false},
+		{RuleConditionMimetypeIs, "", true},
+		{RuleConditionSizeMoreThan, "10 MB", false},
+		{RuleConditionSizeLessThan, "big", true},
+		{RuleConditionPagesMoreThan, "20", false},
+		{RuleConditionPagesIs, "-1", true},
+		{RuleConditionSourceIs, "input_dir", false},
+		{RuleConditionSourceIs, "", true},
+		{RuleConditionSourceIs, "fax", true},
+		{RuleConditionAgeMoreThan, "7 years", false},
+		{RuleConditionAgeLessThan, "soon", true},
+		{RuleConditionExpression, `content[:200] contains "invoice" && metadata_count < 2`, false},
+		{RuleConditionExpression, `date > now() - duration("2160h")`, false},
+		{RuleConditionExpression, `"acme" in metadata["company"]`, false},
+		{RuleConditionExpression, "", true},
+		{RuleConditionExpression, "name +", true},
+		{RuleConditionExpression, "pages", true},
+		{RuleConditionExpression, "unknown_variable > 1", true},
+		{RuleConditionExpression, strings.Repeat("pages > 1 && ", 200) + "true", true},
+		{RuleConditionExpression, strings.Repeat("1+", 400) + "1 > 0", true},
+		{RuleConditionExpression, `any(split(name, " "), # in tags)`, false},
+		{RuleConditionExpression, `any(tags, any(tags, # == "a"))`, true},
+		{RuleConditionExpression, `any(split(name, " "), content contains #)`, true},
+		{RuleConditionExpression, `reduce(tags, #acc + #, "") == ""`, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.conditionType)+" "+tt.value, func(t *testing.T) {
+			condition := &RuleCondition{Enabled: true, ConditionType: tt.conditionType, Value: tt.value}
+			if err := condition.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleCondition_ValidateMatchMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition RuleCondition
+		wantErr   bool
+	}{
+		{"default", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a"}, false},
+		{"exact", RuleCondition{ConditionType: RuleConditionContentContains, Value: "a", MatchMode: RuleMatchExact}, false},
+		{"invalid mode", RuleCondition{ConditionType: RuleConditionContentContains, Value: "a", MatchMode: "similar"}, true},
+		{"not text condition", RuleCondition{ConditionType: RuleConditionMimetypeIs, Value: "image/*", MatchMode: RuleMatchExact}, true},
+		{"regex case-insensitive", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a+", IsRegex: true, MatchMode: RuleMatchCaseInsensitive}, false},
+		{"regex fuzzy", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a+", IsRegex: true, MatchMode: RuleMatchFuzzy, MatchMaxDistance: 1}, true},
+		{"fuzzy distance", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a", MatchMode: RuleMatchFuzzy, MatchMaxDistance: 2}, false},
+		{"fuzzy similarity", RuleCondition{ConditionType: RuleConditionFieldIs, FieldName: DocumentFieldIban, Value: "a", MatchMode: RuleMatchFuzzy, MatchMinSimilarity: 0.9}, false},
+		{"fuzzy without limit", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a", MatchMode: RuleMatchFuzzy}, true},
+		{"fuzzy with both limits", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a", MatchMode: RuleMatchFuzzy, MatchMaxDistance: 1, MatchMinSimilarity: 0.5}, true},
+		{"similarity out of range", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a", MatchMode: RuleMatchFuzzy, MatchMinSimilarity: 1.5}, true},
+		{"distance without fuzzy", RuleCondition{ConditionType: RuleConditionNameIs, Value: "a", MatchMaxDistance: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := tt.condition
+			condition.Enabled = true
+			if err := condition.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewRuleStatisticsReport(t *testing.T) {
+	now := time.Now()
+	daysAgo := func(days int) time.Time {
+		return now.AddDate(0, 0, -days)
+	}
+	matched := func(days int) sql.NullTime {
+		return sql.NullTime{Time: daysAgo(days), Valid: true}
+	}
+	rule := func(id int, enabled bool, resetDays int, lastMatched sql.NullTime, evaluations, matches int) *Rule {
+		return &Rule{Id: id, Enabled: enabled, RuleStatistics: RuleStatistics{
+			Evaluations:   evaluations,
+			Matches:       matches,
+			LastMatchedAt: lastMatched,
+			StatsResetAt:  daysAgo(resetDays),
+		}}
+	}
+	rules := []*Rule{
+		rule(1, true, 100, matched(2), 50, 10),
+		rule(2, true, 100, matched(40), 50, 1),
+		rule(3, true, 100, sql.NullTime{}, 50, 0),
+		// edited recently, too early to tell
+		rule(4, true, 5, sql.NullTime{}, 3, 0),
+		rule(5, false, 100, sql.NullTime{}, 0, 0),
+		rule(6, true, 100, matched(1), 20, 20),
+		// not enough evaluations
+		rule(7, true, 100, matched(1), 2, 2),
+	}
+
+	report := NewRuleStatisticsReport(rules, now, 30, 10)
+	ids := func(rules []*Rule) []int {
+		out := make([]int, len(rules))
+		for i, v := range rules {
+			out[i] = v.Id
+		}
+		return out
+	}
+	if got := ids(report.NotMatched); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("not matched = %v, want [2 3]", got)
+	}
+	if got := ids(report.AlwaysMatched); !reflect.DeepEqual(got, []int{6}) {
+		t.Errorf("always matched = %v, want [6]", got)
+	}
+}
@@ -18,7 +18,12 @@
 
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
 
 // Tag is a per-user label to add to documents. It has many-to-many relationship with documents.
 type Tag struct {
@@ -33,3 +38,66 @@ type TagComposite struct {
 	Tag
 	DocumentCount int `db:"document_count" json:"document_count"`
 }
+
+type DocumentTagHistoryEntry struct {
+	TagId int    `json:"tag_id"`
+	Key   string `json:"key"`
+}
+
+// TagDiff returns history items of tags removed from and added to the document.
+// Removed tags are listed first, both in their original order.
+func TagDiff(id string, userId int, original, updated []Tag) []DocumentHistory {
+	history := make([]DocumentHistory, 0)
+	oldTags := make(map[int]bool, len(original))
+	newTags := make(map[int]bool, len(updated))
+	for _, v := range original {
+		oldTags[v.Id] = true
+	}
+	for _, v := range updated {
+		newTags[v.Id] = true
+	}
+
+	addHistoryItem := func(action string, tag Tag) {
+		bytes, err := json.Marshal(DocumentTagHistoryEntry{TagId: tag.Id, Key: tag.Key})
+		if err != nil {
+			logrus.Errorf("tagdiff, marshal tag %d to json: %v", tag.Id, err)
+			return
+		}
+		item := DocumentHistory{
+			DocumentId: id,
+			Action:     action,
+			UserId:     userId,
+		}
+		if action == DocumentHistoryActionTagRemove {
+			item.OldValue = string(bytes)
+		} else {
+			item.NewValue = string(bytes)
+		}
+		history = append(history, item)
+	}
+
+	removed := map[int]bool{}
+	for _, v := range original {
+		if !newTags[v.Id] && !removed[v.Id] {
+			removed[v.Id] = true
+			addHistoryItem(DocumentHistoryActionTagRemove, v)
+		}
+	}
+	added := map[int]bool{}
+	for _, v := range updated {
+		if !oldTags[v.Id] && !added[v.Id] {
+			added[v.Id] = true
+			addHistoryItem(DocumentHistoryActionTagAdd, v)
+		}
+	}
+	return history
+}
+
+// TagIds returns ids of the tags.
+func TagIds(tags []Tag) []int {
+	ids := make([]int, len(tags))
+	for i, v := range tags {
+		ids[i] = v.Id
+	}
+	return ids
+}
@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"tryffel.net/go/virtualpaper/dateparse"
 )
 
 type User struct {
@@ -80,6 +81,22 @@ type UserPreferences struct {
 	IsAdmin       bool       `json:"is_admin" db:"is_admin"`
 	StopWords     []string   `json:"stop_words""`
 	Synonyms      [][]string `json:"synonyms"`
+	// DateOrder is the order of numeric dates, e.g. 'dmy'.
+	DateOrder string `json:"date_order"`
+	// DateLanguages are languages used to recognize month names in dates.
+	DateLanguages []string `json:"date_languages"`
+}
+
+// DateOptions returns options for parsing dates. Empty preferences use default options.
+func (u *UserPreferences) DateOptions() dateparse.Options {
+	opts := dateparse.DefaultOptions()
+	if u.DateOrder != "" {
+		opts.Order = dateparse.Order(u.DateOrder)
+	}
+	if len(u.DateLanguages) > 0 {
+		opts.Languages = u.DateLanguages
+	}
+	return opts
 }
 
 type UserInfo struct {
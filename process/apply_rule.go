@@ -0,0 +1,259 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/dateparse"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+// update bulk operation progress after every n documents.
+const bulkOperationUpdateInterval = 20
+
+// RuleApplyResult is the result of applying a rule to an existing document.
+type RuleApplyResult struct {
+	DocumentId   string `json:"document_id"`
+	DocumentName string `json:"document_name"`
+	Matched      bool   `json:"matched"`
+	// Changes contains document and metadata changes in the same format as document history.
+	Changes []models.DocumentHistory `json:"changes"`
+	// Metadata is the document metadata after applying the rule.
+	Metadata []models.Metadata `json:"metadata"`
+	// Tags are the document tags after applying the rule.
+	Tags  []models.Tag `json:"tags"`
+	Error string       `json:"error"`
+}
+
+// LoadRuleDocument loads document with all the data that rules can match.
+func LoadRuleDocument(db *storage.Database, userId int, documentId string) (*models.Document, error) {
+	doc, err := db.DocumentStore.GetDocument(userId, documentId)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := db.MetadataStore.GetDocumentMetadata(userId, documentId)
+	if err != nil {
+		return nil, err
+	}
+	doc.Metadata = *metadata
+
+	tags, err := db.MetadataStore.GetDocumentTags(userId, documentId)
+	if err != nil {
+		return nil, err
+	}
+	doc.Tags = *tags
+
+	properties, err := db.DocumentStore.GetDocumentProperties(doc.Id)
+	if err != nil {
+		return nil, err
+	}
+	doc.Properties = *properties
+
+	barcodes, err := db.DocumentStore.GetDocumentBarcodes(doc.Id)
+	if err != nil {
+		return nil, err
+	}
+	doc.Barcodes = *barcodes
+
+	fields, err := db.DocumentStore.GetDocumentFields(doc.Id)
+	if err != nil {
+		return nil, err
+	}
+	doc.Fields = *fields
+	return doc, nil
+}
+
+// ruleApplier applies rule to existing documents.
+type ruleApplier struct {
+	db         *storage.Database
+	search     DocumentSearcher
+	userId     int
+	rule       *models.Rule
+	dateParser *dateparse.Parser
+	dryRun     bool
+}
+
+func newRuleApplier(db *storage.Database, search DocumentSearcher, userId int, rule *models.Rule, dryRun bool) *ruleApplier {
+	dateOptions, err := db.UserStore.GetDateOptions(userId)
+	if err != nil {
+		logrus.Errorf("get date preferences for user %d: %v", userId, err)
+	}
+	return &ruleApplier{
+		db:         db,
+		search:     search,
+		userId:     userId,
+		rule:       rule,
+		dateParser: dateparse.NewParser(dateOptions),
+		dryRun:     dryRun,
+	}
+}
+
+// apply runs rule on the document and returns the changes. Changes are saved unless in dry-run mode.
+func (r *ruleApplier) apply(documentId string) (*RuleApplyResult, error) {
+	doc, err := LoadRuleDocument(r.db, r.userId, documentId)
+	if err != nil {
+		return nil, err
+	}
+	result := &RuleApplyResult{
+		DocumentId:   doc.Id,
+		DocumentName: doc.Name,
+		Changes:      []models.DocumentHistory{},
+		Metadata:     doc.Metadata,
+		Tags:         doc.Tags,
+	}
+
+	runner := NewDocumentRule(doc, r.rule)
+	runner.DateParser = r.dateParser
+	runner.Metadata = r.db.MetadataStore
+	runner.DryRun = r.dryRun
+	runner.Search = r.search
+	runner.Trigger = models.RuleTriggerManual
+	original := snapshotDocument(doc)
+	execution, changes := runner.Execute()
+	changes = enforceRulesMetadataConstraints(r.db.MetadataStore, doc, original.Metadata,
+		[]*models.RuleExecution{execution}, changes)
+	result.Matched = execution.Matched
+	result.Changes = changes
+	result.Metadata = doc.Metadata
+	result.Tags = doc.Tags
+	if r.dryRun {
+		if execution.Error != "" {
+			return result, fmt.Errorf("%s", execution.Error)
+		}
+		return result, nil
+	}
+
+	err = r.db.RuleStore.SaveRuleChanges(&storage.RuleChanges{
+		Document:        doc,
+		History:         withoutEffectHistory(changes),
+		MetadataChanged: metadataChanged(changes),
+		TagsChanged:     tagsChanged(changes),
+		Executions:      []*models.RuleExecution{execution},
+	})
+	if err != nil {
+		return result, fmt.Errorf("save changes: %v", err)
+	}
+	err = applyRuleEffects(r.db, doc, &runner.Effects)
+	if err != nil {
+		return result, fmt.Errorf("apply actions: %v", err)
+	}
+	if execution.Error != "" {
+		return result, fmt.Errorf("%s", execution.Error)
+	}
+	return result, nil
+}
+
+// DryRunRule returns the changes that rule would make to given documents without modifying them.
+func DryRunRule(db *storage.Database, search DocumentSearcher, userId int, rule *models.Rule, documents []string) []*RuleApplyResult {
+	applier := newRuleApplier(db, search, userId, rule, true)
+	results := make([]*RuleApplyResult, 0, len(documents))
+	for _, id := range documents {
+		result, err := applier.apply(id)
+		if result == nil {
+			result = &RuleApplyResult{DocumentId: id, Changes: []models.DocumentHistory{}}
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// ApplyRule applies rule to given documents in the background. Returned bulk operation tracks the progress.
+func (m *Manager) ApplyRule(userId int, rule *models.Rule, documents []string) (*models.BulkOperation, error) {
+	op := &models.BulkOperation{
+		UserId:    userId,
+		Operation: models.BulkOperationApplyRule,
+		RuleId:    models.IntId(rule.Id),
+		Status:    models.BulkOperationPending,
+		Total:     len(documents),
+	}
+	err := m.db.JobStore.CreateBulkOperation(op)
+	if err != nil {
+		return nil, err
+	}
+
+	go m.runApplyRule(op, rule, documents)
+	return op, nil
+}
+
+func (m *Manager) runApplyRule(op *models.BulkOperation, rule *models.Rule, documents []string) {
+	logrus.Infof("apply rule %d to %d documents, operation %d", rule.Id, len(documents), op.Id)
+	op.Status = models.BulkOperationRunning
+	op.StartedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	m.updateBulkOperation(op)
+
+	var searcher DocumentSearcher
+	if m.search != nil {
+		searcher = m.search
+	}
+	applier := newRuleApplier(m.db, searcher, op.UserId, rule, false)
+	changed := make([]string, 0, len(documents))
+	for i, id := range documents {
+		result, err := applier.apply(id)
+		op.Processed += 1
+		if err != nil {
+			logrus.Warningf("apply rule %d to document %s: %v", rule.Id, id, err)
+			op.Failed += 1
+			op.Message = fmt.Sprintf("document %s: %v", id, err)
+		}
+		if result != nil && result.Matched {
+			op.Matched += 1
+		}
+		if result != nil && len(result.Changes) > 0 {
+			op.Changed += 1
+			changed = append(changed, id)
+		}
+		if (i+1)%bulkOperationUpdateInterval == 0 {
+			m.updateBulkOperation(op)
+		}
+	}
+
+	if len(changed) > 0 {
+		err := m.db.JobStore.AddDocuments(op.UserId, changed, models.ProcessFts)
+		if err != nil && !errors.Is(err, errors.ErrAlreadyExists) {
+			logrus.Errorf("add documents to fts queue after applying rule %d: %v", rule.Id, err)
+		}
+		m.PullDocumentsToProcess()
+	}
+
+	op.Status = models.BulkOperationFinished
+	if op.Failed > 0 && op.Failed == op.Total {
+		op.Status = models.BulkOperationFailed
+	}
+	op.StoppedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	m.updateBulkOperation(op)
+	logrus.Infof("apply rule %d finished, matched %d, changed %d, failed %d documents",
+		rule.Id, op.Matched, op.Changed, op.Failed)
+}
+
+func (m *Manager) updateBulkOperation(op *models.BulkOperation) {
+	err := m.db.JobStore.UpdateBulkOperation(op)
+	if err != nil {
+		logrus.Errorf("update bulk operation %d: %v", op.Id, err)
+	}
+}
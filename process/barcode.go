@@ -0,0 +1,357 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+// imagick names multi-page output as page-0.png, page-1.png...
+var pageImageRe = regexp.MustCompile(`-(\d+)\.png$`)
+
+// callZbarImg decodes all barcodes from image file and returns them in zbar xml format.
+// Zbarimg exits with status 4 if there are no barcodes, which is not an error.
+func callZbarImg(file string) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	logrus.Debugf("call zbarimg: %s, %s", config.C.Processing.ZbarImgBin, file)
+	cmd := exec.Command(config.C.Processing.ZbarImgBin, "--quiet", "--xml", file)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 4 {
+			return "", nil
+		}
+		return "", fmt.Errorf("run zbarimg: %v, stderr: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// zbarOutput is the xml output of zbarimg:
+//
+//	<barcodes><source href="page.png"><index num="0">
+//	<symbol type="QR-Code" quality="1"><data><![CDATA[payload]]></data></symbol>
+//	</index></source></barcodes>
+type zbarOutput struct {
+	Sources []struct {
+		Indexes []struct {
+			Symbols []struct {
+				Type string `xml:"type,attr"`
+				Data struct {
+					// Format is 'base64' if payload is binary.
+					Format string `xml:"format,attr"`
+					Value  string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"symbol"`
+		} `xml:"index"`
+	} `xml:"source"`
+}
+
+// parseZbarOutput parses zbarimg xml output. Payloads are kept as is, including newlines
+// of multi-line payloads such as EPC QR codes. Binary payloads are skipped.
+func parseZbarOutput(output string, page int) ([]models.DocumentBarcode, error) {
+	barcodes := make([]models.DocumentBarcode, 0, 2)
+	if strings.TrimSpace(output) == "" {
+		return barcodes, nil
+	}
+	parsed := &zbarOutput{}
+	err := xml.Unmarshal([]byte(output), parsed)
+	if err != nil {
+		return nil, fmt.Errorf("parse zbarimg output: %v", err)
+	}
+	for _, source := range parsed.Sources {
+		for _, index := range source.Indexes {
+			for _, symbol := range index.Symbols {
+				payload := symbol.Data.Value
+				if symbol.Data.Format == "base64" {
+					decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(payload))
+					if err != nil || !utf8.Valid(decoded) {
+						continue
+					}
+					payload = string(decoded)
+				}
+				if payload == "" {
+					continue
+				}
+				barcodes = append(barcodes, models.DocumentBarcode{
+					Page:    page,
+					Type:    symbol.Type,
+					Payload: payload,
+				})
+			}
+		}
+	}
+	return barcodes, nil
+}
+
+// pageImages returns page images in dir ordered by page number.
+func pageImages(dir string) ([]string, error) {
+	files, err := filepath.Glob(path.Join(dir, "*.png"))
+	if err != nil {
+		return nil, err
+	}
+	pageNumber := func(file string) int {
+		match := pageImageRe.FindStringSubmatch(file)
+		if len(match) != 2 {
+			return 0
+		}
+		n, _ := strconv.Atoi(match[1])
+		return n
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return pageNumber(files[i]) < pageNumber(files[j])
+	})
+	return files, nil
+}
+
+// splitPagesBySeparator returns page ranges (first and last page) that are separated by separatorPages.
+// Separator pages are not included in the ranges. If there are no separator pages, return nil.
+func splitPagesBySeparator(pageCount int, separatorPages []int) [][2]int {
+	if len(separatorPages) == 0 {
+		return nil
+	}
+	isSeparator := map[int]bool{}
+	for _, v := range separatorPages {
+		isSeparator[v] = true
+	}
+
+	ranges := make([][2]int, 0, len(separatorPages)+1)
+	start := 0
+	for page := 1; page <= pageCount; page++ {
+		if isSeparator[page] {
+			if start != 0 {
+				ranges = append(ranges, [2]int{start, page - 1})
+				start = 0
+			}
+			continue
+		}
+		if start == 0 {
+			start = page
+		}
+	}
+	if start != 0 {
+		ranges = append(ranges, [2]int{start, pageCount})
+	}
+	return ranges
+}
+
+// separatorPages returns pages that have the separator barcode.
+func separatorPages(barcodes []models.DocumentBarcode, separator string) []int {
+	pages := make([]int, 0)
+	if separator == "" {
+		return pages
+	}
+	for _, v := range barcodes {
+		if v.Payload == separator {
+			if len(pages) == 0 || pages[len(pages)-1] != v.Page {
+				pages = append(pages, v.Page)
+			}
+		}
+	}
+	return pages
+}
+
+// decodeBarcodes decodes barcodes from each document page and stores them. If document is a pdf
+// and it contains barcode separator pages, the document is split into new documents and the original
+// document is moved to trash bin. In this case, return split = true and the processing for document
+// must not continue.
+func (fp *fileProcessor) decodeBarcodes() (bool, error) {
+	process := &models.ProcessItem{
+		DocumentId: fp.document.Id,
+		Step:       models.ProcessBarcodes,
+		CreatedAt:  time.Now(),
+	}
+
+	job, err := fp.db.JobStore.StartProcessItem(process, "decode barcodes")
+	if err != nil {
+		return false, fmt.Errorf("start process: %v", err)
+	}
+	defer fp.completeProcessingStep(process, job)
+
+	if config.C.Processing.ZbarImgBin == "" {
+		job.Message += "; zbarimg not installed, skipping"
+		job.Status = models.JobFinished
+		return false, nil
+	}
+
+	var pages []string
+	if fp.document.IsImage() {
+		pages = []string{fp.rawFile.Name()}
+	} else if fp.document.IsPdf() {
+		dir := storage.TempFilePath(fp.document.Id) + "-barcodes"
+		err = os.Mkdir(dir, os.ModePerm|os.ModeDir)
+		if err != nil {
+			job.Status = models.JobFailure
+			return false, fmt.Errorf("create tmp dir: %v", err)
+		}
+		defer removeTempData(dir)
+
+		err = generatePicture(fp.rawFile.Name(), path.Join(dir, "page.png"))
+		if err != nil {
+			job.Message += "; " + err.Error()
+			job.Status = models.JobFailure
+			return false, fmt.Errorf("generate pictures from pdf pages: %v", err)
+		}
+		pages, err = pageImages(dir)
+		if err != nil {
+			job.Status = models.JobFailure
+			return false, fmt.Errorf("list page images: %v", err)
+		}
+	} else {
+		job.Message += fmt.Sprintf("; no barcodes for mimetype %s", fp.document.Mimetype)
+		job.Status = models.JobFinished
+		return false, nil
+	}
+
+	barcodes := make([]models.DocumentBarcode, 0)
+	for i, page := range pages {
+		output, err := callZbarImg(page)
+		if err != nil {
+			job.Message += "; " + err.Error()
+			job.Status = models.JobFailure
+			return false, fmt.Errorf("decode barcodes from page %d: %v", i+1, err)
+		}
+		pageBarcodes, err := parseZbarOutput(output, i+1)
+		if err != nil {
+			job.Message += "; " + err.Error()
+			job.Status = models.JobFailure
+			return false, fmt.Errorf("decode barcodes from page %d: %v", i+1, err)
+		}
+		barcodes = append(barcodes, pageBarcodes...)
+	}
+
+	err = fp.db.DocumentStore.SetDocumentBarcodes(fp.document.Id, barcodes)
+	if err != nil {
+		job.Message += "; save barcodes: " + err.Error()
+		job.Status = models.JobFailure
+		return false, fmt.Errorf("save document barcodes: %v", err)
+	}
+	fp.document.Barcodes = barcodes
+	fp.Debug("found %d barcodes", len(barcodes))
+	job.Status = models.JobFinished
+
+	if !fp.document.IsPdf() {
+		return false, nil
+	}
+	ranges := splitPagesBySeparator(len(pages), separatorPages(barcodes, config.C.Processing.BarcodeSeparator))
+	if len(ranges) == 0 {
+		return false, nil
+	}
+
+	err = fp.splitDocument(ranges)
+	if err != nil {
+		job.Message += "; split document: " + err.Error()
+		job.Status = models.JobFailure
+		return false, fmt.Errorf("split document by barcode separator: %v", err)
+	}
+	job.Message += fmt.Sprintf("; split into %d documents", len(ranges))
+	return true, nil
+}
+
+// splitDocument creates a new document of each page range and moves the original document to trash bin.
+// New documents are processed separately.
+func (fp *fileProcessor) splitDocument(ranges [][2]int) error {
+	original := fp.document
+	fp.Info("split document into %d documents by barcode separator", len(ranges))
+
+	for i, pages := range ranges {
+		tempFile := storage.TempFilePath(fmt.Sprintf("%s-split-%d", original.Id, i+1))
+		err := extractPdfPages(fp.rawFile.Name(), pages[0], pages[1], tempFile)
+		if err != nil {
+			removeTempData(tempFile)
+			return fmt.Errorf("extract pages %d-%d: %v", pages[0], pages[1], err)
+		}
+
+		hash, err := GetHash(tempFile)
+		if err != nil {
+			removeTempData(tempFile)
+			return fmt.Errorf("get hash: %v", err)
+		}
+		info, err := os.Stat(tempFile)
+		if err != nil {
+			removeTempData(tempFile)
+			return fmt.Errorf("stat file: %v", err)
+		}
+
+		doc := &models.Document{
+			UserId:   original.UserId,
+			Name:     fmt.Sprintf("%s (%d/%d)", original.Name, i+1, len(ranges)),
+			Filename: original.Filename,
+			Hash:     hash,
+			Mimetype: original.Mimetype,
+			Size:     info.Size(),
+			Date:     original.Date,
+			Source:   models.DocumentSourceSplit,
+		}
+		err = fp.db.DocumentStore.Create(doc)
+		if err != nil {
+			removeTempData(tempFile)
+			return fmt.Errorf("create document: %v", err)
+		}
+		err = storage.CreateDocumentDir(doc.Id)
+		if err != nil {
+			return fmt.Errorf("create directory for document: %v", err)
+		}
+		err = storage.MoveFile(tempFile, storage.DocumentPath(doc.Id))
+		if err != nil {
+			return fmt.Errorf("move file: %v", err)
+		}
+		err = fp.db.JobStore.AddDocument(doc)
+		if err != nil {
+			return fmt.Errorf("add process steps for new document: %v", err)
+		}
+		fp.Info("created document %s of pages %d-%d", doc.Id, pages[0], pages[1])
+	}
+
+	err := fp.db.JobStore.CancelDocumentProcessing(original.Id)
+	if err != nil {
+		return fmt.Errorf("cancel processing original document: %v", err)
+	}
+	err = fp.db.DocumentStore.MarkDocumentDeleted(storage.UserIdInternal, original.Id)
+	if err != nil {
+		return fmt.Errorf("move original document to trash bin: %v", err)
+	}
+	err = fp.search.DeleteDocument(original.Id, original.UserId)
+	if err != nil {
+		logrus.Errorf("delete split document %s from search index: %v", original.Id, err)
+	}
+	return nil
+}
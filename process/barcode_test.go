@@ -0,0 +1,159 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"reflect"
+	"testing"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_parseZbarOutput(t *testing.T) {
+	// output of 'zbarimg --quiet --xml' for a page with an EPC QR code and an EAN-13 barcode
+	output := `<barcodes xmlns='http://zbar.sourceforge.net/2008/barcode'>
+<source href='page-1.png'>
+<index num='0'>
+<symbol type='QR-Code' quality='1' orientation='UP'><polygon points='+40,40 +40,200 +200,200 +200,40'/><data><![CDATA[BCD
+002
+1
+SCT
+NDEAFIHH
+Acme Oy
+FI2112345600000785
+EUR125.50
+
+RF18 5390 0754 7034
+Invoice: 2023-01]]></data></symbol>
+<symbol type='EAN-13' quality='220' orientation='UP'><data><![CDATA[6410405082657]]></data></symbol>
+<symbol type='CODE-128' quality='80'><data format='base64' length='4'><![CDATA[Qk9YLQ==
+]]></data></symbol>
+</index>
+</source>
+</barcodes>
+`
+	want := []models.DocumentBarcode{
+		{Page: 2, Type: "QR-Code", Payload: "BCD\n002\n1\nSCT\nNDEAFIHH\nAcme Oy\nFI2112345600000785\nEUR125.50\n\nRF18 5390 0754 7034\nInvoice: 2023-01"},
+		{Page: 2, Type: "EAN-13", Payload: "6410405082657"},
+		{Page: 2, Type: "CODE-128", Payload: "BOX-"},
+	}
+	got, err := parseZbarOutput(output, 2)
+	if err != nil {
+		t.Fatalf("parseZbarOutput() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseZbarOutput() = %q, want %q", got, want)
+	}
+
+	// payment fields are read from the parsed EPC QR code
+	fields := newFieldExtractor([]string{"en"}, nil).extract("", got)
+	gotFields := map[string]string{}
+	for _, v := range fields {
+		gotFields[v.Name] = v.Value
+	}
+	wantFields := map[string]string{
+		models.DocumentFieldAmount:    "125.50",
+		models.DocumentFieldCurrency:  "EUR",
+		models.DocumentFieldIban:      "FI2112345600000785",
+		models.DocumentFieldReference: "RF18539007547034",
+	}
+	if !reflect.DeepEqual(gotFields, wantFields) {
+		t.Errorf("extract() from parsed barcodes = %v, want %v", gotFields, wantFields)
+	}
+
+	got, err = parseZbarOutput("", 1)
+	if err != nil || len(got) != 0 {
+		t.Errorf("parseZbarOutput() with no barcodes = %v, %v, want empty", got, err)
+	}
+	if _, err = parseZbarOutput("QR-Code:payload", 1); err == nil {
+		t.Errorf("parseZbarOutput() with invalid output, want error")
+	}
+}
+
+func Test_splitPagesBySeparator(t *testing.T) {
+	tests := []struct {
+		name       string
+		pageCount  int
+		separators []int
+		want       [][2]int
+	}{
+		{"no separators", 5, nil, nil},
+		{"separator in middle", 5, []int{3}, [][2]int{{1, 2}, {4, 5}}},
+		{"cover sheets", 6, []int{1, 4}, [][2]int{{2, 3}, {5, 6}}},
+		{"consecutive separators", 5, []int{2, 3}, [][2]int{{1, 1}, {4, 5}}},
+		{"only separators", 2, []int{1, 2}, [][2]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitPagesBySeparator(tt.pageCount, tt.separators); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitPagesBySeparator() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_separatorPages(t *testing.T) {
+	barcodes := []models.DocumentBarcode{
+		{Page: 1, Payload: "SEPARATOR"},
+		{Page: 1, Payload: "SEPARATOR"},
+		{Page: 2, Payload: "invoice"},
+		{Page: 4, Payload: "SEPARATOR"},
+	}
+	want := []int{1, 4}
+	if got := separatorPages(barcodes, "SEPARATOR"); !reflect.DeepEqual(got, want) {
+		t.Errorf("separatorPages() = %v, want %v", got, want)
+	}
+	if got := separatorPages(barcodes, ""); len(got) != 0 {
+		t.Errorf("separatorPages() with no separator = %v, want empty", got)
+	}
+}
+
+func TestDocumentRule_matchBarcode(t *testing.T) {
+	doc := &models.Document{
+		Id: "1234",
+		Barcodes: []models.DocumentBarcode{
+			{Page: 1, Type: "QR-Code", Payload: "BCD\n001\nRF18 5390 0754 7034"},
+			{Page: 2, Type: "CODE-128", Payload: "BOX-0042"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		condition *models.RuleCondition
+		want      bool
+	}{
+		{"exact payload", &models.RuleCondition{Enabled: true, ConditionType: models.RuleConditionBarcodeMatches, Value: "BOX-0042"}, true},
+		{"case insensitive", &models.RuleCondition{Enabled: true, CaseInsensitive: true, ConditionType: models.RuleConditionBarcodeMatches, Value: "box-0042"}, true},
+		{"partial payload", &models.RuleCondition{Enabled: true, ConditionType: models.RuleConditionBarcodeMatches, Value: "BOX"}, false},
+		{"regex", &models.RuleCondition{Enabled: true, IsRegex: true, ConditionType: models.RuleConditionBarcodeMatches, Value: `RF\d{2}`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := NewDocumentRule(doc, &models.Rule{Mode: models.RuleMatchAll, Conditions: []*models.RuleCondition{tt.condition}})
+			got, err := dc.Match()
+			if err != nil {
+				t.Errorf("Match() error = %v", err)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Match() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,483 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+const (
+	// maximum number of latest documents with metadata to train the classifier with.
+	classifierMaxDocuments = 3000
+	// maximum number of characters of document content to train the classifier with.
+	classifierContentLength = 10000
+	// minimum number of documents with metadata to train the classifier.
+	classifierMinDocuments = 10
+	// minimum number of documents that have the value for the value to be suggested.
+	classifierMinValueDocuments = 3
+	// minimum number of documents that have the word for the word to be included in the vocabulary.
+	classifierMinWordDocuments = 2
+	// maximum number of most common words in the vocabulary.
+	classifierMaxVocabulary = 5000
+	// number of words that the likelihood of a document is scaled to. Naive bayes is overconfident
+	// with long documents, since words are not independent. Using the average likelihood
+	// of the words keeps the confidence comparable between short and long documents.
+	classifierEvidenceWords = 50
+	// class of the documents that do not have the key.
+	classifierNoValue = 0
+
+	defaultClassifierApplyThreshold   = 0.95
+	defaultClassifierSuggestThreshold = 0.6
+)
+
+// metadataClassifier is a multinomial naive bayes classifier that predicts metadata values from the words
+// of the document. Each key has its own classifier, where each value of the key is a class.
+// Documents that do not have the key form a class of their own, so that the key is only suggested
+// for documents that resemble the documents that have the key. Words are counted once per document.
+type metadataClassifier struct {
+	Vocabulary []string               `json:"vocabulary"`
+	Keys       map[int]*keyClassifier `json:"keys"`
+	vocabulary map[string]bool
+}
+
+type keyClassifier struct {
+	// Classes by value id.
+	Classes map[int]*classifierClass `json:"classes"`
+}
+
+type classifierClass struct {
+	Documents int `json:"documents"`
+	// Words is the total number of words in the documents.
+	Words      int            `json:"words"`
+	WordCounts map[string]int `json:"word_counts"`
+}
+
+type classifierPrediction struct {
+	KeyId   int
+	ValueId int
+	// Confidence is the posterior probability of the value, between 0 and 1.
+	Confidence float64
+}
+
+// classifierWords returns the unique words of the text in the order they appear.
+// Words are lowercase and numbers are ignored.
+func classifierWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool, len(fields))
+	words := make([]string, 0, len(fields))
+	for _, v := range fields {
+		length := len([]rune(v))
+		if length < 3 || length > 30 || seen[v] {
+			continue
+		}
+		if strings.IndexFunc(v, unicode.IsLetter) == -1 {
+			continue
+		}
+		seen[v] = true
+		words = append(words, v)
+	}
+	return words
+}
+
+// trainMetadataClassifier trains the classifier from labelled documents.
+func trainMetadataClassifier(documents []models.ClassifierDocument) *metadataClassifier {
+	words := make([][]string, len(documents))
+	documentFrequency := make(map[string]int)
+	for i, doc := range documents {
+		words[i] = classifierWords(doc.Name + " " + doc.Content)
+		for _, word := range words[i] {
+			documentFrequency[word] += 1
+		}
+	}
+
+	classifier := &metadataClassifier{
+		Vocabulary: classifierVocabulary(documentFrequency),
+		Keys:       make(map[int]*keyClassifier),
+	}
+	classifier.setVocabulary()
+
+	// documents of each value of each key
+	keyValues := make(map[int]map[int][]int)
+	for i, doc := range documents {
+		for j := range doc.KeyIds {
+			if j >= len(doc.ValueIds) {
+				break
+			}
+			keyId, valueId := int(doc.KeyIds[j]), int(doc.ValueIds[j])
+			if keyValues[keyId] == nil {
+				keyValues[keyId] = make(map[int][]int)
+			}
+			keyValues[keyId][valueId] = append(keyValues[keyId][valueId], i)
+		}
+	}
+
+	for keyId, values := range keyValues {
+		key := &keyClassifier{Classes: make(map[int]*classifierClass)}
+		hasKey := make(map[int]bool)
+		for valueId, docs := range values {
+			for _, i := range docs {
+				hasKey[i] = true
+			}
+			if len(docs) >= classifierMinValueDocuments {
+				key.Classes[valueId] = classifier.newClass(words, docs)
+			}
+		}
+		noValue := make([]int, 0)
+		for i, doc := range documents {
+			if !hasKey[i] && !classifierKeyExcluded(doc, keyId) {
+				noValue = append(noValue, i)
+			}
+		}
+		if len(noValue) > 0 {
+			key.Classes[classifierNoValue] = classifier.newClass(words, noValue)
+		}
+		// a single class cannot be predicted
+		if len(key.Classes) < 2 {
+			continue
+		}
+		classifier.Keys[keyId] = key
+	}
+	return classifier
+}
+
+// classifierKeyExcluded returns true if the document is not an example of the key.
+func classifierKeyExcluded(doc models.ClassifierDocument, keyId int) bool {
+	for _, v := range doc.ExcludedKeyIds {
+		if int(v) == keyId {
+			return true
+		}
+	}
+	return false
+}
+
+// classifierVocabulary returns the most common words that appear in at least classifierMinWordDocuments documents.
+func classifierVocabulary(documentFrequency map[string]int) []string {
+	vocabulary := make([]string, 0, len(documentFrequency))
+	for word, count := range documentFrequency {
+		if count >= classifierMinWordDocuments {
+			vocabulary = append(vocabulary, word)
+		}
+	}
+	sort.Slice(vocabulary, func(i, j int) bool {
+		a, b := documentFrequency[vocabulary[i]], documentFrequency[vocabulary[j]]
+		if a != b {
+			return a > b
+		}
+		return vocabulary[i] < vocabulary[j]
+	})
+	if len(vocabulary) > classifierMaxVocabulary {
+		vocabulary = vocabulary[:classifierMaxVocabulary]
+	}
+	sort.Strings(vocabulary)
+	return vocabulary
+}
+
+func (c *metadataClassifier) setVocabulary() {
+	c.vocabulary = make(map[string]bool, len(c.Vocabulary))
+	for _, v := range c.Vocabulary {
+		c.vocabulary[v] = true
+	}
+}
+
+func (c *metadataClassifier) newClass(words [][]string, documents []int) *classifierClass {
+	class := &classifierClass{Documents: len(documents), WordCounts: make(map[string]int)}
+	for _, i := range documents {
+		for _, word := range words[i] {
+			if c.vocabulary[word] {
+				class.WordCounts[word] += 1
+				class.Words += 1
+			}
+		}
+	}
+	return class
+}
+
+// predict returns the values that the classifier predicts for the document, ordered by confidence.
+func (c *metadataClassifier) predict(text string) []classifierPrediction {
+	words := make([]string, 0)
+	for _, v := range classifierWords(text) {
+		if c.vocabulary[v] {
+			words = append(words, v)
+		}
+	}
+	predictions := make([]classifierPrediction, 0)
+	if len(words) == 0 {
+		return predictions
+	}
+	evidence := math.Min(float64(len(words)), classifierEvidenceWords) / float64(len(words))
+	vocabularySize := float64(len(c.Vocabulary))
+
+	for keyId, key := range c.Keys {
+		documents := 0
+		for _, class := range key.Classes {
+			documents += class.Documents
+		}
+		scores := make(map[int]float64, len(key.Classes))
+		maxScore := math.Inf(-1)
+		for valueId, class := range key.Classes {
+			likelihood := 0.0
+			for _, word := range words {
+				// laplace smoothing
+				likelihood += math.Log(float64(class.WordCounts[word]+1) / (float64(class.Words) + vocabularySize))
+			}
+			score := math.Log(float64(class.Documents)/float64(documents)) + likelihood*evidence
+			scores[valueId] = score
+			maxScore = math.Max(maxScore, score)
+		}
+
+		total := 0.0
+		for _, score := range scores {
+			total += math.Exp(score - maxScore)
+		}
+		for valueId, score := range scores {
+			if valueId == classifierNoValue {
+				continue
+			}
+			predictions = append(predictions, classifierPrediction{
+				KeyId:      keyId,
+				ValueId:    valueId,
+				Confidence: math.Exp(score-maxScore) / total,
+			})
+		}
+	}
+	sort.Slice(predictions, func(i, j int) bool {
+		if predictions[i].Confidence != predictions[j].Confidence {
+			return predictions[i].Confidence > predictions[j].Confidence
+		}
+		if predictions[i].KeyId != predictions[j].KeyId {
+			return predictions[i].KeyId < predictions[j].KeyId
+		}
+		return predictions[i].ValueId < predictions[j].ValueId
+	})
+	return predictions
+}
+
+// TrainMetadataClassifier trains the classifier of the user from documents that have metadata, and saves it.
+// If user does not have enough documents, ErrInvalid is returned.
+func TrainMetadataClassifier(db *storage.Database, userId int) (*models.MetadataClassifier, error) {
+	documents, err := db.MetadataStore.GetClassifierTrainingDocuments(userId, classifierMaxDocuments, classifierContentLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(documents) < classifierMinDocuments {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("at least %d documents with metadata are needed, got %d",
+			classifierMinDocuments, len(documents))
+		return nil, e
+	}
+
+	start := time.Now()
+	classifier := trainMetadataClassifier(documents)
+	model, err := json.Marshal(classifier)
+	if err != nil {
+		return nil, fmt.Errorf("serialize classifier: %v", err)
+	}
+	result := &models.MetadataClassifier{
+		UserId:    userId,
+		Model:     string(model),
+		Documents: len(documents),
+		Keys:      len(classifier.Keys),
+		TrainedAt: time.Now(),
+	}
+	err = db.MetadataStore.SaveMetadataClassifier(result)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("trained metadata classifier for user %d with %d documents and %d keys in %s",
+		userId, len(documents), len(classifier.Keys), time.Since(start).String())
+	return result, nil
+}
+
+// classifierCache keeps the parsed classifiers in memory, since parsing the model for each document is slow.
+type classifierCache struct {
+	lock        sync.Mutex
+	classifiers map[int]*cachedClassifier
+}
+
+type cachedClassifier struct {
+	trainedAt  time.Time
+	classifier *metadataClassifier
+}
+
+var classifiers = &classifierCache{classifiers: make(map[int]*cachedClassifier)}
+
+// get returns the latest classifier of the user, or nil if user does not have a classifier.
+func (c *classifierCache) get(db *storage.Database, userId int) (*metadataClassifier, error) {
+	trainedAt, err := db.MetadataStore.GetMetadataClassifierTrainedAt(userId)
+	if errors.Is(err, errors.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached := c.classifiers[userId]
+	if cached != nil && cached.trainedAt.Equal(trainedAt) {
+		return cached.classifier, nil
+	}
+
+	stored, err := db.MetadataStore.GetMetadataClassifier(userId)
+	if err != nil {
+		return nil, err
+	}
+	classifier := &metadataClassifier{}
+	err = json.Unmarshal([]byte(stored.Model), classifier)
+	if err != nil {
+		return nil, fmt.Errorf("parse classifier: %v", err)
+	}
+	classifier.setVocabulary()
+	c.classifiers[userId] = &cachedClassifier{trainedAt: stored.TrainedAt, classifier: classifier}
+	return classifier, nil
+}
+
+func classifierThresholds() (float64, float64) {
+	apply := config.C.Processing.ClassifierApplyThreshold
+	if apply == 0 {
+		apply = defaultClassifierApplyThreshold
+	}
+	suggest := config.C.Processing.ClassifierSuggestThreshold
+	if suggest == 0 {
+		suggest = defaultClassifierSuggestThreshold
+	}
+	return apply, suggest
+}
+
+// selectSuggestions returns the predictions to apply automatically or to suggest to the user.
+// Values that the document has or that have been suggested before are skipped. Values of single-valued keys
+// are only suggested if the document does not have the key, and at most one value is applied.
+func selectSuggestions(doc *models.Document, predictions []classifierPrediction, suggested []int,
+	keys []models.MetadataKey, applyThreshold, suggestThreshold float64) []models.MetadataSuggestion {
+	skip := make(map[int]bool, len(suggested))
+	for _, v := range suggested {
+		skip[v] = true
+	}
+	hasKey := make(map[int]bool, len(doc.Metadata))
+	for _, v := range doc.Metadata {
+		skip[v.ValueId] = true
+		hasKey[v.KeyId] = true
+	}
+	singleValue := make(map[int]bool, len(keys))
+	for _, v := range keys {
+		singleValue[v.Id] = v.SingleValue
+	}
+
+	suggestions := make([]models.MetadataSuggestion, 0)
+	for _, v := range predictions {
+		if v.Confidence < suggestThreshold || skip[v.ValueId] || (singleValue[v.KeyId] && hasKey[v.KeyId]) {
+			continue
+		}
+		suggestion := models.MetadataSuggestion{
+			DocumentId: doc.Id,
+			KeyId:      v.KeyId,
+			ValueId:    v.ValueId,
+			Confidence: v.Confidence,
+			Status:     models.MetadataSuggestionPending,
+		}
+		if v.Confidence >= applyThreshold {
+			suggestion.Status = models.MetadataSuggestionAccepted
+			suggestion.Automatic = true
+			hasKey[v.KeyId] = true
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	return suggestions
+}
+
+// suggestMetadata predicts metadata values for the document with the classifier of the user.
+// Values with high confidence are added to the document, and other values are stored as pending suggestions.
+// All suggestions are stored, so that values that user has rejected or removed are not suggested again.
+func suggestMetadata(db *storage.Database, doc *models.Document) error {
+	if config.C.Processing.ClassifierDisabled {
+		return nil
+	}
+	classifier, err := classifiers.get(db, doc.UserId)
+	if err != nil {
+		return fmt.Errorf("get classifier: %v", err)
+	}
+	if classifier == nil {
+		return nil
+	}
+	predictions := classifier.predict(doc.Name + " " + doc.Description + " " + doc.Content)
+	if len(predictions) == 0 {
+		return nil
+	}
+
+	suggested, err := db.MetadataStore.GetSuggestedValueIds(doc.Id)
+	if err != nil {
+		return err
+	}
+	keys, err := db.MetadataStore.GetUserKeysCached(doc.UserId)
+	if err != nil {
+		return err
+	}
+	applyThreshold, suggestThreshold := classifierThresholds()
+	selected := selectSuggestions(doc, predictions, suggested, *keys, applyThreshold, suggestThreshold)
+
+	suggestions := make([]models.MetadataSuggestion, 0, len(selected))
+	for _, v := range selected {
+		// values may have been deleted after training
+		exists, err := db.MetadataStore.UserHasKeyValue(doc.UserId, v.KeyId, v.ValueId)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if v.Automatic && !metadataSatisfiesConstraints(*keys, doc.Metadata, models.Metadata{KeyId: v.KeyId, ValueId: v.ValueId}) {
+			// e.g. value requires another key, let user decide
+			v.Automatic = false
+			v.Status = models.MetadataSuggestionPending
+		}
+		if v.Automatic {
+			logrus.Debugf("classifier adds metadata value %d to document %s, confidence %.2f", v.ValueId, doc.Id, v.Confidence)
+			err = addMetadata(doc, models.Metadata{KeyId: v.KeyId, ValueId: v.ValueId}, nil)
+			if err != nil {
+				return err
+			}
+		}
+		suggestions = append(suggestions, v)
+	}
+	return db.MetadataStore.AddMetadataSuggestions(suggestions)
+}
+
+// metadataSatisfiesConstraints returns true if adding value to metadata does not add violations of
+// metadata key constraints.
+func metadataSatisfiesConstraints(keys []models.MetadataKey, metadata []models.Metadata, value models.Metadata) bool {
+	updated := make([]models.Metadata, len(metadata), len(metadata)+1)
+	copy(updated, metadata)
+	updated = append(updated, value)
+	return len(models.NewMetadataViolations(keys, metadata, updated)) == 0
+}
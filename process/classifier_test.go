@@ -0,0 +1,162 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_classifierWords(t *testing.T) {
+	got := classifierWords("Invoice #1234, INVOICE from ACME-oy, due 2023 ok")
+	want := []string{"invoice", "from", "acme", "due"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("classifierWords() = %v, want %v", got, want)
+	}
+}
+
+// classifierTestDocuments returns invoices of two companies labelled with key 1 and its values 10 and 11,
+// and meeting notes without key 1.
+func classifierTestDocuments() []models.ClassifierDocument {
+	documents := make([]models.ClassifierDocument, 0)
+	for i := 0; i < 5; i++ {
+		documents = append(documents,
+			models.ClassifierDocument{
+				Id:       fmt.Sprintf("acme-%d", i),
+				Name:     "invoice.pdf",
+				Content:  "Acme electricity invoice, please pay the amount to Acme bank account",
+				KeyIds:   pq.Int64Array{1, 2},
+				ValueIds: pq.Int64Array{10, 20},
+			},
+			models.ClassifierDocument{
+				Id:       fmt.Sprintf("globex-%d", i),
+				Name:     "invoice.pdf",
+				Content:  "Globex internet subscription invoice, please pay the amount to Globex bank account",
+				KeyIds:   pq.Int64Array{1, 2},
+				ValueIds: pq.Int64Array{11, 20},
+			},
+			models.ClassifierDocument{
+				Id:       fmt.Sprintf("notes-%d", i),
+				Name:     "notes.pdf",
+				Content:  "Meeting notes of the housing board, budget discussion and renovation plans",
+				KeyIds:   pq.Int64Array{3},
+				ValueIds: pq.Int64Array{30},
+			})
+	}
+	return documents
+}
+
+func Test_metadataClassifier_predict(t *testing.T) {
+	classifier := trainMetadataClassifier(classifierTestDocuments())
+	if len(classifier.Keys) != 3 {
+		t.Fatalf("got %d keys, want 3", len(classifier.Keys))
+	}
+
+	// classifier survives serialization
+	data, err := json.Marshal(classifier)
+	if err != nil {
+		t.Fatalf("marshal classifier: %v", err)
+	}
+	classifier = &metadataClassifier{}
+	err = json.Unmarshal(data, classifier)
+	if err != nil {
+		t.Fatalf("unmarshal classifier: %v", err)
+	}
+	classifier.setVocabulary()
+
+	tests := []struct {
+		name string
+		text string
+		want map[int]int
+	}{
+		{"acme invoice", "Invoice from Acme for electricity", map[int]int{1: 10, 2: 20}},
+		{"globex invoice", "Your Globex internet invoice", map[int]int{1: 11, 2: 20}},
+		{"meeting notes", "Board meeting notes: renovation budget", map[int]int{3: 30}},
+		{"unknown words", "lorem ipsum", map[int]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[int]int)
+			for _, v := range classifier.predict(tt.text) {
+				if v.Confidence > 0.6 {
+					got[v.KeyId] = v.ValueId
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("predict() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_trainMetadataClassifierExcludedKeys(t *testing.T) {
+	documents := classifierTestDocuments()
+	// value of key 1 was added to two notes by the classifier and has not been confirmed
+	documents[2].ExcludedKeyIds = pq.Int64Array{1}
+	documents[5].ExcludedKeyIds = pq.Int64Array{1}
+	classifier := trainMetadataClassifier(documents)
+	if got := classifier.Keys[1].Classes[classifierNoValue].Documents; got != 3 {
+		t.Errorf("key 1 has %d documents without value, want 3", got)
+	}
+	if got := classifier.Keys[3].Classes[classifierNoValue].Documents; got != 10 {
+		t.Errorf("key 3 has %d documents without value, want 10", got)
+	}
+}
+
+func Test_metadataSatisfiesConstraints(t *testing.T) {
+	keys := []models.MetadataKey{{Id: 1}, {Id: 2, RequiredWhenKeyId: 1, RequiredWhenValueId: 10}}
+	if metadataSatisfiesConstraints(keys, nil, models.Metadata{KeyId: 1, ValueId: 10}) {
+		t.Errorf("value 10 is accepted without required key 2")
+	}
+	if !metadataSatisfiesConstraints(keys, []models.Metadata{{KeyId: 2, ValueId: 20}}, models.Metadata{KeyId: 1, ValueId: 10}) {
+		t.Errorf("value 10 is rejected with required key 2")
+	}
+	if !metadataSatisfiesConstraints(keys, nil, models.Metadata{KeyId: 1, ValueId: 11}) {
+		t.Errorf("value 11 is rejected")
+	}
+}
+
+func Test_selectSuggestions(t *testing.T) {
+	doc := &models.Document{Id: "doc", Metadata: []models.Metadata{{KeyId: 2, ValueId: 20}}}
+	keys := []models.MetadataKey{{Id: 1, SingleValue: true}, {Id: 2, SingleValue: true}, {Id: 3}}
+	predictions := []classifierPrediction{
+		{KeyId: 1, ValueId: 10, Confidence: 0.99},
+		{KeyId: 1, ValueId: 11, Confidence: 0.98},
+		{KeyId: 2, ValueId: 21, Confidence: 0.97},
+		{KeyId: 3, ValueId: 30, Confidence: 0.96},
+		{KeyId: 3, ValueId: 31, Confidence: 0.8},
+		{KeyId: 3, ValueId: 32, Confidence: 0.7},
+		{KeyId: 3, ValueId: 33, Confidence: 0.2},
+	}
+
+	got := selectSuggestions(doc, predictions, []int{32}, keys, 0.95, 0.6)
+	want := []models.MetadataSuggestion{
+		{DocumentId: "doc", KeyId: 1, ValueId: 10, Confidence: 0.99, Status: models.MetadataSuggestionAccepted, Automatic: true},
+		{DocumentId: "doc", KeyId: 3, ValueId: 30, Confidence: 0.96, Status: models.MetadataSuggestionAccepted, Automatic: true},
+		{DocumentId: "doc", KeyId: 3, ValueId: 31, Confidence: 0.8, Status: models.MetadataSuggestionPending},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("selectSuggestions() = %v, want %v", got, want)
+	}
+}
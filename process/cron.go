@@ -6,22 +6,33 @@ import (
 	"github.com/sirupsen/logrus"
 	"time"
 	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
 	"tryffel.net/go/virtualpaper/storage"
 )
 
 type CronJobs struct {
-	c  *cron.Cron
-	db *storage.Database
+	c      *cron.Cron
+	db     *storage.Database
+	search DocumentSearcher
 
 	removeExpiredPasswordPresets cron.EntryID
 	removeExpiredAuthTokens      cron.EntryID
 	cleanupDocumenTrashbins      cron.EntryID
+	runScheduledRules            cron.EntryID
+	trainMetadataClassifiers     cron.EntryID
 }
 
-func NewCron(db *storage.Database) (*CronJobs, error) {
+const (
+	defaultRulesSchedule      = "0 2 * * *"
+	defaultClassifierSchedule = "0 3 * * *"
+)
+
+func NewCron(db *storage.Database, search DocumentSearcher) (*CronJobs, error) {
 	cj := &CronJobs{
-		c:  cron.New(),
-		db: db,
+		c:      cron.New(),
+		db:     db,
+		search: search,
 	}
 	var err error
 	cj.removeExpiredPasswordPresets, err = cj.c.AddFunc("*/15 * * * *", cj.JobRemoveExpiredPasswordResets)
@@ -36,6 +47,22 @@ func NewCron(db *storage.Database) (*CronJobs, error) {
 	if err != nil {
 		return cj, fmt.Errorf("create removeExpiredAuthTokens job: %v", err)
 	}
+	rulesSchedule := config.C.CronJobs.RulesSchedule
+	if rulesSchedule == "" {
+		rulesSchedule = defaultRulesSchedule
+	}
+	cj.runScheduledRules, err = cj.c.AddFunc(rulesSchedule, cj.JobRunScheduledRules)
+	if err != nil {
+		return cj, fmt.Errorf("create runScheduledRules job: %v", err)
+	}
+	classifierSchedule := config.C.CronJobs.ClassifierSchedule
+	if classifierSchedule == "" {
+		classifierSchedule = defaultClassifierSchedule
+	}
+	cj.trainMetadataClassifiers, err = cj.c.AddFunc(classifierSchedule, cj.JobTrainMetadataClassifiers)
+	if err != nil {
+		return cj, fmt.Errorf("create trainMetadataClassifiers job: %v", err)
+	}
 	return cj, nil
 }
 
@@ -139,6 +166,67 @@ func (c *CronJobs) JobCleanupDocumenTrashbins() {
 	logCronOp(action, deletedCount == len(documentsToDelete))
 }
 
+func (c *CronJobs) JobRunScheduledRules() {
+	defer c.recover()
+	action := "run scheduled rules"
+	users, err := c.db.RuleStore.GetUsersWithActiveRules(models.RuleTriggerSchedule)
+	if err != nil {
+		logCronOp(action, false).Error(err)
+		return
+	}
+
+	ok := true
+	for _, userId := range users {
+		documents, err := c.db.DocumentStore.GetUserDocumentIds(userId)
+		if err != nil {
+			logrus.Errorf("get documents of user %d: %v", userId, err)
+			ok = false
+			continue
+		}
+		logrus.Debugf("run scheduled rules for user %d, %d documents", userId, len(documents))
+		changed, err := RunTriggeredRules(c.db, c.search, userId, documents, models.RuleTriggerSchedule)
+		if err != nil {
+			logrus.Errorf("run scheduled rules for user %d: %v", userId, err)
+			ok = false
+		}
+		if len(changed) > 0 {
+			logrus.Infof("scheduled rules changed %d documents of user %d", len(changed), userId)
+		}
+	}
+	logCronOp(action, ok).Infof("ran scheduled rules for %d users", len(users))
+}
+
+func (c *CronJobs) JobTrainMetadataClassifiers() {
+	defer c.recover()
+	action := "train metadata classifiers"
+	if config.C.Processing.ClassifierDisabled {
+		logrus.Debugf("metadata classifier is disabled, skip training")
+		return
+	}
+	users, err := c.db.MetadataStore.GetUsersWithDocumentMetadata()
+	if err != nil {
+		logCronOp(action, false).Error(err)
+		return
+	}
+
+	ok := true
+	trained := 0
+	for _, userId := range users {
+		_, err := TrainMetadataClassifier(c.db, userId)
+		if errors.Is(err, errors.ErrInvalid) {
+			logrus.Debugf("skip training metadata classifier for user %d: %v", userId, err)
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("train metadata classifier for user %d: %v", userId, err)
+			ok = false
+			continue
+		}
+		trained += 1
+	}
+	logCronOp(action, ok).Infof("trained metadata classifiers for %d users", trained)
+}
+
 func (c *CronJobs) deleteDocument(docId string) error {
 	err := DeleteDocument(docId)
 	if err != nil {
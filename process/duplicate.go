@@ -0,0 +1,243 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+const (
+	// minimum number of words in content to calculate content hash.
+	simhashMinTokens = 20
+	// maximum hamming distance between content hashes of duplicate documents.
+	duplicateContentDistance = 5
+	// maximum hamming distance between image hashes of duplicate documents, if content is not available.
+	duplicateImageDistance = 4
+	// maximum hamming distance between image hashes, when content hashes match. Scans of same document
+	// may have different margins or contrast, so this is more relaxed.
+	duplicateImageDistanceWithContent = 16
+)
+
+func (fp *fileProcessor) findDuplicates() error {
+	process := &models.ProcessItem{
+		DocumentId: fp.document.Id,
+		Step:       models.ProcessDuplicates,
+		CreatedAt:  time.Now(),
+	}
+
+	job, err := fp.db.JobStore.StartProcessItem(process, "find duplicates")
+	if err != nil {
+		return fmt.Errorf("persist process item: %v", err)
+	}
+	defer fp.completeProcessingStep(process, job)
+
+	fingerprint := &models.DocumentFingerprint{DocumentId: fp.document.Id}
+	if hash, ok := contentSimhash(fp.document.Content); ok {
+		fingerprint.ContentHash = sql.NullInt64{Int64: int64(hash), Valid: true}
+	}
+	hash, err := thumbnailHash(storage.PreviewPath(fp.document.Id))
+	if err != nil {
+		fp.Warn("calculate thumbnail hash: %v", err)
+	} else {
+		fingerprint.ImageHash = sql.NullInt64{Int64: int64(hash), Valid: true}
+	}
+
+	err = fp.db.DocumentStore.SetDocumentFingerprint(fingerprint)
+	if err != nil {
+		job.Status = models.JobFailure
+		job.Message += "; " + err.Error()
+		return fmt.Errorf("save fingerprint: %v", err)
+	}
+
+	fingerprints, err := fp.db.DocumentStore.GetUserFingerprints(fp.document.UserId)
+	if err != nil {
+		job.Status = models.JobFailure
+		job.Message += "; " + err.Error()
+		return fmt.Errorf("get user fingerprints: %v", err)
+	}
+
+	duplicates := make([]models.DocumentDuplicate, 0)
+	for _, v := range *fingerprints {
+		if v.DocumentId == fp.document.Id {
+			continue
+		}
+		if duplicate, ok := compareFingerprints(fingerprint, &v); ok {
+			duplicates = append(duplicates, *duplicate)
+		}
+	}
+
+	err = fp.db.DocumentStore.SetDocumentDuplicates(fp.document.Id, duplicates)
+	if err != nil {
+		job.Status = models.JobFailure
+		job.Message += "; " + err.Error()
+		return fmt.Errorf("save duplicates: %v", err)
+	}
+	if len(duplicates) > 0 {
+		fp.Info("found %d possible duplicates", len(duplicates))
+	}
+	job.Message += fmt.Sprintf("; found %d possible duplicates", len(duplicates))
+	job.Status = models.JobFinished
+	return nil
+}
+
+// compareFingerprints compares document fingerprints and returns duplicate and true, if documents
+// are likely duplicates. Content is preferred over the thumbnail, since thumbnails of
+// documents with same layout, e.g. invoices from same company, are very similar.
+func compareFingerprints(a, b *models.DocumentFingerprint) (*models.DocumentDuplicate, bool) {
+	duplicate := &models.DocumentDuplicate{
+		DocumentId:  a.DocumentId,
+		DuplicateId: b.DocumentId,
+	}
+
+	contentDistance := -1
+	if a.ContentHash.Valid && b.ContentHash.Valid {
+		contentDistance = hammingDistance(uint64(a.ContentHash.Int64), uint64(b.ContentHash.Int64))
+		duplicate.ContentSimilarity = sql.NullFloat64{Float64: hashSimilarity(contentDistance), Valid: true}
+	}
+	imageDistance := -1
+	if a.ImageHash.Valid && b.ImageHash.Valid {
+		imageDistance = hammingDistance(uint64(a.ImageHash.Int64), uint64(b.ImageHash.Int64))
+		duplicate.ImageSimilarity = sql.NullFloat64{Float64: hashSimilarity(imageDistance), Valid: true}
+	}
+
+	switch {
+	case contentDistance >= 0:
+		if contentDistance > duplicateContentDistance {
+			return nil, false
+		}
+		return duplicate, imageDistance < 0 || imageDistance <= duplicateImageDistanceWithContent
+	case imageDistance >= 0:
+		return duplicate, imageDistance <= duplicateImageDistance
+	default:
+		return nil, false
+	}
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// hashSimilarity converts hamming distance of 64-bit hashes to similarity between 0 and 1.
+func hashSimilarity(distance int) float64 {
+	return 1 - float64(distance)/64
+}
+
+// contentSimhash calculates 64-bit simhash from words of the content. Single words are used as features
+// instead of word sequences, since ocr errors in re-scanned documents affect fewer features this way.
+// Returns false if content is too short to calculate a meaningful hash.
+func contentSimhash(content string) (uint64, bool) {
+	tokens := strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(tokens) < simhashMinTokens {
+		return 0, false
+	}
+
+	var weights [64]int
+	for _, token := range tokens {
+		h := fnv.New64a()
+		h.Write([]byte(token))
+		value := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if value&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return hash, true
+}
+
+// thumbnailHash calculates difference hash of the thumbnail file.
+func thumbnailHash(file string) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("open thumbnail: %v", err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("decode thumbnail: %v", err)
+	}
+	return imageDifferenceHash(img), nil
+}
+
+// imageDifferenceHash calculates 64-bit difference hash (dHash) of the image:
+// image is scaled down to 9x8 grayscale pixels and each bit tells whether the brightness
+// increases between horizontally adjacent pixels.
+func imageDifferenceHash(img image.Image) uint64 {
+	const width, height = 9, 8
+	bounds := img.Bounds()
+	var gray [height][width]float64
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			sum := 0.0
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			gray[y][x] = sum / float64((x1-x0)*(y1-y0))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			if gray[y][x] < gray[y][x+1] {
+				hash |= 1 << (y*(width-1) + x)
+			}
+		}
+	}
+	return hash
+}
@@ -0,0 +1,148 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"database/sql"
+	"image"
+	"image/color"
+	"testing"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+const duplicateTestContent = `Dear customer, thank you for your order. Your invoice number 1234 for the month of March
+is attached to this letter. Please pay the total amount of 120.00 EUR to our bank account before the due date.
+If you have any questions regarding this invoice, please contact our customer service.`
+
+func Test_contentSimhash(t *testing.T) {
+	original, ok := contentSimhash(duplicateTestContent)
+	if !ok {
+		t.Fatalf("no hash for content")
+	}
+
+	// ocr result of a re-scan has small differences
+	rescan, _ := contentSimhash(`Dear customer, thank you for your order. Your invoice number 1234 for the rnonth of March
+is attached to this letter. Please pay the total amount of 120.00 EUR to our bank account before the due date.
+If you have any questions regarding this invoice, please contact our customer service`)
+	// different invoice from same sender
+	template, _ := contentSimhash(`Dear customer, thank you for your order. Your invoice number 5678 for the month of April
+is attached to this letter. Please pay the total amount of 80.00 EUR to our bank account before the due date.
+If you have any questions regarding this invoice, please contact our customer service.`)
+	other, _ := contentSimhash(`Meeting notes from the annual board meeting. The board discussed the budget for next
+year and approved the new office lease. Next meeting will be held in the main office in September, all members
+are asked to prepare their reports in advance and send them to the secretary.`)
+
+	if distance := hammingDistance(original, rescan); distance > duplicateContentDistance {
+		t.Errorf("distance to re-scanned content = %d, want <= %d", distance, duplicateContentDistance)
+	}
+	if distance := hammingDistance(original, template); distance <= duplicateContentDistance {
+		t.Errorf("distance to invoice with same template = %d, want > %d", distance, duplicateContentDistance)
+	}
+	if distance := hammingDistance(original, other); distance <= duplicateContentDistance {
+		t.Errorf("distance to other content = %d, want > %d", distance, duplicateContentDistance)
+	}
+
+	if _, ok := contentSimhash("too short content"); ok {
+		t.Errorf("hash for short content")
+	}
+}
+
+func Test_imageDifferenceHash(t *testing.T) {
+	gradient := func(width, height int, offset uint8, reverse bool) image.Image {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for x := 0; x < width; x++ {
+			for y := 0; y < height; y++ {
+				value := uint8(x * 200 / width)
+				if reverse {
+					value = 200 - value
+				}
+				img.SetGray(x, y, color.Gray{Y: value + offset})
+			}
+		}
+		return img
+	}
+
+	original := imageDifferenceHash(gradient(350, 500, 0, false))
+	// scaled and lighter version of the same image
+	scaled := imageDifferenceHash(gradient(175, 250, 40, false))
+	other := imageDifferenceHash(gradient(350, 500, 0, true))
+
+	if distance := hammingDistance(original, scaled); distance > duplicateImageDistance {
+		t.Errorf("distance to scaled image = %d, want <= %d", distance, duplicateImageDistance)
+	}
+	if distance := hammingDistance(original, other); distance <= duplicateImageDistance {
+		t.Errorf("distance to other image = %d, want > %d", distance, duplicateImageDistance)
+	}
+}
+
+func Test_compareFingerprints(t *testing.T) {
+	hash := func(value uint64) sql.NullInt64 {
+		return sql.NullInt64{Int64: int64(value), Valid: true}
+	}
+	tests := []struct {
+		name           string
+		a              models.DocumentFingerprint
+		b              models.DocumentFingerprint
+		want           bool
+		wantSimilarity float64
+	}{
+		{
+			name: "content matches",
+			a:    models.DocumentFingerprint{ContentHash: hash(0xff00), ImageHash: hash(0)},
+			b:    models.DocumentFingerprint{ContentHash: hash(0xff01), ImageHash: hash(0xff)},
+			want: true, wantSimilarity: 1 - 1.0/64,
+		},
+		{
+			name: "content differs, image matches",
+			a:    models.DocumentFingerprint{ContentHash: hash(0xff00), ImageHash: hash(0)},
+			b:    models.DocumentFingerprint{ContentHash: hash(0x00ff), ImageHash: hash(0)},
+			want: false,
+		},
+		{
+			name: "content matches, image differs",
+			a:    models.DocumentFingerprint{ContentHash: hash(0), ImageHash: hash(0)},
+			b:    models.DocumentFingerprint{ContentHash: hash(0), ImageHash: hash(0xffffffff)},
+			want: false,
+		},
+		{
+			name: "no content, image matches",
+			a:    models.DocumentFingerprint{ImageHash: hash(0xf0)},
+			b:    models.DocumentFingerprint{ContentHash: hash(0), ImageHash: hash(0xf1)},
+			want: true,
+		},
+		{
+			name: "no fingerprints",
+			a:    models.DocumentFingerprint{},
+			b:    models.DocumentFingerprint{},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			duplicate, ok := compareFingerprints(&tt.a, &tt.b)
+			if ok != tt.want {
+				t.Errorf("compareFingerprints() = %v, want %v", ok, tt.want)
+			}
+			if ok && tt.wantSimilarity != 0 && duplicate.ContentSimilarity.Float64 != tt.wantSimilarity {
+				t.Errorf("content similarity = %f, want %f", duplicate.ContentSimilarity.Float64, tt.wantSimilarity)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+const (
+	// max size of tiff image that is read into memory for exif.
+	maxExifTiffSize = 64 * 1024 * 1024
+	// max entries to read from single IFD.
+	maxExifIfdEntries = 1000
+	// numeric values with more items than this are not stored as properties.
+	maxExifValueCount = 16
+	// text values longer than this are not stored as properties.
+	maxExifTextLength = 1024
+
+	exifTagExifIfd = 0x8769
+	exifTagGpsIfd  = 0x8825
+
+	exifGpsLatitudeRef  = 0x01
+	exifGpsLatitude     = 0x02
+	exifGpsLongitudeRef = 0x03
+	exifGpsLongitude    = 0x04
+	exifGpsAltitudeRef  = 0x05
+	exifGpsAltitude     = 0x06
+)
+
+var errInvalidExif = errors.New("invalid exif data")
+
+// exif tags that are stored as document properties, named as in the exif specification.
+var exifTagNames = map[uint16]string{
+	// IFD0
+	0x010e: "ImageDescription",
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x8298: "Copyright",
+	// Exif IFD
+	0x829a: "ExposureTime",
+	0x829d: "FNumber",
+	0x8827: "ISOSpeedRatings",
+	0x9000: "ExifVersion",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9010: "OffsetTime",
+	0x9011: "OffsetTimeOriginal",
+	0x9012: "OffsetTimeDigitized",
+	0x9209: "Flash",
+	0x920a: "FocalLength",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+	0xa420: "ImageUniqueID",
+	0xa430: "CameraOwnerName",
+	0xa431: "BodySerialNumber",
+	0xa433: "LensMake",
+	0xa434: "LensModel",
+}
+
+// byte size of each exif value type, indexed by type.
+var exifTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+const (
+	exifTypeAscii     = 2
+	exifTypeUndefined = 7
+)
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count int
+	value []byte
+}
+
+// exifReader reads IFDs from tiff-formatted exif data.
+type exifReader struct {
+	data    []byte
+	order   binary.ByteOrder
+	visited map[uint32]bool
+}
+
+// readExifFile reads exif properties from jpeg, png or tiff image. Other images, or images without
+// exif data, have no properties. Keys are prefixed with 'exif_' and gps location is
+// stored as signed decimal degrees in 'exif_gpslatitude' and 'exif_gpslongitude'.
+func readExifFile(file string) ([]models.DocumentProperty, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+	header, err := reader.Peek(8)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var data []byte
+	switch {
+	case header[0] == 0xff && header[1] == 0xd8:
+		data, err = readJpegExif(reader)
+	case bytes.Equal(header, []byte("\x89PNG\r\n\x1a\n")):
+		data, err = readPngExif(reader)
+	case bytes.Equal(header[:4], []byte("II*\x00")) || bytes.Equal(header[:4], []byte("MM\x00*")):
+		data, err = io.ReadAll(io.LimitReader(reader, maxExifTiffSize))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read exif: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return parseExif(data)
+}
+
+// readJpegExif returns the tiff data of the exif APP1 segment.
+func readJpegExif(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header[:2]); err != nil {
+		return nil, err
+	}
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if header[0] != 0xff {
+			return nil, errInvalidExif
+		}
+		marker := header[1]
+		// start of scan or end of image: no more metadata segments.
+		if marker == 0xda || marker == 0xd9 {
+			return nil, nil
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, errInvalidExif
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return nil, err
+		}
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// readPngExif returns the tiff data of the png eXIf chunk.
+func readPngExif(reader io.Reader) ([]byte, error) {
+	if _, err := io.CopyN(io.Discard, reader, 8); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		chunk := string(header[4:])
+		if chunk == "eXIf" {
+			if length > maxExifTiffSize {
+				return nil, errInvalidExif
+			}
+			data := make([]byte, length)
+			_, err := io.ReadFull(reader, data)
+			return data, err
+		}
+		// exif must be before image data.
+		if chunk == "IDAT" || chunk == "IEND" {
+			return nil, nil
+		}
+		// skip data and crc.
+		if _, err := io.CopyN(io.Discard, reader, length+4); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseExif parses tiff-formatted exif data.
+func parseExif(data []byte) ([]models.DocumentProperty, error) {
+	if len(data) < 8 {
+		return nil, errInvalidExif
+	}
+	r := &exifReader{data: data, visited: map[uint32]bool{}}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return nil, errInvalidExif
+	}
+	if r.order.Uint16(data[2:]) != 42 {
+		return nil, errInvalidExif
+	}
+
+	ifd0, err := r.readIfd(r.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make([]models.DocumentProperty, 0, 20)
+	found := map[string]bool{}
+	add := func(name, value string) {
+		key := "exif_" + normalizePropertyKey(name)
+		if value == "" || found[key] {
+			return
+		}
+		found[key] = true
+		properties = append(properties, models.DocumentProperty{Key: key, Value: value, Source: propertySourceExif})
+	}
+	addEntries := func(entries []exifEntry) {
+		for _, entry := range entries {
+			name, ok := exifTagNames[entry.tag]
+			if ok {
+				add(name, r.formatValue(entry))
+			}
+		}
+	}
+
+	addEntries(ifd0)
+	for _, entry := range ifd0 {
+		if entry.tag != exifTagExifIfd && entry.tag != exifTagGpsIfd {
+			continue
+		}
+		offset, ok := r.uint(entry, 0)
+		if !ok {
+			continue
+		}
+		// broken sub-IFDs are ignored, ifd0 is still valid.
+		entries, err := r.readIfd(uint32(offset))
+		if err != nil {
+			continue
+		}
+		if entry.tag == exifTagExifIfd {
+			addEntries(entries)
+		} else {
+			lat, lon, alt := r.gpsLocation(entries)
+			add("GPSLatitude", lat)
+			add("GPSLongitude", lon)
+			add("GPSAltitude", alt)
+		}
+	}
+	return properties, nil
+}
+
+// readIfd reads entries of IFD at offset.
+func (r *exifReader) readIfd(offset uint32) ([]exifEntry, error) {
+	if r.visited[offset] {
+		return nil, errInvalidExif
+	}
+	r.visited[offset] = true
+
+	start := int64(offset)
+	if start+2 > int64(len(r.data)) {
+		return nil, errInvalidExif
+	}
+	count := int(r.order.Uint16(r.data[start:]))
+	if count > maxExifIfdEntries {
+		return nil, errInvalidExif
+	}
+	start += 2
+	if start+int64(count)*12 > int64(len(r.data)) {
+		return nil, errInvalidExif
+	}
+
+	entries := make([]exifEntry, 0, count)
+	for i := 0; i < count; i++ {
+		raw := r.data[start+int64(i)*12 : start+int64(i+1)*12]
+		entry := exifEntry{
+			tag: r.order.Uint16(raw),
+			typ: r.order.Uint16(raw[2:]),
+		}
+		if int(entry.typ) >= len(exifTypeSizes) || entry.typ == 0 {
+			continue
+		}
+		entry.count = int(r.order.Uint32(raw[4:]))
+		size := int64(exifTypeSizes[entry.typ]) * int64(entry.count)
+		if size <= 4 {
+			entry.value = raw[8 : 8+size]
+		} else {
+			valueOffset := int64(r.order.Uint32(raw[8:]))
+			if valueOffset+size > int64(len(r.data)) {
+				continue
+			}
+			entry.value = r.data[valueOffset : valueOffset+size]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// uint returns nth value of integer entry.
+func (r *exifReader) uint(entry exifEntry, n int) (uint32, bool) {
+	if n >= entry.count {
+		return 0, false
+	}
+	switch entry.typ {
+	case 1:
+		return uint32(entry.value[n]), true
+	case 3:
+		return uint32(r.order.Uint16(entry.value[n*2:])), true
+	case 4:
+		return r.order.Uint32(entry.value[n*4:]), true
+	}
+	return 0, false
+}
+
+// float returns nth value of numeric entry.
+func (r *exifReader) float(entry exifEntry, n int) (float64, bool) {
+	if n >= entry.count {
+		return 0, false
+	}
+	switch entry.typ {
+	case 1, 3, 4:
+		value, ok := r.uint(entry, n)
+		return float64(value), ok
+	case 6:
+		return float64(int8(entry.value[n])), true
+	case 8:
+		return float64(int16(r.order.Uint16(entry.value[n*2:]))), true
+	case 9:
+		return float64(int32(r.order.Uint32(entry.value[n*4:]))), true
+	case 5, 10:
+		num := r.order.Uint32(entry.value[n*8:])
+		den := r.order.Uint32(entry.value[n*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		if entry.typ == 10 {
+			return float64(int32(num)) / float64(int32(den)), true
+		}
+		return float64(num) / float64(den), true
+	case 11:
+		return float64(math.Float32frombits(r.order.Uint32(entry.value[n*4:]))), true
+	case 12:
+		return math.Float64frombits(r.order.Uint64(entry.value[n*8:])), true
+	}
+	return 0, false
+}
+
+// formatValue formats entry as text. Texts are trimmed, numeric values are separated with comma.
+// Binary data is skipped and returns empty string.
+func (r *exifReader) formatValue(entry exifEntry) string {
+	if entry.typ == exifTypeAscii || entry.typ == exifTypeUndefined {
+		if len(entry.value) > maxExifTextLength {
+			return ""
+		}
+		text := strings.TrimSpace(strings.TrimRight(string(entry.value), "\x00"))
+		for _, c := range text {
+			if c < 0x20 || c > 0x7e {
+				return ""
+			}
+		}
+		return text
+	}
+	if entry.count > maxExifValueCount {
+		return ""
+	}
+	values := make([]string, 0, entry.count)
+	for i := 0; i < entry.count; i++ {
+		value, ok := r.float(entry, i)
+		if !ok {
+			return ""
+		}
+		values = append(values, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return strings.Join(values, ", ")
+}
+
+// gpsLocation returns latitude and longitude in signed decimal degrees, and altitude in meters
+// relative to sea level. Missing or invalid values are empty.
+func (r *exifReader) gpsLocation(entries []exifEntry) (lat, lon, alt string) {
+	tags := make(map[uint16]exifEntry, len(entries))
+	for _, entry := range entries {
+		tags[entry.tag] = entry
+	}
+	coordinate := func(tag, refTag uint16, negativeRef string) string {
+		entry, ok := tags[tag]
+		if !ok || entry.count != 3 {
+			return ""
+		}
+		degrees := 0.0
+		for i, divider := range []float64{1, 60, 3600} {
+			value, ok := r.float(entry, i)
+			if !ok {
+				return ""
+			}
+			degrees += value / divider
+		}
+		ref := tags[refTag]
+		if strings.EqualFold(strings.TrimRight(string(ref.value), "\x00"), negativeRef) {
+			degrees = -degrees
+		}
+		return strconv.FormatFloat(degrees, 'f', 6, 64)
+	}
+	lat = coordinate(exifGpsLatitude, exifGpsLatitudeRef, "S")
+	lon = coordinate(exifGpsLongitude, exifGpsLongitudeRef, "W")
+
+	if entry, ok := tags[exifGpsAltitude]; ok {
+		if altitude, ok := r.float(entry, 0); ok {
+			// ref 1 is below sea level.
+			if ref, ok := r.uint(tags[exifGpsAltitudeRef], 0); ok && ref == 1 {
+				altitude = -altitude
+			}
+			alt = strconv.FormatFloat(altitude, 'f', -1, 64)
+		}
+	}
+	return lat, lon, alt
+}
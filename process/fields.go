@@ -0,0 +1,646 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/dateparse"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// confidence levels for extracted fields.
+const (
+	fieldConfidenceBarcode  = 1.0
+	fieldConfidenceChecksum = 0.95
+	fieldConfidenceKeyword  = 0.8
+	fieldConfidencePattern  = 0.85
+	fieldConfidenceGuess    = 0.4
+)
+
+// fieldKeywords are labels that precede field values in document content, in lowercase.
+type fieldKeywords struct {
+	amount    []string
+	dueDate   []string
+	reference []string
+	vatId     []string
+}
+
+var fieldLocales = map[string]fieldKeywords{
+	"en": {
+		amount:    []string{"total amount", "amount due", "total due", "balance due", "grand total", "to pay", "total"},
+		dueDate:   []string{"due date", "payment due", "pay by", "due on"},
+		reference: []string{"reference number", "payment reference", "reference", "ref"},
+		vatId:     []string{"vat number", "vat reg", "vat id", "tax id", "vat"},
+	},
+	"fi": {
+		amount:    []string{"maksettava", "loppusumma", "yhteensä", "summa"},
+		dueDate:   []string{"eräpäivä", "erääntyy", "maksettava viimeistään"},
+		reference: []string{"viitenumero", "viite"},
+		vatId:     []string{"alv-numero", "alv-tunniste", "y-tunnus", "ytunnus"},
+	},
+	"de": {
+		amount:    []string{"gesamtbetrag", "rechnungsbetrag", "zu zahlen", "endbetrag", "summe", "betrag"},
+		dueDate:   []string{"fälligkeitsdatum", "fällig am", "zahlbar bis", "fällig"},
+		reference: []string{"verwendungszweck", "referenz"},
+		vatId:     []string{"ust-idnr", "ust-id", "umsatzsteuer-id", "ust.-id"},
+	},
+	"sv": {
+		amount:    []string{"att betala", "totalt", "summa", "belopp"},
+		dueDate:   []string{"förfallodatum", "förfallodag", "betalas senast"},
+		reference: []string{"ocr-nummer", "referens", "ocr"},
+		vatId:     []string{"momsregistreringsnummer", "momsreg", "vat-nummer"},
+	},
+}
+
+var currencySymbols = map[string]string{
+	"€":  "EUR",
+	"$":  "USD",
+	"£":  "GBP",
+	"KR": "SEK",
+}
+
+var currencyCodes = []string{"EUR", "USD", "GBP", "SEK", "NOK", "DKK", "CHF"}
+
+const currencyPattern = `[€$£]|EUR|USD|GBP|SEK|NOK|DKK|CHF|kr`
+
+var (
+	amountRe = regexp.MustCompile(`(?i)(` + currencyPattern + `)?\s?\b(\d{1,3}(?:[ .,'\x{00a0}]\d{3})+(?:[.,]\d{1,2})?|\d+(?:[.,]\d{1,2})?)\b\s?(` +
+		currencyPattern + `)?`)
+	ibanRe          = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`)
+	rfReferenceRe   = regexp.MustCompile(`\bRF\d{2}(?: ?[A-Z0-9]){1,21}\b`)
+	referenceRe     = regexp.MustCompile(`[A-Z0-9](?:[A-Z0-9 -]{0,33}[A-Z0-9])?`)
+	vatIdRe         = regexp.MustCompile(`\b(ATU\d{8}|BE0?\d{9}|DE\d{9}|DK\d{8}|EE\d{9}|ES[A-Z0-9]\d{7}[A-Z0-9]|FI\d{8}|FR[A-Z0-9]{2}\d{9}|GB\d{9}|IT\d{11}|NL\d{9}B\d{2}|NO\d{9}(?:MVA)?|PL\d{10}|SE\d{12})\b`)
+	businessIdFiRe  = regexp.MustCompile(`\b(\d{7})-(\d)\b`)
+	fieldWhitespace = regexp.MustCompile(`[\s\x{00a0}]+`)
+)
+
+// fieldExtractor extracts structured fields from document content and barcodes.
+type fieldExtractor struct {
+	locales  []fieldKeywords
+	dates    *dateparse.Parser
+	patterns map[string][]*regexp.Regexp
+	fields   map[string]models.DocumentField
+}
+
+func newFieldExtractor(locales []string, patterns map[string][]string) *fieldExtractor {
+	f := &fieldExtractor{
+		locales:  make([]fieldKeywords, 0, len(locales)),
+		patterns: map[string][]*regexp.Regexp{},
+		fields:   map[string]models.DocumentField{},
+	}
+	for _, v := range locales {
+		keywords, ok := fieldLocales[strings.ToLower(v)]
+		if !ok {
+			logrus.Warningf("unknown locale for field extraction: %s", v)
+			continue
+		}
+		f.locales = append(f.locales, keywords)
+	}
+	if len(f.locales) == 0 {
+		f.locales = append(f.locales, fieldLocales["en"])
+	}
+	// day is expected before month, except with 'en' locale
+	dateOptions := dateparse.Options{Order: dateparse.OrderDayMonthYear, Languages: locales}
+	if len(locales) > 0 && strings.ToLower(locales[0]) == "en" {
+		dateOptions.Order = dateparse.OrderMonthDayYear
+	}
+	f.dates = dateparse.NewParser(dateOptions)
+
+	for field, values := range patterns {
+		for _, v := range values {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				logrus.Warningf("invalid pattern for field %s: %v", field, err)
+				continue
+			}
+			if re.NumSubexp() != 1 {
+				logrus.Warningf("pattern for field %s must have exactly one capture group: %s", field, v)
+				continue
+			}
+			f.patterns[strings.ToLower(field)] = append(f.patterns[strings.ToLower(field)], re)
+		}
+	}
+	return f
+}
+
+// extract returns fields ordered by models.AllDocumentFields.
+func (f *fieldExtractor) extract(content string, barcodes []models.DocumentBarcode) []models.DocumentField {
+	for _, v := range barcodes {
+		f.fromBarcode(v.Payload)
+	}
+	f.fromPatterns(content)
+	f.fromContent(content)
+
+	fields := make([]models.DocumentField, 0, len(f.fields))
+	for _, name := range models.AllDocumentFields {
+		if field, ok := f.fields[name]; ok {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// set stores field if there's no field with higher confidence.
+func (f *fieldExtractor) set(name, value string, confidence float64) {
+	if value == "" {
+		return
+	}
+	if old, ok := f.fields[name]; ok && old.Confidence >= confidence {
+		return
+	}
+	f.fields[name] = models.DocumentField{Name: name, Value: value, Confidence: confidence}
+}
+
+// fromBarcode reads payment information from EPC QR code (SEPA credit transfer)
+// or Finnish bank barcode (pankkiviivakoodi).
+func (f *fieldExtractor) fromBarcode(payload string) {
+	lines := strings.Split(strings.ReplaceAll(payload, "\r\n", "\n"), "\n")
+	if len(lines) >= 7 && lines[0] == "BCD" && lines[3] == "SCT" {
+		if iban := normalizeIban(lines[6]); iban != "" {
+			f.set(models.DocumentFieldIban, iban, fieldConfidenceBarcode)
+		}
+		if len(lines) > 7 && len(lines[7]) > 3 {
+			if amount, ok := parseFieldAmount(lines[7][3:]); ok {
+				f.set(models.DocumentFieldCurrency, strings.ToUpper(lines[7][:3]), fieldConfidenceBarcode)
+				f.set(models.DocumentFieldAmount, amount, fieldConfidenceBarcode)
+			}
+		}
+		if len(lines) > 9 {
+			f.set(models.DocumentFieldReference, strings.ReplaceAll(lines[9], " ", ""), fieldConfidenceBarcode)
+		}
+		return
+	}
+
+	if len(payload) != 54 || !isDigits(payload) {
+		return
+	}
+	version := payload[0]
+	if version != '4' && version != '5' {
+		return
+	}
+	if iban := normalizeIban("FI" + payload[1:17]); iban != "" {
+		f.set(models.DocumentFieldIban, iban, fieldConfidenceBarcode)
+	}
+	euros, _ := strconv.Atoi(payload[17:23])
+	cents, _ := strconv.Atoi(payload[23:25])
+	if euros > 0 || cents > 0 {
+		f.set(models.DocumentFieldAmount, fmt.Sprintf("%d.%02d", euros, cents), fieldConfidenceBarcode)
+		f.set(models.DocumentFieldCurrency, "EUR", fieldConfidenceBarcode)
+	}
+	var reference string
+	if version == '4' {
+		reference = strings.TrimLeft(payload[28:48], "0")
+	} else {
+		reference = "RF" + payload[25:27] + strings.TrimLeft(payload[27:48], "0")
+	}
+	f.set(models.DocumentFieldReference, reference, fieldConfidenceBarcode)
+	if payload[48:54] != "000000" {
+		if date, err := time.Parse("060102", payload[48:54]); err == nil {
+			f.set(models.DocumentFieldDueDate, date.Format("2006-01-02"), fieldConfidenceBarcode)
+		}
+	}
+}
+
+// fromPatterns applies user-configured patterns.
+func (f *fieldExtractor) fromPatterns(content string) {
+	for name, patterns := range f.patterns {
+		for _, re := range patterns {
+			match := re.FindStringSubmatch(content)
+			if len(match) != 2 {
+				continue
+			}
+			if value, ok := f.normalize(name, match[1]); ok {
+				f.set(name, value, fieldConfidencePattern)
+				break
+			}
+		}
+	}
+}
+
+// normalize formats raw value for the field. Return false if value is not valid.
+func (f *fieldExtractor) normalize(name, value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	switch name {
+	case models.DocumentFieldAmount:
+		return parseFieldAmount(value)
+	case models.DocumentFieldCurrency:
+		return parseCurrency(value)
+	case models.DocumentFieldIban:
+		iban := normalizeIban(value)
+		return iban, iban != ""
+	case models.DocumentFieldDueDate:
+		date, ok := f.parseDate(value)
+		if !ok {
+			return "", false
+		}
+		return date.Format("2006-01-02"), true
+	case models.DocumentFieldReference, models.DocumentFieldVatId:
+		value = strings.ToUpper(fieldWhitespace.ReplaceAllString(value, ""))
+		return value, value != ""
+	default:
+		return "", false
+	}
+}
+
+func (f *fieldExtractor) fromContent(content string) {
+	lines := strings.Split(content, "\n")
+
+	for _, match := range ibanRe.FindAllString(content, -1) {
+		if iban := normalizeIban(match); iban != "" {
+			f.set(models.DocumentFieldIban, iban, fieldConfidenceChecksum)
+			break
+		}
+	}
+	for _, match := range rfReferenceRe.FindAllString(content, -1) {
+		if reference := normalizeRfReference(match); reference != "" {
+			f.set(models.DocumentFieldReference, reference, fieldConfidenceChecksum)
+			break
+		}
+	}
+	if match := vatIdRe.FindString(content); match != "" {
+		f.set(models.DocumentFieldVatId, match, fieldConfidenceGuess)
+	}
+
+	for _, locale := range f.locales {
+		f.amountFromLines(lines, locale)
+
+		if date, ok := f.dateAfterKeyword(lines, locale.dueDate); ok {
+			f.set(models.DocumentFieldDueDate, date.Format("2006-01-02"), fieldConfidenceKeyword)
+		}
+
+		if text, ok := textAfterKeyword(lines, locale.reference, referenceRe); ok {
+			reference := strings.ReplaceAll(strings.ReplaceAll(text, " ", ""), "-", "")
+			confidence := fieldConfidenceKeyword * 0.75
+			if validFinnishReference(reference) {
+				confidence = fieldConfidenceKeyword
+			}
+			if isDigits(reference) || strings.HasPrefix(reference, "RF") {
+				f.set(models.DocumentFieldReference, reference, confidence)
+			}
+		}
+
+		if text, ok := textAfterKeyword(lines, locale.vatId, vatIdRe); ok {
+			f.set(models.DocumentFieldVatId, text, fieldConfidenceKeyword)
+		} else if text, ok := textAfterKeyword(lines, locale.vatId, businessIdFiRe); ok {
+			if vatId := finnishBusinessIdToVat(text); vatId != "" {
+				f.set(models.DocumentFieldVatId, vatId, fieldConfidenceKeyword)
+			}
+		}
+	}
+
+	if _, ok := f.fields[models.DocumentFieldCurrency]; !ok {
+		for _, match := range amountRe.FindAllStringSubmatch(content, -1) {
+			symbol := match[1] + match[3]
+			if currency, ok := parseCurrency(symbol); ok {
+				f.set(models.DocumentFieldCurrency, currency, fieldConfidenceGuess)
+				break
+			}
+		}
+	}
+}
+
+// amountFromLines finds the total amount by locale keywords. If there are multiple amounts
+// that match keywords, pick the largest one.
+func (f *fieldExtractor) amountFromLines(lines []string, locale fieldKeywords) {
+	var bestAmount float64
+	var best, currency string
+	for i, line := range lines {
+		text, ok := lineAfterKeyword(line, locale.amount)
+		if !ok {
+			continue
+		}
+		matches := amountRe.FindAllStringSubmatch(f.stripDates(text), -1)
+		if len(matches) == 0 && i+1 < len(lines) {
+			matches = amountRe.FindAllStringSubmatch(f.stripDates(lines[i+1]), -1)
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		// total is usually the last amount on the line
+		match := matches[len(matches)-1]
+		value, ok := parseFieldAmount(match[2])
+		if !ok {
+			continue
+		}
+		amount, _ := strconv.ParseFloat(value, 64)
+		if best == "" || amount > bestAmount {
+			bestAmount = amount
+			best = value
+			currency = match[1] + match[3]
+		}
+	}
+
+	if best == "" {
+		return
+	}
+	confidence := fieldConfidenceKeyword * 0.85
+	if c, ok := parseCurrency(currency); ok {
+		confidence = fieldConfidenceKeyword
+		f.set(models.DocumentFieldCurrency, c, fieldConfidenceKeyword)
+	}
+	f.set(models.DocumentFieldAmount, best, confidence)
+}
+
+// parseDate parses due date with user's locales.
+func (f *fieldExtractor) parseDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(fieldWhitespace.ReplaceAllString(value, " "))
+	date, ok := f.dates.Parse(value)
+	if !ok || date.Year() <= 1900 {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// stripDates replaces all dates in text with whitespace.
+func (f *fieldExtractor) stripDates(text string) string {
+	for _, v := range f.dates.FindAll(text) {
+		text = strings.Replace(text, v.Text, " ", 1)
+	}
+	return text
+}
+
+// dateAfterKeyword finds the first line that has a keyword and returns the first date that follows the keyword
+// on the same line or on the next line.
+func (f *fieldExtractor) dateAfterKeyword(lines []string, keywords []string) (time.Time, bool) {
+	for i, line := range lines {
+		text, ok := lineAfterKeyword(line, keywords)
+		if !ok {
+			continue
+		}
+		candidates := []string{text}
+		if i+1 < len(lines) {
+			candidates = append(candidates, lines[i+1])
+		}
+		for _, candidate := range candidates {
+			for _, match := range f.dates.FindAll(candidate) {
+				if match.Date.Year() > 1900 {
+					return match.Date, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// lineAfterKeyword returns the text that follows any of the keywords in line.
+func lineAfterKeyword(line string, keywords []string) (string, bool) {
+	lower := strings.ToLower(line)
+	for _, keyword := range keywords {
+		index := strings.Index(lower, keyword)
+		if index < 0 {
+			continue
+		}
+		// keyword must not be part of another word
+		if index > 0 && isLetter(lower[index-1]) {
+			continue
+		}
+		end := index + len(keyword)
+		if end < len(lower) && isLetter(lower[end]) {
+			continue
+		}
+		if len(lower) == len(line) {
+			return line[end:], true
+		}
+		return lower[end:], true
+	}
+	return "", false
+}
+
+// textAfterKeyword finds the first line that has a keyword and returns text matching re that follows the keyword
+// on the same line or on the next line.
+func textAfterKeyword(lines []string, keywords []string, re *regexp.Regexp) (string, bool) {
+	for i, line := range lines {
+		text, ok := lineAfterKeyword(line, keywords)
+		if !ok {
+			continue
+		}
+		text = strings.TrimLeft(text, " \t:.#")
+		if match := re.FindString(text); match != "" {
+			return strings.TrimSpace(match), true
+		}
+		if i+1 < len(lines) {
+			if match := re.FindString(lines[i+1]); match != "" {
+				return strings.TrimSpace(match), true
+			}
+		}
+	}
+	return "", false
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || c >= 0x80
+}
+
+func isDigits(text string) bool {
+	if text == "" {
+		return false
+	}
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFieldAmount parses amount, e.g. '1 234,50' or '1,234.50', and formats it as '1234.50'.
+// Last separator is a decimal separator if it's followed by 1-2 digits, otherwise all separators
+// are thousand separators.
+func parseFieldAmount(value string) (string, bool) {
+	value = fieldWhitespace.ReplaceAllString(strings.TrimSpace(value), "")
+	value = strings.ReplaceAll(value, "'", "")
+	if value == "" {
+		return "", false
+	}
+
+	decimalIndex := strings.LastIndexAny(value, ".,")
+	if decimalIndex >= 0 {
+		decimals := len(value) - decimalIndex - 1
+		if decimals == 0 || decimals > 2 {
+			decimalIndex = -1
+		}
+	}
+
+	var integer, fraction string
+	if decimalIndex >= 0 {
+		integer = value[:decimalIndex]
+		fraction = value[decimalIndex+1:]
+	} else {
+		integer = value
+	}
+	integer = strings.NewReplacer(".", "", ",", "").Replace(integer)
+	amount, err := strconv.ParseFloat(integer+"."+fraction+"0", 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatFloat(amount, 'f', 2, 64), true
+}
+
+func parseCurrency(value string) (string, bool) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return "", false
+	}
+	if currency, ok := currencySymbols[value]; ok {
+		return currency, true
+	}
+	for _, v := range currencyCodes {
+		if v == value {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// iban lengths for SEPA countries.
+var ibanLengths = map[string]int{
+	"AD": 24, "AT": 20, "BE": 16, "BG": 22, "CH": 21, "CY": 28, "CZ": 24, "DE": 22, "DK": 18,
+	"EE": 20, "ES": 24, "FI": 18, "FR": 27, "GB": 22, "GI": 23, "GR": 27, "HR": 21, "HU": 28,
+	"IE": 22, "IS": 26, "IT": 27, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MT": 31,
+	"NL": 18, "NO": 15, "PL": 28, "PT": 25, "RO": 24, "SE": 24, "SI": 19, "SK": 24, "SM": 27,
+}
+
+// normalizeIban removes whitespace from iban. If iban is not valid, return empty string.
+// Text that continues after the iban is trimmed away.
+func normalizeIban(value string) string {
+	value = strings.ToUpper(fieldWhitespace.ReplaceAllString(value, ""))
+	if len(value) < 2 {
+		return ""
+	}
+	length, ok := ibanLengths[value[:2]]
+	if !ok || len(value) < length {
+		return ""
+	}
+	iban := value[:length]
+	if !validIso7064(iban[4:] + iban[:4]) {
+		return ""
+	}
+	return iban
+}
+
+// normalizeRfReference removes whitespace from RF creditor reference. If reference is not valid,
+// return empty string.
+func normalizeRfReference(value string) string {
+	value = strings.ToUpper(fieldWhitespace.ReplaceAllString(value, ""))
+	for length := len(value); length >= 5; length-- {
+		reference := value[:length]
+		if validIso7064(reference[4:] + reference[:4]) {
+			return reference
+		}
+	}
+	return ""
+}
+
+// validIso7064 validates mod 97-10 checksum that is used in iban and RF-references.
+// Letters are converted to numbers, A=10, B=11...
+func validIso7064(value string) bool {
+	digits := strings.Builder{}
+	for _, c := range value {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			digits.WriteString(strconv.Itoa(int(c-'A') + 10))
+		default:
+			return false
+		}
+	}
+	number, ok := new(big.Int).SetString(digits.String(), 10)
+	if !ok {
+		return false
+	}
+	return new(big.Int).Mod(number, big.NewInt(97)).Int64() == 1
+}
+
+// validFinnishReference validates the check digit of Finnish national reference number.
+func validFinnishReference(value string) bool {
+	if len(value) < 4 || len(value) > 20 || !isDigits(value) {
+		return false
+	}
+	weights := []int{7, 3, 1}
+	sum := 0
+	body := value[:len(value)-1]
+	for i := 0; i < len(body); i++ {
+		sum += int(body[len(body)-1-i]-'0') * weights[i%3]
+	}
+	check := (10 - sum%10) % 10
+	return check == int(value[len(value)-1]-'0')
+}
+
+// finnishBusinessIdToVat converts Finnish business id '1234567-8' into vat id 'FI12345678'.
+// If business id is not valid, return empty string.
+func finnishBusinessIdToVat(value string) string {
+	match := businessIdFiRe.FindStringSubmatch(value)
+	if len(match) != 3 {
+		return ""
+	}
+	weights := []int{7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i := range match[1] {
+		sum += int(match[1][i]-'0') * weights[i]
+	}
+	check := sum % 11
+	if check == 1 {
+		return ""
+	}
+	if check > 1 {
+		check = 11 - check
+	}
+	if strconv.Itoa(check) != match[2] {
+		return ""
+	}
+	return "FI" + match[1] + match[2]
+}
+
+// extractFields extracts structured fields from document content and barcodes and stores them.
+func (fp *fileProcessor) extractFields() error {
+	process := &models.ProcessItem{
+		DocumentId: fp.document.Id,
+		Step:       models.ProcessFields,
+		CreatedAt:  time.Now(),
+	}
+
+	job, err := fp.db.JobStore.StartProcessItem(process, "extract fields")
+	if err != nil {
+		return fmt.Errorf("start process: %v", err)
+	}
+	defer fp.completeProcessingStep(process, job)
+
+	extractor := newFieldExtractor(config.C.Processing.FieldLocales, config.C.Processing.FieldPatterns)
+	fields := extractor.extract(fp.document.Content, fp.document.Barcodes)
+
+	err = fp.db.DocumentStore.SetDocumentFields(fp.document.Id, fields)
+	if err != nil {
+		job.Message += "; save fields: " + err.Error()
+		job.Status = models.JobFailure
+		return fmt.Errorf("save document fields: %v", err)
+	}
+	fp.document.Fields = fields
+	fp.Debug("found %d fields", len(fields))
+	job.Status = models.JobFinished
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"reflect"
+	"testing"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_parseFieldAmount(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   string
+		wantOk bool
+	}{
+		{"1234", "1234.00", true},
+		{"1 234,50", "1234.50", true},
+		{"1.234,50", "1234.50", true},
+		{"1,234.50", "1234.50", true},
+		{"1,234", "1234.00", true},
+		{"12,5", "12.50", true},
+		{"abc", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseFieldAmount(tt.value)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseFieldAmount() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_checksums(t *testing.T) {
+	if got := normalizeIban("FI21 1234 5600 0007 85 Nordea"); got != "FI2112345600000785" {
+		t.Errorf("normalizeIban() = %s, want FI2112345600000785", got)
+	}
+	if got := normalizeIban("FI21 1234 5600 0007 86"); got != "" {
+		t.Errorf("normalizeIban() with invalid checksum = %s, want empty", got)
+	}
+	if got := normalizeRfReference("RF18 5390 0754 7034"); got != "RF18539007547034" {
+		t.Errorf("normalizeRfReference() = %s, want RF18539007547034", got)
+	}
+	if !validFinnishReference("12345672") {
+		t.Errorf("valid finnish reference was not accepted")
+	}
+	if validFinnishReference("12345673") {
+		t.Errorf("invalid finnish reference was accepted")
+	}
+	if got := finnishBusinessIdToVat("0112038-9"); got != "FI01120389" {
+		t.Errorf("finnishBusinessIdToVat() = %s, want FI01120389", got)
+	}
+	if got := finnishBusinessIdToVat("0112038-8"); got != "" {
+		t.Errorf("finnishBusinessIdToVat() with invalid check digit = %s, want empty", got)
+	}
+}
+
+func Test_fieldExtractor_extract(t *testing.T) {
+	tests := []struct {
+		name     string
+		locales  []string
+		patterns map[string][]string
+		content  string
+		barcodes []models.DocumentBarcode
+		want     map[string]string
+	}{
+		{
+			name:    "english invoice",
+			locales: []string{"en"},
+			content: `Acme Ltd
+VAT number: GB123456789
+Invoice date: 01/10/2023
+Subtotal 100.00
+VAT 20% 20.00
+Total 120.00 EUR
+Due date: 01/31/2023
+IBAN: FI21 1234 5600 0007 85
+Reference: RF18 5390 0754 7034`,
+			want: map[string]string{
+				models.DocumentFieldAmount:    "120.00",
+				models.DocumentFieldCurrency:  "EUR",
+				models.DocumentFieldIban:      "FI2112345600000785",
+				models.DocumentFieldReference: "RF18539007547034",
+				models.DocumentFieldDueDate:   "2023-01-31",
+				models.DocumentFieldVatId:     "GB123456789",
+			},
+		},
+		{
+			name:    "finnish invoice",
+			locales: []string{"fi"},
+			content: `Y-tunnus 0112038-9
+Eräpäivä 15.2.2023
+Viitenumero 1234 5672
+Yhteensä
+1 234,50 €`,
+			want: map[string]string{
+				models.DocumentFieldAmount:    "1234.50",
+				models.DocumentFieldCurrency:  "EUR",
+				models.DocumentFieldReference: "12345672",
+				models.DocumentFieldDueDate:   "2023-02-15",
+				models.DocumentFieldVatId:     "FI01120389",
+			},
+		},
+		{
+			name:    "german invoice",
+			locales: []string{"de"},
+			content: `USt-IdNr.: DE123456789
+Rechnungsbetrag: 99,90 EUR
+Zahlbar bis 3. März 2023`,
+			want: map[string]string{
+				models.DocumentFieldAmount:   "99.90",
+				models.DocumentFieldCurrency: "EUR",
+				models.DocumentFieldVatId:    "DE123456789",
+				models.DocumentFieldDueDate:  "2023-03-03",
+			},
+		},
+		{
+			name:    "finnish bank barcode",
+			locales: []string{"en"},
+			content: "Total 1.00",
+			barcodes: []models.DocumentBarcode{
+				{Page: 1, Type: "CODE-128", Payload: "479440520200360820048831500000000868516259619897100612"},
+			},
+			want: map[string]string{
+				models.DocumentFieldAmount:    "4883.15",
+				models.DocumentFieldCurrency:  "EUR",
+				models.DocumentFieldIban:      "FI7944052020036082",
+				models.DocumentFieldReference: "868516259619897",
+				models.DocumentFieldDueDate:   "2010-06-12",
+			},
+		},
+		{
+			name:    "epc qr code",
+			locales: []string{"en"},
+			barcodes: []models.DocumentBarcode{
+				{Page: 1, Type: "QR-Code", Payload: "BCD\n002\n1\nSCT\nBIC\nAcme\nFI2112345600000785\nEUR12.30\n\nRF18539007547034"},
+			},
+			want: map[string]string{
+				models.DocumentFieldAmount:    "12.30",
+				models.DocumentFieldCurrency:  "EUR",
+				models.DocumentFieldIban:      "FI2112345600000785",
+				models.DocumentFieldReference: "RF18539007547034",
+			},
+		},
+		{
+			name:     "custom pattern",
+			locales:  []string{"en"},
+			patterns: map[string][]string{"reference": {`Our ref\.?\s*(\d+)`}},
+			content:  "Our ref. 4455",
+			want: map[string]string{
+				models.DocumentFieldReference: "4455",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extractor := newFieldExtractor(tt.locales, tt.patterns)
+			fields := extractor.extract(tt.content, tt.barcodes)
+			got := map[string]string{}
+			for _, v := range fields {
+				got[v.Name] = v.Value
+				if v.Confidence <= 0 || v.Confidence > 1 {
+					t.Errorf("field %s has invalid confidence: %f", v.Name, v.Confidence)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extract() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
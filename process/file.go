@@ -388,6 +388,7 @@ func (fp *fileProcessor) createNewDocumentRecordV0() error {
 		Content:  "",
 		Filename: fileName,
 		Date:     time.Now(),
+		Source:   models.DocumentSourceInputDir,
 	}
 	doc.UpdatedAt = time.Now()
 	doc.CreatedAt = time.Now()
@@ -456,6 +457,18 @@ func (fp *fileProcessor) indexSearchContent() error {
 		return errors.New("no search engine available")
 	}
 
+	if fp.document.DeletedAt.Valid {
+		// e.g. rule moved the document to trash
+		err = fp.search.DeleteDocument(fp.document.Id, fp.document.UserId)
+		if err != nil {
+			job.Message += "; " + err.Error()
+			job.Status = models.JobFailure
+		} else {
+			job.Status = models.JobFinished
+		}
+		return nil
+	}
+
 	err = fp.search.IndexDocuments(&[]models.Document{*fp.document}, fp.document.UserId)
 	if err != nil {
 		job.Message += "; " + err.Error()
@@ -124,6 +124,11 @@ func (m *Manager) Start() error {
 		task.Start()
 	}
 
+	err := m.db.JobStore.CancelRunningBulkOperations()
+	if err != nil {
+		logrus.Errorf("cancel old bulk operations: %v", err)
+	}
+
 	f := func() {
 		m.lock.Lock()
 		m.running = true
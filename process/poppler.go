@@ -26,6 +26,8 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 	"tryffel.net/go/virtualpaper/config"
 	"tryffel.net/go/virtualpaper/storage"
@@ -121,3 +123,68 @@ func removeTempData(path string) {
 		}
 	}
 }
+
+// getPdfInfo returns raw output of pdfinfo for given file. Dates are formatted in ISO-8601.
+func getPdfInfo(file string) (string, error) {
+	if config.C.Processing.PdfInfoBin == "" {
+		return "", errors.New("no pdfinfo binary set")
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(config.C.Processing.PdfInfoBin, "-isodates", file)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("run pdfinfo: %v, stderr: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// popplerBin returns path for poppler-utils binary, which is expected to be located in the same directory
+// as pdftotext.
+func popplerBin(name string) string {
+	if config.C.Processing.PdfToTextBin == "" {
+		return ""
+	}
+	return path.Join(path.Dir(config.C.Processing.PdfToTextBin), name)
+}
+
+func callPoppler(name string, args ...string) error {
+	bin := popplerBin(name)
+	if bin == "" {
+		return fmt.Errorf("%s not installed", name)
+	}
+	stderr := &bytes.Buffer{}
+	logrus.Debugf("call %s: %v", bin, args)
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("run %s: %v, stderr: %s", name, err, stderr.String())
+	}
+	return nil
+}
+
+// extractPdfPages copies pages firstPage..lastPage (starting from 1) of input into new pdf file output.
+func extractPdfPages(input string, firstPage, lastPage int, output string) error {
+	dir, err := os.MkdirTemp(config.C.Processing.TmpDir, "split")
+	if err != nil {
+		return fmt.Errorf("create tmp dir: %v", err)
+	}
+	defer removeTempData(dir)
+
+	err = callPoppler("pdfseparate", "-f", fmt.Sprint(firstPage), "-l", fmt.Sprint(lastPage),
+		input, path.Join(dir, "page-%d.pdf"))
+	if err != nil {
+		return err
+	}
+
+	args := make([]string, 0, lastPage-firstPage+2)
+	for i := firstPage; i <= lastPage; i++ {
+		args = append(args, filepath.Join(dir, fmt.Sprintf("page-%d.pdf", i)))
+	}
+	args = append(args, output)
+	return callPoppler("pdfunite", args...)
+}
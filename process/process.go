@@ -5,6 +5,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"os"
 	"time"
+	"tryffel.net/go/virtualpaper/dateparse"
 	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
 	"tryffel.net/go/virtualpaper/storage"
@@ -19,6 +20,14 @@ func (fp *fileProcessor) completeProcessingStep(process *models.ProcessItem, job
 	switch process.Step {
 	case models.ProcessThumbnail:
 		removeStep = true
+	case models.ProcessBarcodes:
+		removeStep = true
+	case models.ProcessProperties:
+		removeStep = true
+	case models.ProcessFields:
+		removeStep = true
+	case models.ProcessDuplicates:
+		removeStep = true
 	case models.ProcessRules:
 		removeStep = true
 	case models.ProcessFts:
@@ -104,6 +113,27 @@ func (fp *fileProcessor) processDocument() {
 		fp.document.Tags = *tags
 	}
 
+	properties, err := fp.db.DocumentStore.GetDocumentProperties(fp.document.Id)
+	if err != nil {
+		logrus.Errorf("get document properties before processing: %v", err)
+	} else {
+		fp.document.Properties = *properties
+	}
+
+	barcodes, err := fp.db.DocumentStore.GetDocumentBarcodes(fp.document.Id)
+	if err != nil {
+		logrus.Errorf("get document barcodes before processing: %v", err)
+	} else {
+		fp.document.Barcodes = *barcodes
+	}
+
+	fields, err := fp.db.DocumentStore.GetDocumentFields(fp.document.Id)
+	if err != nil {
+		logrus.Errorf("get document fields before processing: %v", err)
+	} else {
+		fp.document.Fields = *fields
+	}
+
 	defer fp.cleanup()
 
 	for _, step := range *pendingSteps {
@@ -138,6 +168,24 @@ func (fp *fileProcessor) processDocument() {
 				logrus.Errorf("generate thumbnail: %v", err)
 				return
 			}
+		case models.ProcessBarcodes:
+			err = fp.ensureFileOpenAndLogFailure()
+			if err != nil {
+				err = fp.cancelDocumentProcessing("file not found")
+				if err != nil {
+					logrus.Errorf("cancel document processing: %v", err)
+				}
+				return
+			}
+			split, err := fp.decodeBarcodes()
+			if err != nil {
+				// barcodes are not required for rest of the processing
+				logrus.Errorf("decode barcodes: %v", err)
+			}
+			if split {
+				fp.Info("document was split into new documents, stop processing")
+				return
+			}
 		case models.ProcessParseContent:
 			err = fp.ensureFileOpenAndLogFailure()
 			if err != nil {
@@ -152,6 +200,32 @@ func (fp *fileProcessor) processDocument() {
 				logrus.Errorf("parse content: %v", err)
 				return
 			}
+		case models.ProcessProperties:
+			err = fp.ensureFileOpenAndLogFailure()
+			if err != nil {
+				err = fp.cancelDocumentProcessing("file not found")
+				if err != nil {
+					logrus.Errorf("cancel document processing: %v", err)
+				}
+				return
+			}
+			err := fp.extractProperties()
+			if err != nil {
+				// properties are not required for rest of the processing
+				logrus.Errorf("extract properties: %v", err)
+			}
+		case models.ProcessFields:
+			err := fp.extractFields()
+			if err != nil {
+				// fields are not required for rest of the processing
+				logrus.Errorf("extract fields: %v", err)
+			}
+		case models.ProcessDuplicates:
+			err := fp.findDuplicates()
+			if err != nil {
+				// duplicates are not required for rest of the processing
+				logrus.Errorf("find duplicates: %v", err)
+			}
 		case models.ProcessRules:
 			err := fp.runRules()
 			if err != nil {
@@ -175,7 +249,7 @@ func (fp *fileProcessor) runRules() error {
 		return errors.New("no document set")
 	}
 
-	rules, err := fp.db.RuleStore.GetActiveUserRules(fp.document.UserId)
+	rules, err := fp.db.RuleStore.GetActiveUserRules(fp.document.UserId, models.RuleTriggerProcessing)
 	if err != nil {
 		return fmt.Errorf("load rules: %v", err)
 	}
@@ -195,13 +269,41 @@ func (fp *fileProcessor) runRules() error {
 		defer fp.completeProcessingStep(process, job)
 	}
 
+	// changes made by metadata matching are saved without rule
+	original := snapshotDocument(fp.document)
+	history := make([]models.DocumentHistory, 0)
+
 	metadataValues, err := fp.db.MetadataStore.GetUserValuesWithMatching(fp.document.UserId)
 	if err != nil {
 		logrus.Errorf("get metadata values with matching for user %d: %v", fp.document.UserId, err)
 	} else if len(*metadataValues) != 0 {
-		err = matchMetadata(fp.document, metadataValues)
+		keys, err := fp.db.MetadataStore.GetUserKeysCached(fp.document.UserId)
+		if err != nil {
+			logrus.Errorf("get metadata keys of user %d: %v", fp.document.UserId, err)
+		} else {
+			err = matchMetadata(fp.document, metadataValues, *keys)
+			if err != nil {
+				logrus.Errorf("match metadata for document %s: %v", fp.document.Id, err)
+			}
+		}
+	}
+	err = suggestMetadata(fp.db, fp.document)
+	if err != nil {
+		logrus.Errorf("suggest metadata for document %s: %v", fp.document.Id, err)
 	}
+	history = append(history, models.MetadataDiff(fp.document.Id, storage.UserIdInternal, &original.Metadata, &fp.document.Metadata)...)
 
+	dateOptions, err := fp.db.UserStore.GetDateOptions(fp.document.UserId)
+	if err != nil {
+		logrus.Errorf("get date preferences for user %d: %v", fp.document.UserId, err)
+	}
+	dateParser := dateparse.NewParser(dateOptions)
+
+	// metadata constraints are checked against the metadata before rules
+	beforeRules := snapshotDocument(fp.document)
+	executions := make([]*models.RuleExecution, 0, len(rules))
+	effects := &RuleEffects{}
+	var rulesErr error
 	for i, rule := range rules {
 		logrus.Debugf("(%d.) run user rule %d", i, rule.Id)
 
@@ -216,39 +318,66 @@ func (fp *fileProcessor) runRules() error {
 		}
 
 		runner := NewDocumentRule(fp.document, rule)
-		match, err := runner.Match()
-		if err != nil {
-			logrus.Errorf("match rule (%d): %v", rule.Id, err)
+		runner.DateParser = dateParser
+		runner.Metadata = fp.db.MetadataStore
+		runner.Trigger = models.RuleTriggerProcessing
+		if fp.search != nil {
+			runner.Search = fp.search
 		}
-		if !match {
-			logrus.Debugf("document %s does not match rule: %d", fp.document.Id, rule.Id)
+		execution, changes := runner.Execute()
+		executions = append(executions, execution)
+		history = append(history, changes...)
+		effects.merge(runner.Effects)
+		if execution.Error != "" {
+			rulesErr = fmt.Errorf("rule %d: %s", rule.Id, execution.Error)
+			logrus.Errorf("run rule (%d): %s", rule.Id, execution.Error)
+		} else if execution.Matched {
+			logrus.Debugf("document %s matches rule %d, ran actions", fp.document.Id, rule.Id)
 		} else {
-
-			logrus.Debugf("document %s matches rule %d, run actions", fp.document.Id, rule.Id)
-			err = runner.RunActions()
-			if err != nil {
-				logrus.Errorf("rule (%d) actions: %v", rule.Id, err)
-			}
+			logrus.Debugf("document %s does not match rule: %d", fp.document.Id, rule.Id)
+		}
+		if runner.Stopped {
+			logrus.Debugf("rule %d stopped processing rules for document %s", rule.Id, fp.document.Id)
+			break
 		}
 	}
 
-	if err != nil {
-		logrus.Errorf("run user rules: %v", err)
+	history = enforceRulesMetadataConstraints(fp.db.MetadataStore, fp.document, beforeRules.Metadata, executions, history)
+
+	if rulesErr != nil {
+		logrus.Errorf("run user rules: %v", rulesErr)
 		job.Status = models.JobFailure
 	} else {
 		job.Status = models.JobFinished
 	}
 
-	err = fp.db.DocumentStore.Update(storage.UserIdInternal, fp.document)
+	err = fp.db.DocumentStore.UpdateWithHistory(fp.document, withoutEffectHistory(history))
 	if err != nil {
 		logrus.Errorf("update document (%s) after rules: %v", fp.document.Id, err)
 	}
 
+	err = fp.db.RuleStore.AddRuleExecutions(executions)
+	if err != nil {
+		logrus.Errorf("save rule executions for document %s: %v", fp.document.Id, err)
+	}
+
+	err = applyRuleEffects(fp.db, fp.document, effects)
+	if err != nil {
+		logrus.Errorf("apply rule actions for document %s: %v", fp.document.Id, err)
+	}
+
+	if tagsChanged(history) {
+		err = fp.db.MetadataStore.ReplaceDocumentTags(fp.document.Id, models.TagIds(fp.document.Tags))
+		if err != nil {
+			logrus.Errorf("update document (%s) tags after rules: %v", fp.document.Id, err)
+		}
+	}
+
 	metadata := make([]models.Metadata, len(fp.document.Metadata))
 	for i, _ := range fp.document.Metadata {
 		metadata[i] = fp.document.Metadata[i]
 	}
-	err = fp.db.MetadataStore.UpdateDocumentKeyValues(fp.document.UserId, fp.document.Id, metadata)
+	err = fp.db.MetadataStore.ReplaceDocumentKeyValues(fp.document.Id, metadata)
 	if err != nil {
 		logrus.Errorf("update document metadata after processing rules")
 	} else {
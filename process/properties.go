@@ -0,0 +1,185 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+const (
+	propertySourcePdfInfo = "pdfinfo"
+	propertySourceExif    = "exif"
+)
+
+var propertyKeyRe = regexp.MustCompile(`[\s\-]+`)
+
+// properties that are used for proposing document date, in priority order.
+var datePropertyKeys = []string{"creationdate", "exif_datetimeoriginal", "exif_datetimedigitized", "exif_datetime"}
+
+// layouts that pdfinfo (-isodates) and exif use for dates.
+var propertyDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z07",
+	"2006-01-02T15:04:05",
+	"2006:01:02 15:04:05",
+	"Mon Jan _2 15:04:05 2006 MST",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// normalizePropertyKey formats key to lowercase and replaces whitespace with underscore,
+// e.g. 'PDF version' -> 'pdf_version'.
+func normalizePropertyKey(key string) string {
+	key = strings.TrimSpace(strings.ToLower(key))
+	return propertyKeyRe.ReplaceAllString(key, "_")
+}
+
+// parsePdfInfo parses pdfinfo output that is formatted as 'Key:    value' lines.
+func parsePdfInfo(output string) []models.DocumentProperty {
+	properties := make([]models.DocumentProperty, 0, 20)
+	found := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := normalizePropertyKey(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if key == "" || value == "" || found[key] {
+			continue
+		}
+		found[key] = true
+		properties = append(properties, models.DocumentProperty{Key: key, Value: value, Source: propertySourcePdfInfo})
+	}
+	return properties
+}
+
+// parsePropertyDate tries to parse date from pdfinfo or exif date value.
+func parsePropertyDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range propertyDateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil && !date.IsZero() && date.Year() > 1900 {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// proposeFromProperties sets document name and date from its properties, if the document
+// still has the default values that were set when it was uploaded: name equals filename
+// and date equals upload date. Returns true if document was modified.
+func proposeFromProperties(doc *models.Document) bool {
+	changed := false
+	if doc.Name == doc.Filename {
+		title, ok := doc.GetProperty("title")
+		title = strings.TrimSpace(title)
+		if ok && title != "" && !strings.EqualFold(title, "untitled") && title != doc.Name {
+			doc.Name = title
+			changed = true
+		}
+	}
+
+	if doc.CreatedAt.IsZero() || models.MidnightForDate(doc.Date) == models.MidnightForDate(doc.CreatedAt) {
+		for _, key := range datePropertyKeys {
+			value, ok := doc.GetProperty(key)
+			if !ok {
+				continue
+			}
+			date, ok := parsePropertyDate(value)
+			if !ok || date.After(time.Now()) {
+				continue
+			}
+			if models.MidnightForDate(date) != models.MidnightForDate(doc.Date) {
+				doc.Date = date
+				changed = true
+			}
+			break
+		}
+	}
+	return changed
+}
+
+// extractProperties reads file properties (pdfinfo for pdf files, exif for images), stores them
+// and proposes document name and date from them.
+func (fp *fileProcessor) extractProperties() error {
+	process := &models.ProcessItem{
+		DocumentId: fp.document.Id,
+		Step:       models.ProcessProperties,
+		CreatedAt:  time.Now(),
+	}
+
+	job, err := fp.db.JobStore.StartProcessItem(process, "extract file properties")
+	if err != nil {
+		return fmt.Errorf("start process: %v", err)
+	}
+	defer fp.completeProcessingStep(process, job)
+
+	var output, source string
+	var properties []models.DocumentProperty
+	if fp.document.IsPdf() {
+		if config.C.Processing.PdfInfoBin == "" {
+			job.Message += "; pdfinfo not installed, skipping"
+			job.Status = models.JobFinished
+			return nil
+		}
+		source = propertySourcePdfInfo
+		output, err = getPdfInfo(fp.rawFile.Name())
+		properties = parsePdfInfo(output)
+	} else if fp.document.IsImage() {
+		source = propertySourceExif
+		properties, err = readExifFile(fp.rawFile.Name())
+	} else {
+		job.Message += fmt.Sprintf("; no properties for mimetype %s", fp.document.Mimetype)
+		job.Status = models.JobFinished
+		return nil
+	}
+
+	if err != nil {
+		job.Message += "; " + err.Error()
+		job.Status = models.JobFailure
+		return fmt.Errorf("read file properties: %v", err)
+	}
+
+	err = fp.db.DocumentStore.SetDocumentProperties(fp.document.Id, source, properties)
+	if err != nil {
+		job.Message += "; save properties: " + err.Error()
+		job.Status = models.JobFailure
+		return fmt.Errorf("save document properties: %v", err)
+	}
+	fp.document.Properties = properties
+	fp.Debug("found %d file properties", len(properties))
+
+	if proposeFromProperties(fp.document) {
+		err = fp.db.DocumentStore.Update(storage.UserIdInternal, fp.document)
+		if err != nil {
+			job.Message += "; update document: " + err.Error()
+			job.Status = models.JobFailure
+			return fmt.Errorf("update document from properties: %v", err)
+		}
+	}
+	job.Status = models.JobFinished
+	return nil
+}
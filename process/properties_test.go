@@ -0,0 +1,172 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_parsePdfInfo(t *testing.T) {
+	output := `Title:          Invoice 2022-05
+Author:         Acme Ltd
+Creator:
+CreationDate:   2022-05-03T10:11:12+03:00
+Pages:          2
+PDF version:    1.5
+`
+	want := []models.DocumentProperty{
+		{Key: "title", Value: "Invoice 2022-05", Source: propertySourcePdfInfo},
+		{Key: "author", Value: "Acme Ltd", Source: propertySourcePdfInfo},
+		{Key: "creationdate", Value: "2022-05-03T10:11:12+03:00", Source: propertySourcePdfInfo},
+		{Key: "pages", Value: "2", Source: propertySourcePdfInfo},
+		{Key: "pdf_version", Value: "1.5", Source: propertySourcePdfInfo},
+	}
+	got := parsePdfInfo(output)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePdfInfo() = %v, want %v", got, want)
+	}
+}
+
+func Test_readExifFile(t *testing.T) {
+	want := []models.DocumentProperty{
+		{Key: "exif_make", Value: "Canon", Source: propertySourceExif},
+		{Key: "exif_model", Value: "Canon EOS R6", Source: propertySourceExif},
+		{Key: "exif_orientation", Value: "1", Source: propertySourceExif},
+		{Key: "exif_xresolution", Value: "300", Source: propertySourceExif},
+		{Key: "exif_datetime", Value: "2021:08:14 16:20:01", Source: propertySourceExif},
+		{Key: "exif_exposuretime", Value: "0.004", Source: propertySourceExif},
+		{Key: "exif_exifversion", Value: "0231", Source: propertySourceExif},
+		{Key: "exif_datetimeoriginal", Value: "2021:08:14 16:20:01", Source: propertySourceExif},
+		{Key: "exif_gpslatitude", Value: "-22.908458", Source: propertySourceExif},
+		{Key: "exif_gpslongitude", Value: "-43.196389", Source: propertySourceExif},
+		{Key: "exif_gpsaltitude", Value: "11.5", Source: propertySourceExif},
+	}
+	got, err := readExifFile("testdata/exif-gps.jpg")
+	if err != nil {
+		t.Fatalf("readExifFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readExifFile() = %v, want %v", got, want)
+	}
+}
+
+func Test_readExifFileWithoutExif(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "image.jpg")
+	data := &bytes.Buffer{}
+	err := jpeg.Encode(data, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, data.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readExifFile(file)
+	if err != nil || len(got) != 0 {
+		t.Errorf("readExifFile() = %v, %v, want no properties", got, err)
+	}
+}
+
+func Test_parseExifInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"empty", []byte{}, true},
+		{"byte order", []byte("XX\x00\x2a\x00\x00\x00\x08"), true},
+		{"ifd out of bounds", []byte("II\x2a\x00\xff\x00\x00\x00"), true},
+		{"truncated ifd", []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x05\x01\x0f"), true},
+		// exif IFD pointing back to IFD0 is ignored.
+		{"ifd loop", []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x87\x69\x00\x04\x00\x00\x00\x01\x00\x00\x00\x08\x00\x00\x00\x00"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExif(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseExif() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != 0 {
+				t.Errorf("parseExif() = %v, want no properties", got)
+			}
+		})
+	}
+}
+
+func Test_parsePropertyDate(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Time
+		wantOk bool
+	}{
+		{"2022-05-03T10:11:12Z", time.Date(2022, 5, 3, 10, 11, 12, 0, time.UTC), true},
+		{"2022-05-03T10:11:12", time.Date(2022, 5, 3, 10, 11, 12, 0, time.UTC), true},
+		{"2021:08:14 16:20:01", time.Date(2021, 8, 14, 16, 20, 1, 0, time.UTC), true},
+		{"0000:00:00 00:00:00", time.Time{}, false},
+		{"not a date", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parsePropertyDate(tt.value)
+			if ok != tt.wantOk || !got.Equal(tt.want) {
+				t.Errorf("parsePropertyDate() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_proposeFromProperties(t *testing.T) {
+	uploaded := time.Date(2023, 1, 10, 12, 0, 0, 0, time.UTC)
+	properties := []models.DocumentProperty{
+		{Key: "title", Value: "Invoice 2022-05"},
+		{Key: "creationdate", Value: "2022-05-03T10:11:12Z"},
+	}
+
+	doc := &models.Document{Name: "scan.pdf", Filename: "scan.pdf", Date: uploaded, Properties: properties}
+	doc.CreatedAt = uploaded
+	if !proposeFromProperties(doc) {
+		t.Errorf("document with default values was not modified")
+	}
+	if doc.Name != "Invoice 2022-05" {
+		t.Errorf("name = %s, want %s", doc.Name, "Invoice 2022-05")
+	}
+	if !doc.Date.Equal(time.Date(2022, 5, 3, 10, 11, 12, 0, time.UTC)) {
+		t.Errorf("date = %s, want 2022-05-03", doc.Date)
+	}
+
+	userDate := time.Date(2020, 2, 2, 0, 0, 0, 0, time.UTC)
+	doc = &models.Document{Name: "my invoice", Filename: "scan.pdf", Date: userDate, Properties: properties}
+	doc.CreatedAt = uploaded
+	if proposeFromProperties(doc) {
+		t.Errorf("document with user-edited values was modified")
+	}
+	if doc.Name != "my invoice" || !doc.Date.Equal(userDate) {
+		t.Errorf("user-edited values were overwritten: %s, %s", doc.Name, doc.Date)
+	}
+}
@@ -20,12 +20,14 @@ package process
 
 import (
 	"fmt"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/dateparse"
 	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
 )
@@ -33,14 +35,55 @@ import (
 type DocumentRule struct {
 	Rule     *models.Rule
 	Document *models.Document
+	// DateParser parses dates for date conditions. If nil, default options are used.
+	DateParser *dateparse.Parser
+	// Metadata finds and creates metadata values for actions that extract metadata.
+	Metadata MetadataValueStore
+	// DryRun prevents actions from creating new metadata values.
+	DryRun bool
+	// Trigger is the event that runs the rule. It is recorded in the rule execution.
+	Trigger models.RuleTrigger
+	// Search finds documents for the link documents action.
+	Search DocumentSearcher
+	// Effects contains the changes of actions that are applied outside the document.
+	Effects RuleEffects
+	// Stopped is set when stop processing action runs. Rest of the rules should not be run.
+	Stopped bool
+	// Notified contains the rules that have already sent notification of the document.
+	// Scheduled rules do not notify again of the same document.
+	Notified map[int]bool
 	date     time.Time
+	// history of actions that do not change document fields.
+	actionHistory []models.DocumentHistory
+	// single-valued metadata keys of the user, loaded on first use.
+	singleValueKeys map[int]bool
+	// compiled programs of expression conditions, compiled on first use.
+	expressions map[*models.RuleCondition]*ruleExpression
+	// captures of matched regex conditions, available in action templates.
+	captures []ruleCapture
+	// captures of the condition being evaluated.
+	conditionCaptures []ruleCapture
+	// explanation of how the text of the condition being evaluated was matched.
+	textMatch string
 }
 
+// MetadataValueStore finds and creates metadata values when running rule actions.
+type MetadataValueStore interface {
+	GetValueByName(userId int, keyId int, value string) (*models.MetadataValue, error)
+	CreateValue(userId int, value *models.MetadataValue) error
+	GetUserKeysCached(userId int) (*[]models.MetadataKey, error)
+}
+
+// RuleTestConditionResult is the result of a single condition or a condition group.
 type RuleTestConditionResult struct {
 	ConditionId   int    `json:"condition_id"`
 	ConditionType string `json:"condition_type"`
-	Matched       bool   `json:"matched"`
-	Skipped       bool   `json:"skipped"`
+	// ParentId is the id of the group condition belongs to, or 0 if condition is at the root of the rule.
+	ParentId int `json:"parent_id"`
+	// Depth of the condition, root conditions have depth 0.
+	Depth   int  `json:"depth"`
+	Matched bool `json:"matched"`
+	Skipped bool `json:"skipped"`
 }
 
 type RuleTestAction struct {
@@ -65,64 +108,252 @@ type RuleTestResult struct {
 
 func NewDocumentRule(document *models.Document, rule *models.Rule) DocumentRule {
 	return DocumentRule{
-		Rule:     rule,
-		Document: document,
+		Rule:        rule,
+		Document:    document,
+		expressions: map[*models.RuleCondition]*ruleExpression{},
 	}
 }
 
+// Match evaluates rule conditions against the document and returns true if document matches the rule.
 func (d *DocumentRule) Match() (bool, error) {
-	hasMatch := false
-
 	logrus.Debugf("match document: %s, rule: %d", d.Document.Id, d.Rule.Id)
-	for i, condition := range d.Rule.Conditions {
-		if !condition.Enabled {
-			logrus.Debugf("rule %d - condition: %d (id:%d), %s is disabled", d.Rule.Id, i+1, condition.Id, condition.ConditionType)
+	d.captures = nil
+	ok, _, err := d.evaluateGroup(nil, d.Rule.Conditions, &ruleEvaluation{})
+	return ok, err
+}
+
+// ruleEvaluation contains the state of evaluating rule conditions. When testing the rule,
+// logger and result are set, and the details of each condition are logged to them.
+type ruleEvaluation struct {
+	logger *logrus.Logger
+	result *RuleTestResult
+	// audit contains the condition results when recording rule execution.
+	audit models.RuleConditionResults
+	// index of the condition in result.Conditions and audit
+	index map[*models.RuleCondition]int
+}
+
+func (e *ruleEvaluation) info(format string, args ...interface{}) {
+	if e.logger != nil {
+		e.logger.Infof(format, args...)
+	} else {
+		logrus.Debugf(format, args...)
+	}
+}
+
+// output adds a line to condition output of the test result.
+func (e *ruleEvaluation) output(condition *models.RuleCondition, format string, args ...interface{}) {
+	if e.result == nil {
+		return
+	}
+	i := e.index[condition]
+	e.result.ConditionOutput[i] = append(e.result.ConditionOutput[i], fmt.Sprintf(format, args...))
+}
+
+// setResult sets the result of the condition, if results are being recorded.
+func (e *ruleEvaluation) setResult(condition *models.RuleCondition, matched, skipped bool) {
+	if e.result != nil {
+		e.result.Conditions[e.index[condition]].Matched = matched
+		e.result.Conditions[e.index[condition]].Skipped = skipped
+	}
+	if e.audit != nil {
+		e.audit[e.index[condition]].Matched = matched
+		e.audit[e.index[condition]].Skipped = skipped
+	}
+}
+
+// evaluateGroup evaluates conditions of a group. Group nil is the root group of the rule, which uses the rule mode.
+// Disabled conditions and groups that do not have any enabled conditions are skipped.
+// Returns whether the group matched and whether any condition was evaluated.
+func (d *DocumentRule) evaluateGroup(group *models.RuleCondition, conditions []*models.RuleCondition, eval *ruleEvaluation) (bool, bool, error) {
+	groupType := models.RuleConditionGroupAnd
+	if group != nil {
+		groupType = group.ConditionType
+	} else if d.Rule.Mode == models.RuleMatchAny {
+		groupType = models.RuleConditionGroupOr
+	}
+
+	evaluated := false
+	for _, condition := range conditions {
+		ok, conditionEvaluated, err := d.evaluateCondition(condition, eval)
+		if err != nil {
+			return false, true, err
+		}
+		if !conditionEvaluated {
 			continue
 		}
+		evaluated = true
 
-		logrus.Debugf("evaluate rule %d - condition: %d (id:%d), %s", d.Rule.Id, i+1, condition.Id, condition.ConditionType)
-		condText := string(condition.ConditionType)
-		var ok = false
-		var err error
-		if strings.HasPrefix(condText, "name") {
-			ok, err = d.matchText(condition, d.Document.Name)
-		} else if strings.HasPrefix(condText, "description") {
-			ok, err = d.matchText(condition, d.Document.Description)
-		} else if strings.HasPrefix(condText, "content") {
-			ok, err = d.matchText(condition, d.Document.Content)
-		} else if strings.HasPrefix(condText, "date") {
-			ok, err = d.extractDates(condition, time.Now(), nil)
-		} else if strings.HasPrefix(condText, "metadata_count") {
-			ok, err = d.hasMetadataCount(condition)
-		} else if condition.ConditionType == models.RuleConditionMetadataHasKey {
-			ok = d.hasMetadataKey(condition)
-		} else if condition.ConditionType == models.RuleConditionMetadataHasKeyValue {
-			ok = d.hasMetadataKeyValue(condition)
-		} else {
-			err := errors.ErrInternalError
-			err.ErrMsg = "unknown condition type: " + condText
-			return false, err
+		switch {
+		case groupType == models.RuleConditionGroupAnd && !ok:
+			if group == nil {
+				eval.info("condition %d didn't match, skip rest", condition.Id)
+				eval.output(condition, "rule mode is set to 'match all', stopping execution")
+			} else {
+				eval.output(condition, "group requires all conditions to match, skip rest of the group")
+			}
+			return false, true, nil
+		case groupType == models.RuleConditionGroupOr && ok:
+			if group == nil {
+				eval.info("document matches and mode is set to 'match any', skip rest conditions")
+				eval.output(condition, "rule mode is set to 'match any', skip rest conditions")
+			} else {
+				eval.output(condition, "group requires any condition to match, skip rest of the group")
+			}
+			return true, true, nil
+		case groupType == models.RuleConditionGroupNot && ok:
+			eval.output(condition, "group requires no conditions to match, skip rest of the group")
+			return false, true, nil
 		}
+	}
+
+	if !evaluated {
+		return false, false, nil
+	}
+	return groupType != models.RuleConditionGroupOr, true, nil
+}
+
+// evaluateCondition evaluates single condition or group. Returns whether condition matched and
+// whether it was evaluated at all.
+func (d *DocumentRule) evaluateCondition(condition *models.RuleCondition, eval *ruleEvaluation) (bool, bool, error) {
+	if !condition.Enabled {
+		eval.info("rule %d - condition (id:%d), %s is disabled, skipping condition", d.Rule.Id, condition.Id, condition.ConditionType)
+		eval.output(condition, "condition disabled")
+		return false, false, nil
+	}
+	eval.setResult(condition, false, false)
+
+	var ok bool
+	var err error
+	if condition.IsGroup() {
+		eval.info("evaluate condition group (id:%d), type: '%s'", condition.Id, condition.ConditionType)
+		var evaluated bool
+		ok, evaluated, err = d.evaluateGroup(condition, condition.Conditions, eval)
 		if err != nil {
-			return false, fmt.Errorf("evaluate condition: %v", err)
+			return false, true, err
 		}
-
-		if condition.Inverted {
-			ok = !ok
+		if !evaluated {
+			eval.output(condition, "group does not have enabled conditions, skipping group")
+			eval.setResult(condition, false, true)
+			return false, false, nil
 		}
-
-		if ok {
-			hasMatch = true
-		} else if d.Rule.Mode == models.RuleMatchAll {
-			return false, nil
+	} else {
+		eval.info("evaluate condition (id:%d), type: '%s'", condition.Id, condition.ConditionType)
+		d.conditionCaptures = nil
+		d.textMatch = ""
+		ok, err = d.matchCondition(condition, eval)
+		if err != nil {
+			return false, true, fmt.Errorf("evaluate condition: %v", err)
+		}
+		if d.textMatch != "" {
+			eval.output(condition, "%s", d.textMatch)
+		}
+		if ok && !condition.Inverted && len(d.conditionCaptures) > 0 {
+			for _, v := range d.conditionCaptures {
+				d.captures = append(d.captures, v)
+				eval.output(condition, "captured value %d: '%s'", len(d.captures), v.value)
+			}
 		}
+	}
 
-		if hasMatch && d.Rule.Mode == models.RuleMatchAny {
-			// already found a match, skip rest of the conditions
-			break
+	if condition.Inverted {
+		eval.output(condition, "invert condition matched: %t -> %t", ok, !ok)
+		ok = !ok
+	}
+
+	name := "condition"
+	if condition.IsGroup() {
+		name = "group"
+	}
+	if ok {
+		eval.info("%s (id %d) matched", name, condition.Id)
+		eval.output(condition, "%s matched", name)
+	} else {
+		eval.info("%s (id %d) didn't match", name, condition.Id)
+		eval.output(condition, "%s didn't match", name)
+	}
+	eval.setResult(condition, ok, false)
+	return ok, true, nil
+}
+
+// matchCondition matches single condition that is not a group.
+func (d *DocumentRule) matchCondition(condition *models.RuleCondition, eval *ruleEvaluation) (bool, error) {
+	condText := string(condition.ConditionType)
+	var ok bool
+	var err error
+	if strings.HasPrefix(condText, "name") {
+		ok, err = d.matchText(condition, d.Document.Name)
+	} else if strings.HasPrefix(condText, "description") {
+		ok, err = d.matchText(condition, d.Document.Description)
+	} else if strings.HasPrefix(condText, "content") {
+		ok, err = d.matchText(condition, d.Document.Content)
+	} else if strings.HasPrefix(condText, "property") {
+		value, found := d.Document.GetProperty(condition.PropertyKey)
+		if !found {
+			eval.output(condition, "document does not have property '%s'", condition.PropertyKey)
+		} else {
+			eval.output(condition, "property '%s': '%s'", condition.PropertyKey, value)
 		}
+		ok, err = d.matchProperty(condition)
+	} else if condition.ConditionType == models.RuleConditionBarcodeMatches {
+		eval.output(condition, "document has %d barcodes", len(d.Document.Barcodes))
+		ok, err = d.matchBarcode(condition)
+	} else if strings.HasPrefix(condText, "field") {
+		field, found := d.Document.GetField(condition.FieldName)
+		if !found {
+			eval.output(condition, "document does not have field '%s'", condition.FieldName)
+		} else {
+			eval.output(condition, "field '%s': '%s' (confidence %.2f)", field.Name, field.Value, field.Confidence)
+		}
+		ok, err = d.matchField(condition)
+	} else if strings.HasPrefix(condText, "filename") {
+		ok, err = d.matchFilename(condition)
+	} else if condition.ConditionType == models.RuleConditionMimetypeIs {
+		eval.output(condition, "document mimetype: '%s'", d.Document.Mimetype)
+		ok = matchMimetype(condition.Value, d.Document.Mimetype)
+	} else if strings.HasPrefix(condText, "size") {
+		eval.output(condition, "document size: %d bytes (%s)", d.Document.Size, d.Document.GetSize())
+		ok, err = d.matchSize(condition)
+	} else if strings.HasPrefix(condText, "pages") {
+		pages := documentPages(d.Document)
+		if pages == 0 {
+			eval.output(condition, "document page count is not known")
+		} else {
+			eval.output(condition, "document has %d pages", pages)
+		}
+		ok, err = d.matchPages(condition)
+	} else if condition.ConditionType == models.RuleConditionSourceIs {
+		eval.output(condition, "document source: '%s'", d.Document.Source)
+		ok = string(d.Document.Source) == condition.Value
+	} else if strings.HasPrefix(condText, "age") {
+		date := documentAgeDate(d.Document)
+		eval.output(condition, "document date: %s", date.Format("2006-01-02"))
+		ok, err = d.matchAge(condition, time.Now())
+	} else if strings.HasPrefix(condText, "date") {
+		ok, err = d.extractDates(condition, time.Now(), eval.logger)
+		if ok {
+			y, m, day := d.date.Date()
+			eval.info("found date %d-%d-%d", y, m, day)
+			eval.output(condition, "found date %d-%d-%d", y, m, day)
+		}
+	} else if condition.ConditionType == models.RuleConditionExpression {
+		ok, err = d.matchExpression(condition, eval)
+	} else if strings.HasPrefix(condText, "metadata_count") {
+		ok, err = d.hasMetadataCount(condition)
+	} else if condition.ConditionType == models.RuleConditionMetadataHasKey {
+		ok = d.hasMetadataKey(condition)
+	} else if condition.ConditionType == models.RuleConditionMetadataHasKeyValue {
+		ok = d.hasMetadataKeyValue(condition)
+	} else if strings.HasPrefix(condText, "metadata_value") {
+		ok, err = d.compareMetadataValue(condition, eval)
+	} else if condition.ConditionType == models.RuleConditionHasTag {
+		ok = d.hasTag(condition)
+	} else {
+		e := errors.ErrInternalError
+		e.ErrMsg = "unknown condition type: " + condText
+		return false, e
 	}
-	return hasMatch, nil
+	return ok, err
 }
 
 type formatter struct{}
@@ -137,28 +368,241 @@ func (f *formatter) Format(entry *logrus.Entry) ([]byte, error) {
 }
 
 func (d *DocumentRule) matchText(condition *models.RuleCondition, text string) (bool, error) {
+	if condition.IsRegex {
+		return d.matchTextCapture(condition, text)
+	}
+
 	value := condition.Value
-	if condition.CaseInsensitive {
+	if condition.IgnoreCase() {
 		text = strings.ToLower(text)
 		value = strings.ToLower(value)
 	}
 
+	switch condition.ConditionType {
+	case models.RuleConditionNameIs, models.RuleConditionDescriptionIs, models.RuleConditionContentIs,
+		models.RuleConditionPropertyIs, models.RuleConditionFieldIs:
+		return d.matchTextMode(condition, value, text, textIs)
+	case models.RuleConditionNameStarts, models.RuleConditionDescriptionStarts, models.RuleConditionContentStarts,
+		models.RuleConditionPropertyStarts:
+		return d.matchTextMode(condition, value, text, textStarts)
+	case models.RuleConditionNameContains, models.RuleConditionDescriptionContains, models.RuleConditionContentContains,
+		models.RuleConditionPropertyContains, models.RuleConditionFieldContains:
+		return d.matchTextMode(condition, value, text, textContains)
+	default:
+		err := errors.ErrInternalError
+		err.ErrMsg = fmt.Sprintf("unknown condition type: %s", condition.ConditionType)
+		err.SetStack()
+		return false, err
+	}
+}
+
+// matchFilename matches document filename. Filename is matched exactly, without allowing typos.
+func (d *DocumentRule) matchFilename(condition *models.RuleCondition) (bool, error) {
+	filename := d.Document.Filename
+	value := condition.Value
+	if condition.ConditionType == models.RuleConditionFilenameMatches {
+		if condition.CaseInsensitive {
+			filename = strings.ToLower(filename)
+			value = strings.ToLower(value)
+		}
+		ok, err := path.Match(value, filename)
+		if err != nil {
+			return false, fmt.Errorf("invalid filename pattern: %v", err)
+		}
+		return ok, nil
+	}
 	if condition.IsRegex {
-		return matchTextByRegex(value, text)
-	} else {
-		switch condition.ConditionType {
-		case models.RuleConditionNameIs, models.RuleConditionDescriptionIs, models.RuleConditionContentIs:
-			return matchTextAllowTypo(value, text, false, true)
-		case models.RuleConditionNameStarts, models.RuleConditionDescriptionStarts, models.RuleConditionContentStarts:
-			return matchTextAllowTypo(value, text, true, false)
-		case models.RuleConditionNameContains, models.RuleConditionDescriptionContains, models.RuleConditionContentContains:
-			return matchTextAllowTypo(value, text, false, false)
-		default:
-			err := errors.ErrInternalError
-			err.ErrMsg = fmt.Sprintf("unknown condition type: %s", condition.ConditionType)
-			err.SetStack()
-			return false, err
+		return d.matchTextCapture(condition, filename)
+	}
+	if condition.CaseInsensitive {
+		filename = strings.ToLower(filename)
+		value = strings.ToLower(value)
+	}
+
+	switch condition.ConditionType {
+	case models.RuleConditionFilenameIs:
+		return filename == value, nil
+	case models.RuleConditionFilenameStarts:
+		return strings.HasPrefix(filename, value), nil
+	case models.RuleConditionFilenameContains:
+		return strings.Contains(filename, value), nil
+	default:
+		err := errors.ErrInternalError
+		err.ErrMsg = fmt.Sprintf("unknown condition type: %s", condition.ConditionType)
+		return false, err
+	}
+}
+
+// matchMimetype matches mimetype case-insensitively. Pattern can end with wildcard, e.g. 'image/*'.
+func matchMimetype(pattern, mimetype string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	mimetype = strings.ToLower(mimetype)
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(mimetype, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == mimetype
+}
+
+func (d *DocumentRule) matchSize(condition *models.RuleCondition) (bool, error) {
+	size, err := models.ParseSize(condition.Value)
+	if err != nil {
+		return false, err
+	}
+	if condition.ConditionType == models.RuleConditionSizeMoreThan {
+		return d.Document.Size > size, nil
+	}
+	return d.Document.Size < size, nil
+}
+
+// matchPages matches document page count. Document without known page count does not match.
+func (d *DocumentRule) matchPages(condition *models.RuleCondition) (bool, error) {
+	value, err := strconv.Atoi(strings.TrimSpace(condition.Value))
+	if err != nil {
+		return false, fmt.Errorf("invalid page count: '%s'", condition.Value)
+	}
+	pages := documentPages(d.Document)
+	if pages == 0 {
+		return false, nil
+	}
+	switch condition.ConditionType {
+	case models.RuleConditionPagesMoreThan:
+		return pages > value, nil
+	case models.RuleConditionPagesLessThan:
+		return pages < value, nil
+	default:
+		return pages == value, nil
+	}
+}
+
+// matchAge matches the age of the document at given time.
+func (d *DocumentRule) matchAge(condition *models.RuleCondition, now time.Time) (bool, error) {
+	age, err := models.ParseAge(condition.Value)
+	if err != nil {
+		return false, err
+	}
+	cutoff := age.Before(now)
+	date := documentAgeDate(d.Document)
+	if condition.ConditionType == models.RuleConditionAgeMoreThan {
+		return date.Before(cutoff), nil
+	}
+	return date.After(cutoff), nil
+}
+
+// documentAgeDate returns the date document age is counted from: document date, or creation time
+// if document does not have a date.
+func documentAgeDate(doc *models.Document) time.Time {
+	if doc.Date.IsZero() {
+		return doc.CreatedAt
+	}
+	return doc.Date
+}
+
+// documentPages returns the page count of the document, or 0 if it is not known.
+func documentPages(doc *models.Document) int {
+	value, ok := doc.GetProperty("pages")
+	if !ok {
+		if strings.HasPrefix(doc.Mimetype, "image/") {
+			return 1
+		}
+		return 0
+	}
+	pages, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return pages
+}
+
+// matchProperty matches document property value. Document without the property does not match.
+func (d *DocumentRule) matchProperty(condition *models.RuleCondition) (bool, error) {
+	value, ok := d.Document.GetProperty(condition.PropertyKey)
+	if !ok {
+		return false, nil
+	}
+	return d.matchText(condition, value)
+}
+
+// matchBarcode matches if any of the document barcodes matches. If condition is not regex,
+// the whole payload must match.
+func (d *DocumentRule) matchBarcode(condition *models.RuleCondition) (bool, error) {
+	value := condition.Value
+	if condition.CaseInsensitive {
+		value = strings.ToLower(value)
+	}
+	for _, v := range d.Document.Barcodes {
+		payload := v.Payload
+		if condition.CaseInsensitive {
+			payload = strings.ToLower(payload)
+		}
+		if condition.IsRegex {
+			ok, err := matchTextByRegex(value, payload)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		} else if payload == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchField matches extracted document field. Amount is compared as a number and due date as a date
+// (formatted as 2006-01-02). Document without the field does not match.
+func (d *DocumentRule) matchField(condition *models.RuleCondition) (bool, error) {
+	field, ok := d.Document.GetField(condition.FieldName)
+	if !ok {
+		return false, nil
+	}
+
+	switch condition.ConditionType {
+	case models.RuleConditionFieldExists:
+		return true, nil
+	case models.RuleConditionFieldIs, models.RuleConditionFieldContains:
+		return d.matchText(condition, field.Value)
+	case models.RuleConditionFieldMoreThan, models.RuleConditionFieldLessThan:
+		var diff int
+		if condition.FieldName == models.DocumentFieldDueDate {
+			limit, err := time.Parse("2006-01-02", strings.TrimSpace(condition.Value))
+			if err != nil {
+				e := errors.ErrInvalid
+				e.ErrMsg = "value must be a date formatted as YYYY-MM-DD"
+				return false, e
+			}
+			date, err := time.Parse("2006-01-02", field.Value)
+			if err != nil {
+				return false, nil
+			}
+			if date.After(limit) {
+				diff = 1
+			} else if date.Before(limit) {
+				diff = -1
+			}
+		} else {
+			limit, err := strconv.ParseFloat(strings.TrimSpace(condition.Value), 64)
+			if err != nil {
+				e := errors.ErrInvalid
+				e.ErrMsg = "value must be a number"
+				return false, e
+			}
+			amount, err := strconv.ParseFloat(field.Value, 64)
+			if err != nil {
+				return false, nil
+			}
+			if amount > limit {
+				diff = 1
+			} else if amount < limit {
+				diff = -1
+			}
 		}
+		if condition.ConditionType == models.RuleConditionFieldMoreThan {
+			return diff > 0, nil
+		}
+		return diff < 0, nil
+	default:
+		return false, fmt.Errorf("not field condition: %v", condition.ConditionType)
 	}
 }
 
@@ -171,6 +615,15 @@ func (d *DocumentRule) hasMetadataKey(condition *models.RuleCondition) bool {
 	return false
 }
 
+func (d *DocumentRule) hasTag(condition *models.RuleCondition) bool {
+	for _, v := range d.Document.Tags {
+		if v.Id == int(condition.TagId) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *DocumentRule) hasMetadataKeyValue(condition *models.RuleCondition) bool {
 	for _, v := range d.Document.Metadata {
 		if v.KeyId == int(condition.MetadataKey) && v.ValueId == int(condition.MetadataValue) {
@@ -180,6 +633,39 @@ func (d *DocumentRule) hasMetadataKeyValue(condition *models.RuleCondition) bool
 	return false
 }
 
+// compareMetadataValue compares values of the typed metadata key in the document to the condition value.
+// Matches if any of the values matches.
+func (d *DocumentRule) compareMetadataValue(condition *models.RuleCondition, eval *ruleEvaluation) (bool, error) {
+	found := false
+	for _, v := range d.Document.Metadata {
+		if v.KeyId != int(condition.MetadataKey) {
+			continue
+		}
+		found = true
+		value, ok := v.Number()
+		if !ok {
+			eval.output(condition, "value '%s' of key %s cannot be compared", v.Value, v.Key)
+			continue
+		}
+		_, typed, err := models.ParseMetadataValue(v.ValueType, condition.Value)
+		if err != nil {
+			return false, err
+		}
+		limit, _ := typed.Number()
+		eval.output(condition, "document has %s: %s", v.Key, v.Value)
+		if condition.ConditionType == models.RuleConditionMetadataValueMoreThan && value > limit {
+			return true, nil
+		}
+		if condition.ConditionType == models.RuleConditionMetadataValueLessThan && value < limit {
+			return true, nil
+		}
+	}
+	if !found {
+		eval.output(condition, "document does not have the metadata key")
+	}
+	return false, nil
+}
+
 func (d *DocumentRule) hasMetadataCount(condition *models.RuleCondition) (bool, error) {
 	limit, err := strconv.Atoi(condition.Value)
 	if err != nil || limit < 0 {
@@ -201,18 +687,33 @@ func (d *DocumentRule) hasMetadataCount(condition *models.RuleCondition) (bool,
 }
 
 // Try to extract all dates from the document.
+// If condition has a regex, dates are parsed from regex matches with the date format, or with
+// the date parser if date format is empty or does not match. Without regex, date parser finds
+// all dates from the document name and content.
 // In case there are multiple dates found, prioritice:
 // 1. a future date that has most matches
 // 2. a passed date that has most matches
 // 3. any date found from document.
 func (d *DocumentRule) extractDates(condition *models.RuleCondition, now time.Time, logger *logrus.Logger) (bool, error) {
-	re, err := regexp.Compile(condition.Value)
-	if err != nil {
-		return false, fmt.Errorf("regex: %v", err)
+	parser := d.DateParser
+	if parser == nil {
+		parser = dateparse.NewParser(dateparse.DefaultOptions())
+	}
+
+	var matches []string
+	if condition.Value == "" {
+		for _, v := range parser.FindAll(d.Document.Name + "\n" + d.Document.Content) {
+			matches = append(matches, v.Text)
+		}
+	} else {
+		re, err := regexp.Compile(condition.Value)
+		if err != nil {
+			return false, fmt.Errorf("regex: %v", err)
+		}
+		nameMatches := re.FindAllString(d.Document.Name, -1)
+		matches = re.FindAllString(d.Document.Content, -1)
+		matches = append(nameMatches, matches...)
 	}
-	nameMatches := re.FindAllString(d.Document.Name, -1)
-	matches := re.FindAllString(d.Document.Content, -1)
-	matches = append(nameMatches, matches...)
 
 	if logger != nil {
 		logger.Infof("Regex resulted in total of %d matches", len(matches))
@@ -238,11 +739,30 @@ func (d *DocumentRule) extractDates(condition *models.RuleCondition, now time.Ti
 	}
 
 	for _, v := range matches {
-		date, err := time.Parse(condition.DateFmt, v)
+		var date time.Time
+		var err error
+		if condition.DateFmt != "" {
+			date, err = time.Parse(condition.DateFmt, v)
+		}
+		if condition.DateFmt == "" || err != nil {
+			var ok bool
+			date, ok = parser.Parse(v)
+			if !ok {
+				// matched text may contain other text around the date
+				if found := parser.FindAll(v); len(found) > 0 {
+					date, ok = found[0].Date, true
+				}
+			}
+			if !ok {
+				err = fmt.Errorf("not a date")
+			} else {
+				err = nil
+			}
+		}
 		if err != nil {
 			logrus.Debugf("text %s does not match date fmt %s", v, condition.DateFmt)
 			if logger != nil {
-				logger.Warnf("matched text '%s' does not match date format '%s', skipping", v, condition.DateFmt)
+				logger.Warnf("matched text '%s' is not a valid date (format '%s'), skipping", v, condition.DateFmt)
 			}
 		} else {
 			putDateToMap(date, &dates)
@@ -320,11 +840,39 @@ func (d *DocumentRule) runAction(action *models.RuleAction, log logFunc) error {
 	case models.RuleActionAppendDescription:
 		actionError = d.appendDescription(action, log)
 	case models.RuleActionAddMetadata:
-		actionError = addMetadata(d.Document, int(action.MetadataKey), int(action.MetadataValue), log)
+		actionError = d.addMetadata(models.Metadata{
+			KeyId:   int(action.MetadataKey),
+			Key:     action.MetadataKeyName.String(),
+			ValueId: int(action.MetadataValue),
+			Value:   action.MetadataValueName.String(),
+		}, log)
 	case models.RuleActionRemoveMetadata:
 		removeMetadata(d.Document, int(action.MetadataKey), int(action.MetadataValue), log)
+	case models.RuleActionAddTag:
+		addTag(d.Document, models.Tag{Id: int(action.TagId), Key: action.TagName.String()}, log)
+	case models.RuleActionRemoveTag:
+		removeTag(d.Document, int(action.TagId), log)
 	case models.RuleActionSetDate:
 		actionError = d.setDate(action, log)
+	case models.RuleActionExtractMetadata:
+		actionError = d.extractMetadata(action, log)
+	case models.RuleActionLinkDocuments:
+		actionError = d.linkDocuments(action, log)
+	case models.RuleActionTrash:
+		d.trash(log)
+	case models.RuleActionNeedsReview:
+		d.Document.NeedsReview = true
+		if log != nil {
+			log("mark document as needing review")
+		}
+	case models.RuleActionNotify:
+		actionError = d.notify(action, log)
+	case models.RuleActionStopProcessing:
+		d.Stopped = true
+		d.addActionHistory(models.DocumentHistoryActionStopRules, "", d.Rule.Name)
+		if log != nil {
+			log("stop processing rest of the rules")
+		}
 	default:
 		e := errors.ErrInternalError
 		e.ErrMsg = fmt.Sprintf("unknown action type: %v", action.Action)
@@ -336,16 +884,24 @@ func (d *DocumentRule) runAction(action *models.RuleAction, log logFunc) error {
 type logFunc = func(format string, args ...interface{})
 
 func (d *DocumentRule) setName(action *models.RuleAction, log logFunc) error {
-	d.Document.Name = action.Value
+	value, err := d.renderTemplate(action.Value, log)
+	if err != nil {
+		return err
+	}
+	d.Document.Name = value
 	if log != nil {
-		log("set name to: %s", action.Value)
+		log("set name to: %s", value)
 	}
 	return nil
 }
 
 func (d *DocumentRule) appendName(action *models.RuleAction, log logFunc) error {
-	if !strings.HasSuffix(d.Document.Name, action.Value) {
-		newName := d.Document.Name + action.Value
+	value, err := d.renderTemplate(action.Value, log)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(d.Document.Name, value) {
+		newName := d.Document.Name + value
 		if log != nil {
 			log(`append name: "%s" -> "%s"`, d.Document.Name, newName)
 		}
@@ -357,20 +913,28 @@ func (d *DocumentRule) appendName(action *models.RuleAction, log logFunc) error
 }
 
 func (d *DocumentRule) setDescription(action *models.RuleAction, log logFunc) error {
+	value, err := d.renderTemplate(action.Value, log)
+	if err != nil {
+		return err
+	}
 	if log != nil {
-		log(`set description to "%s"`, action.Value)
+		log(`set description to "%s"`, value)
 	}
-	d.Document.Description = action.Value
+	d.Document.Description = value
 	return nil
 }
 
 func (d *DocumentRule) appendDescription(action *models.RuleAction, log logFunc) error {
+	value, err := d.renderTemplate(action.Value, log)
+	if err != nil {
+		return err
+	}
 	newValue := d.Document.Description
 	appended := true
 	oldValue := d.Document.Description
 
-	if !strings.HasSuffix(d.Document.Description, action.Value) {
-		newValue = d.Document.Description + action.Value
+	if !strings.HasSuffix(d.Document.Description, value) {
+		newValue = d.Document.Description + value
 		appended = false
 	}
 
@@ -385,12 +949,89 @@ func (d *DocumentRule) appendDescription(action *models.RuleAction, log logFunc)
 	return nil
 }
 
-func addMetadata(doc *models.Document, key, value int, log logFunc) error {
+// addMetadata adds metadata to the document. If the key is single-valued,
+// the value replaces existing values of the key.
+func (d *DocumentRule) addMetadata(metadata models.Metadata, log logFunc) error {
+	single, err := d.isSingleValueKey(metadata.KeyId)
+	if err != nil {
+		return err
+	}
+	if single {
+		for _, v := range d.Document.Metadata {
+			if v.KeyId == metadata.KeyId && (v.ValueId != metadata.ValueId || v.ValueId == 0) {
+				if log != nil {
+					log("key allows only one value, replace existing value")
+				}
+				removeMetadata(d.Document, metadata.KeyId, 0, log)
+				break
+			}
+		}
+	}
+	return addMetadata(d.Document, metadata, log)
+}
+
+// isSingleValueKey returns true if the metadata key allows only one value per document.
+// Without metadata store, all keys allow multiple values.
+func (d *DocumentRule) isSingleValueKey(keyId int) (bool, error) {
+	if d.Metadata == nil {
+		return false, nil
+	}
+	if d.singleValueKeys == nil {
+		keys, err := d.Metadata.GetUserKeysCached(d.Document.UserId)
+		if err != nil {
+			return false, fmt.Errorf("get metadata keys: %v", err)
+		}
+		d.singleValueKeys = make(map[int]bool)
+		for _, v := range *keys {
+			if v.SingleValue {
+				d.singleValueKeys[v.Id] = true
+			}
+		}
+	}
+	return d.singleValueKeys[keyId], nil
+}
+
+// enforceMetadataConstraints reverts the metadata of the document to original, if the changes of the rules
+// add violations of metadata key constraints, e.g. add a value that requires another key. Returns error
+// that describes the violations if metadata was reverted. Without metadata store, constraints are not checked.
+func enforceMetadataConstraints(store MetadataValueStore, doc *models.Document, original []models.Metadata) error {
+	if store == nil {
+		return nil
+	}
+	keys, err := store.GetUserKeysCached(doc.UserId)
+	if err != nil {
+		logrus.Errorf("get metadata keys of user %d: %v", doc.UserId, err)
+		return nil
+	}
+	violations := models.NewMetadataViolations(*keys, original, doc.Metadata)
+	if len(violations) == 0 {
+		return nil
+	}
+	doc.Metadata = original
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.String()
+	}
+	e := errors.ErrInvalid
+	e.ErrMsg = fmt.Sprintf("metadata changes reverted: %s", strings.Join(msgs, ", "))
+	return e
+}
+
+// withoutMetadataChanges returns history without the items of metadata changes made by rules.
+func withoutMetadataChanges(history []models.DocumentHistory) []models.DocumentHistory {
+	filtered := make([]models.DocumentHistory, 0, len(history))
+	for _, v := range history {
+		if v.RuleId == 0 ||
+			(v.Action != models.DocumentHistoryActionMetadataAdd && v.Action != models.DocumentHistoryActionMetadataRemove) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+func addMetadata(doc *models.Document, metadata models.Metadata, log logFunc) error {
 	if len(doc.Metadata) == 0 {
-		doc.Metadata = []models.Metadata{{
-			KeyId:   key,
-			ValueId: value,
-		}}
+		doc.Metadata = []models.Metadata{metadata}
 		if log != nil {
 			log("add metadata key-value")
 		}
@@ -399,7 +1040,7 @@ func addMetadata(doc *models.Document, key, value int, log logFunc) error {
 
 	// check if key-value already exists
 	for _, v := range doc.Metadata {
-		if v.KeyId == key && v.ValueId == value {
+		if v.KeyId == metadata.KeyId && v.ValueId == metadata.ValueId {
 			if log != nil {
 				log("key-value already exists (skip duplicate)")
 			}
@@ -407,10 +1048,7 @@ func addMetadata(doc *models.Document, key, value int, log logFunc) error {
 		}
 	}
 
-	doc.Metadata = append(doc.Metadata, models.Metadata{
-		KeyId:   key,
-		ValueId: value,
-	})
+	doc.Metadata = append(doc.Metadata, metadata)
 	if log != nil {
 		log(`add metadata value`)
 	}
@@ -448,6 +1086,131 @@ func removeMetadata(doc *models.Document, keyId, valueId int, log logFunc) {
 	}
 }
 
+func addTag(doc *models.Document, tag models.Tag, log logFunc) {
+	for _, v := range doc.Tags {
+		if v.Id == tag.Id {
+			if log != nil {
+				log("tag already exists (skip duplicate)")
+			}
+			return
+		}
+	}
+	doc.Tags = append(doc.Tags, tag)
+	if log != nil {
+		log("add tag: %s", tag.Key)
+	}
+}
+
+func removeTag(doc *models.Document, tagId int, log logFunc) {
+	tags := make([]models.Tag, 0, len(doc.Tags))
+	for _, v := range doc.Tags {
+		if v.Id == tagId {
+			if log != nil {
+				log("remove tag: %s", v.Key)
+			}
+			continue
+		}
+		tags = append(tags, v)
+	}
+	doc.Tags = tags
+}
+
+// maximum length of extracted metadata value, same as for values created via api.
+const maxExtractedValueLength = 30
+
+// extractMetadata captures a value from document text and adds it as metadata to the document.
+// If metadata value does not exist yet, it is created unless running in dry-run mode.
+func (d *DocumentRule) extractMetadata(action *models.RuleAction, log logFunc) error {
+	if log == nil {
+		log = func(string, ...interface{}) {}
+	}
+
+	var texts []string
+	switch action.TextSource {
+	case models.RuleTextSourceName:
+		texts = []string{d.Document.Name}
+	case models.RuleTextSourceDescription:
+		texts = []string{d.Document.Description}
+	case models.RuleTextSourceBarcode:
+		for _, v := range d.Document.Barcodes {
+			texts = append(texts, v.Payload)
+		}
+	default:
+		texts = []string{d.Document.Content}
+	}
+
+	re, err := regexp.Compile(action.Value)
+	if err != nil {
+		return fmt.Errorf("compile regex: %v", err)
+	}
+	value := ""
+	for _, text := range texts {
+		match := re.FindStringSubmatch(text)
+		// use first capture group that matched, since regex can have alternatives
+		for i := 1; i < len(match); i++ {
+			if match[i] != "" {
+				value = match[i]
+				break
+			}
+		}
+		if value != "" {
+			break
+		}
+	}
+	value = action.NormalizeValue(value)
+	if value == "" {
+		log("no value found (skipping)")
+		return nil
+	}
+	if len([]rune(value)) > maxExtractedValueLength || strings.ContainsAny(value, ";:\n") {
+		log(`extracted value "%s" is not a valid metadata value (skipping)`, value)
+		return nil
+	}
+
+	if d.Metadata == nil {
+		return fmt.Errorf("metadata store not set")
+	}
+	keyId := int(action.MetadataKey)
+	metadataValue, err := d.Metadata.GetValueByName(d.Document.UserId, keyId, value)
+	if errors.Is(err, errors.ErrInvalid) {
+		log(`extracted value "%s" is not valid for the metadata key: %v (skipping)`, value, err)
+		return nil
+	}
+	if errors.Is(err, errors.ErrRecordNotFound) {
+		if d.DryRun {
+			log(`metadata value "%s" does not exist, it will be created`, value)
+			return d.addMetadata(models.Metadata{
+				KeyId: keyId,
+				Key:   action.MetadataKeyName.String(),
+				Value: value,
+			}, log)
+		}
+		metadataValue = &models.MetadataValue{
+			UserId:    d.Document.UserId,
+			KeyId:     keyId,
+			Value:     value,
+			MatchType: models.MetadataMatchExact,
+		}
+		err = d.Metadata.CreateValue(d.Document.UserId, metadataValue)
+		if errors.Is(err, errors.ErrAlreadyExists) {
+			// value was created meanwhile
+			metadataValue, err = d.Metadata.GetValueByName(d.Document.UserId, keyId, value)
+		} else if err == nil {
+			log(`created metadata value "%s"`, value)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("get metadata value: %v", err)
+	}
+	log(`extracted metadata value "%s"`, value)
+	return d.addMetadata(models.Metadata{
+		KeyId:   keyId,
+		Key:     action.MetadataKeyName.String(),
+		ValueId: metadataValue.Id,
+		Value:   metadataValue.Value,
+	}, log)
+}
+
 func (d *DocumentRule) setDate(action *models.RuleAction, log logFunc) error {
 	if !d.date.IsZero() {
 		if log != nil {
@@ -462,16 +1225,7 @@ func (d *DocumentRule) setDate(action *models.RuleAction, log logFunc) error {
 }
 
 func matchTextAllowTypo(match, text string, matchPrefix, matchIs bool) (bool, error) {
-	// max typos affect greatly the number of false positives, so try to be conservative with them..
-	maxTypos := 0
-	if len(match) > 30 {
-		maxTypos = 3
-	}
-	if len(match) > 20 {
-		maxTypos = 2
-	} else if len(match) > 10 {
-		maxTypos = 1
-	}
+	maxTypos := defaultMaxTypos(match)
 
 	if maxTypos == 0 {
 		if matchPrefix {
@@ -562,21 +1316,50 @@ func matchTextByDistance(match, text string, maxTypos int, matchPrefix, matchIs
 	return false, nil
 }
 
-func matchMetadata(document *models.Document, values *[]models.MetadataValue) error {
+// matchMetadata adds the metadata values that match the document. Single-valued keys that
+// already have a value keep it, and only the first matching value is added for the rest of them.
+func matchMetadata(document *models.Document, values *[]models.MetadataValue, keys []models.MetadataKey) error {
 	logrus.Debugf("match metadata keys for doc: %s, %d rules", document.Id, len(*values))
+	matched := make([]models.Metadata, 0)
 	for _, v := range *values {
+		if !v.MatchDocuments {
+			continue
+		}
 		match, err := documentMatchesFilter(document, v.MatchType, v.MatchFilter)
 		if err != nil {
 			logrus.Debugf("automatic metadata rule, filter error: %v", err)
 			continue
 		}
+		// aliases are matched as whole words
+		for i := 0; match == "" && i < len(v.Aliases); i++ {
+			if documentMatchesAlias(document, v.Aliases[i]) {
+				match = v.Aliases[i]
+			}
+		}
 		if match != "" {
-			addMetadata(document, v.KeyId, v.Id, nil)
+			matched = append(matched, models.Metadata{KeyId: v.KeyId, Key: v.Key, ValueId: v.Id, Value: v.Value})
 		}
 	}
+	for _, v := range models.MergeableMetadata(keys, document.Metadata, matched) {
+		addMetadata(document, v, nil)
+	}
 	return nil
 }
 
+// documentMatchesAlias returns true if document content contains the alias as whole words, ignoring case.
+func documentMatchesAlias(document *models.Document, alias string) bool {
+	alias = strings.TrimSpace(alias)
+	if alias == "" {
+		return false
+	}
+	re, err := regexp.Compile(`(?i)(^|[^\pL\pN])` + regexp.QuoteMeta(alias) + `($|[^\pL\pN])`)
+	if err != nil {
+		logrus.Debugf("compile alias %q: %v", alias, err)
+		return false
+	}
+	return re.MatchString(document.Content)
+}
+
 var reRegexHasSubMatch = regexp.MustCompile("\\(.+\\)")
 
 func documentMatchesFilter(document *models.Document, ruleType models.MetadataRuleType, filter string) (string, error) {
@@ -0,0 +1,521 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+// RuleImportResult summarizes the changes of importing a rule bundle.
+type RuleImportResult struct {
+	RulesCreated  int                  `json:"rules_created"`
+	RulesUpdated  int                  `json:"rules_updated"`
+	RulesSkipped  int                  `json:"rules_skipped"`
+	KeysCreated   int                  `json:"keys_created"`
+	KeysUpdated   int                  `json:"keys_updated"`
+	ValuesCreated int                  `json:"values_created"`
+	ValuesUpdated int                  `json:"values_updated"`
+	TagsCreated   int                  `json:"tags_created"`
+	TagsUpdated   int                  `json:"tags_updated"`
+	Rules         []RuleImportRuleItem `json:"rules"`
+}
+
+// RuleImportRuleItem is the result of importing a single rule.
+type RuleImportRuleItem struct {
+	Name string `json:"name"`
+	// ImportedName differs from name when rule was renamed.
+	ImportedName string `json:"imported_name"`
+	RuleId       int    `json:"rule_id"`
+	// Status is one of 'created', 'updated' or 'skipped'.
+	Status string `json:"status"`
+}
+
+// ExportRules exports all rules of the user with the metadata and tags that rules refer to.
+// If allMetadata is true, all metadata keys, values and tags of the user are exported.
+func ExportRules(db *storage.Database, userId int, allMetadata bool) (*models.RuleBundle, error) {
+	rules, err := db.RuleStore.GetAllUserRules(userId)
+	if err != nil {
+		return nil, fmt.Errorf("get rules: %v", err)
+	}
+	keys, err := db.MetadataStore.GetUserKeys(userId)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata keys: %v", err)
+	}
+	values, err := db.MetadataStore.GetUserValues(userId)
+	if err != nil {
+		return nil, fmt.Errorf("get metadata values: %v", err)
+	}
+	tags, err := db.MetadataStore.GetAllTags(userId)
+	if err != nil {
+		return nil, fmt.Errorf("get tags: %v", err)
+	}
+
+	bundle := &models.RuleBundle{
+		Version:    models.RuleBundleVersion,
+		ExportedAt: time.Now(),
+		Metadata:   []models.RuleBundleKey{},
+		Rules:      make([]models.RuleBundleRule, len(rules)),
+	}
+
+	// referenced key -> values
+	referenced := map[string]map[string]bool{}
+	reference := func(key, value string) {
+		if key == "" {
+			return
+		}
+		if referenced[key] == nil {
+			referenced[key] = map[string]bool{}
+		}
+		if value != "" {
+			referenced[key][value] = true
+		}
+	}
+	referencedTags := map[string]bool{}
+	for i, rule := range rules {
+		bundle.Rules[i] = models.NewRuleBundleRule(rule)
+		for _, v := range rule.AllConditions() {
+			reference(v.MetadataKeyName.String(), v.MetadataValueName.String())
+			referencedTags[v.TagName.String()] = true
+		}
+		for _, v := range rule.Actions {
+			reference(v.MetadataKeyName.String(), v.MetadataValueName.String())
+			referencedTags[v.TagName.String()] = true
+		}
+	}
+	for _, tag := range tags {
+		if allMetadata || referencedTags[tag.Key] {
+			bundle.Tags = append(bundle.Tags, models.RuleBundleTag{Key: tag.Key, Comment: tag.Comment})
+		}
+	}
+
+	keyIndex := make(map[int]int, len(keys))
+	for _, key := range keys {
+		if _, ok := referenced[key.Key]; !ok && !allMetadata {
+			continue
+		}
+		keyIndex[key.Id] = len(bundle.Metadata)
+		bundle.Metadata = append(bundle.Metadata, models.RuleBundleKey{Key: key.Key, Comment: key.Comment,
+			ValueType: key.ValueType})
+	}
+	for _, value := range values {
+		i, ok := keyIndex[value.KeyId]
+		if !ok {
+			continue
+		}
+		key := &bundle.Metadata[i]
+		if !allMetadata && !referenced[key.Key][value.Value] {
+			continue
+		}
+		key.Values = append(key.Values, models.RuleBundleValue{
+			Value:          value.Value,
+			MatchDocuments: value.MatchDocuments,
+			MatchType:      value.MatchType,
+			MatchFilter:    value.MatchFilter,
+		})
+	}
+	return bundle, nil
+}
+
+// ruleImporter imports rule bundle for the user.
+type ruleImporter struct {
+	db     *storage.Database
+	userId int
+	mode   models.RuleImportMode
+	result *RuleImportResult
+
+	keys   map[string]*models.MetadataKey
+	values map[int]map[string]*models.MetadataValue
+	tags   map[string]*models.Tag
+	tx     *storage.RuleImport
+}
+
+// ImportRules imports rules, metadata and tags from the bundle. Metadata keys, values and tags
+// are matched by name and created if they do not exist. Mode defines how to handle rules that have the same name
+// as existing rules. The whole bundle is validated before any changes are made, and changes are made
+// in a single transaction.
+func ImportRules(db *storage.Database, userId int, bundle *models.RuleBundle, mode models.RuleImportMode) (*RuleImportResult, error) {
+	if !mode.Valid() {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("invalid import mode: '%s'", mode)
+		return nil, e
+	}
+	err := bundle.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	importer := &ruleImporter{
+		db:     db,
+		userId: userId,
+		mode:   mode,
+		result: &RuleImportResult{Rules: make([]RuleImportRuleItem, 0, len(bundle.Rules))},
+	}
+	err = importer.loadMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	// validate with metadata that either exists or is created
+	names := map[string]map[string]bool{}
+	for name, key := range importer.keys {
+		names[name] = map[string]bool{}
+		for value := range importer.values[key.Id] {
+			names[name][value] = true
+		}
+	}
+	for _, key := range bundle.Metadata {
+		if names[key.Key] == nil {
+			names[key.Key] = map[string]bool{}
+		}
+		for _, v := range key.Values {
+			names[key.Key][v.Value] = true
+		}
+	}
+	validateResolver := func(key, value string) (models.IntId, models.IntId, error) {
+		values, ok := names[key]
+		if !ok {
+			return 0, 0, metadataNotFound(key, "")
+		}
+		if value == "" {
+			return 1, 0, nil
+		}
+		if !values[value] {
+			return 0, 0, metadataNotFound(key, value)
+		}
+		return 1, 1, nil
+	}
+	tagNames := map[string]bool{}
+	for name := range importer.tags {
+		tagNames[name] = true
+	}
+	for _, tag := range bundle.Tags {
+		tagNames[tag.Key] = true
+	}
+	validateTagResolver := func(tag string) (models.IntId, error) {
+		if !tagNames[tag] {
+			return 0, tagNotFound(tag)
+		}
+		return 1, nil
+	}
+	// values are parsed with the type of existing key, if any
+	types := map[string]models.MetadataValueType{}
+	for _, key := range bundle.Metadata {
+		types[key.Key] = key.ValueType
+		if existing, ok := importer.keys[key.Key]; ok {
+			types[key.Key] = existing.ValueType
+		}
+		for _, v := range key.Values {
+			_, _, err = models.ParseMetadataValue(types[key.Key], v.Value)
+			if err != nil {
+				return nil, bundleValueError(key.Key, err)
+			}
+		}
+	}
+	for name, key := range importer.keys {
+		types[name] = key.ValueType
+	}
+	for i, v := range bundle.Rules {
+		rule, err := v.ToRule(validateResolver, validateTagResolver)
+		if err != nil {
+			return nil, ruleImportError(i, v.Name, err)
+		}
+		err = validateComparedKeys(rule, types)
+		if err != nil {
+			return nil, ruleImportError(i, v.Name, err)
+		}
+	}
+
+	err = db.RuleStore.Import(userId, func(tx *storage.RuleImport) error {
+		importer.tx = tx
+		err := importer.importMetadata(bundle.Metadata)
+		if err != nil {
+			return err
+		}
+		err = importer.importTags(bundle.Tags)
+		if err != nil {
+			return err
+		}
+		return importer.importRules(bundle.Rules)
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("imported rules for user %d: %d created, %d updated, %d skipped", userId,
+		importer.result.RulesCreated, importer.result.RulesUpdated, importer.result.RulesSkipped)
+	return importer.result, nil
+}
+
+// validateComparedKeys checks that metadata comparison conditions of the rule refer to keys that can be compared.
+func validateComparedKeys(rule *models.Rule, types map[string]models.MetadataValueType) error {
+	for _, v := range rule.AllConditions() {
+		if v.ConditionType != models.RuleConditionMetadataValueMoreThan &&
+			v.ConditionType != models.RuleConditionMetadataValueLessThan {
+			continue
+		}
+		valueType := types[v.MetadataKeyName.String()]
+		if !valueType.Comparable() {
+			e := errors.ErrInvalid
+			e.ErrMsg = fmt.Sprintf("metadata key %s of type %s cannot be compared", v.MetadataKeyName, valueType)
+			return e
+		}
+		_, _, err := models.ParseMetadataValue(valueType, v.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ruleImporter) loadMetadata() error {
+	keys, err := r.db.MetadataStore.GetUserKeys(r.userId)
+	if err != nil {
+		return fmt.Errorf("get metadata keys: %v", err)
+	}
+	values, err := r.db.MetadataStore.GetUserValues(r.userId)
+	if err != nil {
+		return fmt.Errorf("get metadata values: %v", err)
+	}
+	r.keys = make(map[string]*models.MetadataKey, len(keys))
+	r.values = make(map[int]map[string]*models.MetadataValue, len(keys))
+	for i := range keys {
+		r.keys[keys[i].Key] = &keys[i]
+		r.values[keys[i].Id] = map[string]*models.MetadataValue{}
+	}
+	for i := range values {
+		v := &values[i]
+		if r.values[v.KeyId] == nil {
+			r.values[v.KeyId] = map[string]*models.MetadataValue{}
+		}
+		r.values[v.KeyId][v.Value] = v
+	}
+
+	tags, err := r.db.MetadataStore.GetAllTags(r.userId)
+	if err != nil {
+		return fmt.Errorf("get tags: %v", err)
+	}
+	r.tags = make(map[string]*models.Tag, len(tags))
+	for i := range tags {
+		r.tags[tags[i].Key] = &tags[i].Tag
+	}
+	return nil
+}
+
+func (r *ruleImporter) importMetadata(metadata []models.RuleBundleKey) error {
+	for _, bundleKey := range metadata {
+		key, ok := r.keys[bundleKey.Key]
+		if !ok {
+			key = &models.MetadataKey{UserId: r.userId, Key: bundleKey.Key, Comment: bundleKey.Comment,
+				ValueType: bundleKey.ValueType}
+			err := r.tx.CreateKey(key)
+			if err != nil {
+				return fmt.Errorf("create metadata key %s: %v", key.Key, err)
+			}
+			r.keys[key.Key] = key
+			r.values[key.Id] = map[string]*models.MetadataValue{}
+			r.result.KeysCreated += 1
+		} else if r.mode == models.RuleImportOverwrite && key.Comment != bundleKey.Comment {
+			key.Comment = bundleKey.Comment
+			err := r.tx.UpdateKeyComment(key)
+			if err != nil {
+				return fmt.Errorf("update metadata key %s: %v", key.Key, err)
+			}
+			r.result.KeysUpdated += 1
+		}
+
+		for _, bundleValue := range bundleKey.Values {
+			value, ok := r.values[key.Id][bundleValue.Value]
+			if !ok {
+				value = &models.MetadataValue{
+					UserId:         r.userId,
+					KeyId:          key.Id,
+					Key:            key.Key,
+					Value:          bundleValue.Value,
+					MatchDocuments: bundleValue.MatchDocuments,
+					MatchType:      bundleValue.MatchType,
+					MatchFilter:    bundleValue.MatchFilter,
+				}
+				err := r.tx.CreateValue(value)
+				if err != nil {
+					return fmt.Errorf("create metadata value %s:%s: %v", key.Key, value.Value, err)
+				}
+				// typed values are normalized, rules refer to the name in the bundle
+				r.values[key.Id][bundleValue.Value] = value
+				r.result.ValuesCreated += 1
+			} else if r.mode == models.RuleImportOverwrite && (value.MatchDocuments != bundleValue.MatchDocuments ||
+				value.MatchType != bundleValue.MatchType || value.MatchFilter != bundleValue.MatchFilter) {
+				value.MatchDocuments = bundleValue.MatchDocuments
+				value.MatchType = bundleValue.MatchType
+				value.MatchFilter = bundleValue.MatchFilter
+				err := r.tx.UpdateValue(value)
+				if err != nil {
+					return fmt.Errorf("update metadata value %s:%s: %v", key.Key, value.Value, err)
+				}
+				r.result.ValuesUpdated += 1
+			}
+		}
+	}
+	return nil
+}
+
+func (r *ruleImporter) importTags(tags []models.RuleBundleTag) error {
+	for _, bundleTag := range tags {
+		tag, ok := r.tags[bundleTag.Key]
+		if !ok {
+			tag = &models.Tag{Key: bundleTag.Key, Comment: bundleTag.Comment}
+			err := r.tx.CreateTag(tag)
+			if err != nil {
+				return fmt.Errorf("create tag %s: %v", tag.Key, err)
+			}
+			r.tags[tag.Key] = tag
+			r.result.TagsCreated += 1
+		} else if r.mode == models.RuleImportOverwrite && tag.Comment != bundleTag.Comment {
+			tag.Comment = bundleTag.Comment
+			err := r.tx.UpdateTag(tag)
+			if err != nil {
+				return fmt.Errorf("update tag %s: %v", tag.Key, err)
+			}
+			r.result.TagsUpdated += 1
+		}
+	}
+	return nil
+}
+
+func (r *ruleImporter) resolveTag(tag string) (models.IntId, error) {
+	t, ok := r.tags[tag]
+	if !ok {
+		return 0, tagNotFound(tag)
+	}
+	return models.IntId(t.Id), nil
+}
+
+func (r *ruleImporter) resolve(key, value string) (models.IntId, models.IntId, error) {
+	k, ok := r.keys[key]
+	if !ok {
+		return 0, 0, metadataNotFound(key, "")
+	}
+	if value == "" {
+		return models.IntId(k.Id), 0, nil
+	}
+	v, ok := r.values[k.Id][value]
+	if !ok {
+		return 0, 0, metadataNotFound(key, value)
+	}
+	return models.IntId(k.Id), models.IntId(v.Id), nil
+}
+
+func (r *ruleImporter) importRules(rules []models.RuleBundleRule) error {
+	existing, err := r.db.RuleStore.GetAllUserRules(r.userId)
+	if err != nil {
+		return fmt.Errorf("get rules: %v", err)
+	}
+	byName := make(map[string]*models.Rule, len(existing))
+	for _, v := range existing {
+		byName[v.Name] = v
+	}
+
+	for i, bundleRule := range rules {
+		rule, err := bundleRule.ToRule(r.resolve, r.resolveTag)
+		if err != nil {
+			return ruleImportError(i, bundleRule.Name, err)
+		}
+		item := RuleImportRuleItem{Name: bundleRule.Name, ImportedName: rule.Name}
+		old, exists := byName[rule.Name]
+		switch {
+		case exists && r.mode == models.RuleImportSkip:
+			item.RuleId = old.Id
+			item.Status = "skipped"
+			r.result.RulesSkipped += 1
+		case exists && r.mode == models.RuleImportOverwrite:
+			rule.Id = old.Id
+			rule.Order = old.Order
+			err = r.tx.UpdateRule(rule)
+			if err != nil {
+				return ruleImportError(i, bundleRule.Name, err)
+			}
+			item.RuleId = rule.Id
+			item.Status = "updated"
+			r.result.RulesUpdated += 1
+		default:
+			if exists {
+				rule.Name = uniqueRuleName(rule.Name, byName)
+				item.ImportedName = rule.Name
+			}
+			err = r.tx.AddRule(rule)
+			if err != nil {
+				return ruleImportError(i, bundleRule.Name, err)
+			}
+			byName[rule.Name] = rule
+			item.RuleId = rule.Id
+			item.Status = "created"
+			r.result.RulesCreated += 1
+		}
+		r.result.Rules = append(r.result.Rules, item)
+	}
+	return nil
+}
+
+// uniqueRuleName returns name with the first free suffix, e.g. 'Invoices (2)'.
+func uniqueRuleName(name string, existing map[string]*models.Rule) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", name, i)
+		if _, ok := existing[candidate]; !ok {
+			return candidate
+		}
+	}
+}
+
+func metadataNotFound(key, value string) error {
+	e := errors.ErrInvalid
+	if value == "" {
+		e.ErrMsg = fmt.Sprintf("metadata key '%s' not found", key)
+	} else {
+		e.ErrMsg = fmt.Sprintf("metadata value '%s' not found for key '%s'", value, key)
+	}
+	return e
+}
+
+func tagNotFound(tag string) error {
+	e := errors.ErrInvalid
+	e.ErrMsg = fmt.Sprintf("tag '%s' not found", tag)
+	return e
+}
+
+// bundleValueError adds metadata key to the error of invalid value.
+func bundleValueError(key string, err error) error {
+	if e, ok := err.(errors.Error); ok {
+		e.ErrMsg = fmt.Sprintf("metadata key %s: %s", key, e.ErrMsg)
+		return e
+	}
+	return fmt.Errorf("metadata key %s: %v", key, err)
+}
+
+// ruleImportError adds rule position and name to the error.
+func ruleImportError(index int, name string, err error) error {
+	if e, ok := err.(errors.Error); ok {
+		e.ErrMsg = fmt.Sprintf("rule %d (%s): %s", index+1, name, e.ErrMsg)
+		return e
+	}
+	return fmt.Errorf("rule %d (%s): %v", index+1, name, err)
+}
@@ -0,0 +1,55 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"testing"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_validateComparedKeys(t *testing.T) {
+	types := map[string]models.MetadataValueType{
+		"amount":  models.MetadataValueDecimal,
+		"company": models.MetadataValueText,
+	}
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"decimal", "amount", "100,5", false},
+		{"invalid value", "amount", "a lot", true},
+		{"text key", "company", "100", true},
+		{"missing key", "year", "2020", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &models.Rule{Conditions: []*models.RuleCondition{
+				{ConditionType: models.RuleConditionNameContains, Value: "invoice"},
+				{ConditionType: models.RuleConditionMetadataValueMoreThan, MetadataKeyName: models.Text(tt.key), Value: tt.value},
+			}}
+			err := validateComparedKeys(rule, types)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateComparedKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/mail"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+// maximum number of documents a single link documents action links the document to.
+const maxRuleLinkedDocuments = 50
+
+// DocumentSearcher searches documents of the user, e.g. search.Engine.
+type DocumentSearcher interface {
+	SearchDocuments(userId int, query string, sort storage.SortKey, paging storage.Paging) ([]*models.Document, int, error)
+}
+
+// RuleNotification is a message that rule sends to the owner of the document.
+type RuleNotification struct {
+	RuleId   int
+	RuleName string
+	Message  string
+}
+
+// RuleEffects contains the changes of rule actions that are not stored in the document itself.
+// They are applied after the document is saved and never when testing the rule or in dry-run mode.
+type RuleEffects struct {
+	LinkDocuments []string
+	Trash         bool
+	// TrashRuleId is the rule that moved the document to trash.
+	TrashRuleId   int
+	Notifications []RuleNotification
+}
+
+// merge adds effects from other.
+func (e *RuleEffects) merge(other RuleEffects) {
+	for _, id := range other.LinkDocuments {
+		found := false
+		for _, existing := range e.LinkDocuments {
+			if existing == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			e.LinkDocuments = append(e.LinkDocuments, id)
+		}
+	}
+	if !e.Trash && other.Trash {
+		e.Trash = true
+		e.TrashRuleId = other.TrashRuleId
+	}
+	e.Notifications = append(e.Notifications, other.Notifications...)
+}
+
+func (e *RuleEffects) empty() bool {
+	return len(e.LinkDocuments) == 0 && !e.Trash && len(e.Notifications) == 0
+}
+
+// applyRuleEffects links documents, moves document to trash and sends notifications.
+// History of the effects is saved with the rule executions, except moving to trash, which is
+// recorded only after the document was moved. Use withoutEffectHistory for the rest of the history.
+func applyRuleEffects(db *storage.Database, doc *models.Document, effects *RuleEffects) error {
+	if effects == nil || effects.empty() {
+		return nil
+	}
+	failed := make([]string, 0)
+	if len(effects.LinkDocuments) > 0 {
+		err := db.MetadataStore.AddLinkedDocuments(doc.Id, effects.LinkDocuments)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("link documents: %v", err))
+		}
+	}
+	if effects.Trash && !doc.DeletedAt.Valid {
+		err := db.DocumentStore.MoveToTrash(doc.Id, effects.TrashRuleId)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("move to trash: %v", err))
+		} else {
+			doc.DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	for _, v := range effects.Notifications {
+		err := notifyOwner(db, doc, v)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("notify (rule %d): %v", v.RuleId, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// withoutEffectHistory returns history without the items that applyRuleEffects records itself.
+func withoutEffectHistory(history []models.DocumentHistory) []models.DocumentHistory {
+	filtered := make([]models.DocumentHistory, 0, len(history))
+	for _, v := range history {
+		if v.RuleId == 0 || v.Action != models.DocumentHistoryActionDelete {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+// notifyOwner sends the notification to the document owner by email.
+func notifyOwner(db *storage.Database, doc *models.Document, notification RuleNotification) error {
+	if !mail.MailEnabled() {
+		logrus.Warningf("mail is not configured, cannot send notification of rule %d for document %s",
+			notification.RuleId, doc.Id)
+		return nil
+	}
+	user, err := db.UserStore.GetUser(doc.UserId)
+	if err != nil {
+		return fmt.Errorf("get user: %v", err)
+	}
+	if user.Email == "" {
+		logrus.Warningf("user %d does not have email, cannot send notification of rule %d",
+			doc.UserId, notification.RuleId)
+		return nil
+	}
+	subject := fmt.Sprintf("Virtualpaper: %s", doc.Name)
+	msg := fmt.Sprintf("%s\r\n\r\nDocument: %s (%s)\r\nRule: %s", notification.Message, doc.Name, doc.Id, notification.RuleName)
+	return mail.SendMail(subject, msg, user.Email)
+}
+
+// addActionHistory records change of action that is not visible in document fields.
+func (d *DocumentRule) addActionHistory(action, oldValue, newValue string) {
+	d.actionHistory = append(d.actionHistory, models.DocumentHistory{
+		DocumentId: d.Document.Id,
+		Action:     action,
+		OldValue:   oldValue,
+		NewValue:   newValue,
+		UserId:     storage.UserIdInternal,
+	})
+}
+
+func (d *DocumentRule) linkDocuments(action *models.RuleAction, log logFunc) error {
+	query, err := d.renderTemplate(action.Value, log)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(query) == "" {
+		e := errors.ErrInvalid
+		e.ErrMsg = "search query is empty"
+		return e
+	}
+	if d.Search == nil {
+		e := errors.ErrInternalError
+		e.ErrMsg = "search engine not available"
+		return e
+	}
+
+	paging := storage.Paging{Offset: 0, Limit: maxRuleLinkedDocuments + 1}
+	docs, _, err := d.Search.SearchDocuments(d.Document.UserId, query, storage.SortKey{}, paging)
+	if err != nil {
+		return fmt.Errorf("search documents: %v", err)
+	}
+	ids := make([]string, 0, len(docs))
+	for _, v := range docs {
+		if v.Id == d.Document.Id || len(ids) >= maxRuleLinkedDocuments {
+			continue
+		}
+		ids = append(ids, v.Id)
+	}
+	if len(ids) == 0 {
+		if log != nil {
+			log("no documents found with query '%s'", query)
+		}
+		return nil
+	}
+	d.Effects.merge(RuleEffects{LinkDocuments: ids})
+	d.addActionHistory(models.DocumentHistoryActionLinkDocuments, "", strings.Join(ids, ","))
+	if log != nil {
+		log("link %d documents found with query '%s': %s", len(ids), query, strings.Join(ids, ", "))
+	}
+	return nil
+}
+
+func (d *DocumentRule) trash(log logFunc) {
+	if d.Document.DeletedAt.Valid || d.Effects.Trash {
+		if log != nil {
+			log("document is already in trash")
+		}
+		return
+	}
+	d.Effects.Trash = true
+	d.Effects.TrashRuleId = d.Rule.Id
+	d.addActionHistory(models.DocumentHistoryActionDelete, "", "")
+	if log != nil {
+		log("move document to trash")
+	}
+}
+
+func (d *DocumentRule) notify(action *models.RuleAction, log logFunc) error {
+	if d.Trigger == models.RuleTriggerSchedule && d.Notified[d.Rule.Id] {
+		if log != nil {
+			log("rule has already notified of the document")
+		}
+		return nil
+	}
+	message, err := d.renderTemplate(action.Value, log)
+	if err != nil {
+		return err
+	}
+	d.Effects.Notifications = append(d.Effects.Notifications, RuleNotification{
+		RuleId:   d.Rule.Id,
+		RuleName: d.Rule.Name,
+		Message:  message,
+	})
+	d.addActionHistory(models.DocumentHistoryActionNotify, "", message)
+	if log != nil {
+		log("send notification: %s", message)
+	}
+	return nil
+}
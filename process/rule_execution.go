@@ -0,0 +1,192 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+// Execute matches the document with the rule and runs the actions if document matches.
+// The returned execution records the result of each condition and the changes of each action.
+// Changes are also returned as document history items that refer to the rule.
+func (d *DocumentRule) Execute() (*models.RuleExecution, []models.DocumentHistory) {
+	logrus.Debugf("execute rule %d for document: %s", d.Rule.Id, d.Document.Id)
+	conditions := d.Rule.AllConditions()
+	execution := &models.RuleExecution{
+		DocumentId:  d.Document.Id,
+		RuleId:      models.IntId(d.Rule.Id),
+		RuleName:    d.Rule.Name,
+		RuleVersion: d.Rule.Version,
+		Trigger:     d.Trigger,
+		Conditions:  make(models.RuleConditionResults, len(conditions)),
+		Actions:     models.RuleActionResults{},
+	}
+	history := make([]models.DocumentHistory, 0)
+
+	eval := &ruleEvaluation{
+		audit: execution.Conditions,
+		index: make(map[*models.RuleCondition]int, len(conditions)),
+	}
+	for i, v := range conditions {
+		eval.index[v] = i
+		execution.Conditions[i] = models.RuleConditionResult{
+			ConditionId:   v.Id,
+			ConditionType: v.ConditionType.String(),
+			ParentId:      int(v.ParentId),
+			Skipped:       true,
+		}
+	}
+
+	d.captures = nil
+	d.actionHistory = nil
+	d.Effects = RuleEffects{}
+	d.Stopped = false
+	matched, _, err := d.evaluateGroup(nil, d.Rule.Conditions, eval)
+	if err != nil {
+		execution.Error = fmt.Sprintf("match rule: %v", err)
+		return execution, history
+	}
+	execution.Matched = matched
+	if !matched {
+		return execution, history
+	}
+
+	for _, action := range d.Rule.Actions {
+		if !action.Enabled {
+			continue
+		}
+		before := snapshotDocument(d.Document)
+		err = d.runAction(action, nil)
+
+		result := models.RuleActionResult{
+			ActionId:   action.Id,
+			ActionType: action.Action.String(),
+			Changes:    []models.RuleActionChange{},
+		}
+		changes, diffErr := d.documentChanges(before)
+		if diffErr != nil {
+			logrus.Errorf("rule %d, get changes of action %d: %v", d.Rule.Id, action.Id, diffErr)
+		}
+		for _, v := range changes {
+			result.Changes = append(result.Changes, models.RuleActionChange{
+				Action:   v.Action,
+				OldValue: v.OldValue,
+				NewValue: v.NewValue,
+			})
+		}
+		history = append(history, changes...)
+
+		if err != nil {
+			result.Error = err.Error()
+			execution.Error = fmt.Sprintf("action %d: %v", action.Id, err)
+			execution.Actions = append(execution.Actions, result)
+			break
+		}
+		execution.Actions = append(execution.Actions, result)
+	}
+
+	return execution, history
+}
+
+// enforceRulesMetadataConstraints checks metadata key constraints once after all rules have run on the document,
+// so that a later rule can still add the metadata required by an earlier one. If the rules add violations,
+// metadata is reverted to original, the metadata changes of rules are removed from history and
+// the error is added to the executions that changed metadata.
+func enforceRulesMetadataConstraints(store MetadataValueStore, doc *models.Document, original []models.Metadata,
+	executions []*models.RuleExecution, history []models.DocumentHistory) []models.DocumentHistory {
+	err := enforceMetadataConstraints(store, doc, original)
+	if err == nil {
+		return history
+	}
+	logrus.Warningf("document %s: %v", doc.Id, err)
+	for _, execution := range executions {
+		if !executionChangedMetadata(execution) {
+			continue
+		}
+		if execution.Error == "" {
+			execution.Error = err.Error()
+		} else {
+			execution.Error += "; " + err.Error()
+		}
+	}
+	return withoutMetadataChanges(history)
+}
+
+// executionChangedMetadata returns true if any action of the execution changed metadata.
+func executionChangedMetadata(execution *models.RuleExecution) bool {
+	for _, action := range execution.Actions {
+		for _, change := range action.Changes {
+			if change.Action == models.DocumentHistoryActionMetadataAdd ||
+				change.Action == models.DocumentHistoryActionMetadataRemove {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// documentChanges returns the changes from before to the current document as history items of the rule.
+func (d *DocumentRule) documentChanges(before *models.Document) ([]models.DocumentHistory, error) {
+	changes, err := before.Diff(d.Document, storage.UserIdInternal)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, models.MetadataDiff(d.Document.Id, storage.UserIdInternal, &before.Metadata, &d.Document.Metadata)...)
+	changes = append(changes, models.TagDiff(d.Document.Id, storage.UserIdInternal, before.Tags, d.Document.Tags)...)
+	changes = append(changes, d.actionHistory...)
+	d.actionHistory = nil
+	for i := range changes {
+		changes[i].RuleId = models.IntId(d.Rule.Id)
+	}
+	return changes, nil
+}
+
+// snapshotDocument copies the document fields that actions modify.
+func snapshotDocument(doc *models.Document) *models.Document {
+	snapshot := *doc
+	snapshot.Metadata = make([]models.Metadata, len(doc.Metadata))
+	copy(snapshot.Metadata, doc.Metadata)
+	snapshot.Tags = make([]models.Tag, len(doc.Tags))
+	copy(snapshot.Tags, doc.Tags)
+	return &snapshot
+}
+
+// metadataChanged returns true if history contains changes of document metadata.
+func metadataChanged(history []models.DocumentHistory) bool {
+	for _, v := range history {
+		if v.Action == models.DocumentHistoryActionMetadataAdd || v.Action == models.DocumentHistoryActionMetadataRemove {
+			return true
+		}
+	}
+	return false
+}
+
+// tagsChanged returns true if history contains changes of document tags.
+func tagsChanged(history []models.DocumentHistory) bool {
+	for _, v := range history {
+		if v.Action == models.DocumentHistoryActionTagAdd || v.Action == models.DocumentHistoryActionTagRemove {
+			return true
+		}
+	}
+	return false
+}
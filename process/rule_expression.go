@@ -0,0 +1,130 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// newRuleExpressionEnv creates the view of the document for expression conditions.
+func newRuleExpressionEnv(doc *models.Document) models.RuleExpressionEnv {
+	env := models.RuleExpressionEnv{
+		Name:          doc.Name,
+		Description:   doc.Description,
+		Content:       doc.Content,
+		Filename:      doc.Filename,
+		Mimetype:      doc.Mimetype,
+		Source:        string(doc.Source),
+		Size:          doc.Size,
+		Pages:         documentPages(doc),
+		Date:          doc.Date,
+		CreatedAt:     doc.CreatedAt,
+		Metadata:      make(map[string][]string, len(doc.Metadata)),
+		MetadataCount: len(doc.Metadata),
+		Tags:          make([]string, len(doc.Tags)),
+		Fields:        make(map[string]string, len(doc.Fields)),
+	}
+	for i, v := range doc.Tags {
+		env.Tags[i] = v.Key
+	}
+	for _, v := range doc.Metadata {
+		env.Metadata[v.Key] = append(env.Metadata[v.Key], v.Value)
+	}
+	for _, v := range doc.Fields {
+		env.Fields[v.Name] = v.Value
+	}
+	return env
+}
+
+// ruleExpression is the compiled program of expression condition.
+type ruleExpression struct {
+	program *vm.Program
+	err     error
+}
+
+// expression returns the compiled program of the condition. Programs are compiled once per DocumentRule.
+func (d *DocumentRule) expression(condition *models.RuleCondition) (*vm.Program, error) {
+	if d.expressions == nil {
+		d.expressions = map[*models.RuleCondition]*ruleExpression{}
+	}
+	compiled, ok := d.expressions[condition]
+	if !ok {
+		compiled = &ruleExpression{}
+		compiled.program, compiled.err = models.CompileRuleExpression(condition.Value)
+		d.expressions[condition] = compiled
+	}
+	return compiled.program, compiled.err
+}
+
+// runExpression runs the program and returns an error if it does not finish in
+// models.MaxRuleExpressionDuration. The compile time limits of the expression bound the work that
+// is left running after a timeout.
+func runExpression(program *vm.Program, env models.RuleExpressionEnv) (interface{}, error) {
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := expr.Run(program, env)
+		done <- result{value: value, err: err}
+	}()
+	timer := time.NewTimer(models.MaxRuleExpressionDuration)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("timeout after %s", models.MaxRuleExpressionDuration)
+	}
+}
+
+// matchExpression evaluates expression condition. Errors in the expression are returned and written
+// to the condition output. See models.CompileRuleExpression for the limits of evaluation.
+func (d *DocumentRule) matchExpression(condition *models.RuleCondition, eval *ruleEvaluation) (bool, error) {
+	program, err := d.expression(condition)
+	if err != nil {
+		eval.output(condition, "%v", err)
+		return false, err
+	}
+
+	value, err := runExpression(program, newRuleExpressionEnv(d.Document))
+	if err != nil {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("expression failed: %v", err)
+		e.Err = err
+		eval.output(condition, "%s", e.ErrMsg)
+		return false, e
+	}
+	ok, isBool := value.(bool)
+	if !isBool {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("expression returned %T, expected bool", value)
+		eval.output(condition, "%s", e.ErrMsg)
+		return false, e
+	}
+	eval.output(condition, "expression returned %t", ok)
+	return ok, nil
+}
@@ -0,0 +1,198 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// textPosition is where the value must be found in the text.
+type textPosition int
+
+const (
+	textContains textPosition = iota
+	textStarts
+	textIs
+)
+
+// matchTextMode matches value to text with the match mode of the condition. Value and text must already
+// be in lowercase if case is ignored. Explanation of the match is stored for the test output.
+func (d *DocumentRule) matchTextMode(condition *models.RuleCondition, value, text string, position textPosition) (bool, error) {
+	switch condition.MatchMode {
+	case models.RuleMatchDefault:
+		maxTypos := defaultMaxTypos(value)
+		d.textMatch = fmt.Sprintf("match mode 'default': allow %d typos for value of %d characters", maxTypos, len(value))
+		return matchTextAllowTypo(value, text, position == textStarts, position == textIs)
+	case models.RuleMatchExact, models.RuleMatchCaseInsensitive:
+		d.textMatch = fmt.Sprintf("match mode '%s': no typos allowed", condition.MatchMode)
+		return matchTextExact(value, text, position), nil
+	case models.RuleMatchFuzzy:
+		distance, limit := fuzzyDistance(value, text, position, condition.MatchMaxDistance, condition.MatchMinSimilarity)
+		d.textMatch = fmt.Sprintf("match mode 'fuzzy': closest match has %d edits, max %d allowed", distance, limit)
+		return distance <= limit, nil
+	case models.RuleMatchTokenSet:
+		found, total := matchTokenSet(value, text, position)
+		d.textMatch = fmt.Sprintf("match mode 'token_set': found %d of %d words", found, total)
+		if position == textIs {
+			return found == total && len(uniqueTokens(text)) == total, nil
+		}
+		return total > 0 && found == total, nil
+	case models.RuleMatchOcr:
+		value = normalizeOcrText(value, condition.IgnoreCase())
+		text = normalizeOcrText(text, condition.IgnoreCase())
+		d.textMatch = fmt.Sprintf("match mode 'ocr': match '%s' to text with OCR-confused characters normalized", value)
+		return matchTextExact(value, text, position), nil
+	default:
+		return false, fmt.Errorf("unknown match mode: %s", condition.MatchMode)
+	}
+}
+
+func matchTextExact(value, text string, position textPosition) bool {
+	switch position {
+	case textStarts:
+		return strings.HasPrefix(text, value)
+	case textIs:
+		return text == value
+	default:
+		return strings.Contains(text, value)
+	}
+}
+
+// defaultMaxTypos returns the number of typos allowed in the default match mode.
+func defaultMaxTypos(match string) int {
+	// max typos affect greatly the number of false positives, so try to be conservative with them..
+	maxTypos := 0
+	if len(match) > 30 {
+		maxTypos = 3
+	}
+	if len(match) > 20 {
+		maxTypos = 2
+	} else if len(match) > 10 {
+		maxTypos = 1
+	}
+	return maxTypos
+}
+
+// fuzzyDistance returns the smallest edit distance between value and text, and the maximum distance allowed.
+// If maxDistance is 0, the limit is calculated from minSimilarity and the length of the value,
+// or the longer of value and text when whole text must match.
+func fuzzyDistance(value, text string, position textPosition, maxDistance int, minSimilarity float64) (int, int) {
+	valueRunes := []rune(value)
+	textRunes := []rune(text)
+
+	limit := maxDistance
+	if limit == 0 {
+		length := len(valueRunes)
+		if position == textIs && len(textRunes) > length {
+			length = len(textRunes)
+		}
+		limit = int(math.Floor((1 - minSimilarity) * float64(length)))
+	}
+	return editDistance(valueRunes, textRunes, position), limit
+}
+
+// editDistance returns the Levenshtein distance between value and the closest part of the text:
+// any substring when position is textContains, a prefix when textStarts and the whole text when textIs.
+func editDistance(value, text []rune, position textPosition) int {
+	// previous and current row, indexed by text position
+	prev := make([]int, len(text)+1)
+	curr := make([]int, len(text)+1)
+	for j := range prev {
+		if position != textContains {
+			prev[j] = j
+		}
+	}
+	for i := 1; i <= len(value); i++ {
+		curr[0] = i
+		for j := 1; j <= len(text); j++ {
+			cost := 1
+			if value[i-1] == text[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j-1]+cost, minInt(prev[j]+1, curr[j-1]+1))
+		}
+		prev, curr = curr, prev
+	}
+
+	if position == textIs {
+		return prev[len(text)]
+	}
+	best := prev[0]
+	for _, v := range prev {
+		if v < best {
+			best = v
+		}
+	}
+	return best
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// matchTokenSet returns the number of unique words of the value that are found in the text, and
+// the total number of unique words in the value. When position is textStarts, words must be found at
+// the beginning of the text.
+func matchTokenSet(value, text string, position textPosition) (int, int) {
+	valueTokens := uniqueTokens(value)
+	textTokens := tokenize(text)
+	if position == textStarts && len(textTokens) > len(valueTokens) {
+		textTokens = textTokens[:len(valueTokens)]
+	}
+	found := make(map[string]bool, len(valueTokens))
+	for _, v := range textTokens {
+		if valueTokens[v] {
+			found[v] = true
+		}
+	}
+	return len(found), len(valueTokens)
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func uniqueTokens(text string) map[string]bool {
+	tokens := map[string]bool{}
+	for _, v := range tokenize(text) {
+		tokens[v] = true
+	}
+	return tokens
+}
+
+// normalizeOcrText replaces characters that OCR often confuses with a single character:
+// 'rn' with 'm', '0' with 'O' and '1' and 'I' with 'l'. If case is ignored, text is already in lowercase,
+// '0' is replaced with 'o' and 'i' with 'l'.
+func normalizeOcrText(text string, ignoreCase bool) string {
+	text = strings.ReplaceAll(text, "rn", "m")
+	if ignoreCase {
+		return strings.NewReplacer("0", "o", "1", "l", "i", "l").Replace(text)
+	}
+	return strings.NewReplacer("0", "O", "1", "l", "I", "l").Replace(text)
+}
@@ -3,10 +3,13 @@ package process
 import (
 	"database/sql"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
 )
 
 func TestDocumentRule_matchText(t *testing.T) {
@@ -714,6 +717,42 @@ func TestDocumentRule_extractDates(t *testing.T) {
 			wantErr:  false,
 			wantDate: "2021-08-05",
 		},
+		{
+			name: "detect dates automatically",
+			fields: fields{
+				Document: &models.Document{
+					Content: `Invoice date 30.7.2020. Due date 3rd of August 2021.`,
+				},
+				date: time.Time{},
+			},
+			args: args{
+				condition: &models.RuleCondition{
+					ConditionType: models.RuleConditionDateIs,
+				},
+			},
+			want:     true,
+			wantErr:  false,
+			wantDate: "2021-08-03",
+		},
+		{
+			name: "date format fallback",
+			fields: fields{
+				Document: &models.Document{
+					Content: `Due: March 5, 2020`,
+				},
+				date: time.Time{},
+			},
+			args: args{
+				condition: &models.RuleCondition{
+					ConditionType: models.RuleConditionDateIs,
+					Value:         "Due: (.*)",
+					DateFmt:       "2006-01-02",
+				},
+			},
+			want:     true,
+			wantErr:  false,
+			wantDate: "2020-03-05",
+		},
 	}
 
 	for _, tt := range tests {
@@ -744,3 +783,1037 @@ func TestDocumentRule_extractDates(t *testing.T) {
 		})
 	}
 }
+
+func TestDocumentRule_matchProperty(t *testing.T) {
+	doc := &models.Document{
+		Id:       "1234",
+		Name:     "scan.pdf",
+		Mimetype: "application/pdf",
+		Properties: []models.DocumentProperty{
+			{Key: "author", Value: "Acme Ltd", Source: "pdfinfo"},
+			{Key: "producer", Value: "Scanner software 1.2", Source: "pdfinfo"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		condition *models.RuleCondition
+		want      bool
+	}{
+		{
+			name: "property is",
+			condition: &models.RuleCondition{Enabled: true, CaseInsensitive: true,
+				ConditionType: models.RuleConditionPropertyIs, PropertyKey: "Author", Value: "acme ltd"},
+			want: true,
+		},
+		{
+			name: "property starts",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionPropertyStarts, PropertyKey: "producer", Value: "Scanner"},
+			want: true,
+		},
+		{
+			name: "property contains regex",
+			condition: &models.RuleCondition{Enabled: true, IsRegex: true,
+				ConditionType: models.RuleConditionPropertyContains, PropertyKey: "producer", Value: `\d\.\d`},
+			want: true,
+		},
+		{
+			name: "property does not exist",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionPropertyContains, PropertyKey: "title", Value: "Acme"},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := NewDocumentRule(doc, &models.Rule{Mode: models.RuleMatchAll, Conditions: []*models.RuleCondition{tt.condition}})
+			got, err := dc.Match()
+			if err != nil {
+				t.Errorf("Match() error = %v", err)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Match() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentRule_matchField(t *testing.T) {
+	doc := &models.Document{
+		Id: "1234",
+		Fields: []models.DocumentField{
+			{Name: models.DocumentFieldAmount, Value: "120.50", Confidence: 0.8},
+			{Name: models.DocumentFieldDueDate, Value: "2023-01-31", Confidence: 0.8},
+			{Name: models.DocumentFieldIban, Value: "FI2112345600000785", Confidence: 0.95},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		condition *models.RuleCondition
+		want      bool
+		wantErr   bool
+	}{
+		{
+			name: "field exists",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionFieldExists, FieldName: models.DocumentFieldIban},
+			want: true,
+		},
+		{
+			name: "field does not exist",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionFieldExists, FieldName: models.DocumentFieldVatId},
+			want: false,
+		},
+		{
+			name: "field is",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionFieldIs, FieldName: models.DocumentFieldIban, Value: "FI2112345600000785"},
+			want: true,
+		},
+		{
+			name: "field contains",
+			condition: &models.RuleCondition{Enabled: true, CaseInsensitive: true,
+				ConditionType: models.RuleConditionFieldContains, FieldName: models.DocumentFieldIban, Value: "fi21"},
+			want: true,
+		},
+		{
+			name: "amount more than",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionFieldMoreThan, FieldName: models.DocumentFieldAmount, Value: "100"},
+			want: true,
+		},
+		{
+			name: "amount less than",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionFieldLessThan, FieldName: models.DocumentFieldAmount, Value: "100"},
+			want: false,
+		},
+		{
+			name: "due date before",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionFieldLessThan, FieldName: models.DocumentFieldDueDate, Value: "2023-02-01"},
+			want: true,
+		},
+		{
+			name: "invalid number",
+			condition: &models.RuleCondition{Enabled: true,
+				ConditionType: models.RuleConditionFieldMoreThan, FieldName: models.DocumentFieldAmount, Value: "abc"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := NewDocumentRule(doc, &models.Rule{Mode: models.RuleMatchAll, Conditions: []*models.RuleCondition{tt.condition}})
+			got, err := dc.Match()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Match() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Match() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentRule_matchConditionGroups(t *testing.T) {
+	doc := &models.Document{
+		Id:      "1234",
+		Name:    "invoice-2023.pdf",
+		Content: "Invoice from Acme Ltd",
+	}
+	nameContains := func(value string) *models.RuleCondition {
+		return &models.RuleCondition{Enabled: true, ConditionType: models.RuleConditionNameContains, Value: value}
+	}
+	contentContains := func(value string) *models.RuleCondition {
+		return &models.RuleCondition{Enabled: true, ConditionType: models.RuleConditionContentContains, Value: value}
+	}
+	group := func(conditionType models.RuleConditionType, conditions ...*models.RuleCondition) *models.RuleCondition {
+		return &models.RuleCondition{Enabled: true, ConditionType: conditionType, Conditions: conditions}
+	}
+
+	tests := []struct {
+		name       string
+		mode       models.RuleConditionMatchType
+		conditions []*models.RuleCondition
+		want       bool
+	}{
+		{
+			name: "and with nested or",
+			mode: models.RuleMatchAll,
+			conditions: []*models.RuleCondition{
+				nameContains("invoice"),
+				group(models.RuleConditionGroupOr, contentContains("Globex"), contentContains("Acme")),
+			},
+			want: true,
+		},
+		{
+			name: "nested or does not match",
+			mode: models.RuleMatchAll,
+			conditions: []*models.RuleCondition{
+				nameContains("invoice"),
+				group(models.RuleConditionGroupOr, contentContains("Globex"), contentContains("Initech")),
+			},
+			want: false,
+		},
+		{
+			name: "not group",
+			mode: models.RuleMatchAll,
+			conditions: []*models.RuleCondition{
+				nameContains("invoice"),
+				group(models.RuleConditionGroupNot, contentContains("Globex"), contentContains("Initech")),
+			},
+			want: true,
+		},
+		{
+			name: "not group with matching condition",
+			mode: models.RuleMatchAll,
+			conditions: []*models.RuleCondition{
+				group(models.RuleConditionGroupNot, contentContains("Globex"), contentContains("Acme")),
+			},
+			want: false,
+		},
+		{
+			name: "inverted and group",
+			mode: models.RuleMatchAny,
+			conditions: []*models.RuleCondition{
+				nameContains("receipt"),
+				func() *models.RuleCondition {
+					g := group(models.RuleConditionGroupAnd, nameContains("invoice"), contentContains("Globex"))
+					g.Inverted = true
+					return g
+				}(),
+			},
+			want: true,
+		},
+		{
+			name: "deeply nested",
+			mode: models.RuleMatchAll,
+			conditions: []*models.RuleCondition{
+				group(models.RuleConditionGroupOr,
+					contentContains("Globex"),
+					group(models.RuleConditionGroupAnd,
+						nameContains("2023"),
+						group(models.RuleConditionGroupNot, nameContains("receipt")),
+					),
+				),
+			},
+			want: true,
+		},
+		{
+			name: "disabled group is skipped",
+			mode: models.RuleMatchAll,
+			conditions: []*models.RuleCondition{
+				nameContains("invoice"),
+				func() *models.RuleCondition {
+					g := group(models.RuleConditionGroupAnd, contentContains("Globex"))
+					g.Enabled = false
+					return g
+				}(),
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := NewDocumentRule(doc, &models.Rule{Mode: tt.mode, Conditions: tt.conditions})
+			got, err := dc.Match()
+			if err != nil {
+				t.Errorf("Match() error = %v", err)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Match() got = %v, want %v", got, tt.want)
+			}
+
+			result := dc.MatchTest()
+			if result.Match != tt.want {
+				t.Errorf("MatchTest() got = %v, want %v", result.Match, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentRule_MatchTestConditionGroups(t *testing.T) {
+	doc := &models.Document{Id: "1234", Name: "invoice.pdf", Content: "Invoice from Acme Ltd"}
+	rule := &models.Rule{
+		Mode: models.RuleMatchAll,
+		Conditions: []*models.RuleCondition{
+			{Id: 1, Enabled: true, ConditionType: models.RuleConditionNameContains, Value: "invoice"},
+			{Id: 2, Enabled: true, ConditionType: models.RuleConditionGroupOr, Conditions: []*models.RuleCondition{
+				{Id: 3, ParentId: 2, Enabled: true, ConditionType: models.RuleConditionContentContains, Value: "Acme"},
+				{Id: 4, ParentId: 2, Enabled: true, ConditionType: models.RuleConditionContentContains, Value: "Globex"},
+			}},
+		},
+	}
+
+	dc := NewDocumentRule(doc, rule)
+	result := dc.MatchTest()
+	if !result.Match {
+		t.Fatalf("rule did not match: %s", result.Log)
+	}
+	if len(result.Conditions) != 4 || len(result.ConditionOutput) != 4 {
+		t.Fatalf("got %d conditions and %d outputs, want 4", len(result.Conditions), len(result.ConditionOutput))
+	}
+
+	wantDepth := []int{0, 0, 1, 1}
+	wantParent := []int{0, 0, 2, 2}
+	wantMatched := []bool{true, true, true, false}
+	wantSkipped := []bool{false, false, false, true}
+	for i, v := range result.Conditions {
+		if v.Depth != wantDepth[i] {
+			t.Errorf("condition %d depth = %d, want %d", i, v.Depth, wantDepth[i])
+		}
+		if v.ParentId != wantParent[i] {
+			t.Errorf("condition %d parent = %d, want %d", i, v.ParentId, wantParent[i])
+		}
+		if v.Matched != wantMatched[i] {
+			t.Errorf("condition %d matched = %t, want %t", i, v.Matched, wantMatched[i])
+		}
+		if v.Skipped != wantSkipped[i] {
+			t.Errorf("condition %d skipped = %t, want %t", i, v.Skipped, wantSkipped[i])
+		}
+	}
+}
+
+// fakeMetadataStore stores metadata values in memory.
+type fakeMetadataStore struct {
+	values []*models.MetadataValue
+	keys   []models.MetadataKey
+}
+
+func (f *fakeMetadataStore) GetValueByName(userId int, keyId int, value string) (*models.MetadataValue, error) {
+	for _, v := range f.values {
+		if v.UserId == userId && v.KeyId == keyId && v.Value == value {
+			return v, nil
+		}
+	}
+	return nil, errors.ErrRecordNotFound
+}
+
+func (f *fakeMetadataStore) CreateValue(userId int, value *models.MetadataValue) error {
+	value.Id = len(f.values) + 100
+	value.UserId = userId
+	f.values = append(f.values, value)
+	return nil
+}
+
+func (f *fakeMetadataStore) GetUserKeysCached(userId int) (*[]models.MetadataKey, error) {
+	return &f.keys, nil
+}
+
+func TestDocumentRule_addMetadataSingleValue(t *testing.T) {
+	store := &fakeMetadataStore{keys: []models.MetadataKey{{Id: 1, Key: "year", SingleValue: true}, {Id: 2, Key: "topic"}}}
+	doc := &models.Document{Id: "1234", UserId: 1, Metadata: []models.Metadata{
+		{KeyId: 1, ValueId: 10}, {KeyId: 2, ValueId: 20},
+	}}
+	rule := &models.Rule{Actions: []*models.RuleAction{
+		{Enabled: true, Action: models.RuleActionAddMetadata, MetadataKey: 1, MetadataValue: 11},
+		{Enabled: true, Action: models.RuleActionAddMetadata, MetadataKey: 2, MetadataValue: 21},
+	}}
+	dc := NewDocumentRule(doc, rule)
+	dc.Metadata = store
+
+	err := dc.RunActions()
+	if err != nil {
+		t.Fatalf("RunActions() error = %v", err)
+	}
+	want := []models.Metadata{{KeyId: 2, ValueId: 20}, {KeyId: 1, ValueId: 11}, {KeyId: 2, ValueId: 21}}
+	if !reflect.DeepEqual(doc.Metadata, want) {
+		t.Errorf("got metadata %v, want %v", doc.Metadata, want)
+	}
+}
+
+func TestDocumentRule_extractMetadata(t *testing.T) {
+	content := "Invoice\nCustomer number:   12345 \nCompany:  ACME   ltd.\n"
+
+	tests := []struct {
+		name      string
+		action    *models.RuleAction
+		dryRun    bool
+		wantValue string
+		wantId    int
+		wantNew   bool
+	}{
+		{
+			name: "existing value",
+			action: &models.RuleAction{Enabled: true, Action: models.RuleActionExtractMetadata, MetadataKey: 1,
+				Value: `Customer number:\s*(\d+)`},
+			wantValue: "12345",
+			wantId:    10,
+		},
+		{
+			name: "create value",
+			action: &models.RuleAction{Enabled: true, Action: models.RuleActionExtractMetadata, MetadataKey: 2,
+				Value: `Company:([^\n]+)`, TrimValue: true, CollapseWhitespace: true, ValueCase: models.RuleValueCaseTitle},
+			wantValue: "Acme Ltd",
+			wantId:    101,
+			wantNew:   true,
+		},
+		{
+			name: "dry run does not create value",
+			action: &models.RuleAction{Enabled: true, Action: models.RuleActionExtractMetadata, MetadataKey: 2,
+				Value: `Company:([^\n]+)`, TrimValue: true, ValueCase: models.RuleValueCaseLower},
+			dryRun:    true,
+			wantValue: "acme   ltd",
+		},
+		{
+			name: "no match",
+			action: &models.RuleAction{Enabled: true, Action: models.RuleActionExtractMetadata, MetadataKey: 2,
+				Value: `Order:\s*(\d+)`},
+		},
+		{
+			name: "name as source",
+			action: &models.RuleAction{Enabled: true, Action: models.RuleActionExtractMetadata, MetadataKey: 1,
+				Value: `^(\d+)`, TextSource: models.RuleTextSourceName},
+			wantValue: "12345",
+			wantId:    10,
+		},
+		{
+			name: "barcode as source",
+			action: &models.RuleAction{Enabled: true, Action: models.RuleActionExtractMetadata, MetadataKey: 2,
+				Value: `^INV-(\d+)$`, TextSource: models.RuleTextSourceBarcode},
+			wantValue: "778",
+			wantId:    101,
+			wantNew:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeMetadataStore{values: []*models.MetadataValue{{Id: 10, UserId: 1, KeyId: 1, Value: "12345"}}}
+			doc := &models.Document{Id: "1234", UserId: 1, Name: "12345.pdf", Content: content}
+			doc.Barcodes = []models.DocumentBarcode{
+				{Page: 1, Type: "EAN-13", Payload: "6410405082657"},
+				{Page: 2, Type: "QR-Code", Payload: "INV-778"},
+			}
+			dc := NewDocumentRule(doc, &models.Rule{Actions: []*models.RuleAction{tt.action}})
+			dc.Metadata = store
+			dc.DryRun = tt.dryRun
+
+			err := dc.RunActions()
+			if err != nil {
+				t.Fatalf("RunActions() error = %v", err)
+			}
+			if tt.wantValue == "" {
+				if len(doc.Metadata) != 0 {
+					t.Errorf("got metadata %v, want none", doc.Metadata)
+				}
+				return
+			}
+			if len(doc.Metadata) != 1 {
+				t.Fatalf("got %d metadata, want 1", len(doc.Metadata))
+			}
+			if doc.Metadata[0].ValueId != tt.wantId {
+				t.Errorf("got value id %d, want %d", doc.Metadata[0].ValueId, tt.wantId)
+			}
+			if tt.wantNew {
+				if len(store.values) != 2 || store.values[1].Value != tt.wantValue {
+					t.Errorf("value %s was not created", tt.wantValue)
+				}
+			} else if len(store.values) != 1 {
+				t.Errorf("value was created")
+			}
+			if tt.dryRun && doc.Metadata[0].Value != tt.wantValue {
+				t.Errorf("got value %s, want %s", doc.Metadata[0].Value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestDocumentRule_Execute(t *testing.T) {
+	doc := &models.Document{
+		Id:       "1234",
+		Name:     "scan.pdf",
+		Content:  "Invoice from Acme Ltd",
+		Metadata: []models.Metadata{{KeyId: 10, ValueId: 15}},
+	}
+	rule := &models.Rule{
+		Id:      5,
+		Name:    "acme invoices",
+		Version: 3,
+		Mode:    models.RuleMatchAny,
+		Conditions: []*models.RuleCondition{
+			{Id: 1, Enabled: true, ConditionType: models.RuleConditionContentContains, Value: "Acme"},
+			{Id: 2, Enabled: true, ConditionType: models.RuleConditionContentContains, Value: "Globex"},
+		},
+		Actions: []*models.RuleAction{
+			{Id: 1, Enabled: true, Action: models.RuleActionSetName, Value: "Acme invoice"},
+			{Id: 2, Enabled: false, Action: models.RuleActionSetDescription, Value: "disabled"},
+			{Id: 3, Enabled: true, Action: models.RuleActionAddMetadata, MetadataKey: 1, MetadataValue: 2},
+			{Id: 4, Enabled: true, Action: models.RuleActionAppendName, Value: "{{ capture 1 }"},
+			{Id: 5, Enabled: true, Action: models.RuleActionAppendDescription, Value: "not run"},
+		},
+	}
+
+	dc := NewDocumentRule(doc, rule)
+	execution, history := dc.Execute()
+	if !execution.Matched {
+		t.Fatalf("rule did not match")
+	}
+	if execution.RuleId != 5 || execution.RuleVersion != 3 || execution.RuleName != "acme invoices" {
+		t.Errorf("execution rule = %d/%d/%s", execution.RuleId, execution.RuleVersion, execution.RuleName)
+	}
+	wantConditions := models.RuleConditionResults{
+		{ConditionId: 1, ConditionType: "content_contains", Matched: true},
+		{ConditionId: 2, ConditionType: "content_contains", Skipped: true},
+	}
+	if !reflect.DeepEqual(execution.Conditions, wantConditions) {
+		t.Errorf("conditions = %v, want %v", execution.Conditions, wantConditions)
+	}
+
+	// disabled action is not recorded, execution stops at the failing template
+	if len(execution.Actions) != 3 {
+		t.Fatalf("got %d actions, want 3", len(execution.Actions))
+	}
+	wantChanges := []models.RuleActionChange{{Action: models.DocumentHistoryActionRename, OldValue: "scan.pdf", NewValue: "Acme invoice"}}
+	if !reflect.DeepEqual(execution.Actions[0].Changes, wantChanges) {
+		t.Errorf("set name changes = %v, want %v", execution.Actions[0].Changes, wantChanges)
+	}
+	if len(execution.Actions[1].Changes) != 1 || execution.Actions[1].Changes[0].Action != models.DocumentHistoryActionMetadataAdd {
+		t.Errorf("add metadata changes = %v", execution.Actions[1].Changes)
+	}
+	if execution.Actions[2].Error == "" || execution.Error == "" {
+		t.Errorf("no error for invalid template")
+	}
+	if len(execution.Actions[2].Changes) != 0 {
+		t.Errorf("failed action has changes: %v", execution.Actions[2].Changes)
+	}
+
+	if len(history) != 2 {
+		t.Fatalf("got %d history items, want 2", len(history))
+	}
+	for _, v := range history {
+		if v.RuleId != 5 {
+			t.Errorf("history item %s rule id = %d, want 5", v.Action, v.RuleId)
+		}
+	}
+}
+
+type mockSearcher struct {
+	query string
+	ids   []string
+}
+
+func (m *mockSearcher) SearchDocuments(userId int, query string, sort storage.SortKey, paging storage.Paging) ([]*models.Document, int, error) {
+	m.query = query
+	docs := make([]*models.Document, len(m.ids))
+	for i, v := range m.ids {
+		docs[i] = &models.Document{Id: v}
+	}
+	return docs, len(docs), nil
+}
+
+func TestDocumentRule_ExecuteEffects(t *testing.T) {
+	doc := &models.Document{
+		Id:      "1234",
+		Name:    "scan.pdf",
+		Content: "Invoice number: 1001",
+	}
+	rule := &models.Rule{
+		Id:   5,
+		Name: "invoices",
+		Mode: models.RuleMatchAll,
+		Conditions: []*models.RuleCondition{
+			{Id: 1, Enabled: true, ConditionType: models.RuleConditionContentContains, IsRegex: true, Value: `Invoice number: (\d+)`},
+		},
+		Actions: []*models.RuleAction{
+			{Id: 1, Enabled: true, Action: models.RuleActionLinkDocuments, Value: `"{{ capture 1 }}"`},
+			{Id: 2, Enabled: true, Action: models.RuleActionNeedsReview},
+			{Id: 3, Enabled: true, Action: models.RuleActionNotify, Value: "Invoice {{ capture 1 }}"},
+			{Id: 4, Enabled: true, Action: models.RuleActionTrash},
+			{Id: 5, Enabled: true, Action: models.RuleActionStopProcessing},
+		},
+	}
+	searcher := &mockSearcher{ids: []string{"1234", "2345", "3456"}}
+
+	dc := NewDocumentRule(doc, rule)
+	dc.Search = searcher
+	execution, history := dc.Execute()
+	if execution.Error != "" {
+		t.Fatalf("execution error: %s", execution.Error)
+	}
+	if searcher.query != `"1001"` {
+		t.Errorf("search query = %s", searcher.query)
+	}
+	if !reflect.DeepEqual(dc.Effects.LinkDocuments, []string{"2345", "3456"}) {
+		t.Errorf("linked documents = %v", dc.Effects.LinkDocuments)
+	}
+	if !doc.NeedsReview {
+		t.Errorf("document does not need review")
+	}
+	if len(dc.Effects.Notifications) != 1 || dc.Effects.Notifications[0].Message != "Invoice 1001" {
+		t.Errorf("notifications = %v", dc.Effects.Notifications)
+	}
+	if !dc.Effects.Trash || doc.DeletedAt.Valid {
+		t.Errorf("trash effect = %v, deleted = %v", dc.Effects.Trash, doc.DeletedAt.Valid)
+	}
+	if !dc.Stopped {
+		t.Errorf("rule did not stop processing")
+	}
+
+	wantActions := []string{
+		models.DocumentHistoryActionLinkDocuments,
+		models.DocumentHistoryActionNeedsReview,
+		models.DocumentHistoryActionNotify,
+		models.DocumentHistoryActionDelete,
+		models.DocumentHistoryActionStopRules,
+	}
+	if len(history) != len(wantActions) {
+		t.Fatalf("got %d history items, want %d", len(history), len(wantActions))
+	}
+	for i, v := range history {
+		if v.Action != wantActions[i] || v.RuleId != 5 {
+			t.Errorf("history item %d = %s (rule %d), want %s", i, v.Action, v.RuleId, wantActions[i])
+		}
+		if len(execution.Actions[i].Changes) != 1 {
+			t.Errorf("action %d changes = %v", i, execution.Actions[i].Changes)
+		}
+	}
+
+	// testing reports the actions without side effects
+	doc.NeedsReview = false
+	result := dc.MatchTest()
+	if !result.Match || len(result.ActionOutput) != len(rule.Actions) {
+		t.Fatalf("test result match = %v, action output = %v", result.Match, result.ActionOutput)
+	}
+	if !strings.Contains(strings.Join(result.ActionOutput[0], ""), "2345") {
+		t.Errorf("link action output = %v", result.ActionOutput[0])
+	}
+
+	// moving to trash is recorded when the document is moved
+	if dc.Effects.TrashRuleId != 5 {
+		t.Errorf("trash rule = %d, want 5", dc.Effects.TrashRuleId)
+	}
+	for _, v := range withoutEffectHistory(history) {
+		if v.Action == models.DocumentHistoryActionDelete {
+			t.Errorf("history contains trash item: %v", v)
+		}
+	}
+
+	// scheduled rule does not notify again of the same document
+	doc = &models.Document{Id: "1234", Name: "scan.pdf", Content: "Invoice number: 1001"}
+	dc = NewDocumentRule(doc, rule)
+	dc.Search = searcher
+	dc.Trigger = models.RuleTriggerSchedule
+	dc.Notified = map[int]bool{5: true}
+	execution, history = dc.Execute()
+	if execution.Error != "" || len(dc.Effects.Notifications) != 0 {
+		t.Errorf("execution error = %q, notifications = %v", execution.Error, dc.Effects.Notifications)
+	}
+	for _, v := range history {
+		if v.Action == models.DocumentHistoryActionNotify {
+			t.Errorf("history contains notify item: %v", v)
+		}
+	}
+}
+
+func Test_ruleTriggerGuard(t *testing.T) {
+	guard := newRuleTriggerGuard()
+	if !guard.acquire("doc-1") {
+		t.Fatalf("acquire() = false for new document")
+	}
+	if guard.acquire("doc-1") {
+		t.Errorf("acquire() = true for document that is already running rules")
+	}
+	if !guard.acquire("doc-2") {
+		t.Errorf("acquire() = false for other document")
+	}
+	guard.release("doc-1")
+	if !guard.acquire("doc-1") {
+		t.Errorf("acquire() = false after release")
+	}
+}
+
+func TestDocumentRule_matchFileConditions(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	doc := &models.Document{
+		Id:         "1234",
+		Filename:   "IMG_0042.JPG",
+		Mimetype:   "image/jpeg",
+		Size:       12 * 1024 * 1024,
+		Source:     models.DocumentSourceInputDir,
+		Date:       time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC),
+		Properties: []models.DocumentProperty{{Key: "pages", Value: "24"}},
+	}
+
+	tests := []struct {
+		name      string
+		condition models.RuleCondition
+		want      bool
+	}{
+		{"filename glob", models.RuleCondition{ConditionType: models.RuleConditionFilenameMatches, Value: "IMG_*"}, true},
+		{"filename glob case", models.RuleCondition{ConditionType: models.RuleConditionFilenameMatches, Value: "img_*.jpg"}, false},
+		{"filename glob case-insensitive", models.RuleCondition{ConditionType: models.RuleConditionFilenameMatches, Value: "img_*.jpg", CaseInsensitive: true}, true},
+		{"filename is no typos", models.RuleCondition{ConditionType: models.RuleConditionFilenameIs, Value: "IMG_0043.JPG"}, false},
+		{"filename regex", models.RuleCondition{ConditionType: models.RuleConditionFilenameContains, Value: `\d{4}`, IsRegex: true}, true},
+		{"mimetype wildcard", models.RuleCondition{ConditionType: models.RuleConditionMimetypeIs, Value: "image/*"}, true},
+		{"mimetype exact", models.RuleCondition{ConditionType: models.RuleConditionMimetypeIs, Value: "application/pdf"}, false},
+		{"size more than", models.RuleCondition{ConditionType: models.RuleConditionSizeMoreThan, Value: "10 MB"}, true},
+		{"size less than", models.RuleCondition{ConditionType: models.RuleConditionSizeLessThan, Value: "10 MB"}, false},
+		{"pages more than", models.RuleCondition{ConditionType: models.RuleConditionPagesMoreThan, Value: "20"}, true},
+		{"pages is", models.RuleCondition{ConditionType: models.RuleConditionPagesIs, Value: "20"}, false},
+		{"source", models.RuleCondition{ConditionType: models.RuleConditionSourceIs, Value: "input_dir"}, true},
+		{"other source", models.RuleCondition{ConditionType: models.RuleConditionSourceIs, Value: "upload"}, false},
+		{"older than", models.RuleCondition{ConditionType: models.RuleConditionAgeMoreThan, Value: "7 years"}, true},
+		{"newer than", models.RuleCondition{ConditionType: models.RuleConditionAgeLessThan, Value: "7 years"}, false},
+		{"not older than", models.RuleCondition{ConditionType: models.RuleConditionAgeMoreThan, Value: "10y"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := tt.condition
+			condition.Enabled = true
+			d := NewDocumentRule(doc, &models.Rule{Conditions: []*models.RuleCondition{&condition}})
+			var got bool
+			var err error
+			if strings.HasPrefix(string(condition.ConditionType), "age") {
+				got, err = d.matchAge(&condition, now)
+			} else {
+				got, err = d.matchCondition(&condition, &ruleEvaluation{})
+			}
+			if err != nil {
+				t.Fatalf("match error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// page count is not known for pdf without pages property
+	pdf := &models.Document{Id: "5678", Mimetype: "application/pdf"}
+	d := NewDocumentRule(pdf, &models.Rule{})
+	got, err := d.matchPages(&models.RuleCondition{ConditionType: models.RuleConditionPagesLessThan, Value: "5"})
+	if err != nil || got {
+		t.Errorf("matchPages() for unknown page count = %v, %v", got, err)
+	}
+}
+
+func Test_sameChanges(t *testing.T) {
+	a := []models.DocumentHistory{
+		{Action: models.DocumentHistoryActionRename, OldValue: "a", NewValue: "b"},
+		{Action: models.DocumentHistoryActionMetadataAdd, NewValue: "1"},
+	}
+	tests := []struct {
+		name string
+		b    []models.DocumentHistory
+		want bool
+	}{
+		{name: "same", b: []models.DocumentHistory{a[0], a[1]}, want: true},
+		{name: "different length", b: a[:1], want: false},
+		{name: "empty", b: []models.DocumentHistory{}, want: false},
+		{name: "different value", b: []models.DocumentHistory{a[0], {Action: models.DocumentHistoryActionMetadataAdd, NewValue: "2"}}, want: false},
+		{name: "different order", b: []models.DocumentHistory{a[1], a[0]}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameChanges(a, tt.b); got != tt.want {
+				t.Errorf("sameChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentRule_matchExpression(t *testing.T) {
+	doc := &models.Document{
+		Id:       "1234",
+		Name:     "Invoice 42",
+		Content:  "ACME Ltd invoice for services. Total 120.00 EUR",
+		Mimetype: "application/pdf",
+		Date:     time.Now().AddDate(0, -1, 0),
+		Metadata: []models.Metadata{
+			{KeyId: 1, Key: "company", ValueId: 1, Value: "acme"},
+			{KeyId: 2, Key: "category", ValueId: 2, Value: "invoices"},
+		},
+		Fields:     []models.DocumentField{{Name: models.DocumentFieldAmount, Value: "120.00"}},
+		Properties: []models.DocumentProperty{{Key: "pages", Value: "3"}},
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		want       bool
+		wantErr    bool
+	}{
+		{"content prefix", `lower(content[:20]) contains "invoice"`, true, false},
+		{"content not in prefix", `content[:5] contains "invoice"`, false, false},
+		{"last quarter", `date > now() - duration("2160h") && metadata_count < 3`, true, false},
+		{"metadata", `"acme" in metadata["company"] && !("tax" in metadata)`, true, false},
+		{"fields and pages", `float(fields["amount"]) > 100 && pages == 3`, true, false},
+		{"runtime error", `int(name) > 1`, false, true},
+		{"not bool", `name`, false, true},
+		{"memory budget", `len(1..200000) > 0`, false, true},
+		{"range", `len(1..10) == 10 && 3 in 1..5`, true, false},
+		{"repeat", `len(repeat(name, 2)) > 0 && len(repeat(content, 100000)) > 0`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := &models.RuleCondition{Enabled: true, ConditionType: models.RuleConditionExpression, Value: tt.expression}
+			d := NewDocumentRule(doc, &models.Rule{Conditions: []*models.RuleCondition{condition}})
+			got, err := d.matchCondition(condition, &ruleEvaluation{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("match error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentRule_matchTextModes(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition models.RuleCondition
+		text      string
+		want      bool
+	}{
+		{"default allows typo", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "electricity bill"}, "your electrcity bill", true},
+		{"exact", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "electricity bill", MatchMode: models.RuleMatchExact}, "your electrcity bill", false},
+		{"exact case", models.RuleCondition{ConditionType: models.RuleConditionNameIs, Value: "Invoice", MatchMode: models.RuleMatchExact}, "invoice", false},
+		{"case-insensitive", models.RuleCondition{ConditionType: models.RuleConditionNameIs, Value: "Invoice", MatchMode: models.RuleMatchCaseInsensitive}, "INVOICE", true},
+		{"fuzzy distance", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "acme corporation", MatchMode: models.RuleMatchFuzzy, MatchMaxDistance: 3}, "from: aCme c0rp0ration ltd", true},
+		{"fuzzy distance exceeded", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "acme corporation", MatchMode: models.RuleMatchFuzzy, MatchMaxDistance: 2}, "from: aCme c0rp0ration ltd", false},
+		{"fuzzy short word", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "tax", MatchMode: models.RuleMatchFuzzy, MatchMinSimilarity: 0.8}, "total", false},
+		{"fuzzy similarity", models.RuleCondition{ConditionType: models.RuleConditionNameStarts, Value: "receipt", MatchMode: models.RuleMatchFuzzy, MatchMinSimilarity: 0.7}, "reciept 2023", true},
+		{"fuzzy is", models.RuleCondition{ConditionType: models.RuleConditionNameIs, Value: "receipt", MatchMode: models.RuleMatchFuzzy, MatchMaxDistance: 1}, "receipt 2023", false},
+		{"token set", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "bill electricity", MatchMode: models.RuleMatchTokenSet}, "electricity, monthly bill", true},
+		{"token set missing", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "bill water", MatchMode: models.RuleMatchTokenSet}, "electricity, monthly bill", false},
+		{"token set is", models.RuleCondition{ConditionType: models.RuleConditionNameIs, Value: "bill electricity", MatchMode: models.RuleMatchTokenSet}, "electricity - bill", true},
+		{"token set starts", models.RuleCondition{ConditionType: models.RuleConditionNameStarts, Value: "bill electricity", MatchMode: models.RuleMatchTokenSet}, "monthly electricity bill", false},
+		{"ocr", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "INVOICE 10", MatchMode: models.RuleMatchOcr}, "lNV0ICE l0", true},
+		{"ocr rn", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "summary", MatchMode: models.RuleMatchOcr}, "surnrnary", true},
+		{"ocr case-insensitive", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "Invoice", MatchMode: models.RuleMatchOcr, CaseInsensitive: true}, "lnv0ice", true},
+		{"ocr other characters", models.RuleCondition{ConditionType: models.RuleConditionContentContains, Value: "invoice", MatchMode: models.RuleMatchOcr}, "involce", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := tt.condition
+			condition.Enabled = true
+			if err := condition.Validate(); err != nil {
+				t.Fatalf("invalid condition: %v", err)
+			}
+			d := NewDocumentRule(&models.Document{Name: tt.text, Content: tt.text}, &models.Rule{})
+			got, err := d.matchText(&condition, tt.text)
+			if err != nil {
+				t.Fatalf("matchText() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("matchText() = %v, want %v (%s)", got, tt.want, d.textMatch)
+			}
+			if d.textMatch == "" {
+				t.Errorf("match is not explained")
+			}
+		})
+	}
+}
+
+func TestDocumentRule_compareMetadataValue(t *testing.T) {
+	total := func(value string) models.Metadata {
+		_, typed, _ := models.ParseMetadataValue(models.MetadataValueDecimal, value)
+		return models.Metadata{KeyId: 1, Key: "total", Value: value, ValueType: models.MetadataValueDecimal, MetadataTypedValue: typed}
+	}
+	expires, _ := time.Parse("2006-01-02", "2025-01-31")
+	doc := &models.Document{
+		Id: "1234",
+		Metadata: []models.Metadata{
+			total("20.5"),
+			total("150"),
+			{KeyId: 2, Key: "expires", Value: "2025-01-31", ValueType: models.MetadataValueDate,
+				MetadataTypedValue: models.MetadataTypedValue{ValueDate: sql.NullTime{Time: expires, Valid: true}}},
+			{KeyId: 3, Key: "class", Value: "paper"},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		conditionType models.RuleConditionType
+		key           int
+		value         string
+		want          bool
+		wantErr       bool
+	}{
+		{"any value more than", models.RuleConditionMetadataValueMoreThan, 1, "100", true, false},
+		{"no value more than", models.RuleConditionMetadataValueMoreThan, 1, "150", false, false},
+		{"any value less than", models.RuleConditionMetadataValueLessThan, 1, "21", true, false},
+		{"date before", models.RuleConditionMetadataValueLessThan, 2, "2025-02-01", true, false},
+		{"date after", models.RuleConditionMetadataValueMoreThan, 2, "2025-02-01", false, false},
+		{"invalid date", models.RuleConditionMetadataValueMoreThan, 2, "tomorrow", false, true},
+		{"text key", models.RuleConditionMetadataValueMoreThan, 3, "a", false, false},
+		{"missing key", models.RuleConditionMetadataValueMoreThan, 4, "1", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := &models.RuleCondition{Enabled: true, ConditionType: tt.conditionType,
+				MetadataKey: models.IntId(tt.key), Value: tt.value}
+			d := NewDocumentRule(doc, &models.Rule{Conditions: []*models.RuleCondition{condition}})
+			got, err := d.matchCondition(condition, &ruleEvaluation{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("match error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_matchMetadataAliases(t *testing.T) {
+	doc := &models.Document{Id: "1234", Content: "Invoice from acme, total 100 EUR. Shipped from Europe by Neuron Ltd."}
+	values := []models.MetadataValue{
+		{Id: 1, KeyId: 1, Key: "company", Value: "ACME Oy", MatchDocuments: true, MatchType: models.MetadataMatchExact,
+			MatchFilter: "acme oy", Aliases: []string{"acme ltd", "acme"}},
+		{Id: 2, KeyId: 1, Key: "company", Value: "Globex", MatchDocuments: true, MatchType: models.MetadataMatchExact,
+			MatchFilter: "globex", Aliases: []string{"globex corp"}},
+		{Id: 3, KeyId: 2, Key: "currency", Value: "Dollar", MatchType: models.MetadataMatchExact,
+			MatchFilter: "invoice", Aliases: []string{"ltd"}},
+		{Id: 4, KeyId: 2, Key: "currency", Value: "Euro", MatchDocuments: true, MatchType: models.MetadataMatchExact,
+			MatchFilter: "yen", Aliases: []string{"eur"}},
+		{Id: 5, KeyId: 3, Key: "region", Value: "Europe", MatchDocuments: true, MatchType: models.MetadataMatchExact,
+			MatchFilter: "asia", Aliases: []string{"euro", "neuro"}},
+	}
+	err := matchMetadata(doc, &values, nil)
+	if err != nil {
+		t.Fatalf("matchMetadata() error = %v", err)
+	}
+	// aliases are not used when matching is disabled, and they only match whole words
+	want := []models.Metadata{{KeyId: 1, Key: "company", ValueId: 1, Value: "ACME Oy"},
+		{KeyId: 2, Key: "currency", ValueId: 4, Value: "Euro"}}
+	if !reflect.DeepEqual(doc.Metadata, want) {
+		t.Errorf("matchMetadata() metadata = %v, want %v", doc.Metadata, want)
+	}
+}
+
+func Test_matchMetadataSingleValue(t *testing.T) {
+	keys := []models.MetadataKey{{Id: 1, Key: "company", SingleValue: true}, {Id: 2, Key: "year", SingleValue: true},
+		{Id: 3, Key: "topic"}}
+	doc := &models.Document{Id: "1234", Content: "invoice from acme and globex, year 2023",
+		Metadata: []models.Metadata{{KeyId: 2, ValueId: 20}}}
+	values := []models.MetadataValue{
+		{Id: 10, KeyId: 1, MatchDocuments: true, MatchType: models.MetadataMatchExact, MatchFilter: "acme"},
+		{Id: 11, KeyId: 1, MatchDocuments: true, MatchType: models.MetadataMatchExact, MatchFilter: "globex"},
+		{Id: 21, KeyId: 2, MatchDocuments: true, MatchType: models.MetadataMatchExact, MatchFilter: "2023"},
+		{Id: 30, KeyId: 3, MatchDocuments: true, MatchType: models.MetadataMatchExact, MatchFilter: "invoice"},
+		{Id: 31, KeyId: 3, MatchDocuments: true, MatchType: models.MetadataMatchExact, MatchFilter: "year"},
+	}
+	err := matchMetadata(doc, &values, keys)
+	if err != nil {
+		t.Fatalf("matchMetadata() error = %v", err)
+	}
+	want := []models.Metadata{{KeyId: 2, ValueId: 20}, {KeyId: 1, ValueId: 10}, {KeyId: 3, ValueId: 30},
+		{KeyId: 3, ValueId: 31}}
+	if !reflect.DeepEqual(doc.Metadata, want) {
+		t.Errorf("matchMetadata() metadata = %v, want %v", doc.Metadata, want)
+	}
+}
+
+func TestDocumentRule_tags(t *testing.T) {
+	doc := &models.Document{Id: "1234", Tags: []models.Tag{{Id: 1, Key: "bills"}, {Id: 2, Key: "to do"}}}
+	d := NewDocumentRule(doc, &models.Rule{})
+
+	for _, tt := range []struct {
+		tagId models.IntId
+		want  bool
+	}{{1, true}, {2, true}, {3, false}} {
+		condition := &models.RuleCondition{Enabled: true, ConditionType: models.RuleConditionHasTag, TagId: tt.tagId}
+		got, err := d.matchCondition(condition, &ruleEvaluation{})
+		if err != nil {
+			t.Fatalf("matchCondition() error = %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("matchCondition(tag %d) = %v, want %v", tt.tagId, got, tt.want)
+		}
+	}
+
+	actions := []*models.RuleAction{
+		{Enabled: true, Action: models.RuleActionAddTag, TagId: 3, TagName: "paid"},
+		{Enabled: true, Action: models.RuleActionAddTag, TagId: 1, TagName: "bills"},
+		{Enabled: true, Action: models.RuleActionRemoveTag, TagId: 2},
+	}
+	for _, action := range actions {
+		err := d.runAction(action, nil)
+		if err != nil {
+			t.Fatalf("runAction(%s) error = %v", action.Action, err)
+		}
+	}
+	want := []models.Tag{{Id: 1, Key: "bills"}, {Id: 3, Key: "paid"}}
+	if !reflect.DeepEqual(doc.Tags, want) {
+		t.Errorf("tags = %v, want %v", doc.Tags, want)
+	}
+
+	history := models.TagDiff(doc.Id, 0, []models.Tag{{Id: 1, Key: "bills"}, {Id: 2, Key: "to do"}}, doc.Tags)
+	if !tagsChanged(history) || tagsChanged(nil) {
+		t.Errorf("tagsChanged() = %v, want true", tagsChanged(history))
+	}
+}
+
+func Test_enforceRulesMetadataConstraints(t *testing.T) {
+	store := &fakeMetadataStore{keys: []models.MetadataKey{
+		{Id: 1, Key: "category"},
+		{Id: 2, Key: "invoice number", RequiredWhenKeyId: 1, RequiredWhenValueId: 10},
+	}}
+	condition := &models.RuleCondition{Enabled: true, ConditionType: models.RuleConditionNameContains, Value: "invoice"}
+	first := &models.Rule{Id: 1, Conditions: []*models.RuleCondition{condition}, Actions: []*models.RuleAction{
+		{Enabled: true, Action: models.RuleActionAddMetadata, MetadataKey: 1, MetadataValue: 10},
+		{Enabled: true, Action: models.RuleActionSetDescription, Value: "invoice"},
+	}}
+	second := &models.Rule{Id: 2, Conditions: []*models.RuleCondition{condition}, Actions: []*models.RuleAction{
+		{Enabled: true, Action: models.RuleActionAddMetadata, MetadataKey: 2, MetadataValue: 20},
+	}}
+
+	run := func(rules ...*models.Rule) (*models.Document, []*models.RuleExecution, []models.DocumentHistory) {
+		doc := &models.Document{Id: "1234", UserId: 1, Name: "invoice", Metadata: []models.Metadata{}}
+		original := snapshotDocument(doc)
+		executions := make([]*models.RuleExecution, 0)
+		history := make([]models.DocumentHistory, 0)
+		for _, rule := range rules {
+			runner := NewDocumentRule(doc, rule)
+			runner.Metadata = store
+			execution, changes := runner.Execute()
+			executions = append(executions, execution)
+			history = append(history, changes...)
+		}
+		history = enforceRulesMetadataConstraints(store, doc, original.Metadata, executions, history)
+		return doc, executions, history
+	}
+
+	doc, executions, history := run(first)
+	if !strings.Contains(executions[0].Error, "invoice number") {
+		t.Errorf("execution error = %q, want missing required key", executions[0].Error)
+	}
+	if len(doc.Metadata) != 0 {
+		t.Errorf("metadata = %v, want reverted", doc.Metadata)
+	}
+	if len(history) != 1 || history[0].Action != models.DocumentHistoryActionDescription {
+		t.Errorf("history = %v, want description change only", history)
+	}
+
+	// required key is added by a later rule
+	doc, executions, history = run(first, second)
+	if executions[0].Error != "" || executions[1].Error != "" || len(doc.Metadata) != 2 {
+		t.Errorf("execution errors = %q, %q, metadata = %v", executions[0].Error, executions[1].Error, doc.Metadata)
+	}
+	if len(history) != 3 {
+		t.Errorf("history = %v, want 3 changes", history)
+	}
+}
+
+func Test_keepRuleExecution(t *testing.T) {
+	tests := []struct {
+		execution models.RuleExecution
+		want      bool
+	}{
+		{models.RuleExecution{Trigger: models.RuleTriggerProcessing}, true},
+		{models.RuleExecution{Trigger: models.RuleTriggerSchedule}, false},
+		{models.RuleExecution{Trigger: models.RuleTriggerSchedule, Matched: true}, true},
+		{models.RuleExecution{Trigger: models.RuleTriggerSchedule, Error: "match rule: invalid"}, true},
+	}
+	for _, tt := range tests {
+		if got := keepRuleExecution(&tt.execution); got != tt.want {
+			t.Errorf("keepRuleExecution(%v) = %v, want %v", tt.execution, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/dateparse"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+// ruleTriggerGuard prevents running triggered rules for a document that is already running them.
+// Together with saving the changes of rules directly to the storage, which does not fire new events,
+// it prevents loops where rule action triggers the same rule again.
+type ruleTriggerGuard struct {
+	lock    sync.Mutex
+	running map[string]bool
+}
+
+func newRuleTriggerGuard() *ruleTriggerGuard {
+	return &ruleTriggerGuard{running: map[string]bool{}}
+}
+
+// acquire marks the document as running rules. Returns false if rules are already running for the document.
+func (g *ruleTriggerGuard) acquire(documentId string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.running[documentId] {
+		return false
+	}
+	g.running[documentId] = true
+	return true
+}
+
+func (g *ruleTriggerGuard) release(documentId string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.running, documentId)
+}
+
+var triggerGuard = newRuleTriggerGuard()
+
+// RunTriggeredRules runs the enabled rules of the user that have any of the triggers on given documents.
+// Each rule is run at most once per document. Changes are saved and changed documents are added to
+// the search index queue. Returns ids of the documents that rules changed.
+func RunTriggeredRules(db *storage.Database, searcher DocumentSearcher, userId int, documents []string,
+	triggers ...models.RuleTrigger) ([]string, error) {
+	changed := make([]string, 0)
+	if len(documents) == 0 || len(triggers) == 0 {
+		return changed, nil
+	}
+
+	rules, err := db.RuleStore.GetActiveUserRules(userId, triggers...)
+	if err != nil {
+		return changed, fmt.Errorf("load rules: %v", err)
+	}
+	if len(rules) == 0 {
+		return changed, nil
+	}
+
+	dateOptions, err := db.UserStore.GetDateOptions(userId)
+	if err != nil {
+		logrus.Errorf("get date preferences for user %d: %v", userId, err)
+	}
+	dateParser := dateparse.NewParser(dateOptions)
+
+	var runErr error
+	for _, id := range documents {
+		ok, err := runTriggeredRulesForDocument(db, searcher, userId, id, rules, dateParser)
+		if err != nil {
+			logrus.Errorf("run triggered rules (%v) for document %s: %v", triggers, id, err)
+			runErr = err
+		}
+		if ok {
+			changed = append(changed, id)
+		}
+	}
+
+	if len(changed) > 0 {
+		err = db.JobStore.AddDocuments(userId, changed, models.ProcessFts)
+		if err != nil && !errors.Is(err, errors.ErrAlreadyExists) {
+			logrus.Errorf("add documents to fts queue after triggered rules: %v", err)
+		}
+	}
+	return changed, runErr
+}
+
+// runTriggeredRulesForDocument runs the rules on document and saves the changes.
+// Returns true if the document was changed.
+func runTriggeredRulesForDocument(db *storage.Database, searcher DocumentSearcher, userId int, documentId string,
+	rules []*models.Rule, dateParser *dateparse.Parser) (bool, error) {
+	if !triggerGuard.acquire(documentId) {
+		logrus.Warningf("rules are already running for document %s, skip triggered rules", documentId)
+		return false, nil
+	}
+	defer triggerGuard.release(documentId)
+
+	doc, err := LoadRuleDocument(db, userId, documentId)
+	if err != nil {
+		return false, fmt.Errorf("load document: %v", err)
+	}
+
+	notified, err := notifiedRules(db, documentId, rules)
+	if err != nil {
+		return false, fmt.Errorf("load notified rules: %v", err)
+	}
+
+	original := snapshotDocument(doc)
+	history := make([]models.DocumentHistory, 0)
+	executions := make([]*models.RuleExecution, 0, len(rules))
+	effects := &RuleEffects{}
+	for _, rule := range rules {
+		if len(rule.Actions) == 0 || len(rule.Conditions) == 0 {
+			continue
+		}
+		runner := NewDocumentRule(doc, rule)
+		runner.DateParser = dateParser
+		runner.Metadata = db.MetadataStore
+		runner.Search = searcher
+		runner.Trigger = rule.Trigger
+		runner.Notified = notified
+		execution, changes := runner.Execute()
+		if execution.Error != "" {
+			logrus.Errorf("run rule (%d) for document %s: %s", rule.Id, documentId, execution.Error)
+		}
+		if keepRuleExecution(execution) {
+			executions = append(executions, execution)
+		}
+		history = append(history, changes...)
+		effects.merge(runner.Effects)
+		if runner.Stopped {
+			break
+		}
+	}
+	history = enforceRulesMetadataConstraints(db.MetadataStore, doc, original.Metadata, executions, history)
+
+	err = db.RuleStore.SaveRuleChanges(&storage.RuleChanges{
+		Document:        doc,
+		History:         withoutEffectHistory(history),
+		MetadataChanged: metadataChanged(history),
+		TagsChanged:     tagsChanged(history),
+		Executions:      executions,
+	})
+	if err != nil {
+		return false, fmt.Errorf("save changes: %v", err)
+	}
+	if len(history) == 0 {
+		return false, nil
+	}
+	err = applyRuleEffects(db, doc, effects)
+	if err != nil {
+		return true, fmt.Errorf("apply rule actions: %v", err)
+	}
+	return true, nil
+}
+
+// notifiedRules returns the rules that have already sent notification of the document.
+// History is only loaded if any of the rules is scheduled and sends notifications.
+func notifiedRules(db *storage.Database, documentId string, rules []*models.Rule) (map[int]bool, error) {
+	notified := map[int]bool{}
+	load := false
+	for _, rule := range rules {
+		if rule.Trigger != models.RuleTriggerSchedule {
+			continue
+		}
+		for _, action := range rule.Actions {
+			if action.Action == models.RuleActionNotify {
+				load = true
+			}
+		}
+	}
+	if !load {
+		return notified, nil
+	}
+	ids, err := db.DocumentStore.GetNotifiedRuleIds(documentId)
+	if err != nil {
+		return notified, err
+	}
+	for _, id := range ids {
+		notified[id] = true
+	}
+	return notified, nil
+}
+
+// keepRuleExecution returns true if the execution is saved. Scheduled rules run on every document every night,
+// so their executions are only saved when the rule matched or failed. This keeps rule history and
+// rule statistics from growing with executions that did nothing.
+func keepRuleExecution(execution *models.RuleExecution) bool {
+	if execution.Trigger != models.RuleTriggerSchedule {
+		return true
+	}
+	return execution.Matched || execution.Error != ""
+}
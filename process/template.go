@@ -0,0 +1,123 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// ruleCapture is a value captured by regex condition.
+type ruleCapture struct {
+	// name of the capture group, if group is named.
+	name  string
+	value string
+}
+
+// matchTextCapture matches text with the regex of the condition and stores capture groups of the match
+// to be used in action templates. Case-insensitive regex is matched against the original text,
+// so that captured values keep their case.
+func (d *DocumentRule) matchTextCapture(condition *models.RuleCondition, text string) (bool, error) {
+	regex := condition.Value
+	if condition.IgnoreCase() {
+		regex = "(?i)" + regex
+	}
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return false, fmt.Errorf("invalid regex: %v", err)
+	}
+	match := re.FindStringSubmatch(text)
+	if match == nil {
+		return false, nil
+	}
+	names := re.SubexpNames()
+	for i := 1; i < len(match); i++ {
+		d.conditionCaptures = append(d.conditionCaptures, ruleCapture{name: names[i], value: match[i]})
+	}
+	return true, nil
+}
+
+// renderTemplate renders action value as a template. See models.RuleTemplateFuncs for available functions.
+func (d *DocumentRule) renderTemplate(text string, log logFunc) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("action").Funcs(d.templateFuncs()).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parse template: %v", err)
+	}
+
+	out := &strings.Builder{}
+	err = tmpl.Execute(out, nil)
+	if err != nil {
+		return "", fmt.Errorf("render template: %v", err)
+	}
+	if log != nil {
+		log(`render template "%s" -> "%s"`, text, out.String())
+	}
+	return out.String(), nil
+}
+
+func (d *DocumentRule) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"date": func(layout string) string {
+			if d.Document.Date.IsZero() {
+				return ""
+			}
+			return d.Document.Date.Format(layout)
+		},
+		"filename": func() string {
+			return d.Document.Filename
+		},
+		"meta": func(key string) string {
+			values := make([]string, 0, 2)
+			for _, v := range d.Document.Metadata {
+				if strings.EqualFold(v.Key, key) && v.Value != "" {
+					values = append(values, v.Value)
+				}
+			}
+			return strings.Join(values, ", ")
+		},
+		"capture": func(group interface{}) (string, error) {
+			switch ref := group.(type) {
+			case int:
+				if ref < 1 || ref > len(d.captures) {
+					return "", nil
+				}
+				return d.captures[ref-1].value, nil
+			case string:
+				for _, v := range d.captures {
+					if v.name == ref {
+						return v.value, nil
+					}
+				}
+				return "", nil
+			default:
+				return "", fmt.Errorf("capture must be referred by number or name, got %v", group)
+			}
+		},
+		"pages": func() int {
+			return documentPages(d.Document)
+		},
+	}
+}
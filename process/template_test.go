@@ -0,0 +1,131 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func TestDocumentRule_renderTemplate(t *testing.T) {
+	doc := &models.Document{
+		Id:       "1234",
+		Name:     "scan.pdf",
+		Filename: "scan_0001.pdf",
+		Mimetype: "application/pdf",
+		Date:     time.Date(2023, 3, 14, 0, 0, 0, 0, time.UTC),
+		Content:  "Invoice number: INV-5678\nCustomer: 12345",
+		Metadata: []models.Metadata{
+			{KeyId: 1, Key: "company", ValueId: 1, Value: "Acme"},
+			{KeyId: 2, Key: "category", ValueId: 2, Value: "invoice"},
+			{KeyId: 2, Key: "category", ValueId: 3, Value: "paid"},
+		},
+		Properties: []models.DocumentProperty{{Key: "pages", Value: "3", Source: "pdfinfo"}},
+	}
+	rule := &models.Rule{
+		Mode: models.RuleMatchAll,
+		Conditions: []*models.RuleCondition{
+			{Enabled: true, ConditionType: models.RuleConditionContentContains, IsRegex: true, CaseInsensitive: true,
+				Value: `invoice number: (?P<invoice>[\w-]+)`},
+			{Enabled: true, ConditionType: models.RuleConditionContentContains, IsRegex: true, Value: `Customer: (\d+)`},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{"plain text", "plain text", "plain text", false},
+		{"date", `{{date "2006-01"}} invoice`, "2023-03 invoice", false},
+		{"metadata", `{{meta "company"}}: {{meta "Category"}}`, "Acme: invoice, paid", false},
+		{"missing metadata", `{{meta "project"}}`, "", false},
+		{"filename and pages", `{{filename}} ({{pages}} pages)`, "scan_0001.pdf (3 pages)", false},
+		{"capture by number", `{{capture 1}} / {{capture 2}}`, "INV-5678 / 12345", false},
+		{"capture by name", `{{capture "invoice"}}`, "INV-5678", false},
+		{"capture out of range", `{{capture 3}}`, "", false},
+		{"invalid capture", `{{capture 1.5}}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := NewDocumentRule(doc, rule)
+			ok, err := dc.Match()
+			if err != nil || !ok {
+				t.Fatalf("rule did not match: %v", err)
+			}
+			got, err := dc.renderTemplate(tt.template, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderTemplate() got = '%s', want '%s'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentRule_templateActions(t *testing.T) {
+	doc := &models.Document{
+		Id:       "1234",
+		Name:     "scan.pdf",
+		Date:     time.Date(2023, 3, 14, 0, 0, 0, 0, time.UTC),
+		Metadata: []models.Metadata{{KeyId: 1, Key: "company", ValueId: 1, Value: "Acme"}},
+	}
+	rule := &models.Rule{
+		Actions: []*models.RuleAction{
+			{Enabled: true, Action: models.RuleActionSetName, Value: `{{date "2006-01"}} {{meta "company"}}`},
+			{Enabled: true, Action: models.RuleActionAppendName, Value: ` invoice`},
+			{Enabled: true, Action: models.RuleActionSetDescription, Value: `Invoice from {{meta "company"}}`},
+		},
+	}
+
+	dc := NewDocumentRule(doc, rule)
+	err := dc.RunActions()
+	if err != nil {
+		t.Fatalf("RunActions() error = %v", err)
+	}
+	if doc.Name != "2023-03 Acme invoice" {
+		t.Errorf("got name '%s'", doc.Name)
+	}
+	if doc.Description != "Invoice from Acme" {
+		t.Errorf("got description '%s'", doc.Description)
+	}
+}
+
+func TestDocumentRule_templateFuncs(t *testing.T) {
+	dc := NewDocumentRule(&models.Document{}, &models.Rule{})
+	got := make([]string, 0)
+	for name := range dc.templateFuncs() {
+		got = append(got, name)
+	}
+	want := make([]string, 0)
+	for name := range models.RuleTemplateFuncs {
+		want = append(want, name)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("template functions = %v, validated functions = %v", got, want)
+	}
+}
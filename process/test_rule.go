@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"strings"
 	"time"
 	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
@@ -12,6 +11,12 @@ import (
 
 // run rule in test mode, logging all results
 func (d *DocumentRule) MatchTest() *RuleTestResult {
+	// testing must not have any side effects
+	d.DryRun = true
+	d.captures = nil
+	d.actionHistory = nil
+	d.Effects = RuleEffects{}
+	d.Stopped = false
 	logBuf := &bytes.Buffer{}
 
 	logger := logrus.New()
@@ -24,118 +29,52 @@ func (d *DocumentRule) MatchTest() *RuleTestResult {
 
 	}
 
-	hasMatch := false
-
+	conditions := d.Rule.AllConditions()
 	result := &RuleTestResult{
 		StartedAt:       int(time.Now().UnixNano() / 1000000),
 		RuleId:          d.Rule.Id,
-		Conditions:      make([]RuleTestConditionResult, len(d.Rule.Conditions)),
+		Conditions:      make([]RuleTestConditionResult, len(conditions)),
 		Actions:         make([]RuleTestAction, len(d.Rule.Actions)),
-		ConditionOutput: [][]string{},
+		ConditionOutput: make([][]string, len(conditions)),
 		ActionOutput:    [][]string{},
 	}
 
-	for i, v := range d.Rule.Conditions {
+	eval := &ruleEvaluation{
+		logger: logger,
+		result: result,
+		index:  make(map[*models.RuleCondition]int, len(conditions)),
+	}
+
+	for i, v := range conditions {
+		eval.index[v] = i
 		result.Conditions[i].ConditionId = v.Id
 		result.Conditions[i].ConditionType = v.ConditionType.String()
+		result.Conditions[i].ParentId = int(v.ParentId)
 		result.Conditions[i].Skipped = true
+		result.ConditionOutput[i] = []string{}
 	}
+	var setDepth func(conditions []*models.RuleCondition, depth int)
+	setDepth = func(conditions []*models.RuleCondition, depth int) {
+		for _, v := range conditions {
+			result.Conditions[eval.index[v]].Depth = depth
+			setDepth(v.Conditions, depth+1)
+		}
+	}
+	setDepth(d.Rule.Conditions, 0)
+
 	for i, v := range d.Rule.Actions {
 		result.Actions[i].Skipped = !v.Enabled
 		result.Actions[i].ActionId = v.Id
 		result.Actions[i].ActionType = v.Action.String()
 	}
 
-	var conditionResult []string
-	logConditionOut := func(format string, args ...interface{}) {
-		out := fmt.Sprintf(format, args...)
-		conditionResult = append(conditionResult, out)
-	}
-
 	logger.Infof("Try to match document: %s with rule: '%s' (id: %d)", d.Document.Id, d.Rule.Name, d.Rule.Id)
-	for i, condition := range d.Rule.Conditions {
-		result.Conditions[i].ConditionId = condition.Id
-		doBreak := false
-		if !condition.Enabled {
-			logger.Warnf("condition: %d (id:%d), %s is disabled, skipping condition", condition.Id, i+1, condition.ConditionType)
-			logConditionOut("condition disabled")
-			continue
-		} else {
-			result.Conditions[i].Skipped = false
-			logger.Infof("evaluate condition %d (id:%d), type: '%s'", condition.Id, i+1, condition.ConditionType)
-			condText := string(condition.ConditionType)
-			var ok = false
-			var err error
-			if strings.HasPrefix(condText, "name") {
-				ok, err = d.matchText(condition, d.Document.Name)
-			} else if strings.HasPrefix(condText, "description") {
-				ok, err = d.matchText(condition, d.Document.Description)
-			} else if strings.HasPrefix(condText, "content") {
-				ok, err = d.matchText(condition, d.Document.Content)
-			} else if strings.HasPrefix(condText, "metadata_has_key") {
-				ok = d.hasMetadataKey(condition)
-			} else if strings.HasPrefix(condText, "date") {
-				ok, err = d.extractDates(condition, time.Now(), logger)
-
-				if ok {
-					y, m, d := d.date.Date()
-					logger.Infof("found date %d-%d-%d", y, m, d)
-					logConditionOut("found date %d-%d-%d", y, m, d)
-				}
-
-			} else if strings.HasPrefix(condText, "metadata_count") {
-				ok, err = d.hasMetadataCount(condition)
-			} else if condition.ConditionType == models.RuleConditionMetadataHasKey {
-				ok = d.hasMetadataKey(condition)
-			} else if condition.ConditionType == models.RuleConditionMetadataHasKeyValue {
-				ok = d.hasMetadataKeyValue(condition)
-			} else {
-				err := errors.ErrInternalError
-				err.ErrMsg = "unknown condition type: " + condText
-				result.Error = err.Error()
-				break
-			}
-			if err != nil {
-				e := errors.ErrInternalError
-				e.ErrMsg = fmt.Errorf("evaluate condition: %v", err).Error()
-				result.Error = e.Error()
-				break
-			}
-
-			if condition.Inverted {
-				logConditionOut("invert condition matched: %t -> %t", ok, !ok)
-				ok = !ok
-			}
-
-			if ok {
-				hasMatch = true
-				logger.Infof("condition %d (id %d) matched", i+1, condition.Id)
-				logConditionOut("condition matched")
-				result.Conditions[i].Matched = true
-				if d.Rule.Mode == models.RuleMatchAny {
-					// already found a match, skip rest of the conditions
-					logger.Infof("document matches and mode is set to 'match any', skip rest conditions")
-					logConditionOut("rule mode is set to 'match any', skip rest conditions")
-					doBreak = true
-				}
-
-			} else if d.Rule.Mode == models.RuleMatchAll {
-				logger.Infof("condition %d didn't match, skip rest", condition.Id)
-				logConditionOut("condition didn't match")
-				logConditionOut("rule mode is set to 'match all', stopping execution")
-				hasMatch = false
-				doBreak = true
-			} else {
-				logger.Infof("condition %d didn't match, continuing", condition.Id)
-				logConditionOut("condition didn't match")
-			}
-		}
-
-		result.ConditionOutput = append(result.ConditionOutput, conditionResult)
-		conditionResult = []string{}
-		if doBreak {
-			break
-		}
+	hasMatch, _, err := d.evaluateGroup(nil, d.Rule.Conditions, eval)
+	if err != nil {
+		e := errors.ErrInternalError
+		e.ErrMsg = err.Error()
+		result.Error = e.Error()
+		hasMatch = false
 	}
 
 	if hasMatch {
@@ -145,6 +84,7 @@ func (d *DocumentRule) MatchTest() *RuleTestResult {
 			actionResult = append(actionResult, out)
 		}
 
+		original := snapshotDocument(d.Document)
 		for _, action := range d.Rule.Actions {
 			err := d.runAction(action, logActionOut)
 			if err != nil {
@@ -153,6 +93,11 @@ func (d *DocumentRule) MatchTest() *RuleTestResult {
 			result.ActionOutput = append(result.ActionOutput, actionResult)
 			actionResult = []string{}
 		}
+		err = enforceMetadataConstraints(d.Metadata, d.Document, original.Metadata)
+		if err != nil {
+			logger.Warn(err.Error())
+			result.Error = err.Error()
+		}
 	}
 
 	result.StoppedAt = int(time.Now().UnixNano() / 1000000)
@@ -0,0 +1,170 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/dateparse"
+	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/storage"
+)
+
+// RuleBatchTestResult is the result of testing a rule against multiple documents.
+type RuleBatchTestResult struct {
+	Total   int `json:"total"`
+	Matched int `json:"matched"`
+	// Changed is the number of documents that the rule would change.
+	Changed int `json:"changed"`
+	Failed  int `json:"failed"`
+	// Compared is true if results were compared to the saved version of the rule.
+	Compared     bool `json:"compared"`
+	SavedMatched int  `json:"saved_matched"`
+	// OutcomeChanged is the number of documents whose result differs from the saved version of the rule.
+	OutcomeChanged int                      `json:"outcome_changed"`
+	Documents      []*RuleBatchTestDocument `json:"documents"`
+}
+
+// RuleBatchTestDocument is the result of testing a rule against a single document.
+type RuleBatchTestDocument struct {
+	DocumentId   string `json:"document_id"`
+	DocumentName string `json:"document_name"`
+	Matched      bool   `json:"matched"`
+	// Changes that the rule would make, in the same format as document history.
+	Changes []models.DocumentHistory `json:"changes"`
+	Result  *RuleTestResult          `json:"result"`
+	// SavedMatched and SavedChanges are the result of the saved version of the rule.
+	SavedMatched bool                     `json:"saved_matched"`
+	SavedChanges []models.DocumentHistory `json:"saved_changes"`
+	// OutcomeChanged is true if the rule matches or changes the document differently than the saved version.
+	OutcomeChanged bool   `json:"outcome_changed"`
+	Error          string `json:"error"`
+}
+
+// ruleBatchTester tests rules without side effects.
+type ruleBatchTester struct {
+	// load returns the document to test with.
+	load       func(documentId string) (*models.Document, error)
+	metadata   MetadataValueStore
+	search     DocumentSearcher
+	dateParser *dateparse.Parser
+}
+
+// BatchTestRule tests the rule against given documents without modifying them. If saved is not nil,
+// results are compared to the saved version of the rule.
+func BatchTestRule(db *storage.Database, search DocumentSearcher, userId int, rule, saved *models.Rule,
+	documents []string) *RuleBatchTestResult {
+	dateOptions, err := db.UserStore.GetDateOptions(userId)
+	if err != nil {
+		logrus.Errorf("get date preferences for user %d: %v", userId, err)
+	}
+	tester := &ruleBatchTester{
+		load: func(documentId string) (*models.Document, error) {
+			return LoadRuleDocument(db, userId, documentId)
+		},
+		metadata:   db.MetadataStore,
+		search:     search,
+		dateParser: dateparse.NewParser(dateOptions),
+	}
+	return tester.test(rule, saved, documents)
+}
+
+// test tests the rule against the documents and compares the results to saved, if it is not nil.
+func (b *ruleBatchTester) test(rule, saved *models.Rule, documents []string) *RuleBatchTestResult {
+	result := &RuleBatchTestResult{
+		Total:     len(documents),
+		Compared:  saved != nil,
+		Documents: make([]*RuleBatchTestDocument, 0, len(documents)),
+	}
+	for _, id := range documents {
+		item := &RuleBatchTestDocument{
+			DocumentId:   id,
+			Changes:      []models.DocumentHistory{},
+			SavedChanges: []models.DocumentHistory{},
+		}
+		result.Documents = append(result.Documents, item)
+
+		doc, err := b.load(id)
+		if err != nil {
+			item.Error = err.Error()
+			result.Failed += 1
+			continue
+		}
+		item.DocumentName = doc.Name
+		original := snapshotDocument(doc)
+
+		item.Result, item.Changes = b.run(doc, rule)
+		item.Matched = item.Result.Match
+		if item.Result.Error != "" {
+			item.Error = item.Result.Error
+			result.Failed += 1
+		}
+		if item.Matched {
+			result.Matched += 1
+		}
+		if len(item.Changes) > 0 {
+			result.Changed += 1
+		}
+
+		if saved != nil {
+			var savedResult *RuleTestResult
+			savedResult, item.SavedChanges = b.run(original, saved)
+			item.SavedMatched = savedResult.Match
+			item.OutcomeChanged = item.Matched != item.SavedMatched || !sameChanges(item.Changes, item.SavedChanges)
+			if item.SavedMatched {
+				result.SavedMatched += 1
+			}
+			if item.OutcomeChanged {
+				result.OutcomeChanged += 1
+			}
+		}
+	}
+	return result
+}
+
+// run tests the rule against the document and returns the result with the changes rule would make.
+// Document is modified.
+func (b *ruleBatchTester) run(doc *models.Document, rule *models.Rule) (*RuleTestResult, []models.DocumentHistory) {
+	runner := NewDocumentRule(doc, rule)
+	runner.DateParser = b.dateParser
+	runner.Metadata = b.metadata
+	runner.Search = b.search
+	before := snapshotDocument(doc)
+	result := runner.MatchTest()
+	changes, err := runner.documentChanges(before)
+	if err != nil {
+		logrus.Errorf("rule %d, get changes for document %s: %v", rule.Id, doc.Id, err)
+	}
+	if changes == nil {
+		changes = []models.DocumentHistory{}
+	}
+	return result, changes
+}
+
+// sameChanges returns true if both contain the same changes in the same order.
+func sameChanges(a, b []models.DocumentHistory) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Action != b[i].Action || a[i].OldValue != b[i].OldValue || a[i].NewValue != b[i].NewValue {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package process
+
+import (
+	"testing"
+
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_ruleBatchTester_test(t *testing.T) {
+	documents := map[string]*models.Document{
+		"invoice": {Id: "invoice", Name: "invoice 2023.pdf", Content: "invoice"},
+		"receipt": {Id: "receipt", Name: "receipt.pdf", Content: "receipt"},
+		"notes":   {Id: "notes", Name: "notes.pdf", Content: "notes"},
+	}
+	tester := &ruleBatchTester{
+		load: func(documentId string) (*models.Document, error) {
+			doc, ok := documents[documentId]
+			if !ok {
+				return nil, errors.ErrRecordNotFound
+			}
+			copied := *doc
+			return &copied, nil
+		},
+		metadata: &fakeMetadataStore{},
+	}
+	newRule := func(name string) *models.Rule {
+		return &models.Rule{Id: 1, Mode: models.RuleMatchAll, Conditions: []*models.RuleCondition{
+			{Enabled: true, ConditionType: models.RuleConditionNameContains, Value: name},
+		}, Actions: []*models.RuleAction{
+			{Enabled: true, Action: models.RuleActionAddTag, TagId: 1, TagName: "bills"},
+		}}
+	}
+
+	// unsaved rule is not compared
+	result := tester.test(newRule("invoice"), nil, []string{"invoice", "receipt", "missing"})
+	if result.Total != 3 || result.Matched != 1 || result.Changed != 1 || result.Failed != 1 || result.Compared {
+		t.Errorf("result = %+v", result)
+	}
+	if !result.Documents[0].Matched || len(result.Documents[0].Changes) != 1 ||
+		result.Documents[0].Changes[0].Action != models.DocumentHistoryActionTagAdd {
+		t.Errorf("invoice result = %+v", result.Documents[0])
+	}
+	if result.Documents[2].Error == "" {
+		t.Errorf("missing document does not have error")
+	}
+
+	// edited rule is compared to the saved rule
+	result = tester.test(newRule("receipt"), newRule("invoice"), []string{"invoice", "receipt", "notes"})
+	if !result.Compared || result.Matched != 1 || result.SavedMatched != 1 || result.OutcomeChanged != 2 {
+		t.Errorf("result = %+v", result)
+	}
+	if result.Documents[0].Matched || !result.Documents[0].SavedMatched || !result.Documents[0].OutcomeChanged {
+		t.Errorf("invoice result = %+v", result.Documents[0])
+	}
+	if result.Documents[2].OutcomeChanged {
+		t.Errorf("notes result changed")
+	}
+}
@@ -110,38 +110,67 @@ func (e *Engine) ping() error {
 // IndexDocuments sends documents to meilisearch for indexing
 func (e *Engine) IndexDocuments(docs *[]models.Document, userId int) error {
 	data := make([]map[string]interface{}, len(*docs))
+	names, err := e.metadataValueNames(userId)
+	if err != nil {
+		return fmt.Errorf("get metadata value names: %v", err)
+	}
+
 	for i, v := range *docs {
 
 		tags := make([]string, len(v.Tags))
 		for tagI, tag := range v.Tags {
-			tags[tagI] = tag.Key
+			tags[tagI] = normalizeMetadataValue(tag.Key)
 		}
 
-		metadata := make([]string, len(v.Metadata))
-		for metadataI, v := range v.Metadata {
-			key := normalizeMetadataKey(v.Key)
-			value := normalizeMetadataValue(v.Value)
-			metadata[metadataI] = key + ":" + value
+		metadata := indexedMetadata(v.Metadata, names)
+
+		typedMetadata := make(map[string][]interface{})
+		for _, v := range v.Metadata {
+			field := typedMetadataField(v.Key)
+			if number, ok := v.Number(); ok {
+				typedMetadata[field] = append(typedMetadata[field], number)
+			} else if v.ValueBool.Valid {
+				typedMetadata[field] = append(typedMetadata[field], v.ValueBool.Bool)
+			}
 		}
 
-		data[i] = map[string]interface{}{
-			"document_id": v.Id,
-			"user_id":     v.UserId,
-			"name":        v.Name,
-			"file_name":   v.Filename,
-			"content":     v.Content,
-			"hash":        v.Hash,
-			"created_at":  v.CreatedAt.Unix(),
-			"updated_at":  v.UpdatedAt.Unix(),
-			"tags":        tags,
-			"metadata":    metadata,
-			"date":        v.Date.Unix(),
-			"description": v.Description,
-			"mimetype":    v.Mimetype,
+		item := map[string]interface{}{
+			"document_id":          v.Id,
+			"user_id":              v.UserId,
+			"name":                 v.Name,
+			"file_name":            v.Filename,
+			"content":              v.Content,
+			"hash":                 v.Hash,
+			"created_at":           v.CreatedAt.Unix(),
+			"updated_at":           v.UpdatedAt.Unix(),
+			"tags":                 tags,
+			"metadata":             metadata,
+			"date":                 v.Date.Unix(),
+			typedMetadataAttribute: typedMetadata,
+			"description":          v.Description,
+			"mimetype":             v.Mimetype,
 		}
+
+		for _, field := range v.Fields {
+			switch field.Name {
+			case models.DocumentFieldAmount:
+				amount, err := strconv.ParseFloat(field.Value, 64)
+				if err == nil {
+					item[field.Name] = amount
+				}
+			case models.DocumentFieldDueDate:
+				date, err := time.Parse("2006-01-02", field.Value)
+				if err == nil {
+					item[field.Name] = date.Unix()
+				}
+			default:
+				item[field.Name] = strings.ToLower(field.Value)
+			}
+		}
+		data[i] = item
 	}
 
-	_, err := e.client.Index(indexName(userId)).UpdateDocuments(data)
+	_, err = e.client.Index(indexName(userId)).UpdateDocuments(data)
 	if err != nil {
 		return fmt.Errorf("index documents: %v", err)
 	}
@@ -149,6 +178,42 @@ func (e *Engine) IndexDocuments(docs *[]models.Document, userId int) error {
 	return nil
 }
 
+// metadataValueNames returns the other names that user's metadata values are indexed with:
+// the paths of their ancestors and their aliases.
+func (e *Engine) metadataValueNames(userId int) (map[int][]string, error) {
+	values, err := e.db.MetadataStore.GetUserValues(userId)
+	if err != nil {
+		return nil, err
+	}
+	names := models.MetadataValueAncestorPaths(values)
+	for _, v := range values {
+		names[v.Id] = append(names[v.Id], v.Aliases...)
+	}
+	return names, nil
+}
+
+// indexedMetadata returns the key-value pairs of the metadata. Values are also indexed with their other names,
+// so that filtering with an alias or a parent value matches the value, e.g. 'Kitchen' -> 'project:Kitchen',
+// 'project:Renovation', 'project:Renovation/Kitchen'.
+func indexedMetadata(metadata []models.Metadata, names map[int][]string) []string {
+	indexed := make([]string, 0, len(metadata))
+	added := make(map[string]bool, len(metadata))
+	add := func(key, value string) {
+		item := normalizeMetadataKey(key) + ":" + normalizeMetadataValue(value)
+		if !added[item] {
+			added[item] = true
+			indexed = append(indexed, item)
+		}
+	}
+	for _, v := range metadata {
+		add(v.Key, v.Value)
+		for _, name := range names[v.ValueId] {
+			add(v.Key, name)
+		}
+	}
+	return indexed
+}
+
 func (e *Engine) DeleteDocument(docId string, userId int) error {
 
 	_, err := e.client.Index(indexName(userId)).DeleteDocument(docId)
@@ -341,6 +406,12 @@ func (e *Engine) AddUserIndex(userId int) error {
 			"metadata_value",
 			"mimetype",
 		}
+		_, err = e.client.Index(index).UpdateSearchableAttributes(fields)
+		if err != nil {
+			logrus.Errorf("meilisearch set searchable attributes: %v", err)
+		}
+
+		*fields = append(*fields, indexedFieldAttributes()...)
 		_, err = e.client.Index(index).UpdateFilterableAttributes(fields)
 		if err != nil {
 			logrus.Errorf("meilisearch set filterable attributes: %v", err)
@@ -350,13 +421,65 @@ func (e *Engine) AddUserIndex(userId int) error {
 		if err != nil {
 			logrus.Errorf("meilisearch set sortable attributes: %v", err)
 		}
-		_, err = e.client.Index(index).UpdateSearchableAttributes(fields)
+	} else {
+		err = e.ensureFieldAttributes(index)
+	}
+	if err != nil {
+		return fmt.Errorf("create index: %v", err)
+	}
+	return nil
+}
+
+// indexedFieldAttributes returns the filterable and sortable attributes that were added after
+// the first version of the index: document fields and typed metadata.
+func indexedFieldAttributes() []string {
+	fields := make([]string, 0, len(models.AllDocumentFields)+1)
+	fields = append(fields, models.AllDocumentFields...)
+	return append(fields, typedMetadataAttribute)
+}
+
+// ensureFieldAttributes adds document fields and typed metadata to filterable and sortable attributes
+// of an index that was created before they were indexed.
+func (e *Engine) ensureFieldAttributes(index string) error {
+	addMissing := func(attributes *[]string) bool {
+		changed := false
+		for _, field := range indexedFieldAttributes() {
+			found := false
+			for _, v := range *attributes {
+				if v == field {
+					found = true
+					break
+				}
+			}
+			if !found {
+				*attributes = append(*attributes, field)
+				changed = true
+			}
+		}
+		return changed
+	}
+
+	filterable, err := e.client.Index(index).GetFilterableAttributes()
+	if err != nil {
+		return fmt.Errorf("get filterable attributes: %v", err)
+	}
+	if addMissing(filterable) {
+		logrus.Infof("add document fields to filterable attributes in meilisearch index '%s'", index)
+		_, err = e.client.Index(index).UpdateFilterableAttributes(filterable)
 		if err != nil {
-			logrus.Errorf("meilisearch set searchable attributes: %v", err)
+			return fmt.Errorf("update filterable attributes: %v", err)
 		}
 	}
+
+	sortable, err := e.client.Index(index).GetSortableAttributes()
 	if err != nil {
-		return fmt.Errorf("create index: %v", err)
+		return fmt.Errorf("get sortable attributes: %v", err)
+	}
+	if addMissing(sortable) {
+		_, err = e.client.Index(index).UpdateSortableAttributes(sortable)
+		if err != nil {
+			return fmt.Errorf("update sortable attributes: %v", err)
+		}
 	}
 	return nil
 }
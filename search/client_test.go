@@ -21,6 +21,8 @@ package search
 import (
 	"reflect"
 	"testing"
+
+	"tryffel.net/go/virtualpaper/models"
 )
 
 func Test_buildSynonyms(t *testing.T) {
@@ -68,3 +70,32 @@ func Test_buildSynonyms(t *testing.T) {
 		})
 	}
 }
+
+func Test_indexedMetadata(t *testing.T) {
+	values := []models.MetadataValue{
+		{Id: 1, Value: "Renovation"},
+		{Id: 2, Value: "Kitchen", ParentId: 1},
+		{Id: 3, Value: "Sink Parts", ParentId: 2},
+		{Id: 4, Value: "paper"},
+	}
+	metadata := []models.Metadata{
+		{KeyId: 1, Key: "project", ValueId: 3, Value: "Sink Parts"},
+		{KeyId: 1, Key: "project", ValueId: 2, Value: "Kitchen"},
+		{KeyId: 2, Key: "class", ValueId: 4, Value: "paper"},
+	}
+	want := []string{
+		"project:Sink_Parts",
+		"project:Renovation",
+		"project:Renovation/Kitchen",
+		"project:Renovation/Kitchen/Sink_Parts",
+		"project:Kitchen",
+		"class:paper",
+		"class:Paper_Documents",
+	}
+	names := models.MetadataValueAncestorPaths(values)
+	names[4] = append(names[4], "Paper Documents")
+	got := indexedMetadata(metadata, names)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("indexedMetadata() = %v, want %v", got, want)
+	}
+}
@@ -20,12 +20,15 @@ package search
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/meilisearch/meilisearch-go"
 	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/dateparse"
 	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
 	"tryffel.net/go/virtualpaper/storage"
@@ -46,7 +49,17 @@ type DocumentFilter struct {
 // else search only specified field
 func (e *Engine) SearchDocuments(userId int, query string, sort storage.SortKey, paging storage.Paging) ([]*models.Document, int, error) {
 
-	qs, err := parseFilter(query)
+	dateOptions, err := e.db.UserStore.GetDateOptions(userId)
+	if err != nil {
+		logrus.Errorf("get date preferences for user %d: %v", userId, err)
+	}
+
+	keys, err := e.typedMetadataKeys(userId)
+	if err != nil {
+		logrus.Errorf("get metadata keys for user %d: %v", userId, err)
+	}
+
+	qs, err := parseFilter(query, dateparse.NewParser(dateOptions), keys)
 	if err != nil {
 		e := errors.ErrInvalid
 		e.ErrMsg = err.Error()
@@ -195,7 +208,24 @@ func tokenizeFilter(filter string) []string {
 	return tokens
 }
 
-func parseFilter(filter string) (*searchQuery, error) {
+// typedMetadataKeys returns the value types of user's metadata keys that can be compared in search,
+// keyed by lowercase key name.
+func (e *Engine) typedMetadataKeys(userId int) (map[string]models.MetadataValueType, error) {
+	keys, err := e.db.MetadataStore.GetUserKeysCached(userId)
+	if err != nil {
+		return nil, err
+	}
+	typed := make(map[string]models.MetadataValueType)
+	for _, v := range *keys {
+		if v.ValueType.Comparable() {
+			typed[strings.ToLower(v.Key)] = v.ValueType
+		}
+	}
+	return typed, nil
+}
+
+// parseFilter parses the query. Keys are the comparable metadata keys that support range filters.
+func parseFilter(filter string, dateParser *dateparse.Parser, keys map[string]models.MetadataValueType) (*searchQuery, error) {
 	sq := &searchQuery{RawQuery: filter}
 	tokens := tokenizeFilter(strings.ToLower(filter))
 
@@ -205,7 +235,9 @@ func parseFilter(filter string) (*searchQuery, error) {
 	textQuery := []string{}
 
 	matchers := map[string]parseFunc{
-		"date":        parseDate,
+		"date": func(value string, sq *searchQuery) bool {
+			return parseDate(value, dateParser, sq)
+		},
 		"name":        parseName,
 		"content":     parseContent,
 		"description": parseDescription,
@@ -221,6 +253,25 @@ func parseFilter(filter string) (*searchQuery, error) {
 	for iteration < maxIterations && len(tokensLeft) > 0 {
 		iteration += 1
 		token := tokensLeft[0]
+		// user's typed keys take precedence over extracted fields with the same name
+		typedFilter, isTyped, err := parseTypedMetadataFilter(token, keys, dateParser)
+		if err != nil {
+			return sq, fmt.Errorf("invalid query: %v: %v", token, err)
+		}
+		if isTyped {
+			sq.FieldFilters = append(sq.FieldFilters, typedFilter)
+			removeToken()
+			continue
+		}
+		fieldFilter, isField, err := parseFieldFilter(token, dateParser)
+		if err != nil {
+			return sq, fmt.Errorf("invalid query: %v: %v", token, err)
+		}
+		if isField {
+			sq.FieldFilters = append(sq.FieldFilters, fieldFilter)
+			removeToken()
+			continue
+		}
 		splits := strings.Split(tokensLeft[0], ":")
 		if len(splits) == 1 {
 			found := false
@@ -258,6 +309,12 @@ func parseFilter(filter string) (*searchQuery, error) {
 			continue
 		}
 
+		if splits[0] == "tag" {
+			metadataQuery = append(metadataQuery, fmt.Sprintf(`tags="%s"`, normalizeMetadataValue(splits[1])))
+			removeToken()
+			continue
+		}
+
 		metadataFilter := fmt.Sprintf(`metadata="%s:%s"`, normalizeMetadataKey(splits[0]), normalizeMetadataValue(splits[1]))
 		metadataQuery = append(metadataQuery, metadataFilter)
 		removeToken()
@@ -270,8 +327,94 @@ func parseFilter(filter string) (*searchQuery, error) {
 
 type parseFunc func(value string, sq *searchQuery) bool
 
-func parseDate(value string, sq *searchQuery) bool {
-	status, _, startT, endT := matchDate(value)
+var fieldFilterRe = regexp.MustCompile(`^(amount|currency|iban|reference|due_date|vat_id)(>=|<=|>|<|=)(.+)$`)
+
+// parseFieldFilter parses comparison of extracted document field into meilisearch filter,
+// e.g. 'amount>100' or 'due_date<2023-01-01'. Text fields only support '='.
+// If token is not a field comparison, return false.
+func parseFieldFilter(token string, dateParser *dateparse.Parser) (string, bool, error) {
+	match := fieldFilterRe.FindStringSubmatch(token)
+	if len(match) != 4 {
+		return "", false, nil
+	}
+	field, operator, value := match[1], match[2], match[3]
+
+	switch field {
+	case models.DocumentFieldAmount:
+		amount, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+		if err != nil {
+			return "", true, fmt.Errorf("amount must be a number")
+		}
+		return fmt.Sprintf("%s %s %s", field, operator, strconv.FormatFloat(amount, 'f', -1, 64)), true, nil
+	case models.DocumentFieldDueDate:
+		status, _, start, end := matchDate(value, dateParser)
+		if status != valueMatchStatusOk {
+			return "", true, fmt.Errorf("invalid date")
+		}
+		switch operator {
+		case ">":
+			return fmt.Sprintf("%s >= %d", field, end.Unix()), true, nil
+		case ">=":
+			return fmt.Sprintf("%s >= %d", field, start.Unix()), true, nil
+		case "<":
+			return fmt.Sprintf("%s < %d", field, start.Unix()), true, nil
+		case "<=":
+			return fmt.Sprintf("%s < %d", field, end.Unix()), true, nil
+		default:
+			return fmt.Sprintf("%s >= %d AND %s < %d", field, start.Unix(), field, end.Unix()), true, nil
+		}
+	default:
+		if operator != "=" {
+			return "", true, fmt.Errorf("%s can only be compared with '='", field)
+		}
+		return fmt.Sprintf(`%s = "%s"`, field, escapeFilterString(strings.ReplaceAll(value, " ", ""))), true, nil
+	}
+}
+
+var typedMetadataFilterRe = regexp.MustCompile(`^([^:<>=]+)(>=|<=|>|<)(.+)$`)
+
+// parseTypedMetadataFilter parses range comparison of a typed metadata key into meilisearch filter,
+// e.g. 'amount>100' or 'expires<2025-01-01'. If token is not a comparison or the key is not comparable,
+// return false.
+func parseTypedMetadataFilter(token string, keys map[string]models.MetadataValueType, dateParser *dateparse.Parser) (string, bool, error) {
+	match := typedMetadataFilterRe.FindStringSubmatch(token)
+	if len(match) != 4 {
+		return "", false, nil
+	}
+	key, operator, value := match[1], match[2], match[3]
+	valueType, ok := keys[key]
+	if !ok {
+		return "", false, nil
+	}
+	field := typedMetadataAttribute + "." + typedMetadataField(key)
+
+	if valueType == models.MetadataValueDate {
+		status, _, start, end := matchDate(value, dateParser)
+		if status != valueMatchStatusOk {
+			return "", true, fmt.Errorf("invalid date")
+		}
+		switch operator {
+		case ">":
+			return fmt.Sprintf("%s >= %d", field, end.Unix()), true, nil
+		case ">=":
+			return fmt.Sprintf("%s >= %d", field, start.Unix()), true, nil
+		case "<":
+			return fmt.Sprintf("%s < %d", field, start.Unix()), true, nil
+		default:
+			return fmt.Sprintf("%s < %d", field, end.Unix()), true, nil
+		}
+	}
+
+	_, typed, err := models.ParseMetadataValue(valueType, value)
+	if err != nil {
+		return "", true, err
+	}
+	number, _ := typed.Number()
+	return fmt.Sprintf("%s %s %s", field, operator, strconv.FormatFloat(number, 'f', -1, 64)), true, nil
+}
+
+func parseDate(value string, dateParser *dateparse.Parser, sq *searchQuery) bool {
+	status, _, startT, endT := matchDate(value, dateParser)
 	if status == valueMatchStatusOk {
 		sq.DateAfter = startT
 		sq.DateBefore = endT
@@ -303,6 +446,24 @@ func normalizeMetadataValue(value string) string {
 	return normalizeMetadataKey(value)
 }
 
+// typedMetadataAttribute is the index attribute that holds typed metadata values by key.
+const typedMetadataAttribute = "metadata_typed"
+
+var typedMetadataFieldRe = regexp.MustCompile(`[^a-z0-9_]`)
+
+// typedMetadataField returns the name of the metadata key in typed metadata attribute.
+func typedMetadataField(key string) string {
+	return typedMetadataFieldRe.ReplaceAllString(strings.ToLower(key), "_")
+}
+
+var filterStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// escapeFilterString escapes backslashes and quotes of a value that is placed inside quotes
+// in meilisearch filter.
+func escapeFilterString(value string) string {
+	return filterStringEscaper.Replace(value)
+}
+
 func escapeMetadataKey(key string) string {
 	if strings.Contains(key, " ") {
 		return `"` + key + `"`
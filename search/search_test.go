@@ -19,9 +19,12 @@
 package search
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
+
+	"tryffel.net/go/virtualpaper/dateparse"
 	"tryffel.net/go/virtualpaper/models"
 )
 
@@ -116,6 +119,17 @@ func Test_parseFilter(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "tags",
+			args: args{`invoice tag:important AND (tag:"to do" OR key:value)`},
+			want: &searchQuery{
+				RawQuery:       `invoice tag:important AND (tag:"to do" OR key:value)`,
+				Query:          "invoice",
+				MetadataQuery:  []string{`tags="important"`, "AND", "(", `tags="to_do"`, "OR", `metadata="key:value"`, ")"},
+				MetadataString: `tags="important" AND ( tags="to_do" OR metadata="key:value" )`,
+			},
+			wantErr: false,
+		},
 		{
 			name: "date today",
 			args: args{"date:today"},
@@ -249,7 +263,7 @@ func Test_parseFilter(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := parseFilter(tt.args.filter)
+			got, err := parseFilter(tt.args.filter, dateparse.NewParser(dateparse.DefaultOptions()), nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseFilter() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -264,3 +278,102 @@ func Test_parseFilter(t *testing.T) {
 func timeFromDate(year, month, day int) time.Time {
 	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
 }
+
+func Test_parseFieldFilter(t *testing.T) {
+	tests := []struct {
+		token   string
+		want    string
+		isField bool
+		wantErr bool
+	}{
+		{"amount>100", "amount > 100", true, false},
+		{"amount<=50,5", "amount <= 50.5", true, false},
+		{"amount>abc", "", true, true},
+		{"due_date<2023-01-01", fmt.Sprintf("due_date < %d", timeFromDate(2023, 1, 1).Unix()), true, false},
+		{"due_date>2023-01-01", fmt.Sprintf("due_date >= %d", timeFromDate(2023, 1, 2).Unix()), true, false},
+		{"currency=eur", `currency = "eur"`, true, false},
+		{`reference=12"34`, `reference = "12\"34"`, true, false},
+		{`reference=a" OR user_id = 2 OR "`, `reference = "a\"ORuser_id=2OR\""`, true, false},
+		{`iban=fi\"`, `iban = "fi\\\""`, true, false},
+		{"iban>fi21", "", true, true},
+		{"key:value", "", false, false},
+		{"text", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			got, isField, err := parseFieldFilter(tt.token, dateparse.NewParser(dateparse.DefaultOptions()))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFieldFilter() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want || isField != tt.isField {
+				t.Errorf("parseFieldFilter() = %v, %v, want %v, %v", got, isField, tt.want, tt.isField)
+			}
+		})
+	}
+
+	sq, err := parseFilter("invoice amount>100 class:paper", dateparse.NewParser(dateparse.DefaultOptions()), nil)
+	if err != nil {
+		t.Errorf("parseFilter() error = %v", err)
+		return
+	}
+	if sq.Query != "invoice" || !reflect.DeepEqual(sq.FieldFilters, []string{"amount > 100"}) || sq.MetadataString != `metadata="class:paper"` {
+		t.Errorf("parseFilter() with field filter = %+v", sq)
+	}
+}
+
+func Test_parseTypedMetadataFilter(t *testing.T) {
+	keys := map[string]models.MetadataValueType{
+		"total":      models.MetadataValueDecimal,
+		"year":       models.MetadataValueInteger,
+		"expires on": models.MetadataValueDate,
+	}
+	tests := []struct {
+		token   string
+		want    string
+		isTyped bool
+		wantErr bool
+	}{
+		{"total>100", "metadata_typed.total > 100", true, false},
+		{"total<=50,5", "metadata_typed.total <= 50.5", true, false},
+		{"year>=2020", "metadata_typed.year >= 2020", true, false},
+		{"year>abc", "", true, true},
+		{"expires on<2025-01-01", fmt.Sprintf("metadata_typed.expires_on < %d", timeFromDate(2025, 1, 1).Unix()), true, false},
+		{"expires on>2025-01-01", fmt.Sprintf("metadata_typed.expires_on >= %d", timeFromDate(2025, 1, 2).Unix()), true, false},
+		{"class>100", "", false, false},
+		{"total:100", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			got, isTyped, err := parseTypedMetadataFilter(tt.token, keys, dateparse.NewParser(dateparse.DefaultOptions()))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTypedMetadataFilter() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want || isTyped != tt.isTyped {
+				t.Errorf("parseTypedMetadataFilter() = %v, %v, want %v, %v", got, isTyped, tt.want, tt.isTyped)
+			}
+		})
+	}
+
+	sq, err := parseFilter("invoice total>100 amount>5 class:paper", dateparse.NewParser(dateparse.DefaultOptions()), keys)
+	if err != nil {
+		t.Errorf("parseFilter() error = %v", err)
+		return
+	}
+	want := []string{"metadata_typed.total > 100", "amount > 5"}
+	if sq.Query != "invoice" || !reflect.DeepEqual(sq.FieldFilters, want) || sq.MetadataString != `metadata="class:paper"` {
+		t.Errorf("parseFilter() with typed metadata filter = %+v", sq)
+	}
+
+	// typed key with the same name as an extracted field is range-filtered as metadata
+	keys["amount"] = models.MetadataValueDecimal
+	sq, err = parseFilter("amount>100", dateparse.NewParser(dateparse.DefaultOptions()), keys)
+	if err != nil {
+		t.Errorf("parseFilter() error = %v", err)
+		return
+	}
+	if !reflect.DeepEqual(sq.FieldFilters, []string{"metadata_typed.amount > 100"}) {
+		t.Errorf("parseFilter() with typed key 'amount' = %+v", sq.FieldFilters)
+	}
+}
@@ -20,11 +20,10 @@ package search
 
 import (
 	"fmt"
-	"regexp"
 	"strings"
 	"time"
 
-	"tryffel.net/go/virtualpaper/models"
+	"tryffel.net/go/virtualpaper/dateparse"
 
 	"github.com/meilisearch/meilisearch-go"
 	"github.com/sirupsen/logrus"
@@ -104,7 +103,9 @@ type searchQuery struct {
 	DateAfter      time.Time
 	MetadataQuery  []string
 	MetadataString string
-	Suggestions    []string
+	// FieldFilters are comparisons of extracted document fields, e.g. 'amount > 100'.
+	FieldFilters []string
+	Suggestions  []string
 }
 
 func (s *searchQuery) addSuggestion(text string) {
@@ -146,6 +147,9 @@ func (s *searchQuery) prepareMeiliQuery(userId int, sort storage.SortKey, paging
 	if len(datefilters) > 0 {
 		filter = strings.Join(append(datefilters, filter), " AND ")
 	}
+	if len(s.FieldFilters) > 0 {
+		filter = strings.Join(append(s.FieldFilters, filter), " AND ")
+	}
 	filter = strings.TrimSuffix(filter, " AND ")
 	//logrus.Infof("filter: %s", filter)
 	// TODO : fix
@@ -420,116 +424,46 @@ func suggestDate(token string) []string {
 	return suggestions
 }
 
-// matchDate tries to validate and autocomplete date filter
-func matchDate(token string) (valueMatchStatus, string, time.Time, time.Time) {
+// matchDate tries to validate and autocomplete date filter. Token is either a single date expression
+// (see dateparse.Parser.ParseRange) or a range of two expressions separated with '|', e.g. '2020|today'.
+// Empty end of range means today.
+func matchDate(token string, parser *dateparse.Parser) (valueMatchStatus, string, time.Time, time.Time) {
 	if token == "" {
 		return valueMatchStatusIncomplete, "", time.Time{}, time.Time{}
 	}
-	if token == "today" {
-		return valueMatchStatusOk, "today", models.MidnightForDate(time.Now()), models.MidnightForDate(time.Now().AddDate(0, 0, 1))
-	} else if token == "yesterday" {
-		return valueMatchStatusOk, "yesterday", models.MidnightForDate(time.Now().AddDate(0, 0, -1)), models.MidnightForDate(time.Now())
-	} else if token == "week" {
-		return valueMatchStatusOk, "week", models.MidnightForDate(time.Now().AddDate(0, 0, -7)), models.MidnightForDate(time.Now())
-	} else if token == "month" {
-		return valueMatchStatusOk, "month", models.MidnightForDate(time.Now().AddDate(0, -1, 0)), models.MidnightForDate(time.Now())
-	} else if token == "year" {
-		return valueMatchStatusOk, "year", models.MidnightForDate(time.Now().AddDate(-1, 0, 0)), models.MidnightForDate(time.Now())
-	}
+	now := time.Now()
 
-	separator := "|"
-	splits := strings.Split(token, separator)
+	splits := strings.Split(token, "|")
 	if len(splits) == 1 {
-		t := parseDateFromLayout(token, false, false)
-		if !t.IsZero() {
-			endDate := parseDateFromLayout(token, true, false)
-			return valueMatchStatusOk, token, t, endDate
+		start, end, ok := parser.ParseRange(token, now)
+		if ok {
+			return valueMatchStatusOk, token, start, end
 		}
+		return valueMatchStatusInvalid, "", time.Time{}, time.Time{}
 	}
 
 	if len(splits) == 2 {
-		startD := parseDateFromLayout(splits[0], false, false)
-
+		startD, _, ok := parser.ParseRange(splits[0], now)
+		if !ok {
+			return valueMatchStatusInvalid, token, time.Time{}, time.Time{}
+		}
 		if splits[1] == "" {
 			splits[1] = "today"
 		}
 
-		stopD := parseDateFromLayout(splits[1], true, false)
-		if startD.IsZero() || stopD.IsZero() {
-			return valueMatchStatusInvalid, token, startD, stopD
+		// relative day as the end of range is exclusive, e.g. '2020|today' does not include today.
+		stopD, ok := dateparse.RelativeDay(splits[1], now)
+		if !ok {
+			_, stopD, ok = parser.ParseRange(splits[1], now)
 		}
-		return valueMatchStatusOk, token, startD, stopD
-	}
-
-	layouts := []string{
-		//"1/2/2006",
-		//"2.1.2006",
-		"2006-1-2",
-	}
-
-	for _, layout := range layouts {
-		t, err := time.Parse(layout, token)
-		if err == nil {
-			return valueMatchStatusOk, token, t.UTC(), t.UTC()
+		if !ok {
+			return valueMatchStatusInvalid, token, startD, time.Time{}
 		}
+		return valueMatchStatusOk, token, startD, stopD
 	}
-
 	return valueMatchStatusInvalid, "", time.Time{}, time.Time{}
 }
 
-var regexYear = regexp.MustCompile(`^(\d{4})$`)
-var regexYearMonth = regexp.MustCompile(`^(\d{4}-\d{1,2})$`)
-var regexDate = regexp.MustCompile(`^(\d{4}-\d{1,2}-\d{1,2})$`)
-
-func parseDateFromLayout(token string, addDigit bool, removeDigit bool) time.Time {
-
-	if token == "today" {
-		return models.MidnightForDate(time.Now())
-	} else if token == "yesterday" {
-		return models.MidnightForDate(time.Now().AddDate(0, 0, -1))
-	} else if token == "week" {
-		return models.MidnightForDate(time.Now().AddDate(0, 0, 7))
-	} else if token == "month" {
-		return models.MidnightForDate(time.Now().AddDate(0, 1, 0))
-	} else if token == "year" {
-		return models.MidnightForDate(time.Now().AddDate(1, 0, 0))
-	}
-
-	t, err := time.Parse("2006", "2006")
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-	fmt.Println(t.Format("2006-01-02"))
-	layout := ""
-	addYears := 0
-	addMonths := 0
-	addDays := 0
-	if regexYear.MatchString(token) {
-		addYears = 1
-		layout = "2006"
-	} else if regexYearMonth.MatchString(token) {
-		addMonths = 1
-		layout = "2006-1"
-	} else if regexDate.MatchString(token) {
-		addDays = 1
-		layout = "2006-1-2"
-	}
-
-	if layout != "" {
-		date, err := time.Parse(layout, token)
-		if err == nil {
-			if addDigit {
-				date = date.AddDate(addYears, addMonths, addDays)
-			}
-			if removeDigit {
-				date = date.AddDate(-addYears, -addMonths, -addDays)
-			}
-			return models.MidnightForDate(date)
-		}
-	}
-	return time.Time{}
-}
-
 type metadataQuerier interface {
 	queryKeys(key string, prefis string, suffix string) []string
 	queryValues(key, value string) []string
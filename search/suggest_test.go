@@ -24,6 +24,7 @@ import (
 	"testing"
 	"time"
 
+	"tryffel.net/go/virtualpaper/dateparse"
 	"tryffel.net/go/virtualpaper/models"
 )
 
@@ -56,10 +57,34 @@ func Test_matchDate(t *testing.T) {
 			want2: models.MidnightForDate(time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)),
 			want3: models.MidnightForDate(time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC)),
 		},
+		{
+			name:  "month name",
+			args:  args{"march 2022"},
+			want:  valueMatchStatusOk,
+			want1: "march 2022",
+			want2: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+			want3: time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "iso week",
+			args:  args{"2022-w10"},
+			want:  valueMatchStatusOk,
+			want1: "2022-w10",
+			want2: time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC),
+			want3: time.Date(2022, 3, 14, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "range with day first",
+			args:  args{"1.3.2022|15.3.2022"},
+			want:  valueMatchStatusOk,
+			want1: "1.3.2022|15.3.2022",
+			want2: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+			want3: time.Date(2022, 3, 16, 0, 0, 0, 0, time.UTC),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1, got2, got3 := matchDate(tt.args.token)
+			got, got1, got2, got3 := matchDate(tt.args.token, dateparse.NewParser(dateparse.DefaultOptions()))
 			if got != tt.want {
 				t.Errorf("matchDate() got = %v, want %v", got, tt.want)
 			}
@@ -25,6 +25,7 @@ import (
 	"github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
 	"github.com/sirupsen/logrus"
+	"tryffel.net/go/virtualpaper/config"
 	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
 )
@@ -67,7 +68,7 @@ func (s *DocumentStore) GetDocuments(userId int, paging Paging, sort SortKey, li
 	sql := `
 SELECT id, name, ` + contenSelect + `, 
 	filename, created_at, updated_at,
-	hash, mimetype, size, date, description, deleted_at
+	hash, mimetype, size, date, description, deleted_at, needs_review
 FROM documents
 WHERE user_id = $1 AND deleted_at %s
 ORDER BY ` + sort.QueryKey() + " " + sort.SortOrder() + `
@@ -202,13 +203,13 @@ func (s *DocumentStore) GetByHash(userId int, hash string) (*models.Document, er
 
 func (s *DocumentStore) Create(doc *models.Document) error {
 	sql := `
-INSERT INTO documents (id, user_id, name, content, filename, hash, mimetype, size, description, date)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id;`
+INSERT INTO documents (id, user_id, name, content, filename, hash, mimetype, size, description, date, source)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id;`
 
 	doc.Init()
 
 	rows, err := s.db.Query(sql, doc.Id, doc.UserId, doc.Name, doc.Content, doc.Filename, doc.Hash, doc.Mimetype, doc.Size,
-		doc.Description, doc.Date)
+		doc.Description, doc.Date, doc.Source)
 	if err != nil {
 		return s.parseError(err, "created")
 	}
@@ -225,23 +226,23 @@ INSERT INTO documents (id, user_id, name, content, filename, hash, mimetype, siz
 	return err
 }
 
-func addDocumentHistoryAction(db *sqlx.DB, queryBuilder squirrel.StatementBuilderType, items []models.DocumentHistory, userId int) error {
+func addDocumentHistoryAction(db sqlx.Execer, queryBuilder squirrel.StatementBuilderType, items []models.DocumentHistory, userId int) error {
 	if len(items) == 0 {
 		return nil
 	}
 
-	query := queryBuilder.Insert("document_history").Columns("document_id", "action", "old_value", "new_value")
+	query := queryBuilder.Insert("document_history").Columns("document_id", "action", "old_value", "new_value", "rule_id")
 	if userId != UserIdInternal {
 		query = query.Columns("user_id")
 	}
 
 	if userId != UserIdInternal {
 		for _, v := range items {
-			query = query.Values(v.DocumentId, v.Action, v.OldValue, v.NewValue, userId)
+			query = query.Values(v.DocumentId, v.Action, v.OldValue, v.NewValue, v.RuleId, userId)
 		}
 	} else {
 		for _, v := range items {
-			query = query.Values(v.DocumentId, v.Action, v.OldValue, v.NewValue)
+			query = query.Values(v.DocumentId, v.Action, v.OldValue, v.NewValue, v.RuleId)
 		}
 	}
 
@@ -318,18 +319,9 @@ func (s *DocumentStore) Update(userId int, doc *models.Document) error {
 	if err != nil {
 		return s.parseError(err, "get document by id")
 	}
-	doc.UpdatedAt = time.Now()
-	sql := `
-UPDATE documents SET 
-name=$2, content=$3, filename=$4, hash=$5, mimetype=$6, size=$7, date=$8,
-updated_at=$9, description=$10
-WHERE id=$1
-`
-
-	_, err = s.db.Exec(sql, doc.Id, doc.Name, doc.Content, doc.Filename, doc.Hash, doc.Mimetype, doc.Size,
-		doc.Date, doc.UpdatedAt, doc.Description)
+	err = s.update(doc)
 	if err != nil {
-		return s.parseError(err, "update")
+		return err
 	}
 
 	diff, err := oldDoc.Diff(doc, userId)
@@ -342,6 +334,36 @@ WHERE id=$1
 	return err
 }
 
+// UpdateWithHistory updates document and saves given history items instead of calculating the diff.
+// History items are saved without user, e.g. when changes are made by processing rules.
+func (s *DocumentStore) UpdateWithHistory(doc *models.Document, history []models.DocumentHistory) error {
+	err := s.update(doc)
+	if err != nil {
+		return err
+	}
+	err = addDocumentHistoryAction(s.db, s.sq, history, UserIdInternal)
+	logrus.Infof("Server edited document %s with %d actions", doc.Id, len(history))
+	return err
+}
+
+func (s *DocumentStore) update(doc *models.Document) error {
+	return s.parseError(updateDocument(s.db, doc), "update")
+}
+
+func updateDocument(db sqlx.Execer, doc *models.Document) error {
+	doc.UpdatedAt = time.Now()
+	sql := `
+UPDATE documents SET 
+name=$2, content=$3, filename=$4, hash=$5, mimetype=$6, size=$7, date=$8,
+updated_at=$9, description=$10, needs_review=$11
+WHERE id=$1
+`
+
+	_, err := db.Exec(sql, doc.Id, doc.Name, doc.Content, doc.Filename, doc.Hash, doc.Mimetype, doc.Size,
+		doc.Date, doc.UpdatedAt, doc.Description, doc.NeedsReview)
+	return err
+}
+
 func (s *DocumentStore) SetModifiedAt(docIds []string, modifiedAt time.Time) error {
 	query := s.sq.Update("documents").Set("updated_at", modifiedAt).Where(squirrel.Eq{"id": docIds})
 	sql, args, err := query.ToSql()
@@ -353,17 +375,9 @@ func (s *DocumentStore) SetModifiedAt(docIds []string, modifiedAt time.Time) err
 }
 
 func (s *DocumentStore) MarkDocumentDeleted(userId int, docId string) error {
-	query := s.sq.Update("documents").Set("deleted_at", time.Now()).Where("id=?", docId)
-	if userId != 0 {
-		query = query.Where("user_id = ?", userId)
-	}
-	sql, args, err := query.ToSql()
+	err := s.markDeleted(userId, docId)
 	if err != nil {
-		return fmt.Errorf("sql: %v", err)
-	}
-	_, err = s.db.Exec(sql, args...)
-	if err != nil {
-		return s.parseError(err, "mark document deleted")
+		return err
 	}
 
 	err = addDocumentHistoryAction(s.db, s.sq, []models.DocumentHistory{{
@@ -380,6 +394,53 @@ func (s *DocumentStore) MarkDocumentDeleted(userId int, docId string) error {
 	return nil
 }
 
+// MoveToTrash marks the document deleted by the rule and adds the history entry.
+func (s *DocumentStore) MoveToTrash(docId string, ruleId int) error {
+	xTx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin tx: %v", err)
+	}
+	tx := &tx{tx: xTx, resource: s}
+	defer tx.Close()
+	_, err = tx.tx.Exec(`UPDATE documents SET deleted_at = $2 WHERE id = $1`, docId, time.Now())
+	if err != nil {
+		return s.parseError(err, "mark document deleted")
+	}
+	err = addDocumentHistoryAction(tx.tx, s.sq, []models.DocumentHistory{{
+		DocumentId: docId,
+		Action:     models.DocumentHistoryActionDelete,
+		RuleId:     models.IntId(ruleId),
+	}}, UserIdInternal)
+	if err != nil {
+		return fmt.Errorf("add history entry: %v", err)
+	}
+	tx.ok = true
+	return nil
+}
+
+// GetNotifiedRuleIds returns the ids of the rules that have sent notification of the document.
+func (s *DocumentStore) GetNotifiedRuleIds(docId string) ([]int, error) {
+	sql := `
+SELECT DISTINCT rule_id FROM document_history
+WHERE document_id = $1 AND action = $2 AND rule_id IS NOT NULL`
+	ids := make([]int, 0)
+	err := s.db.Select(&ids, sql, docId, models.DocumentHistoryActionNotify)
+	return ids, s.parseError(err, "get notified rules")
+}
+
+func (s *DocumentStore) markDeleted(userId int, docId string) error {
+	query := s.sq.Update("documents").Set("deleted_at", time.Now()).Where("id=?", docId)
+	if userId != 0 && userId != UserIdInternal {
+		query = query.Where("user_id = ?", userId)
+	}
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("sql: %v", err)
+	}
+	_, err = s.db.Exec(sql, args...)
+	return s.parseError(err, "mark document deleted")
+}
+
 func (s *DocumentStore) MarkDocumentNonDeleted(userId int, docId string) error {
 	query := s.sq.Update("documents").Set("deleted_at", nil).Where("id=?", docId)
 	sql, args, err := query.ToSql()
@@ -420,10 +481,13 @@ func (s *DocumentStore) GetDocumentHistory(userId int, docId string) (*[]models.
 		dh.new_value as new_value,
 		dh.created_at as created_at,
 		coalesce(dh.user_id, 0) as user_id,
-		coalesce(u.name, 'Server') as user
+		coalesce(u.name, 'Server') as user,
+		dh.rule_id as rule_id,
+		coalesce(r.name, '') as rule_name
 	FROM document_history dh 
 	LEFT JOIN documents d ON dh.document_id=d.id 
 	LEFT JOIN users u ON dh.user_id=u.id
+	LEFT JOIN rules r ON dh.rule_id=r.id
 	WHERE document_id=$1
 	ORDER BY created_at ASC;
 	`
@@ -468,3 +532,422 @@ func (s *DocumentStore) GetDocumentsInTrashbin(deletedAt time.Time) ([]string, e
 	}
 	return ids, nil
 }
+
+// GetUserDocumentIds returns ids of all documents of the user that are not in trash.
+func (s *DocumentStore) GetUserDocumentIds(userId int) ([]string, error) {
+	query := s.sq.Select("id").
+		From("documents").
+		Where(squirrel.Eq{"user_id": userId, "deleted_at": nil}).
+		OrderBy("created_at ASC")
+	sql, args, err := query.ToSql()
+	ids := make([]string, 0)
+	if err != nil {
+		return ids, fmt.Errorf("sql: %v", err)
+	}
+
+	err = s.db.Select(&ids, sql, args...)
+	return ids, s.parseError(err, "get user document ids")
+}
+
+// GetLatestDocumentIds returns ids of the latest non-deleted documents of the user, newest first.
+func (s *DocumentStore) GetLatestDocumentIds(userId int, limit int) ([]string, error) {
+	query := s.sq.Select("id").
+		From("documents").
+		Where(squirrel.Eq{"user_id": userId, "deleted_at": nil}).
+		OrderBy("created_at DESC", "id ASC").
+		Limit(uint64(limit))
+	sql, args, err := query.ToSql()
+	ids := make([]string, 0)
+	if err != nil {
+		return ids, fmt.Errorf("sql: %v", err)
+	}
+
+	err = s.db.Select(&ids, sql, args...)
+	return ids, s.parseError(err, "get latest document ids")
+}
+
+// GetDocumentProperties returns all properties extracted from the document file.
+func (s *DocumentStore) GetDocumentProperties(documentId string) (*[]models.DocumentProperty, error) {
+	sql := `
+	SELECT document_id, key, value, source
+	FROM document_properties
+	WHERE document_id = $1
+	ORDER BY source, key;
+	`
+
+	properties := &[]models.DocumentProperty{}
+	err := s.db.Select(properties, sql, documentId)
+	return properties, s.parseError(err, "get document properties")
+}
+
+// SetDocumentProperties replaces all document properties of given source with properties.
+func (s *DocumentStore) SetDocumentProperties(documentId string, source string, properties []models.DocumentProperty) error {
+	xTx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin tx: %v", err)
+	}
+	tx := &tx{tx: xTx, resource: s}
+	defer tx.Close()
+
+	_, err = tx.tx.Exec("DELETE FROM document_properties WHERE document_id = $1 AND source = $2", documentId, source)
+	if err != nil {
+		return s.parseError(err, "delete old document properties")
+	}
+
+	if len(properties) > 0 {
+		query := s.sq.Insert("document_properties").Columns("document_id", "key", "value", "source")
+		for _, v := range properties {
+			query = query.Values(documentId, v.Key, v.Value, source)
+		}
+		query = query.Suffix("ON CONFLICT (document_id, key) DO UPDATE SET value = EXCLUDED.value, source = EXCLUDED.source")
+
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("build sql: %v", err)
+		}
+		_, err = tx.tx.Exec(sql, args...)
+		if err != nil {
+			return s.parseError(err, "insert document properties")
+		}
+	}
+	tx.ok = true
+	return nil
+}
+
+// GetDocumentBarcodes returns all barcodes decoded from the document, ordered by page.
+func (s *DocumentStore) GetDocumentBarcodes(documentId string) (*[]models.DocumentBarcode, error) {
+	sql := `
+	SELECT document_id, page, type, payload
+	FROM document_barcodes
+	WHERE document_id = $1
+	ORDER BY page, id;
+	`
+
+	barcodes := &[]models.DocumentBarcode{}
+	err := s.db.Select(barcodes, sql, documentId)
+	return barcodes, s.parseError(err, "get document barcodes")
+}
+
+// SetDocumentBarcodes replaces all document barcodes with barcodes.
+func (s *DocumentStore) SetDocumentBarcodes(documentId string, barcodes []models.DocumentBarcode) error {
+	xTx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin tx: %v", err)
+	}
+	tx := &tx{tx: xTx, resource: s}
+	defer tx.Close()
+
+	_, err = tx.tx.Exec("DELETE FROM document_barcodes WHERE document_id = $1", documentId)
+	if err != nil {
+		return s.parseError(err, "delete old document barcodes")
+	}
+
+	if len(barcodes) > 0 {
+		query := s.sq.Insert("document_barcodes").Columns("document_id", "page", "type", "payload")
+		for _, v := range barcodes {
+			query = query.Values(documentId, v.Page, v.Type, v.Payload)
+		}
+
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("build sql: %v", err)
+		}
+		_, err = tx.tx.Exec(sql, args...)
+		if err != nil {
+			return s.parseError(err, "insert document barcodes")
+		}
+	}
+	tx.ok = true
+	return nil
+}
+
+// GetDocumentFields returns structured fields extracted from the document.
+func (s *DocumentStore) GetDocumentFields(documentId string) (*[]models.DocumentField, error) {
+	sql := `
+	SELECT document_id, name, value, confidence
+	FROM document_fields
+	WHERE document_id = $1
+	ORDER BY name;
+	`
+
+	fields := &[]models.DocumentField{}
+	err := s.db.Select(fields, sql, documentId)
+	return fields, s.parseError(err, "get document fields")
+}
+
+// SetDocumentFields replaces all document fields with fields.
+func (s *DocumentStore) SetDocumentFields(documentId string, fields []models.DocumentField) error {
+	xTx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin tx: %v", err)
+	}
+	tx := &tx{tx: xTx, resource: s}
+	defer tx.Close()
+
+	_, err = tx.tx.Exec("DELETE FROM document_fields WHERE document_id = $1", documentId)
+	if err != nil {
+		return s.parseError(err, "delete old document fields")
+	}
+
+	if len(fields) > 0 {
+		query := s.sq.Insert("document_fields").Columns("document_id", "name", "value", "confidence")
+		for _, v := range fields {
+			query = query.Values(documentId, v.Name, v.Value, v.Confidence)
+		}
+
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("build sql: %v", err)
+		}
+		_, err = tx.tx.Exec(sql, args...)
+		if err != nil {
+			return s.parseError(err, "insert document fields")
+		}
+	}
+	tx.ok = true
+	return nil
+}
+
+// SetDocumentFingerprint inserts or replaces document fingerprint.
+func (s *DocumentStore) SetDocumentFingerprint(fingerprint *models.DocumentFingerprint) error {
+	sql := `
+	INSERT INTO document_fingerprints (document_id, content_hash, image_hash)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (document_id) DO UPDATE 
+	SET content_hash = EXCLUDED.content_hash, image_hash = EXCLUDED.image_hash, created_at = now();
+	`
+	_, err := s.db.Exec(sql, fingerprint.DocumentId, fingerprint.ContentHash, fingerprint.ImageHash)
+	return s.parseError(err, "set document fingerprint")
+}
+
+// GetUserFingerprints returns fingerprints of all user's documents that are not in trash bin.
+func (s *DocumentStore) GetUserFingerprints(userId int) (*[]models.DocumentFingerprint, error) {
+	sql := `
+	SELECT f.document_id, f.content_hash, f.image_hash
+	FROM document_fingerprints f
+	JOIN documents d ON f.document_id = d.id
+	WHERE d.user_id = $1 AND d.deleted_at IS NULL;
+	`
+
+	fingerprints := &[]models.DocumentFingerprint{}
+	err := s.db.Select(fingerprints, sql, userId)
+	return fingerprints, s.parseError(err, "get user fingerprints")
+}
+
+// duplicatePair returns document ids in the order they are stored in document_duplicates.
+func duplicatePair(docId, duplicateId string) (string, string) {
+	if docId < duplicateId {
+		return docId, duplicateId
+	}
+	return duplicateId, docId
+}
+
+// SetDocumentDuplicates replaces pending duplicates of document with duplicates.
+// Duplicates that user has already ignored are kept as ignored.
+func (s *DocumentStore) SetDocumentDuplicates(documentId string, duplicates []models.DocumentDuplicate) error {
+	xTx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin tx: %v", err)
+	}
+	tx := &tx{tx: xTx, resource: s}
+	defer tx.Close()
+
+	_, err = tx.tx.Exec("DELETE FROM document_duplicates WHERE (doc_a_id = $1 OR doc_b_id = $1) AND status = $2",
+		documentId, models.DocumentDuplicatePending)
+	if err != nil {
+		return s.parseError(err, "delete old document duplicates")
+	}
+
+	if len(duplicates) > 0 {
+		query := s.sq.Insert("document_duplicates").
+			Columns("doc_a_id", "doc_b_id", "content_similarity", "image_similarity").
+			Suffix("ON CONFLICT (doc_a_id, doc_b_id) DO NOTHING")
+		for _, v := range duplicates {
+			docA, docB := duplicatePair(documentId, v.DuplicateId)
+			query = query.Values(docA, docB, v.ContentSimilarity, v.ImageSimilarity)
+		}
+
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("build sql: %v", err)
+		}
+		_, err = tx.tx.Exec(sql, args...)
+		if err != nil {
+			return s.parseError(err, "insert document duplicates")
+		}
+	}
+	tx.ok = true
+	return nil
+}
+
+func (s *DocumentStore) duplicatesQuery(userId int) squirrel.SelectBuilder {
+	return s.sq.Select("dd.doc_a_id AS document_id", "da.name AS document_name",
+		"dd.doc_b_id AS duplicate_id", "db.name AS duplicate_name",
+		"dd.content_similarity", "dd.image_similarity", "dd.status", "dd.created_at").
+		From("document_duplicates dd").
+		Join("documents da ON dd.doc_a_id = da.id").
+		Join("documents db ON dd.doc_b_id = db.id").
+		Where(squirrel.Eq{"da.user_id": userId, "db.user_id": userId, "dd.status": models.DocumentDuplicatePending}).
+		Where("da.deleted_at IS NULL AND db.deleted_at IS NULL")
+}
+
+// GetDocumentDuplicates returns pending duplicates for document. DocumentId is always set to documentId.
+func (s *DocumentStore) GetDocumentDuplicates(userId int, documentId string) (*[]models.DocumentDuplicate, error) {
+	query := s.duplicatesQuery(userId).
+		Where(squirrel.Or{squirrel.Eq{"dd.doc_a_id": documentId}, squirrel.Eq{"dd.doc_b_id": documentId}}).
+		OrderBy("dd.created_at DESC").
+		Limit(config.MaxRows)
+
+	duplicates := &[]models.DocumentDuplicate{}
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return duplicates, fmt.Errorf("build sql: %v", err)
+	}
+	err = s.db.Select(duplicates, sql, args...)
+	if err != nil {
+		return duplicates, s.parseError(err, "get document duplicates")
+	}
+	for i, v := range *duplicates {
+		if v.DocumentId != documentId {
+			(*duplicates)[i].DocumentId, (*duplicates)[i].DuplicateId = v.DuplicateId, v.DocumentId
+			(*duplicates)[i].DocumentName, (*duplicates)[i].DuplicateName = v.DuplicateName, v.DocumentName
+		}
+	}
+	return duplicates, nil
+}
+
+// GetUserDuplicates returns all pending duplicate pairs for user. In addition, return total count of pairs.
+func (s *DocumentStore) GetUserDuplicates(userId int, paging Paging) (*[]models.DocumentDuplicate, int, error) {
+	duplicates := &[]models.DocumentDuplicate{}
+	countQuery := s.sq.Select("COUNT(*)").FromSelect(s.duplicatesQuery(userId), "duplicates")
+	sql, args, err := countQuery.ToSql()
+	if err != nil {
+		return duplicates, 0, fmt.Errorf("build count sql: %v", err)
+	}
+	count := 0
+	err = s.db.Get(&count, sql, args...)
+	if err != nil {
+		return duplicates, 0, s.parseError(err, "count user duplicates")
+	}
+
+	query := s.duplicatesQuery(userId).
+		OrderBy("dd.created_at DESC", "dd.doc_a_id").
+		Offset(uint64(paging.Offset)).
+		Limit(uint64(paging.Limit))
+	sql, args, err = query.ToSql()
+	if err != nil {
+		return duplicates, 0, fmt.Errorf("build sql: %v", err)
+	}
+	err = s.db.Select(duplicates, sql, args...)
+	return duplicates, count, s.parseError(err, "get user duplicates")
+}
+
+// IgnoreDuplicate marks documents as not being duplicates, so they are not reported again.
+func (s *DocumentStore) IgnoreDuplicate(userId int, documentId, duplicateId string) error {
+	docA, docB := duplicatePair(documentId, duplicateId)
+	sql := `
+	UPDATE document_duplicates SET status = $3
+	WHERE doc_a_id = $1 AND doc_b_id = $2;
+	`
+	res, err := s.db.Exec(sql, docA, docB, models.DocumentDuplicateIgnored)
+	if err != nil {
+		return s.parseError(err, "ignore duplicate")
+	}
+	rows, err := res.RowsAffected()
+	if err == nil && rows == 0 {
+		return errors.ErrRecordNotFound
+	}
+	logrus.Infof("User %d marked documents %s and %s as not duplicates", userId, documentId, duplicateId)
+	return nil
+}
+
+// MergeDuplicate keeps document keepId and moves document trashId to trash bin.
+// Metadata of the trashed document is copied to the kept document, respecting the key constraints:
+// single-valued keys keep the value of the kept document.
+func (s *DocumentStore) MergeDuplicate(userId int, keepId, trashId string) error {
+	oldMetadata, err := s.metadataStore.GetDocumentMetadata(userId, keepId)
+	if err != nil {
+		return fmt.Errorf("get document metadata: %v", err)
+	}
+
+	err = s.mergeDuplicate(userId, keepId, trashId)
+	if err != nil {
+		return err
+	}
+
+	history := []models.DocumentHistory{
+		{DocumentId: keepId, Action: models.DocumentHistoryActionMergeDuplicate, NewValue: trashId, UserId: userId},
+		{DocumentId: trashId, Action: models.DocumentHistoryActionDelete, UserId: userId},
+	}
+	newMetadata, err := s.metadataStore.GetDocumentMetadata(userId, keepId)
+	if err != nil {
+		logrus.Errorf("get merged document metadata for history: %v", err)
+	} else {
+		history = append(history, models.MetadataDiff(keepId, userId, oldMetadata, newMetadata)...)
+	}
+	err = addDocumentHistoryAction(s.db, s.sq, history, userId)
+	if err != nil {
+		return fmt.Errorf("add history entries: %v", err)
+	}
+	return nil
+}
+
+func (s *DocumentStore) mergeDuplicate(userId int, keepId, trashId string) error {
+	keys, err := s.metadataStore.GetUserKeys(userId)
+	if err != nil {
+		return err
+	}
+
+	xTx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin tx: %v", err)
+	}
+	tx := &tx{tx: xTx, resource: s}
+	defer tx.Close()
+
+	docA, docB := duplicatePair(keepId, trashId)
+	res, err := tx.tx.Exec("DELETE FROM document_duplicates WHERE doc_a_id = $1 AND doc_b_id = $2", docA, docB)
+	if err != nil {
+		return s.parseError(err, "delete duplicate")
+	}
+	rows, err := res.RowsAffected()
+	if err == nil && rows == 0 {
+		return errors.ErrRecordNotFound
+	}
+
+	err = s.mergeDuplicateMetadata(tx, keys, keepId, trashId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.tx.Exec("UPDATE documents SET deleted_at = now(), updated_at = now() WHERE id = $1", trashId)
+	if err != nil {
+		return s.parseError(err, "mark duplicate deleted")
+	}
+	_, err = tx.tx.Exec("UPDATE documents SET updated_at = now() WHERE id = $1", keepId)
+	if err != nil {
+		return s.parseError(err, "update document")
+	}
+	tx.ok = true
+	return nil
+}
+
+// mergeDuplicateMetadata copies metadata of document trashId to document keepId. Values of
+// single-valued keys in the kept document are not replaced.
+func (s *DocumentStore) mergeDuplicateMetadata(tx *tx, keys []models.MetadataKey, keepId, trashId string) error {
+	metadata := make(map[string][]models.Metadata, 2)
+	for _, id := range []string{keepId, trashId} {
+		values := make([]models.Metadata, 0)
+		err := tx.tx.Select(&values, "SELECT key_id, value_id FROM document_metadata WHERE document_id = $1 ORDER BY value_id", id)
+		if err != nil {
+			return s.parseError(err, "get document metadata")
+		}
+		metadata[id] = values
+	}
+
+	merged := models.MergeableMetadata(keys, metadata[keepId], metadata[trashId])
+	if len(merged) == 0 {
+		return nil
+	}
+	return s.metadataStore.upsertDocumentMetadata(tx, keys, []string{keepId}, merged)
+}
@@ -498,3 +498,54 @@ func (s *JobStore) AddDocuments(userId int, documents []string, step models.Proc
 	_, err = s.db.Exec(sql, args...)
 	return getDatabaseError(err, s, "queue documents by metadata")
 }
+
+// CreateBulkOperation creates new bulk operation record.
+func (s *JobStore) CreateBulkOperation(op *models.BulkOperation) error {
+	sql := `
+INSERT INTO bulk_operations (user_id, operation, rule_id, status, total)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, created_at;
+`
+	err := s.db.QueryRowx(sql, op.UserId, op.Operation, op.RuleId, op.Status, op.Total).Scan(&op.Id, &op.CreatedAt)
+	return s.parseError(err, "create bulk operation")
+}
+
+// UpdateBulkOperation updates the status and progress of the bulk operation.
+func (s *JobStore) UpdateBulkOperation(op *models.BulkOperation) error {
+	sql := `
+UPDATE bulk_operations
+SET status=$2, total=$3, processed=$4, matched=$5, changed=$6, failed=$7, message=$8,
+    started_at=$9, stopped_at=$10
+WHERE id=$1;
+`
+	_, err := s.db.Exec(sql, op.Id, op.Status, op.Total, op.Processed, op.Matched, op.Changed, op.Failed,
+		op.Message, op.StartedAt, op.StoppedAt)
+	return s.parseError(err, "update bulk operation")
+}
+
+// GetBulkOperation returns bulk operation. If userId != 0, user must own the operation.
+func (s *JobStore) GetBulkOperation(userId int, id int) (*models.BulkOperation, error) {
+	query := s.sq.Select("*").From("bulk_operations").Where("id=?", id)
+	if userId != 0 {
+		query = query.Where("user_id=?", userId)
+	}
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("sql: %v", err)
+	}
+
+	op := &models.BulkOperation{}
+	err = s.db.Get(op, sql, args...)
+	return op, s.parseError(err, "get bulk operation")
+}
+
+// CancelRunningBulkOperations marks unfinished bulk operations as failed. Operations are not resumed after restart.
+func (s *JobStore) CancelRunningBulkOperations() error {
+	sql := `
+UPDATE bulk_operations
+SET status=$1, message='interrupted', stopped_at=now()
+WHERE status IN ($2, $3);
+`
+	_, err := s.db.Exec(sql, models.BulkOperationFailed, models.BulkOperationPending, models.BulkOperationRunning)
+	return s.parseError(err, "cancel running bulk operations")
+}
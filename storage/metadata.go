@@ -25,6 +25,7 @@ import (
 
 	"github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
 	"tryffel.net/go/virtualpaper/config"
@@ -92,6 +93,8 @@ func (m *MetadataStore) getCachedKeyValues(userId int, key string) *[]models.Met
 
 func (m *MetadataStore) flushCachedUserKeyValues(userId int, key string) {
 	m.cache.Delete(m.cacheNameUserKeyValues(userId, key))
+	// values are queried with lowercase key
+	m.cache.Delete(m.cacheNameUserKeyValues(userId, strings.ToLower(key)))
 }
 
 func (s MetadataStore) Name() string {
@@ -114,7 +117,12 @@ SELECT
 	mk.id AS key_id,
 	mk.key AS key,
 	mv.id AS value_id,
-	mv.value AS value
+	mv.value AS value,
+	COALESCE(mk.value_type, 'text') AS value_type,
+	mv.value_int AS value_int,
+	mv.value_decimal AS value_decimal,
+	mv.value_date AS value_date,
+	mv.value_bool AS value_bool
 FROM documents d
 LEFT JOIN document_metadata dm ON d.id = dm.document_id
 LEFT JOIN metadata_keys mk ON dm.key_id = mk.id
@@ -131,7 +139,12 @@ SELECT
 	mk.id AS key_id,
 	mk.key AS key,
 	mv.id AS value_id,
-	mv.value AS value
+	mv.value AS value,
+	COALESCE(mk.value_type, 'text') AS value_type,
+	mv.value_int AS value_int,
+	mv.value_decimal AS value_decimal,
+	mv.value_date AS value_date,
+	mv.value_bool AS value_bool
 FROM documents d
 LEFT JOIN document_metadata dm ON d.id = dm.document_id
 LEFT JOIN metadata_keys mk ON dm.key_id = mk.id
@@ -161,7 +174,8 @@ func (s *MetadataStore) GetUserKeysCached(userId int) (*[]models.MetadataKey, er
 	}
 
 	query := s.sq.Select("mk.id as id", "lower(mk.key) as key", "mk.comment as comment",
-		"mk.created_at as created_at").
+		"mk.created_at as created_at", "mk.value_type as value_type", "mk.single_value as single_value", "mk.required_when_key_id as required_when_key_id",
+		"mk.required_when_value_id as required_when_value_id").
 		From("metadata_keys mk").LeftJoin("document_metadata dm ON mk.id = dm.key_id").
 		Where(squirrel.Eq{"user_id": userId}).GroupBy("mk.id").
 		OrderBy("COUNT(dm.document_id) DESC").Limit(config.MaxRows)
@@ -181,32 +195,39 @@ func (s *MetadataStore) GetUserKeysCached(userId int) (*[]models.MetadataKey, er
 	s.cache.SetDefault(s.cacheNameUserKeys(userId), keys)
 	return keys, nil
 }
+
+// GetUserKeyValuesCached returns values of the key in lowercase, ordered by the number of documents.
+// Aliases of the values are returned as separate items with the id of the value.
 func (s *MetadataStore) GetUserKeyValuesCached(userId int, key string) (*[]models.Metadata, error) {
 	values := s.getCachedKeyValues(userId, key)
 	if values != nil {
 		return values, nil
 	}
 
-	query := s.sq.Select(
-		"mv.id as value_id",
-		"mk.id as key_id",
-		"lower(mv.value) as value",
-		"lower(mk.key) as key").
-		From("metadata_values mv").
-		LeftJoin("metadata_keys mk on mv.key_id = mk.id").
-		LeftJoin("document_metadata dm on mv.id = dm.value_id").
-		Where(squirrel.Eq{"mv.user_id": userId}).
-		Where(squirrel.Eq{"lower(mk.key)": key}).
-		GroupBy("mv.id", "mv.value", "mk.id", "mk.key").
-		OrderBy("count(dm.document_id) DESC").Limit(config.MaxRows)
-
-	sql, args, err := query.ToSql()
-	if err != nil {
-		return nil, fmt.Errorf("construct sql: %v", err)
-	}
+	sql := `
+SELECT value_id, key_id, value, key FROM (
+	SELECT mv.id AS value_id, mk.id AS key_id, lower(mv.value) AS value, lower(mk.key) AS key,
+		count(dm.document_id) AS documents
+	FROM metadata_values mv
+	LEFT JOIN metadata_keys mk ON mv.key_id = mk.id
+	LEFT JOIN document_metadata dm ON mv.id = dm.value_id
+	WHERE mv.user_id = $1 AND lower(mk.key) = $2
+	GROUP BY mv.id, mv.value, mk.id, mk.key
+	UNION ALL
+	SELECT a.value_id AS value_id, mk.id AS key_id, lower(a.alias) AS value, lower(mk.key) AS key,
+		count(dm.document_id) AS documents
+	FROM metadata_value_aliases a
+	LEFT JOIN metadata_keys mk ON a.key_id = mk.id
+	LEFT JOIN document_metadata dm ON a.value_id = dm.value_id
+	WHERE a.user_id = $1 AND lower(mk.key) = $2
+	GROUP BY a.id, a.value_id, a.alias, mk.id, mk.key
+) v
+ORDER BY documents DESC
+LIMIT $3;
+`
 
 	values = &[]models.Metadata{}
-	err = s.db.Select(values, sql, args...)
+	err := s.db.Select(values, sql, userId, key, config.MaxRows)
 	if err != nil {
 		return values, s.parseError(err, "get key values")
 	}
@@ -219,8 +240,10 @@ func (s *MetadataStore) GetUserKeyValuesCached(userId int, key string) (*[]model
 func (s *MetadataStore) GetKeys(userId int, ids []int, sort SortKey, paging Paging) (*[]models.MetadataKeyAnnotated, int, error) {
 	paging.Validate()
 	sort.Validate("id")
-	query := s.sq.Select("mk.id as id", "mk.key as key", "mk.comment as comment",
-		"mk.created_at as created_at", "COUNT(distinct(dm.document_id)) as documents_count", "COUNT(distinct(mv.id)) as values_count").
+	query := s.sq.Select("mk.id as id", "mk.key as key", "mk.comment as comment", "mk.value_type as value_type",
+		"mk.created_at as created_at", "COUNT(distinct(dm.document_id)) as documents_count", "COUNT(distinct(mv.id)) as values_count",
+		"mk.single_value as single_value", "mk.required_when_key_id as required_when_key_id",
+		"mk.required_when_value_id as required_when_value_id").
 		From("metadata_keys mk").
 		LeftJoin("document_metadata dm ON mk.id = dm.key_id").
 		LeftJoin("metadata_values mv on mk.id = mv.key_id").
@@ -265,11 +288,138 @@ AND id = $2;
 	return key, s.parseError(err, "get key")
 }
 
+// GetUserKeys returns all metadata keys of the user.
+func (s *MetadataStore) GetUserKeys(userId int) ([]models.MetadataKey, error) {
+	sql := `
+SELECT id, user_id, key, comment, created_at, value_type, single_value, required_when_key_id,
+	required_when_value_id
+FROM metadata_keys
+WHERE user_id = $1
+ORDER BY key ASC;
+`
+	keys := make([]models.MetadataKey, 0)
+	err := s.db.Select(&keys, sql, userId)
+	return keys, s.parseError(err, "get user keys")
+}
+
+// valueAliasesSql selects aliases of metadata value 'mv' as an array.
+const valueAliasesSql = `COALESCE((SELECT array_agg(a.alias ORDER BY a.alias) FROM metadata_value_aliases a
+	WHERE a.value_id = mv.id), '{}') AS aliases`
+
+// GetUserValues returns all metadata values of the user.
+func (s *MetadataStore) GetUserValues(userId int) ([]models.MetadataValue, error) {
+	sql := `
+SELECT mv.id AS id, mv.user_id AS user_id, mv.key_id AS key_id, mk.key AS key, mv.value AS value,
+	mv.created_at AS created_at, mv.match_documents AS match_documents, mv.match_type AS match_type,
+	mv.match_filter AS match_filter, mv.parent_id AS parent_id, ` + valueAliasesSql + `
+FROM metadata_values mv
+LEFT JOIN metadata_keys mk ON mv.key_id = mk.id
+WHERE mv.user_id = $1
+ORDER BY mk.key ASC, mv.value ASC;
+`
+	values := make([]models.MetadataValue, 0)
+	err := s.db.Select(&values, sql, userId)
+	return values, s.parseError(err, "get user values")
+}
+
+// GetValueByName returns the value of given key that has exactly the given text. If the key is typed,
+// value is normalized before searching, and error is ErrInvalid if value is not valid for the type.
+func (s *MetadataStore) GetValueByName(userId int, keyId int, value string) (*models.MetadataValue, error) {
+	normalized := &models.MetadataValue{KeyId: keyId, Value: value}
+	err := s.parseTypedValue(s.db, userId, normalized)
+	if err != nil {
+		return nil, err
+	}
+	value = normalized.Value
+
+	sql := `
+SELECT *
+FROM metadata_values
+WHERE user_id = $1
+AND key_id = $2
+AND value = $3;
+`
+
+	metadataValue := &models.MetadataValue{}
+	err = s.db.Get(metadataValue, sql, userId, keyId, value)
+	return metadataValue, s.parseError(err, "get value by name")
+}
+
 // GetValues returns all values to given key.
 func (s *MetadataStore) GetValues(userId int, keyId int, sort SortKey, paging Paging) (*[]models.MetadataValue, error) {
 	paging.Validate()
+	query := s.valuesQuery(userId, keyId, sort).Limit(uint64(paging.Limit)).Offset(uint64(paging.Offset))
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("construct sql: %v", err)
+	}
+
+	values := &[]models.MetadataValue{}
+	err = s.db.Select(values, sql, args...)
+	return values, s.parseError(err, "get key values")
+}
+
+// rootValueCondition selects values that are at the top level of the value hierarchy of the key.
+const rootValueCondition = `(mv.parent_id IS NULL OR NOT EXISTS (
+	SELECT 1 FROM metadata_values p WHERE p.id = mv.parent_id AND p.key_id = mv.key_id))`
+
+// GetValueTree returns values of the key as a tree. Paging applies to top level values, which are
+// sorted with sort, and children are sorted in the same order under their parents.
+// Total is the number of top level values.
+func (s *MetadataStore) GetValueTree(userId int, keyId int, sort SortKey, paging Paging) ([]*models.MetadataValue, int, error) {
+	paging.Validate()
+	var total int
+	err := s.db.Get(&total, "SELECT count(*) FROM metadata_values mv WHERE mv.user_id = $1 AND mv.key_id = $2 AND "+
+		rootValueCondition, userId, keyId)
+	if err != nil {
+		return nil, 0, s.parseError(err, "count key values")
+	}
+
+	query := s.valuesQuery(userId, keyId, sort).Where(rootValueCondition).
+		Limit(uint64(paging.Limit)).Offset(uint64(paging.Offset))
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, 0, fmt.Errorf("construct sql: %v", err)
+	}
+	values := make([]*models.MetadataValue, 0)
+	err = s.db.Select(&values, sql, args...)
+	if err != nil {
+		return nil, 0, s.parseError(err, "get key values")
+	}
+	if len(values) == 0 {
+		return values, total, nil
+	}
+
+	rootIds := make([]int, len(values))
+	for i, v := range values {
+		rootIds[i] = v.Id
+	}
+	// top level values are at depth 1, so descendants can be MaxMetadataValueDepth-1 levels below them
+	query = s.valuesQuery(userId, keyId, sort).Where(`mv.id IN (
+	WITH RECURSIVE descendants AS (
+		SELECT id, 1 AS depth FROM metadata_values WHERE parent_id = ANY(?)
+		UNION ALL
+		SELECT c.id, d.depth + 1 FROM metadata_values c
+		JOIN descendants d ON c.parent_id = d.id
+		WHERE d.depth < ?
+	)
+	SELECT id FROM descendants)`, pq.Array(rootIds), models.MaxMetadataValueDepth-1)
+	sql, args, err = query.ToSql()
+	if err != nil {
+		return nil, 0, fmt.Errorf("construct sql: %v", err)
+	}
+	descendants := make([]*models.MetadataValue, 0)
+	err = s.db.Select(&descendants, sql, args...)
+	if err != nil {
+		return nil, 0, s.parseError(err, "get key value descendants")
+	}
+	return models.BuildMetadataValueTree(append(values, descendants...)), total, nil
+}
+
+func (s *MetadataStore) valuesQuery(userId int, keyId int, sort SortKey) squirrel.SelectBuilder {
 	sort.Validate("id")
-	query := s.sq.Select(
+	return s.sq.Select(
 		"mv.id as id",
 		"mv.value as value",
 		"mk.key as key",
@@ -277,22 +427,163 @@ func (s *MetadataStore) GetValues(userId int, keyId int, sort SortKey, paging Pa
 		"match_documents",
 		"match_type",
 		"match_filter",
+		"mv.parent_id as parent_id",
+		valueAliasesSql,
 		"count(dm.document_id) as documents_count").
 		From("metadata_values mv").
 		LeftJoin("document_metadata dm on mv.id = dm.value_id").
 		LeftJoin("metadata_keys mk on mv.key_id = mk.id").
 		Where(squirrel.Eq{"mv.user_id": userId}).
 		Where(squirrel.Eq{"mv.key_id": keyId}).GroupBy("mv.id", "mv.value", "mk.key").
-		OrderBy(sort.QueryKey() + " " + sort.SortOrder()).Limit(uint64(paging.Limit)).Offset(uint64(paging.Offset))
+		OrderBy(sort.QueryKey() + " " + sort.SortOrder())
+}
 
-	sql, args, err := query.ToSql()
+// GetValueDescendants returns ids of all values below the value in the hierarchy.
+func (s *MetadataStore) GetValueDescendants(userId int, valueId int) ([]int, error) {
+	sql := `
+WITH RECURSIVE descendants AS (
+	SELECT id, 1 AS depth FROM metadata_values WHERE parent_id = $1 AND user_id = $2
+	UNION ALL
+	SELECT mv.id, d.depth + 1 FROM metadata_values mv
+	JOIN descendants d ON mv.parent_id = d.id
+	WHERE d.depth < $3
+)
+SELECT DISTINCT id FROM descendants;
+`
+	ids := make([]int, 0)
+	err := s.db.Select(&ids, sql, valueId, userId, models.MaxMetadataValueDepth)
+	return ids, s.parseError(err, "get value descendants")
+}
+
+// validateParent checks that the parent of the value exists in the same key, and that setting the parent
+// does not create a cycle or exceed the maximum depth of the hierarchy.
+func (s *MetadataStore) validateParent(db sqlx.Queryer, userId int, value *models.MetadataValue) error {
+	if value.ParentId == 0 {
+		return nil
+	}
+	e := errors.ErrInvalid
+	if int(value.ParentId) == value.Id {
+		e.ErrMsg = "value cannot be its own parent"
+		return e
+	}
+
+	sql := `
+WITH RECURSIVE ancestors AS (
+	SELECT id, parent_id, 1 AS depth FROM metadata_values WHERE id = $1 AND user_id = $2 AND key_id = $3
+	UNION ALL
+	SELECT mv.id, mv.parent_id, a.depth + 1 FROM metadata_values mv
+	JOIN ancestors a ON mv.id = a.parent_id
+	WHERE a.depth <= $4
+)
+SELECT id FROM ancestors;
+`
+	ancestors := make([]int, 0)
+	err := sqlx.Select(db, &ancestors, sql, value.ParentId, userId, value.KeyId, models.MaxMetadataValueDepth)
 	if err != nil {
-		return nil, fmt.Errorf("construct sql: %v", err)
+		return s.parseError(err, "get value ancestors")
+	}
+	if len(ancestors) == 0 {
+		e.ErrMsg = "parent value not found in the key"
+		return e
+	}
+	for _, id := range ancestors {
+		if value.Id != 0 && id == value.Id {
+			e.ErrMsg = "parent value cannot be a descendant of the value"
+			return e
+		}
 	}
 
-	values := &[]models.MetadataValue{}
-	err = s.db.Select(values, sql, args...)
-	return values, s.parseError(err, "get key values")
+	depth := len(ancestors) + 1
+	if value.Id != 0 {
+		subtree, err := s.subtreeDepth(userId, value.Id)
+		if err != nil {
+			return err
+		}
+		depth += subtree
+	}
+	if depth > models.MaxMetadataValueDepth {
+		e.ErrMsg = fmt.Sprintf("value hierarchy can have at most %d levels", models.MaxMetadataValueDepth)
+		return e
+	}
+	return nil
+}
+
+// subtreeDepth returns the number of levels below the value.
+func (s *MetadataStore) subtreeDepth(userId int, valueId int) (int, error) {
+	sql := `
+WITH RECURSIVE descendants AS (
+	SELECT id, 1 AS depth FROM metadata_values WHERE parent_id = $1 AND user_id = $2
+	UNION ALL
+	SELECT mv.id, d.depth + 1 FROM metadata_values mv
+	JOIN descendants d ON mv.parent_id = d.id
+	WHERE d.depth <= $3
+)
+SELECT COALESCE(MAX(depth), 0) FROM descendants;
+`
+	var depth int
+	err := s.db.Get(&depth, sql, valueId, userId, models.MaxMetadataValueDepth)
+	return depth, s.parseError(err, "get value hierarchy depth")
+}
+
+// validateKeyConstraints validates that the key required by the key exists,
+// and that the required value belongs to the required key.
+func (s *MetadataStore) validateKeyConstraints(userId int, key *models.MetadataKey) error {
+	e := errors.ErrInvalid
+	if key.RequiredWhenKeyId == 0 {
+		if key.RequiredWhenValueId != 0 {
+			e.ErrMsg = "required value needs a required key"
+			return e
+		}
+		return nil
+	}
+	if key.Id != 0 && int(key.RequiredWhenKeyId) == key.Id {
+		e.ErrMsg = "key cannot require itself"
+		return e
+	}
+
+	ok, err := s.UserHasKey(userId, int(key.RequiredWhenKeyId))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		e.ErrMsg = "required key not found"
+		return e
+	}
+	if key.RequiredWhenValueId == 0 {
+		return nil
+	}
+	ok, err = s.UserHasKeyValue(userId, int(key.RequiredWhenKeyId), int(key.RequiredWhenValueId))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		e.ErrMsg = "required value not found in the required key"
+		return e
+	}
+	return nil
+}
+
+// CheckDocumentMetadata returns error if updated metadata of the document violates the constraints
+// of user's metadata keys and the original metadata does not.
+func (s *MetadataStore) CheckDocumentMetadata(userId int, documentId string, original, updated []models.Metadata) error {
+	keys, err := s.GetUserKeys(userId)
+	if err != nil {
+		return err
+	}
+	return metadataViolationError(documentId, models.NewMetadataViolations(keys, original, updated))
+}
+
+func metadataViolationError(documentId string, violations []models.MetadataConstraintViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.String()
+	}
+	e := errors.ErrInvalid
+	e.ErrMsg = fmt.Sprintf("document %s: %s", documentId, strings.Join(msgs, ", "))
+	return e
 }
 
 // UpdateDocumentKeyValues updates key-values for document.
@@ -333,73 +624,91 @@ END;
 	if err != nil {
 		return s.parseError(err, "get document")
 	}
-
-	tx, err := s.db.Beginx()
+	err = s.CheckDocumentMetadata(userId, documentId, *originalMetadata, metadata)
 	if err != nil {
-		return s.parseError(err, "update document, start tx")
+		return err
 	}
 
-	sql = `
-	DELETE
-	FROM document_metadata m
-	WHERE m.document_id = $1;
-	`
-
-	_, err = tx.Exec(sql, documentId)
+	err = s.replaceDocumentKeyValues(documentId, metadata)
 	if err != nil {
-		logrus.Warningf("error deleting old metadata: %v", err)
-		return s.parseError(tx.Rollback(), "rollback tx")
+		return err
 	}
 
-	if len(metadata) > 0 {
-
-		sql = `	
-	INSERT INTO document_metadata (document_id, key_id, value_id)
-	VALUES `
+	updatedMetadata, err := s.GetDocumentMetadata(userId, documentId)
+	if err != nil {
+		return s.parseError(err, "get updated document metadata")
+	}
 
-		var args []interface{}
-		args = append(args, documentId)
-		for i, v := range metadata {
-			if i > 0 {
-				sql += ", "
-			}
-			value := fmt.Sprintf("($1, $%d, $%d)", i*2+2, i*2+3)
-			sql += value
-			args = append(args, v.KeyId, v.ValueId)
-		}
+	diff := models.MetadataDiff(documentId, userId, originalMetadata, updatedMetadata)
+	err = addDocumentHistoryAction(s.db, s.sq, diff, userId)
+	logrus.Infof("User %d edited document %s with %d actions", userId, documentId, len(diff))
+	return err
+}
 
-		_, err = tx.Exec(sql, args...)
+// ReplaceDocumentKeyValues replaces document metadata without checking ownership or saving document history.
+// Caller is responsible for saving the history.
+func (s *MetadataStore) ReplaceDocumentKeyValues(documentId string, metadata []models.Metadata) error {
+	logrus.Debugf("replace document %s metadata, key-values: %d", documentId, len(metadata))
+	return s.replaceDocumentKeyValues(documentId, metadata)
+}
 
+func (s *MetadataStore) replaceDocumentKeyValues(documentId string, metadata []models.Metadata) error {
+	tx, err := s.beginTx()
+	if err != nil {
+		return err
 	}
+	defer tx.Close()
+	err = s.replaceDocumentMetadata(tx.tx, documentId, metadata)
 	if err != nil {
-		err = tx.Rollback()
-	} else {
-		err = tx.Commit()
+		return err
 	}
+	tx.ok = true
+	return nil
+}
+
+func (s *MetadataStore) replaceDocumentMetadata(db sqlx.Execer, documentId string, metadata []models.Metadata) error {
+	sql := `
+	DELETE
+	FROM document_metadata m
+	WHERE m.document_id = $1;
+	`
 
+	_, err := db.Exec(sql, documentId)
 	if err != nil {
-		return s.parseError(err, "update document key-values")
+		return s.parseError(err, "delete old document key-values")
+	}
+	if len(metadata) == 0 {
+		return nil
 	}
 
-	updatedMetadata, err := s.GetDocumentMetadata(userId, documentId)
-	if err != nil {
-		return s.parseError(err, "get updated document metadata")
+	sql = `	
+	INSERT INTO document_metadata (document_id, key_id, value_id)
+	VALUES `
+
+	var args []interface{}
+	args = append(args, documentId)
+	for i, v := range metadata {
+		if i > 0 {
+			sql += ", "
+		}
+		value := fmt.Sprintf("($1, $%d, $%d)", i*2+2, i*2+3)
+		sql += value
+		args = append(args, v.KeyId, v.ValueId)
 	}
 
-	diff := models.MetadataDiff(documentId, userId, originalMetadata, updatedMetadata)
-	err = addDocumentHistoryAction(s.db, s.sq, diff, userId)
-	logrus.Infof("User %d edited document %s with %d actions", userId, documentId, len(diff))
-	return err
+	_, err = db.Exec(sql, args...)
+	return s.parseError(err, "update document key-values")
 }
 
 // GetUserValuesWithMatching retusn all metadata values that
 // have Metadatavalue.MatchDocuments enabled.
 func (s *MetadataStore) GetUserValuesWithMatching(userId int) (*[]models.MetadataValue, error) {
 	sql := `
-SELECT * FROM
-metadata_values
-WHERE user_id = $1
-AND match_documents = TRUE;
+SELECT mv.*, mk.key AS key, ` + valueAliasesSql + `
+FROM metadata_values mv
+LEFT JOIN metadata_keys mk ON mv.key_id = mk.id
+WHERE mv.user_id = $1
+AND mv.match_documents = TRUE;
 `
 
 	values := &[]models.MetadataValue{}
@@ -431,154 +740,145 @@ END AS exists;
 
 // CreateKey creates new metadata key.
 func (s *MetadataStore) CreateKey(userId int, key *models.MetadataKey) error {
+	err := s.validateKeyConstraints(userId, key)
+	if err != nil {
+		return err
+	}
+	err = s.createKey(s.db, userId, key)
+	if err != nil {
+		return err
+	}
+	s.flushCachedUserKeys(userId)
+	return nil
+}
+
+func (s *MetadataStore) createKey(db sqlx.Queryer, userId int, key *models.MetadataKey) error {
+	if key.ValueType == "" {
+		key.ValueType = models.MetadataValueText
+	}
+	if !key.ValueType.Valid() {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("invalid value type: '%s'", key.ValueType)
+		return e
+	}
 
 	sql := `
 INSERT INTO metadata_keys
-(user_id, key, comment)
-VALUES ($1, $2, $3)
+(user_id, key, comment, value_type, single_value, required_when_key_id, required_when_value_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
 RETURNING id;
 `
 
-	res, err := s.db.Query(sql, userId, key.Key, key.Comment)
+	err := sqlx.Get(db, &key.Id, sql, userId, key.Key, key.Comment, key.ValueType, key.SingleValue,
+		key.RequiredWhenKeyId, key.RequiredWhenValueId)
+	return s.parseError(err, "create key")
+}
+
+// CreateValue creates new metadata value. Value is validated and normalized for the type of the key.
+// Aliases of the value are created too.
+func (s *MetadataStore) CreateValue(userId int, value *models.MetadataValue) error {
+	tx, err := s.beginTx()
 	if err != nil {
-		return s.parseError(err, "create key")
+		return fmt.Errorf("begin transaction: %v", err)
 	}
+	defer tx.Close()
 
-	if res.Next() {
-		var id int
-		err = res.Scan(&id)
-		if err != nil {
-			return s.parseError(err, "create key, scan id")
-		}
-		key.Id = id
+	err = s.createValue(tx, userId, value)
+	if err != nil {
+		return err
 	}
-	s.flushCachedUserKeys(userId)
+	tx.ok = true
 	return nil
 }
 
-// CreateValue creates new metadata value.
-func (s *MetadataStore) CreateValue(userId int, value *models.MetadataValue) error {
+func (s *MetadataStore) createValue(tx *tx, userId int, value *models.MetadataValue) error {
+	err := s.parseTypedValue(tx.tx, userId, value)
+	if err != nil {
+		return err
+	}
+	err = s.validateParent(tx.tx, userId, value)
+	if err != nil {
+		return err
+	}
+	err = s.validateAliases(tx.tx, userId, value)
+	if err != nil {
+		return err
+	}
+
 	sql := `
 INSERT INTO metadata_values
-(user_id, key_id, value, match_documents, match_type, match_filter)
-VALUES ($1, $2, $3, $4, $5, $6)
+(user_id, key_id, value, match_documents, match_type, match_filter, value_int, value_decimal, value_date, value_bool,
+ parent_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 RETURNING id;
 `
 
-	res, err := s.db.Query(sql, userId, value.KeyId, value.Value, value.MatchDocuments, value.MatchType, value.MatchFilter)
+	err = tx.tx.Get(&value.Id, sql, userId, value.KeyId, value.Value, value.MatchDocuments, value.MatchType,
+		value.MatchFilter, value.ValueInt, value.ValueDecimal, value.ValueDate, value.ValueBool, value.ParentId)
 	if err != nil {
 		return s.parseError(err, "create value")
 	}
+	return s.replaceAliases(tx, userId, value)
+}
 
-	if res.Next() {
-		var id int
-		err = res.Scan(&id)
+// validateAliases normalizes aliases of the value, and checks that the value and its aliases are not
+// names or aliases of other values in the key, ignoring case.
+func (s *MetadataStore) validateAliases(db sqlx.Queryer, userId int, value *models.MetadataValue) error {
+	var err error
+	if value.Aliases != nil {
+		value.Aliases, err = models.NormalizeMetadataAliases(value.Value, value.Aliases)
 		if err != nil {
-			return s.parseError(err, "create value, scan id")
+			return err
 		}
-		value.Id = id
 	}
-	return nil
-}
-
-// GetDocumentTags returns tags for given document.
-func (s *MetadataStore) GetDocumentTags(userId int, documentId string) (*[]models.Tag, error) {
-	sql := `
-select tags.id as id, tags.key as key, tags.comment as comment
-from tags
-LEFT JOIN document_tags dt on tags.id = dt.tag_id
-LEFT JOIN documents d on dt.document_id = d.id
-WHERE dt.document_id= $1
-and d.user_id = $2
-order by key asc
-limit 100;
-`
-	object := &[]models.Tag{}
-	err := s.db.Select(object, sql, documentId, userId)
-	return object, s.parseError(err, "get document tags")
-}
-
-// GetTags returns all tags for user.
-func (s *MetadataStore) GetTags(userid int, paging Paging) (*[]models.TagComposite, int, error) {
 
+	names := append([]string{value.Value}, value.Aliases...)
 	sql := `
-SELECT
-       tags.id AS id, COUNT(tags.id) AS document_count,
-       tags.key AS key, tags.comment AS comment,
-       tags.created_at AS created_at, tags.updated_at AS updated_at
-FROM tags
-LEFT JOIN document_tags dt on tags.id = dt.tag_id
-WHERE tags.user_id = $1
-GROUP BY (tags.id)
-ORDER BY tags.key asc
-OFFSET $2
-LIMIT $3;
+SELECT n.name FROM unnest($3::text[]) AS n(name)
+WHERE EXISTS (
+	SELECT 1 FROM metadata_values mv
+	WHERE mv.key_id = $1 AND mv.user_id = $4 AND mv.id <> $2 AND lower(mv.value) = lower(n.name) AND n.name <> $5
+) OR EXISTS (
+	SELECT 1 FROM metadata_value_aliases a
+	WHERE a.key_id = $1 AND a.user_id = $4 AND a.value_id <> $2 AND lower(a.alias) = lower(n.name)
+)
+LIMIT 1;
 `
-
-	object := &[]models.TagComposite{}
-
-	err := s.db.Select(object, sql, userid, paging.Offset, paging.Limit)
+	conflicts := make([]string, 0)
+	err = sqlx.Select(db, &conflicts, sql, value.KeyId, value.Id, pq.Array(names), userId, value.Value)
 	if err != nil {
-		return object, len(*object), s.parseError(err, "get tags")
+		return s.parseError(err, "check value aliases")
 	}
-
-	sql = `SELECT
-	COUNT(tags.id) AS count
-	FROM tags
-	WHERE tags.user_id = $1;
-	`
-
-	n := 0
-	row := s.db.QueryRow(sql, userid)
-	err = row.Scan(&n)
-	if err != nil {
-		return object, len(*object), s.parseError(err, "scan tags count")
+	if len(conflicts) > 0 {
+		e := errors.ErrAlreadyExists
+		e.ErrMsg = fmt.Sprintf("'%s' is already a value or an alias of another value", conflicts[0])
+		return e
 	}
-	return object, n, s.parseError(err, "get tags count")
-}
-
-// GetTag returns tag with given id.
-func (s *MetadataStore) GetTag(userId, tagId int) (*models.TagComposite, error) {
-	sql := `
-SELECT 
-	tags.id AS id, 
-	tags.key AS key, 
-	tags.comment AS comment, 
-	COUNT(d.id) as document_count, 
-	tags.created_at AS created_at, 
-	tags.updated_at AS updated_at
-FROM tags
-LEFT JOIN document_tags dt ON tags.id = dt.tag_id
-LEFT JOIN documents d ON dt.document_id = d.id
-WHERE tags.id = $1
-AND tags.user_id = $2
-GROUP BY (tags.id);
-`
-
-	object := &models.TagComposite{}
-	err := s.db.Get(object, sql, tagId, userId)
-	return object, s.parseError(err, "get tag")
+	return nil
 }
 
-// CreateTag creates new tag.
-func (s *MetadataStore) CreateTag(userId int, tag *models.Tag) error {
-	sql := `
-INSERT INTO tags (user_id, key, comment, created_at, updated_at)
-VALUES ($1, $2, $3, $4, $5) RETURNING id;
-`
-
-	tag.CreatedAt = time.Now()
-	tag.UpdatedAt = time.Now()
-
-	id := 0
-	row := s.db.QueryRow(sql, userId, tag.Key, tag.Comment, tag.CreatedAt, tag.UpdatedAt)
-	err := row.Scan(&id)
+// replaceAliases replaces aliases of the value. If aliases is nil, aliases are not changed.
+func (s *MetadataStore) replaceAliases(tx *tx, userId int, value *models.MetadataValue) error {
+	if value.Aliases == nil {
+		return nil
+	}
+	_, err := tx.tx.Exec("DELETE FROM metadata_value_aliases WHERE value_id = $1", value.Id)
 	if err != nil {
-		return s.parseError(err, "create tag")
+		return s.parseError(err, "delete value aliases")
 	}
-
-	tag.Id = id
-	return nil
+	if len(value.Aliases) == 0 {
+		return nil
+	}
+	query := s.sq.Insert("metadata_value_aliases").Columns("user_id", "key_id", "value_id", "alias")
+	for _, v := range value.Aliases {
+		query = query.Values(userId, value.KeyId, value.Id, v)
+	}
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("construct sql: %v", err)
+	}
+	_, err = tx.tx.Exec(sql, args...)
+	return s.parseError(err, "add value aliases")
 }
 
 func (s *MetadataStore) UserHasKeyValue(userId, keyId, valueId int) (bool, error) {
@@ -640,32 +940,140 @@ WHERE user_id=$1 AND id IN (
 	return keyCount == len(keys), s.parseError(err, "check user owns metadata")
 }
 
+// UpdateValue updates the value. Value is validated and normalized for the type of the key.
+// If aliases is not nil, aliases of the value are replaced.
 func (s *MetadataStore) UpdateValue(value *models.MetadataValue) error {
+	tx, err := s.beginTx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %v", err)
+	}
+	defer tx.Close()
+
+	err = s.updateValue(tx, value)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+func (s *MetadataStore) updateValue(tx *tx, value *models.MetadataValue) error {
+	err := s.parseTypedValue(tx.tx, value.UserId, value)
+	if err != nil {
+		return err
+	}
+	err = s.validateParent(tx.tx, value.UserId, value)
+	if err != nil {
+		return err
+	}
+	err = s.validateAliases(tx.tx, value.UserId, value)
+	if err != nil {
+		return err
+	}
+
 	sql := `
 	UPDATE metadata_values
-	SET value=$1, match_documents=$2, match_type=$3, match_filter=$4
-	WHERE id=$5;
+	SET value=$1, match_documents=$2, match_type=$3, match_filter=$4,
+		value_int=$5, value_decimal=$6, value_date=$7, value_bool=$8, parent_id=$9
+	WHERE id=$10;
 `
 
-	_, err := s.db.Exec(sql, value.Value, value.MatchDocuments, value.MatchType, value.MatchFilter, value.Id)
-	return s.parseError(err, "update value")
+	_, err = tx.tx.Exec(sql, value.Value, value.MatchDocuments, value.MatchType, value.MatchFilter,
+		value.ValueInt, value.ValueDecimal, value.ValueDate, value.ValueBool, value.ParentId, value.Id)
+	if err != nil {
+		return s.parseError(err, "update value")
+	}
+	return s.replaceAliases(tx, value.UserId, value)
 }
 
+// UpdateKey updates the key. If value type is empty, the type is not changed. If type changes,
+// existing values are converted to the new type, and if any value is not valid for the type, nothing is updated.
 func (s *MetadataStore) UpdateKey(key *models.MetadataKey) error {
+	current, err := s.GetKey(key.UserId, key.Id)
+	if err != nil {
+		return err
+	}
+	if key.ValueType == "" {
+		key.ValueType = current.ValueType
+	}
+	if !key.ValueType.Valid() {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("invalid value type: '%s'", key.ValueType)
+		return e
+	}
+	err = s.validateKeyConstraints(key.UserId, key)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.beginTx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %v", err)
+	}
+	defer tx.Close()
+
 	sql := `
 UPDATE metadata_keys 
-SET key=$1, comment=$2
-WHERE id=$3;
+SET key=$1, comment=$2, value_type=$3, single_value=$4, required_when_key_id=$5, required_when_value_id=$6
+WHERE id=$7;
 `
 
-	_, err := s.db.Exec(sql, key.Key, key.Comment, key.Id)
+	_, err = tx.tx.Exec(sql, key.Key, key.Comment, key.ValueType, key.SingleValue, key.RequiredWhenKeyId,
+		key.RequiredWhenValueId, key.Id)
 	if err != nil {
 		return s.parseError(err, "update key")
 	}
+	if key.ValueType != current.ValueType {
+		err = s.convertKeyValues(tx, key)
+		if err != nil {
+			return err
+		}
+	}
+	tx.ok = true
 	s.flushCachedUserKeys(key.UserId)
 	return nil
 }
 
+// convertKeyValues validates and normalizes all values of the key for the value type of the key.
+func (s *MetadataStore) convertKeyValues(tx *tx, key *models.MetadataKey) error {
+	values := make([]models.MetadataValue, 0)
+	err := tx.tx.Select(&values, "SELECT id, value FROM metadata_values WHERE key_id = $1 ORDER BY id", key.Id)
+	if err != nil {
+		return s.parseError(err, "get key values")
+	}
+
+	sql := `
+UPDATE metadata_values
+SET value=$1, value_int=$2, value_decimal=$3, value_date=$4, value_bool=$5
+WHERE id=$6;
+`
+	for _, v := range values {
+		var typed models.MetadataTypedValue
+		v.Value, typed, err = models.ParseMetadataValue(key.ValueType, v.Value)
+		if err != nil {
+			e := errors.ErrInvalid
+			e.ErrMsg = fmt.Sprintf("cannot change type of key to %s: %s", key.ValueType, err.(errors.Error).ErrMsg)
+			return e
+		}
+		_, err = tx.tx.Exec(sql, v.Value, typed.ValueInt, typed.ValueDecimal, typed.ValueDate, typed.ValueBool, v.Id)
+		if err != nil {
+			return s.parseError(err, "convert value")
+		}
+	}
+	return nil
+}
+
+// parseTypedValue validates and normalizes the value for the type of its key.
+func (s *MetadataStore) parseTypedValue(db sqlx.Queryer, userId int, value *models.MetadataValue) error {
+	var valueType models.MetadataValueType
+	err := sqlx.Get(db, &valueType, "SELECT value_type FROM metadata_keys WHERE id = $1 AND user_id = $2", value.KeyId, userId)
+	if err != nil {
+		return s.parseError(err, "get key value type")
+	}
+	value.Value, value.MetadataTypedValue, err = models.ParseMetadataValue(valueType, value.Value)
+	return err
+}
+
 // CheckKeyValuesExist verifies key-value pairs exist and user owns them.
 func (s *MetadataStore) CheckKeyValuesExist(userId int, values []models.Metadata) error {
 	array := make(squirrel.Or, len(values))
@@ -696,10 +1104,76 @@ func (s *MetadataStore) CheckKeyValuesExist(userId int, values []models.Metadata
 	return userErr
 }
 
+// UpsertDocumentMetadata adds metadata to the documents. Added values of single-valued keys replace
+// existing values of the key. Nothing is added if it would violate the constraints of the keys in any document.
 func (s *MetadataStore) UpsertDocumentMetadata(userId int, documents []string, metadata []models.Metadata) error {
-	// when checking metadata: need to remove duplicate keys
+	keys, err := s.GetUserKeys(userId)
+	if err != nil {
+		return err
+	}
 
-	sql := `
+	tx, err := s.beginTx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %v", err)
+	}
+	defer tx.Close()
+
+	err = s.upsertDocumentMetadata(tx, keys, documents, metadata)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+func (s *MetadataStore) upsertDocumentMetadata(tx *tx, keys []models.MetadataKey, documents []string, metadata []models.Metadata) error {
+	query := s.sq.Select("document_id", "key_id", "value_id").From("document_metadata").
+		Where(squirrel.Eq{"document_id": documents})
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("construct sql: %v", err)
+	}
+	existing := make([]struct {
+		DocumentId string `db:"document_id"`
+		models.Metadata
+	}, 0)
+	err = tx.tx.Select(&existing, sql, args...)
+	if err != nil {
+		return s.parseError(err, "get documents metadata")
+	}
+	documentMetadata := make(map[string][]models.Metadata, len(documents))
+	for _, v := range existing {
+		documentMetadata[v.DocumentId] = append(documentMetadata[v.DocumentId], v.Metadata)
+	}
+	for _, id := range documents {
+		updated := models.ApplySingleValueKeys(keys, documentMetadata[id], metadata)
+		err = metadataViolationError(id, models.NewMetadataViolations(keys, documentMetadata[id], updated))
+		if err != nil {
+			return err
+		}
+	}
+
+	singleValue := make(map[int]bool)
+	for _, v := range keys {
+		singleValue[v.Id] = v.SingleValue
+	}
+	for _, v := range metadata {
+		if !singleValue[v.KeyId] {
+			continue
+		}
+		query := s.sq.Delete("document_metadata").Where(squirrel.Eq{"document_id": documents}).
+			Where(squirrel.Eq{"key_id": v.KeyId}).Where(squirrel.NotEq{"value_id": v.ValueId})
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("construct sql: %v", err)
+		}
+		_, err = tx.tx.Exec(sql, args...)
+		if err != nil {
+			return s.parseError(err, "replace single-valued metadata")
+		}
+	}
+
+	sql = `
 INSERT INTO document_metadata (document_id, key_id, value_id) VALUES %s 
 ON CONFLICT (document_id, key_id, value_id) DO NOTHING
 `
@@ -707,7 +1181,7 @@ ON CONFLICT (document_id, key_id, value_id) DO NOTHING
 	sqlParams := ""
 
 	index := 1
-	args := make([]interface{}, 0, len(documents)*len(metadata))
+	args = make([]interface{}, 0, len(documents)*len(metadata))
 	for iDoc, vDoc := range documents {
 		if iDoc > 0 {
 			sqlParams += ","
@@ -726,12 +1200,62 @@ ON CONFLICT (document_id, key_id, value_id) DO NOTHING
 	}
 
 	sql = fmt.Sprintf(sql, sqlParams)
-	_, err := s.db.Exec(sql, args...)
+	_, err = tx.tx.Exec(sql, args...)
 	return s.parseError(err, "upsert multiple documents metadata")
 }
 
+// GetMetadataViolations returns documents of the user that violate the constraints of metadata keys,
+// ordered by document and key, and the total number of violations.
+func (s *MetadataStore) GetMetadataViolations(userId int, paging Paging) ([]models.MetadataConstraintViolation, int, error) {
+	paging.Validate()
+	sql := `
+WITH violations AS (
+	SELECT d.id AS document_id, d.name AS document_name, mk.id AS key_id, mk.key AS key,
+		'multiple_values' AS violation
+	FROM document_metadata dm
+	JOIN documents d ON dm.document_id = d.id
+	JOIN metadata_keys mk ON dm.key_id = mk.id
+	WHERE mk.user_id = $1 AND mk.single_value AND d.deleted_at IS NULL
+	GROUP BY d.id, d.name, mk.id, mk.key
+	HAVING COUNT(DISTINCT dm.value_id) > 1
+	UNION ALL
+	SELECT DISTINCT d.id AS document_id, d.name AS document_name, mk.id AS key_id, mk.key AS key,
+		'missing_required_key' AS violation
+	FROM metadata_keys mk
+	JOIN document_metadata rm ON rm.key_id = mk.required_when_key_id
+		AND (mk.required_when_value_id IS NULL OR rm.value_id = mk.required_when_value_id)
+	JOIN documents d ON rm.document_id = d.id
+	WHERE mk.user_id = $1 AND d.deleted_at IS NULL
+	AND NOT EXISTS (SELECT 1 FROM document_metadata dm WHERE dm.document_id = d.id AND dm.key_id = mk.id)
+)
+SELECT *, COUNT(*) OVER() AS total
+FROM violations
+ORDER BY document_id, key_id, violation
+LIMIT $2 OFFSET $3;
+`
+	rows := make([]struct {
+		models.MetadataConstraintViolation
+		Total int `db:"total"`
+	}, 0)
+	err := s.db.Select(&rows, sql, userId, paging.Limit, paging.Offset)
+	if err != nil {
+		return nil, 0, s.parseError(err, "get metadata violations")
+	}
+
+	violations := make([]models.MetadataConstraintViolation, len(rows))
+	total := 0
+	for i, v := range rows {
+		violations[i] = v.MetadataConstraintViolation
+		total = v.Total
+	}
+	return violations, total, nil
+}
+
 func (s *MetadataStore) DeleteDocumentsMetadata(userId int, documents []string, metadata []models.Metadata) error {
+	return s.deleteDocumentsMetadata(s.db, documents, metadata)
+}
 
+func (s *MetadataStore) deleteDocumentsMetadata(db sqlx.Execer, documents []string, metadata []models.Metadata) error {
 	sqlFormat := `
 DELETE FROM document_metadata 
 WHERE 
@@ -769,10 +1293,75 @@ WHERE
 		index += 2
 	}
 	sql := fmt.Sprintf(sqlFormat, docArgs, keyArgs, valueArgs)
-	_, err := s.db.Exec(sql, args...)
+	_, err := db.Exec(sql, args...)
 	return s.parseError(err, "remove multiple documents metadata")
 }
 
+// DocumentsEdit is a change to the metadata and tags of multiple documents.
+type DocumentsEdit struct {
+	AddMetadata    []models.Metadata
+	RemoveMetadata []models.Metadata
+	AddTags        []int
+	RemoveTags     []int
+}
+
+// BulkEditDocuments applies the edit to the documents of the user in a single transaction.
+// Metadata is added before removing it, and tags are added before removing them.
+// User must own the tags. Tag changes are saved to document history.
+func (s *MetadataStore) BulkEditDocuments(userId int, documents []string, edit DocumentsEdit) error {
+	var keys []models.MetadataKey
+	var err error
+	if len(edit.AddMetadata) > 0 {
+		keys, err = s.GetUserKeys(userId)
+		if err != nil {
+			return err
+		}
+	}
+	tags, err := s.getUserTagsExist(userId, append(append([]int{}, edit.AddTags...), edit.RemoveTags...))
+	if err != nil {
+		return err
+	}
+	tagMap := make(map[int]models.Tag, len(tags))
+	for _, v := range tags {
+		tagMap[v.Id] = v
+	}
+
+	tx, err := s.beginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	if len(edit.AddMetadata) > 0 {
+		err = s.upsertDocumentMetadata(tx, keys, documents, edit.AddMetadata)
+		if err != nil {
+			return err
+		}
+	}
+	if len(edit.RemoveMetadata) > 0 {
+		err = s.deleteDocumentsMetadata(tx.tx, documents, edit.RemoveMetadata)
+		if err != nil {
+			return err
+		}
+	}
+	if len(edit.AddTags) > 0 {
+		err = s.updateDocumentsTags(tx, userId, tagMap, documents, edit.AddTags, addDocumentsTagsSql,
+			models.DocumentHistoryActionTagAdd)
+		if err != nil {
+			return err
+		}
+	}
+	if len(edit.RemoveTags) > 0 {
+		err = s.updateDocumentsTags(tx, userId, tagMap, documents, edit.RemoveTags, removeDocumentsTagsSql,
+			models.DocumentHistoryActionTagRemove)
+		if err != nil {
+			return err
+		}
+	}
+	tx.ok = true
+	return nil
+}
+
 // DeleteKey deletes metadata key.
 // If userId != 0, user has to own the key.
 // This will cascade the deletion to any table that uses metadata keys too: document_metadata, rules.
@@ -815,8 +1404,27 @@ func (s *MetadataStore) DeleteValue(userId int, valueId int) error {
 		return e
 	}
 
-	_, err = s.db.Exec(sql, args...)
-	return s.parseError(err, "delete value")
+	tx, err := s.beginTx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %v", err)
+	}
+	defer tx.Close()
+
+	// children of the value are moved to the parent of the value
+	_, err = tx.tx.Exec(`
+UPDATE metadata_values
+SET parent_id = (SELECT parent_id FROM metadata_values WHERE id = $1)
+WHERE parent_id = $1;`, valueId)
+	if err != nil {
+		return s.parseError(err, "move child values")
+	}
+
+	_, err = tx.tx.Exec(sql, args...)
+	if err != nil {
+		return s.parseError(err, "delete value")
+	}
+	tx.ok = true
+	return nil
 }
 
 // GetLinkedDocuments returns a list of documents that are linked to docId.
@@ -872,6 +1480,50 @@ func (s *MetadataStore) GetLinkedDocuments(userId int, docId string) ([]*models.
 	return docs, nil
 }
 
+// AddLinkedDocuments links document to docs, keeping the existing links. No history entry is added.
+// This does not validate ownership of the documents.
+func (s *MetadataStore) AddLinkedDocuments(docId string, docs []string) error {
+	existing := map[string]bool{}
+	query := s.sq.Select("doc_a_id", "doc_b_id").From("linked_documents").
+		Where(squirrel.Or{squirrel.Eq{"doc_a_id": docId}, squirrel.Eq{"doc_b_id": docId}})
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("get SELECT sql: %v", err)
+	}
+	rows := []struct {
+		DocAId string `db:"doc_a_id"`
+		DocBId string `db:"doc_b_id"`
+	}{}
+	err = s.db.Select(&rows, sql, args...)
+	if err != nil {
+		return s.parseError(err, "get linked documents")
+	}
+	for _, v := range rows {
+		existing[v.DocAId] = true
+		existing[v.DocBId] = true
+	}
+
+	insertQuery := s.sq.Insert("linked_documents").Columns("doc_a_id", "doc_b_id")
+	added := 0
+	for _, doc := range docs {
+		if doc == docId || existing[doc] {
+			continue
+		}
+		existing[doc] = true
+		insertQuery = insertQuery.Values(docId, doc)
+		added += 1
+	}
+	if added == 0 {
+		return nil
+	}
+	sql, args, err = insertQuery.ToSql()
+	if err != nil {
+		return fmt.Errorf("get INSERT sql: %v", err)
+	}
+	_, err = s.db.Exec(sql, args...)
+	return s.parseError(err, "add linked documents")
+}
+
 // UpdateLinkedDocuments updates document. This does not validate ownership of the documents.
 func (s *MetadataStore) UpdateLinkedDocuments(userId int, docId string, docs []string) error {
 	tx, err := s.beginTx()
@@ -0,0 +1,412 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Masterminds/squirrel"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// metadataMerge moves documents, rules and child values from source key-value pairs to the target
+// inside a transaction, and records the changes to document history.
+type metadataMerge struct {
+	store     *MetadataStore
+	tx        *tx
+	result    *models.MetadataMergeResult
+	history   []models.DocumentHistory
+	documents map[string]bool
+}
+
+// MergeValues merges source values into the target value of the same key. Documents and rules that use
+// the source values are changed to use the target, child values are moved under the target, and source
+// values are deleted. If preview is true, nothing is saved and the result contains the changes the merge
+// would make. Caller must index affected documents.
+func (s *MetadataStore) MergeValues(userId, keyId int, sources []int, target int, preview bool) (*models.MetadataMergeResult, error) {
+	err := validateMergeIds(sources, target, "value")
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.GetKey(userId, keyId)
+	if err != nil {
+		return nil, err
+	}
+	ids := append([]int{target}, sources...)
+	var count int
+	query, args, err := s.sq.Select("COUNT(id)").From("metadata_values").
+		Where(squirrel.Eq{"user_id": userId, "key_id": keyId, "id": ids}).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("construct sql: %v", err)
+	}
+	err = s.db.Get(&count, query, args...)
+	if err != nil {
+		return nil, s.parseError(err, "check values exist")
+	}
+	if count != len(ids) {
+		e := errors.ErrRecordNotFound
+		e.ErrMsg = "metadata value not found"
+		return nil, e
+	}
+
+	merge, err := s.beginMerge(preview)
+	if err != nil {
+		return nil, err
+	}
+	defer merge.tx.Close()
+
+	for _, id := range sources {
+		err = merge.repointValue(models.Metadata{KeyId: keyId, ValueId: id}, models.Metadata{KeyId: keyId, ValueId: target})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = merge.deleteValues(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := merge.finish(userId)
+	if err != nil {
+		return nil, err
+	}
+	s.flushCachedUserKeyValues(userId, key.Key)
+	return result, nil
+}
+
+// MergeKeys merges source keys into the target key. Values of the source keys are moved to the target key,
+// or merged into the target value if the target key already has a value with the same name. Values are
+// converted to the type of the target key. Documents and rules that use the source keys are changed to use
+// the target, and source keys are deleted. If preview is true, nothing is saved and the result contains
+// the changes the merge would make. Caller must index affected documents.
+func (s *MetadataStore) MergeKeys(userId int, sources []int, target int, preview bool) (*models.MetadataMergeResult, error) {
+	err := validateMergeIds(sources, target, "key")
+	if err != nil {
+		return nil, err
+	}
+	targetKey, err := s.GetKey(userId, target)
+	if err != nil {
+		return nil, err
+	}
+	sourceKeys := make([]*models.MetadataKey, len(sources))
+	for i, id := range sources {
+		sourceKeys[i], err = s.GetKey(userId, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	merge, err := s.beginMerge(preview)
+	if err != nil {
+		return nil, err
+	}
+	defer merge.tx.Close()
+
+	targetValues := make([]models.MetadataValue, 0)
+	err = merge.tx.tx.Select(&targetValues, "SELECT id, value FROM metadata_values WHERE key_id = $1", target)
+	if err != nil {
+		return nil, s.parseError(err, "get target key values")
+	}
+	valueIds := make(map[string]int, len(targetValues))
+	for _, v := range targetValues {
+		valueIds[v.Value] = v.Id
+	}
+
+	merged := make([]int, 0)
+	for _, key := range sourceKeys {
+		values := make([]models.MetadataValue, 0)
+		err = merge.tx.tx.Select(&values, "SELECT id, value FROM metadata_values WHERE key_id = $1 ORDER BY id", key.Id)
+		if err != nil {
+			return nil, s.parseError(err, "get source key values")
+		}
+		for _, v := range values {
+			name, typed, err := models.ParseMetadataValue(targetKey.ValueType, v.Value)
+			if err != nil {
+				e := errors.ErrInvalid
+				e.ErrMsg = fmt.Sprintf("cannot move value of key %s to key %s: %s", key.Key, targetKey.Key,
+					err.(errors.Error).ErrMsg)
+				return nil, e
+			}
+			targetId, exists := valueIds[name]
+			if !exists {
+				// move the value to target key
+				_, err = merge.tx.tx.Exec(`
+UPDATE metadata_values
+SET key_id=$1, value=$2, value_int=$3, value_decimal=$4, value_date=$5, value_bool=$6
+WHERE id=$7;`, target, name, typed.ValueInt, typed.ValueDecimal, typed.ValueDate, typed.ValueBool, v.Id)
+				if err != nil {
+					return nil, s.parseError(err, "move value to key")
+				}
+				targetId = v.Id
+				valueIds[name] = v.Id
+				merge.result.MovedValues += 1
+			} else {
+				merged = append(merged, v.Id)
+			}
+			err = merge.repointValue(models.Metadata{KeyId: key.Id, ValueId: v.Id}, models.Metadata{KeyId: target, ValueId: targetId})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// rules that only use the key, e.g. 'metadata_has_key'
+		conditions, err := merge.exec("UPDATE rule_conditions SET metadata_key = $1 WHERE metadata_key = $2", target, key.Id)
+		if err != nil {
+			return nil, err
+		}
+		actions, err := merge.exec("UPDATE rule_actions SET metadata_key = $1 WHERE metadata_key = $2", target, key.Id)
+		if err != nil {
+			return nil, err
+		}
+		merge.result.RuleConditions += conditions
+		merge.result.RuleActions += actions
+
+		// keys required by the source key are required by the target key, target cannot require itself
+		_, err = merge.exec(`
+UPDATE metadata_keys
+SET required_when_key_id = CASE WHEN id = $1 THEN NULL ELSE $1 END,
+	required_when_value_id = CASE WHEN id = $1 THEN NULL ELSE required_when_value_id END
+WHERE required_when_key_id = $2;`, target, key.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = merge.deleteValues(merged)
+	if err != nil {
+		return nil, err
+	}
+	deleteSql, args, err := s.sq.Delete("metadata_keys").Where(squirrel.Eq{"user_id": userId, "id": sources}).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("construct sql: %v", err)
+	}
+	merge.result.DeletedKeys, err = merge.exec(deleteSql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := merge.finish(userId)
+	if err != nil {
+		return nil, err
+	}
+	s.flushCachedUserKeys(userId)
+	s.flushCachedUserKeyValues(userId, targetKey.Key)
+	for _, v := range sourceKeys {
+		s.flushCachedUserKeyValues(userId, v.Key)
+	}
+	return result, nil
+}
+
+func validateMergeIds(sources []int, target int, resource string) error {
+	e := errors.ErrInvalid
+	if len(sources) == 0 {
+		e.ErrMsg = fmt.Sprintf("no source %ss", resource)
+		return e
+	}
+	seen := make(map[int]bool, len(sources))
+	for _, v := range sources {
+		if v == target {
+			e.ErrMsg = fmt.Sprintf("target %s cannot be a source", resource)
+			return e
+		}
+		if seen[v] {
+			e.ErrMsg = fmt.Sprintf("duplicate source %s: %d", resource, v)
+			return e
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+func (s *MetadataStore) beginMerge(preview bool) (*metadataMerge, error) {
+	tx, err := s.beginTx()
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %v", err)
+	}
+	return &metadataMerge{
+		store:     s,
+		tx:        tx,
+		result:    &models.MetadataMergeResult{Preview: preview},
+		documents: make(map[string]bool),
+	}, nil
+}
+
+// exec executes the statement and returns the number of affected rows.
+func (m *metadataMerge) exec(sql string, args ...interface{}) (int, error) {
+	res, err := m.tx.tx.Exec(sql, args...)
+	if err != nil {
+		return 0, m.store.parseError(err, "merge metadata")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, m.store.parseError(err, "merge metadata, get affected rows")
+	}
+	return int(rows), nil
+}
+
+// repointValue changes documents, rules and child values that use the source key-value pair
+// to use the target pair.
+func (m *metadataMerge) repointValue(source, target models.Metadata) error {
+	documents := make([]struct {
+		DocumentId string `db:"document_id"`
+		HasTarget  bool   `db:"has_target"`
+	}, 0)
+	err := m.tx.tx.Select(&documents, `
+SELECT dm.document_id AS document_id, EXISTS(
+	SELECT 1 FROM document_metadata t
+	WHERE t.document_id = dm.document_id AND t.key_id = $3 AND t.value_id = $4
+) AS has_target
+FROM document_metadata dm
+WHERE dm.key_id = $1 AND dm.value_id = $2
+ORDER BY dm.document_id;`, source.KeyId, source.ValueId, target.KeyId, target.ValueId)
+	if err != nil {
+		return m.store.parseError(err, "get documents with value")
+	}
+	for _, v := range documents {
+		m.documents[v.DocumentId] = true
+		m.history = append(m.history, models.DocumentHistory{
+			DocumentId: v.DocumentId,
+			Action:     models.DocumentHistoryActionMetadataRemove,
+			OldValue:   formatMergedMetadata(source),
+		})
+		if !v.HasTarget {
+			m.history = append(m.history, models.DocumentHistory{
+				DocumentId: v.DocumentId,
+				Action:     models.DocumentHistoryActionMetadataAdd,
+				NewValue:   formatMergedMetadata(target),
+			})
+		}
+	}
+
+	_, err = m.exec(`
+INSERT INTO document_metadata (document_id, key_id, value_id)
+SELECT document_id, $3, $4 FROM document_metadata
+WHERE key_id = $1 AND value_id = $2
+ON CONFLICT DO NOTHING;`, source.KeyId, source.ValueId, target.KeyId, target.ValueId)
+	if err != nil {
+		return err
+	}
+	rows, err := m.exec("DELETE FROM document_metadata WHERE key_id = $1 AND value_id = $2", source.KeyId, source.ValueId)
+	if err != nil {
+		return err
+	}
+	m.result.DocumentMetadata += rows
+
+	conditions, err := m.exec(`
+UPDATE rule_conditions SET metadata_key = $3, metadata_value = $4
+WHERE metadata_key = $1 AND metadata_value = $2;`, source.KeyId, source.ValueId, target.KeyId, target.ValueId)
+	if err != nil {
+		return err
+	}
+	actions, err := m.exec(`
+UPDATE rule_actions SET metadata_key = $3, metadata_value = $4
+WHERE metadata_key = $1 AND metadata_value = $2;`, source.KeyId, source.ValueId, target.KeyId, target.ValueId)
+	if err != nil {
+		return err
+	}
+	m.result.RuleConditions += conditions
+	m.result.RuleActions += actions
+
+	// keys required by the source value are required by the target value
+	_, err = m.exec(`
+UPDATE metadata_keys SET required_when_key_id = $3, required_when_value_id = $4
+WHERE required_when_key_id = $1 AND required_when_value_id = $2 AND id <> $3;`,
+		source.KeyId, source.ValueId, target.KeyId, target.ValueId)
+	if err != nil {
+		return err
+	}
+
+	// aliases are moved to the target, unless the target key already has the alias
+	_, err = m.exec(`
+UPDATE metadata_value_aliases a SET key_id = $3, value_id = $4
+WHERE a.key_id = $1 AND a.value_id = $2 AND NOT EXISTS (
+	SELECT 1 FROM metadata_value_aliases b
+	WHERE b.key_id = $3 AND b.id <> a.id AND lower(b.alias) = lower(a.alias)
+);`, source.KeyId, source.ValueId, target.KeyId, target.ValueId)
+	if err != nil {
+		return err
+	}
+
+	if source.ValueId == target.ValueId {
+		return nil
+	}
+	// if target is below the source, it takes the place of the source so that moving the children
+	// of the source under the target does not create a cycle
+	values := make([]struct {
+		Id       int `db:"id"`
+		ParentId int `db:"parent_id"`
+	}, 0)
+	err = m.tx.tx.Select(&values, `SELECT id, COALESCE(parent_id, 0) AS parent_id FROM metadata_values
+WHERE key_id = $1 OR id = $2`, target.KeyId, source.ValueId)
+	if err != nil {
+		return m.store.parseError(err, "get value hierarchy")
+	}
+	parents := make(map[int]int, len(values))
+	for _, v := range values {
+		parents[v.Id] = v.ParentId
+	}
+	if models.MetadataValueIsDescendant(parents, target.ValueId, source.ValueId) {
+		_, err = m.exec("UPDATE metadata_values SET parent_id = NULLIF($2, 0) WHERE id = $1",
+			target.ValueId, parents[source.ValueId])
+		if err != nil {
+			return err
+		}
+	}
+	_, err = m.exec("UPDATE metadata_values SET parent_id = $2 WHERE parent_id = $1 AND id <> $2",
+		source.ValueId, target.ValueId)
+	return err
+}
+
+func (m *metadataMerge) deleteValues(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	sql, args, err := m.store.sq.Delete("metadata_values").Where(squirrel.Eq{"id": ids}).ToSql()
+	if err != nil {
+		return fmt.Errorf("construct sql: %v", err)
+	}
+	m.result.DeletedValues, err = m.exec(sql, args...)
+	return err
+}
+
+// finish adds document history and commits the transaction, unless merge is a preview.
+func (m *metadataMerge) finish(userId int) (*models.MetadataMergeResult, error) {
+	m.result.Documents = len(m.documents)
+	m.result.DocumentIds = make([]string, 0, len(m.documents))
+	for id := range m.documents {
+		m.result.DocumentIds = append(m.result.DocumentIds, id)
+	}
+	if m.result.Preview {
+		return m.result, nil
+	}
+
+	err := addDocumentHistoryAction(m.tx.tx, m.store.sq, m.history, userId)
+	if err != nil {
+		return nil, err
+	}
+	m.tx.ok = true
+	return m.result, nil
+}
+
+func formatMergedMetadata(m models.Metadata) string {
+	bytes, _ := json.Marshal(models.DocumentMetadataHistoryEntry{KeyId: m.KeyId, ValueId: m.ValueId})
+	return string(bytes)
+}
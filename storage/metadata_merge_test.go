@@ -0,0 +1,81 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_validateMergeIds(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []int
+		target  int
+		wantErr bool
+	}{
+		{"ok", []int{1, 2}, 3, false},
+		{"no sources", []int{}, 3, true},
+		{"target is source", []int{1, 3}, 3, true},
+		{"duplicate source", []int{1, 1}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMergeIds(tt.sources, tt.target, "value"); (err != nil) != tt.wantErr {
+				t.Errorf("validateMergeIds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetadataMerge_repointValueDescendantTarget(t *testing.T) {
+	db, mock, err := NewMockDatabase(sqlmock.QueryMatcherRegexp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// source 1 -> 2 -> target 3, source has parent 10
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT dm.document_id").WillReturnRows(sqlmock.NewRows([]string{"document_id", "has_target"}))
+	for _, table := range []string{"INSERT INTO document_metadata", "DELETE FROM document_metadata",
+		"UPDATE rule_conditions", "UPDATE rule_actions", "UPDATE metadata_keys", "UPDATE metadata_value_aliases"} {
+		mock.ExpectExec(table).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectQuery("SELECT id, COALESCE\\(parent_id, 0\\) AS parent_id FROM metadata_values").WithArgs(5, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "parent_id"}).
+			AddRow(1, 10).AddRow(2, 1).AddRow(3, 2).AddRow(10, 0))
+	mock.ExpectExec("UPDATE metadata_values SET parent_id = NULLIF\\(\\$2, 0\\) WHERE id = \\$1").WithArgs(3, 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE metadata_values SET parent_id = \\$2 WHERE parent_id = \\$1 AND id <> \\$2").WithArgs(1, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	merge, err := db.MetadataStore.beginMerge(false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = merge.repointValue(models.Metadata{KeyId: 5, ValueId: 1}, models.Metadata{KeyId: 5, ValueId: 3})
+	if err != nil {
+		t.Fatalf("repointValue() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// GetUsersWithDocumentMetadata returns users that have documents with metadata.
+func (s *MetadataStore) GetUsersWithDocumentMetadata() ([]int, error) {
+	sql := `
+SELECT DISTINCT d.user_id
+FROM documents d
+JOIN document_metadata dm ON d.id = dm.document_id
+WHERE d.deleted_at IS NULL
+ORDER BY d.user_id;`
+
+	users := []int{}
+	err := s.db.Select(&users, sql)
+	return users, s.parseError(err, "get users with document metadata")
+}
+
+// GetClassifierTrainingDocuments returns the latest documents of the user that have metadata.
+// Content contains the description and at most contentLength characters of the document content.
+// Values that the classifier added automatically are not included, unless user has confirmed them,
+// so that the classifier is not trained with its own predictions. Keys of those values are returned
+// in ExcludedKeyIds, so that the document is not used as an example of not having the key either.
+func (s *MetadataStore) GetClassifierTrainingDocuments(userId int, limit int, contentLength int) ([]models.ClassifierDocument, error) {
+	sql := `
+SELECT d.id AS id, d.name AS name, concat_ws(' ', d.description, left(d.content, $2)) AS content,
+	COALESCE(array_agg(dm.key_id ORDER BY dm.value_id) FILTER (WHERE ms.id IS NULL), '{}') AS key_ids,
+	COALESCE(array_agg(dm.value_id ORDER BY dm.value_id) FILTER (WHERE ms.id IS NULL), '{}') AS value_ids,
+	COALESCE(array_agg(DISTINCT dm.key_id) FILTER (WHERE ms.id IS NOT NULL), '{}') AS excluded_key_ids
+FROM documents d
+JOIN document_metadata dm ON d.id = dm.document_id
+LEFT JOIN metadata_suggestions ms ON ms.document_id = dm.document_id AND ms.value_id = dm.value_id AND ms.automatic
+WHERE d.user_id = $1 AND d.deleted_at IS NULL
+GROUP BY d.id
+ORDER BY d.updated_at DESC
+LIMIT $3;`
+
+	documents := make([]models.ClassifierDocument, 0)
+	err := s.db.Select(&documents, sql, userId, contentLength, limit)
+	return documents, s.parseError(err, "get classifier training documents")
+}
+
+// SaveMetadataClassifier saves the classifier, replacing the previous classifier of the user.
+func (s *MetadataStore) SaveMetadataClassifier(classifier *models.MetadataClassifier) error {
+	sql := `
+INSERT INTO metadata_classifiers (user_id, model, documents, keys, trained_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (user_id) DO UPDATE
+SET model = $2, documents = $3, keys = $4, trained_at = $5;`
+
+	_, err := s.db.Exec(sql, classifier.UserId, classifier.Model, classifier.Documents, classifier.Keys,
+		classifier.TrainedAt)
+	return s.parseError(err, "save metadata classifier")
+}
+
+// GetMetadataClassifier returns the classifier of the user, or ErrRecordNotFound if it has not been trained.
+func (s *MetadataStore) GetMetadataClassifier(userId int) (*models.MetadataClassifier, error) {
+	classifier := &models.MetadataClassifier{}
+	err := s.db.Get(classifier, "SELECT * FROM metadata_classifiers WHERE user_id = $1", userId)
+	return classifier, s.parseError(err, "get metadata classifier")
+}
+
+// GetMetadataClassifierTrainedAt returns the time the classifier of the user was trained,
+// or ErrRecordNotFound if it has not been trained.
+func (s *MetadataStore) GetMetadataClassifierTrainedAt(userId int) (time.Time, error) {
+	var trainedAt time.Time
+	err := s.db.Get(&trainedAt, "SELECT trained_at FROM metadata_classifiers WHERE user_id = $1", userId)
+	return trainedAt, s.parseError(err, "get metadata classifier")
+}
+
+// AddMetadataSuggestions saves suggestions. Values that have already been suggested for the document are skipped.
+func (s *MetadataStore) AddMetadataSuggestions(suggestions []models.MetadataSuggestion) error {
+	if len(suggestions) == 0 {
+		return nil
+	}
+	query := s.sq.Insert("metadata_suggestions").
+		Columns("document_id", "key_id", "value_id", "confidence", "status", "automatic").
+		Suffix("ON CONFLICT (document_id, value_id) DO NOTHING")
+	for _, v := range suggestions {
+		query = query.Values(v.DocumentId, v.KeyId, v.ValueId, v.Confidence, v.Status, v.Automatic)
+	}
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("build sql: %v", err)
+	}
+	_, err = s.db.Exec(sql, args...)
+	return s.parseError(err, "add metadata suggestions")
+}
+
+// GetSuggestedValueIds returns ids of all values that have been suggested for the document, in any status.
+func (s *MetadataStore) GetSuggestedValueIds(documentId string) ([]int, error) {
+	ids := []int{}
+	err := s.db.Select(&ids, "SELECT value_id FROM metadata_suggestions WHERE document_id = $1", documentId)
+	return ids, s.parseError(err, "get suggested values")
+}
+
+func (s *MetadataStore) suggestionsQuery(userId int) squirrel.SelectBuilder {
+	return s.sq.Select("ms.id AS id", "ms.document_id AS document_id", "d.name AS document_name",
+		"ms.key_id AS key_id", "mk.key AS key", "ms.value_id AS value_id", "mv.value AS value",
+		"ms.confidence AS confidence", "ms.status AS status", "ms.automatic AS automatic",
+		"ms.created_at AS created_at", "ms.updated_at AS updated_at").
+		From("metadata_suggestions ms").
+		Join("documents d ON ms.document_id = d.id").
+		Join("metadata_keys mk ON ms.key_id = mk.id").
+		Join("metadata_values mv ON ms.value_id = mv.id").
+		Where(squirrel.Eq{"d.user_id": userId}).
+		Where("d.deleted_at IS NULL")
+}
+
+// pendingSuggestionsQuery returns pending suggestions of values that the documents do not have yet.
+func (s *MetadataStore) pendingSuggestionsQuery(userId int, documentId string) squirrel.SelectBuilder {
+	query := s.suggestionsQuery(userId).
+		Where(squirrel.Eq{"ms.status": models.MetadataSuggestionPending}).
+		Where(`NOT EXISTS (SELECT 1 FROM document_metadata dm
+			WHERE dm.document_id = ms.document_id AND dm.value_id = ms.value_id)`)
+	if documentId != "" {
+		query = query.Where(squirrel.Eq{"ms.document_id": documentId})
+	}
+	return query
+}
+
+// GetMetadataSuggestions returns pending suggestions of the user, ordered by confidence.
+// If documentId is set, only suggestions for the document are returned. In addition, return total count.
+func (s *MetadataStore) GetMetadataSuggestions(userId int, documentId string, paging Paging) ([]models.MetadataSuggestion, int, error) {
+	paging.Validate()
+	suggestions := make([]models.MetadataSuggestion, 0)
+	countQuery := s.sq.Select("COUNT(*)").FromSelect(s.pendingSuggestionsQuery(userId, documentId), "suggestions")
+	sql, args, err := countQuery.ToSql()
+	if err != nil {
+		return suggestions, 0, fmt.Errorf("build count sql: %v", err)
+	}
+	count := 0
+	err = s.db.Get(&count, sql, args...)
+	if err != nil {
+		return suggestions, 0, s.parseError(err, "count metadata suggestions")
+	}
+
+	query := s.pendingSuggestionsQuery(userId, documentId).
+		OrderBy("ms.confidence DESC", "ms.id").
+		Offset(uint64(paging.Offset)).
+		Limit(uint64(paging.Limit))
+	sql, args, err = query.ToSql()
+	if err != nil {
+		return suggestions, 0, fmt.Errorf("build sql: %v", err)
+	}
+	err = s.db.Select(&suggestions, sql, args...)
+	return suggestions, count, s.parseError(err, "get metadata suggestions")
+}
+
+// GetMetadataSuggestion returns suggestion of the user.
+func (s *MetadataStore) GetMetadataSuggestion(userId int, id int) (*models.MetadataSuggestion, error) {
+	sql, args, err := s.suggestionsQuery(userId).Where(squirrel.Eq{"ms.id": id}).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build sql: %v", err)
+	}
+	suggestion := &models.MetadataSuggestion{}
+	err = s.db.Get(suggestion, sql, args...)
+	return suggestion, s.parseError(err, "get metadata suggestion")
+}
+
+// pendingSuggestion returns pending suggestion of the user, or ErrInvalid if the suggestion is already handled.
+func (s *MetadataStore) pendingSuggestion(userId int, id int) (*models.MetadataSuggestion, error) {
+	suggestion, err := s.GetMetadataSuggestion(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	if suggestion.Status != models.MetadataSuggestionPending {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("suggestion is already %s", suggestion.Status)
+		return nil, e
+	}
+	return suggestion, nil
+}
+
+// setSuggestionStatus changes the status of pending suggestion.
+// If the suggestion has been handled meanwhile, ErrInvalid is returned.
+func (s *MetadataStore) setSuggestionStatus(db sqlx.Execer, suggestion *models.MetadataSuggestion, status string) error {
+	res, err := db.Exec("UPDATE metadata_suggestions SET status = $1, updated_at = now() WHERE id = $2 AND status = $3",
+		status, suggestion.Id, models.MetadataSuggestionPending)
+	if err != nil {
+		return s.parseError(err, "update metadata suggestion")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return s.parseError(err, "update metadata suggestion")
+	}
+	if rows == 0 {
+		e := errors.ErrInvalid
+		e.ErrMsg = "suggestion is already handled"
+		return e
+	}
+	suggestion.Status = status
+	return nil
+}
+
+// ConfirmAutomaticSuggestions marks values that the classifier added automatically and that the document
+// still has as accepted by user. This is called when user has edited the metadata of the document.
+func (s *MetadataStore) ConfirmAutomaticSuggestions(userId int, documentId string) error {
+	sql := `
+UPDATE metadata_suggestions ms SET automatic = FALSE, updated_at = now()
+FROM documents d
+WHERE ms.document_id = d.id AND d.id = $1 AND d.user_id = $2 AND ms.automatic
+AND EXISTS (SELECT 1 FROM document_metadata dm WHERE dm.document_id = ms.document_id AND dm.value_id = ms.value_id);`
+	_, err := s.db.Exec(sql, documentId, userId)
+	return s.parseError(err, "confirm automatic metadata suggestions")
+}
+
+// AcceptMetadataSuggestion adds the suggested value to the document and marks the suggestion accepted.
+// Value is added with the same constraints as bulk editing metadata. Caller must index the document.
+func (s *MetadataStore) AcceptMetadataSuggestion(userId int, id int) (*models.MetadataSuggestion, error) {
+	suggestion, err := s.pendingSuggestion(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	original, err := s.GetDocumentMetadata(userId, suggestion.DocumentId)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.GetUserKeys(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.beginTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	added := []models.Metadata{{KeyId: suggestion.KeyId, ValueId: suggestion.ValueId}}
+	err = s.upsertDocumentMetadata(tx, keys, []string{suggestion.DocumentId}, added)
+	if err != nil {
+		return nil, err
+	}
+	err = s.setSuggestionStatus(tx.tx, suggestion, models.MetadataSuggestionAccepted)
+	if err != nil {
+		return nil, err
+	}
+	updated := models.ApplySingleValueKeys(keys, *original, added)
+	diff := models.MetadataDiff(suggestion.DocumentId, userId, original, &updated)
+	err = addDocumentHistoryAction(tx.tx, s.sq, diff, userId)
+	if err != nil {
+		return nil, fmt.Errorf("add history entries: %v", err)
+	}
+	tx.ok = true
+	return suggestion, nil
+}
+
+// RejectMetadataSuggestion marks the suggestion rejected, so the value is not suggested again for the document.
+func (s *MetadataStore) RejectMetadataSuggestion(userId int, id int) (*models.MetadataSuggestion, error) {
+	suggestion, err := s.pendingSuggestion(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	return suggestion, s.setSuggestionStatus(s.db, suggestion, models.MetadataSuggestionRejected)
+}
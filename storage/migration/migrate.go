@@ -103,6 +103,101 @@ var Migrations = []Migrator{
 		Level:  15,
 		Schema: schemaV15,
 	},
+	&Migration{
+		Name:   "document properties",
+		Level:  16,
+		Schema: schemaV16,
+	},
+	&Migration{
+		Name:   "document barcodes",
+		Level:  17,
+		Schema: schemaV17,
+	},
+	&Migration{
+		Name:   "document fields",
+		Level:  18,
+		Schema: schemaV18,
+	},
+	&Migration{
+		Name:   "document duplicates",
+		Level:  19,
+		Schema: schemaV19,
+	},
+	&Migration{
+		Name:   "rule condition groups",
+		Level:  20,
+		Schema: schemaV20,
+	},
+	&Migration{
+		Name:   "rule action extract metadata",
+		Level:  21,
+		Schema: schemaV21,
+	},
+	&Migration{
+		Name:   "bulk operations",
+		Level:  22,
+		Schema: schemaV22,
+	},
+	&Migration{
+		Name:   "rule executions",
+		Level:  23,
+		Schema: schemaV23,
+	},
+	&Migration{
+		Name:   "rule triggers",
+		Level:  24,
+		Schema: schemaV24,
+	},
+	&Migration{
+		Name:   "document source",
+		Level:  25,
+		Schema: schemaV25,
+	},
+	&Migration{
+		Name:   "document needs review",
+		Level:  26,
+		Schema: schemaV26,
+	},
+	&Migration{
+		Name:   "rule statistics",
+		Level:  27,
+		Schema: schemaV27,
+	},
+	&Migration{
+		Name:   "rule condition match mode",
+		Level:  28,
+		Schema: schemaV28,
+	},
+	&Migration{
+		Name:   "typed metadata values",
+		Level:  29,
+		Schema: schemaV29,
+	},
+	&Migration{
+		Name:   "metadata value hierarchy",
+		Level:  30,
+		Schema: schemaV30,
+	},
+	&Migration{
+		Name:   "metadata value aliases",
+		Level:  31,
+		Schema: schemaV31,
+	},
+	&Migration{
+		Name:   "metadata key constraints",
+		Level:  32,
+		Schema: schemaV32,
+	},
+	&Migration{
+		Name:   "metadata classifier",
+		Level:  33,
+		Schema: schemaV33,
+	},
+	&Migration{
+		Name:   "tags",
+		Level:  34,
+		Schema: schemaV34,
+	},
 }
 
 type Schema struct {
@@ -0,0 +1,42 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV16 = `
+-- make room for properties-step in process queue: rules 4 -> 5, fts 5 -> 6
+UPDATE process_queue SET step = step + 10 WHERE step >= 4;
+UPDATE process_queue SET step = step - 9 WHERE step >= 14;
+
+CREATE TABLE document_properties (
+    document_id TEXT NOT NULL,
+    key TEXT NOT NULL,
+    value TEXT NOT NULL DEFAULT '',
+    source TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ DEFAULT now(),
+
+    CONSTRAINT pk_document_properties PRIMARY KEY (document_id, key),
+
+	CONSTRAINT fk_document_id
+		FOREIGN KEY (document_id) 
+		REFERENCES documents(id) 
+		ON DELETE CASCADE
+);
+
+ALTER TABLE rule_conditions
+    ADD COLUMN property_key TEXT NOT NULL DEFAULT '';
+`
@@ -0,0 +1,40 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV17 = `
+-- make room for barcodes-step in process queue: content 3 -> 4, properties 4 -> 5, rules 5 -> 6, fts 6 -> 7
+UPDATE process_queue SET step = step + 10 WHERE step >= 3;
+UPDATE process_queue SET step = step - 9 WHERE step >= 13;
+
+CREATE TABLE document_barcodes (
+    id SERIAL PRIMARY KEY,
+    document_id TEXT NOT NULL,
+    page INT NOT NULL DEFAULT 1,
+    type TEXT NOT NULL DEFAULT '',
+    payload TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now(),
+
+	CONSTRAINT fk_document_id
+		FOREIGN KEY (document_id) 
+		REFERENCES documents(id) 
+		ON DELETE CASCADE
+);
+
+CREATE INDEX document_barcodes_document_idx ON document_barcodes(document_id);
+`
@@ -0,0 +1,42 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV18 = `
+-- make room for fields-step in process queue: rules 6 -> 7, fts 7 -> 8
+UPDATE process_queue SET step = step + 10 WHERE step >= 6;
+UPDATE process_queue SET step = step - 9 WHERE step >= 16;
+
+CREATE TABLE document_fields (
+    document_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    confidence REAL NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT now(),
+
+    CONSTRAINT pk_document_fields PRIMARY KEY (document_id, name),
+
+	CONSTRAINT fk_document_id
+		FOREIGN KEY (document_id) 
+		REFERENCES documents(id) 
+		ON DELETE CASCADE
+);
+
+ALTER TABLE rule_conditions
+    ADD COLUMN field_name TEXT NOT NULL DEFAULT '';
+`
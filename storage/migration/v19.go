@@ -0,0 +1,61 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV19 = `
+-- make room for duplicates-step in process queue: rules 7 -> 8, fts 8 -> 9
+UPDATE process_queue SET step = step + 10 WHERE step >= 7;
+UPDATE process_queue SET step = step - 9 WHERE step >= 17;
+
+CREATE TABLE document_fingerprints (
+    document_id TEXT NOT NULL PRIMARY KEY,
+    -- simhash of document content, null if content is too short
+    content_hash BIGINT,
+    -- difference hash of document thumbnail, null if there is no thumbnail
+    image_hash BIGINT,
+    created_at TIMESTAMPTZ DEFAULT now(),
+
+	CONSTRAINT fk_document_id
+		FOREIGN KEY (document_id) 
+		REFERENCES documents(id) 
+		ON DELETE CASCADE
+);
+
+-- pair of near-duplicate documents, doc_a_id < doc_b_id
+CREATE TABLE document_duplicates (
+    doc_a_id TEXT NOT NULL,
+    doc_b_id TEXT NOT NULL,
+    content_similarity REAL,
+    image_similarity REAL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ DEFAULT now(),
+
+    CONSTRAINT pk_document_duplicates PRIMARY KEY (doc_a_id, doc_b_id),
+
+	CONSTRAINT fk_doc_a_id
+		FOREIGN KEY (doc_a_id) 
+		REFERENCES documents(id) 
+		ON DELETE CASCADE,
+	CONSTRAINT fk_doc_b_id
+		FOREIGN KEY (doc_b_id) 
+		REFERENCES documents(id) 
+		ON DELETE CASCADE
+);
+
+CREATE INDEX document_duplicates_doc_b_id ON document_duplicates(doc_b_id);
+`
@@ -0,0 +1,26 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV21 = `
+-- options for extracting metadata values from document text
+ALTER TABLE rule_actions ADD COLUMN text_source TEXT NOT NULL DEFAULT '';
+ALTER TABLE rule_actions ADD COLUMN trim_value BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE rule_actions ADD COLUMN value_case TEXT NOT NULL DEFAULT '';
+ALTER TABLE rule_actions ADD COLUMN collapse_whitespace BOOLEAN NOT NULL DEFAULT FALSE;
+`
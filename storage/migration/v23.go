@@ -0,0 +1,39 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV23 = `
+ALTER TABLE rules ADD COLUMN version INT NOT NULL DEFAULT 1;
+
+ALTER TABLE document_history ADD COLUMN rule_id INT REFERENCES rules(id) ON DELETE SET NULL;
+
+CREATE TABLE rule_executions (
+    id SERIAL PRIMARY KEY,
+    document_id TEXT NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    rule_id INT REFERENCES rules(id) ON DELETE SET NULL,
+    rule_name TEXT NOT NULL DEFAULT '',
+    rule_version INT NOT NULL DEFAULT 1,
+    matched BOOLEAN NOT NULL DEFAULT FALSE,
+    conditions JSONB NOT NULL DEFAULT '[]',
+    actions JSONB NOT NULL DEFAULT '[]',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX rule_executions_document_id ON rule_executions(document_id, created_at);
+`
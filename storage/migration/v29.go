@@ -0,0 +1,33 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV29 = `
+ALTER TABLE metadata_keys
+	ADD COLUMN value_type TEXT NOT NULL DEFAULT 'text';
+
+ALTER TABLE metadata_values
+	ADD COLUMN value_int BIGINT DEFAULT NULL,
+	ADD COLUMN value_decimal NUMERIC DEFAULT NULL,
+	ADD COLUMN value_date DATE DEFAULT NULL,
+	ADD COLUMN value_bool BOOLEAN DEFAULT NULL;
+
+CREATE INDEX metadata_values_value_int ON metadata_values(key_id, value_int) WHERE value_int IS NOT NULL;
+CREATE INDEX metadata_values_value_decimal ON metadata_values(key_id, value_decimal) WHERE value_decimal IS NOT NULL;
+CREATE INDEX metadata_values_value_date ON metadata_values(key_id, value_date) WHERE value_date IS NOT NULL;
+`
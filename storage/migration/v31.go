@@ -0,0 +1,32 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV31 = `
+CREATE TABLE metadata_value_aliases (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	key_id INT NOT NULL REFERENCES metadata_keys(id) ON DELETE CASCADE,
+	value_id INT NOT NULL REFERENCES metadata_values(id) ON DELETE CASCADE,
+	alias TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX metadata_value_aliases_key_alias ON metadata_value_aliases(key_id, lower(alias));
+CREATE INDEX metadata_value_aliases_value_id ON metadata_value_aliases(value_id);
+`
@@ -0,0 +1,49 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV33 = `
+-- per-user metadata classifier, model is stored as json
+CREATE TABLE metadata_classifiers (
+    user_id INT NOT NULL PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    model TEXT NOT NULL,
+    -- number of documents used for training
+    documents INT NOT NULL DEFAULT 0,
+    keys INT NOT NULL DEFAULT 0,
+    trained_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- metadata values suggested by the classifier. Suggestions that are accepted or rejected are kept,
+-- so that the same value is not suggested again for the document.
+CREATE TABLE metadata_suggestions (
+    id SERIAL PRIMARY KEY,
+    document_id TEXT NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    key_id INT NOT NULL REFERENCES metadata_keys(id) ON DELETE CASCADE,
+    value_id INT NOT NULL REFERENCES metadata_values(id) ON DELETE CASCADE,
+    confidence REAL NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    -- suggestion was applied automatically during processing
+    automatic BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    CONSTRAINT unique_metadata_suggestion UNIQUE (document_id, value_id)
+);
+
+CREATE INDEX metadata_suggestions_status ON metadata_suggestions(status);
+`
@@ -0,0 +1,44 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package migration
+
+const schemaV34 = `
+-- document_tags did not have foreign keys, remove rows of deleted documents and tags.
+DELETE FROM document_tags dt
+WHERE NOT EXISTS (SELECT 1 FROM documents d WHERE d.id = dt.document_id)
+OR NOT EXISTS (SELECT 1 FROM tags t WHERE t.id = dt.tag_id);
+
+ALTER TABLE document_tags
+	ADD CONSTRAINT fk_document_tags_document FOREIGN KEY (document_id)
+		REFERENCES documents(id) ON DELETE CASCADE,
+	ADD CONSTRAINT fk_document_tags_tag FOREIGN KEY (tag_id)
+		REFERENCES tags(id) ON DELETE CASCADE;
+
+CREATE INDEX document_tags_tag_id ON document_tags(tag_id);
+
+-- rules are not deleted with the tag, since removing a condition would change what the rule matches.
+ALTER TABLE rule_conditions
+	ADD COLUMN tag_id INT,
+	ADD CONSTRAINT fk_tag FOREIGN KEY (tag_id)
+		REFERENCES tags(id);
+
+ALTER TABLE rule_actions
+	ADD COLUMN tag_id INT,
+	ADD CONSTRAINT fk_tag FOREIGN KEY (tag_id)
+		REFERENCES tags(id);
+`
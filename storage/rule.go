@@ -19,6 +19,7 @@
 package storage
 
 import (
+	"database/sql"
 	"fmt"
 	"strings"
 	"time"
@@ -74,12 +75,14 @@ func (s *RuleStore) setRuleCached(rule *models.Rule) {
 	s.cache.Set(fmt.Sprintf("rule-%d", rule.Id), rule, cache.DefaultExpiration)
 }
 
-func (s *RuleStore) GetUserRules(userId int, paging Paging) ([]*models.Rule, int, error) {
+func (s *RuleStore) GetUserRules(userId int, sort SortKey, paging Paging) ([]*models.Rule, int, error) {
+	sort.SetDefaults("rule_order", false)
+	sort.Validate("rule_order")
 	sql := `
 SELECT *
 FROM rules
 WHERE user_id = $1
-ORDER BY rule_order ASC
+ORDER BY ` + sort.QueryKey() + " " + sort.SortOrder() + ` NULLS LAST, id ASC
 OFFSET $2
 LIMIT $3
 ;`
@@ -112,6 +115,23 @@ LIMIT $3
 	return ruleArr, totalRules, nil
 }
 
+// GetAllUserRules returns all rules of the user in rule order, with conditions and actions.
+func (s *RuleStore) GetAllUserRules(userId int) ([]*models.Rule, error) {
+	rules := make([]*models.Rule, 0)
+	paging := Paging{Offset: 0, Limit: config.MaxRows}
+	for {
+		page, total, err := s.GetUserRules(userId, SortKey{}, paging)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, page...)
+		if len(page) < paging.Limit || len(rules) >= total {
+			return rules, nil
+		}
+		paging.Offset += paging.Limit
+	}
+}
+
 func (s *RuleStore) GetUserRule(userId, ruleId int) (*models.Rule, error) {
 	sql := `
 SELECT *
@@ -143,16 +163,27 @@ func (s *RuleStore) AddRule(userId int, rule *models.Rule) error {
 	}
 
 	tx, err := s.beginTx()
-	defer tx.Close()
 	if err != nil {
 		return fmt.Errorf("begin tx: %v", err)
 	}
+	defer tx.Close()
 
+	err = s.addRule(tx, userId, rule)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+// addRule inserts validated rule.
+func (s *RuleStore) addRule(tx *tx, userId int, rule *models.Rule) error {
 	// insert rule
 	query := s.sq.Insert("rules").
-		Columns("user_id", "name", "description", "enabled", "rule_order", "mode").
+		Columns("user_id", "name", "description", "enabled", "rule_order", "mode", "trigger_type").
 		Values(userId, rule.Name, rule.Description, rule.Enabled,
-			squirrel.Expr("(SELECT COALESCE(MAX(rule_order)+1, 1) FROM rules WHERE user_id=?)", userId), rule.Mode).
+			squirrel.Expr("(SELECT COALESCE(MAX(rule_order)+1, 1) FROM rules WHERE user_id=?)", userId), rule.Mode,
+			rule.Trigger).
 		Suffix("RETURNING \"id\"")
 	sql, args, err := query.ToSql()
 	if err != nil {
@@ -174,23 +205,22 @@ func (s *RuleStore) AddRule(userId int, rule *models.Rule) error {
 	if err != nil {
 		return fmt.Errorf("add conditions: %v", err)
 	}
-	tx.ok = true
 	return nil
 }
 
-// GetActiveUresRules returns all enabled rules (with some limit) for given user.
-func (s *RuleStore) GetActiveUserRules(userId int) ([]*models.Rule, error) {
-
-	sql := `
-SELECT *
-FROM rules
-WHERE user_id = $1
-AND enabled=TRUE
-ORDER BY rule_order ASC
-limit $2;`
+// GetActiveUserRules returns all enabled rules (with some limit) for given user and triggers.
+func (s *RuleStore) GetActiveUserRules(userId int, triggers ...models.RuleTrigger) ([]*models.Rule, error) {
+	query := s.sq.Select("*").From("rules").
+		Where(squirrel.Eq{"user_id": userId, "enabled": true, "trigger_type": triggers}).
+		OrderBy("rule_order ASC").
+		Limit(uint64(config.MaxRulesToProcess))
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build sql: %v", err)
+	}
 
 	rules := &[]models.Rule{}
-	err := s.db.Select(rules, sql, userId, config.MaxRulesToProcess)
+	err = s.db.Select(rules, sql, args...)
 	if err != nil {
 		return nil, s.parseError(err, "get active user rules")
 	}
@@ -216,6 +246,7 @@ func (s *RuleStore) getUserRuleConditionsForRules(userId int, rules []*models.Ru
 SELECT
     rule_conditions.id AS id,
     rule_id,
+    parent_id,
     rule_conditions.enabled AS enabled,
     case_insensitive,
     inverted_match,
@@ -226,11 +257,19 @@ SELECT
     metadata_value,
     mk.key as metadata_key_name,
     mv.value as metadata_value_name,
-	date_fmt
+    rule_conditions.tag_id AS tag_id,
+    t.key as tag_name,
+	date_fmt,
+	property_key,
+	field_name,
+	match_mode,
+	match_max_distance,
+	match_min_similarity
 FROM rule_conditions
 	LEFT JOIN rules ON rule_conditions.rule_id = rules.id
 	LEFT join metadata_keys mk on rule_conditions.metadata_key = mk.id
 	LEFT JOIN metadata_values mv on rule_conditions.metadata_value = mv.id
+	LEFT JOIN tags t on rule_conditions.tag_id = t.id
 WHERE rules.user_id = $1
 ORDER BY rule_id, rule_conditions.id ASC;
 `
@@ -256,12 +295,19 @@ SELECT
     rule_actions.action AS action,
     metadata_key,
     metadata_value,
+    text_source,
+    trim_value,
+    value_case,
+    collapse_whitespace,
 	mk.key as metadata_key_name,
-    mv.value as metadata_value_name
+    mv.value as metadata_value_name,
+    rule_actions.tag_id AS tag_id,
+    t.key as tag_name
 FROM rule_actions
 	LEFT JOIN rules ON rule_actions.rule_id = rules.id
 	LEFT join metadata_keys mk on rule_actions.metadata_key = mk.id
     LEFT JOIN metadata_values mv on rule_actions.metadata_value = mv.id
+    LEFT JOIN tags t on rule_actions.tag_id = t.id
 WHERE rules.user_id = $1
 ORDER BY rule_id, rule_actions.id ASC;
 `
@@ -312,22 +358,41 @@ func (s *RuleStore) UpdateRule(userId int, rule *models.Rule) error {
 	}
 	defer tx.Close()
 
+	err = s.updateRule(tx, userId, rule)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+// updateRule updates validated rule that user owns.
+func (s *RuleStore) updateRule(tx *tx, userId int, rule *models.Rule) error {
 	rule.Update()
 	query := s.sq.Update("rules").SetMap(map[string]interface{}{
-		"name":        rule.Name,
-		"description": rule.Description,
-		"enabled":     rule.Enabled,
-		"rule_order":  rule.Order,
-		"mode":        rule.Mode,
-		"updated_at":  rule.UpdatedAt,
-	}).Where(squirrel.Eq{"user_id": userId, "id": rule.Id})
+		"name":         rule.Name,
+		"description":  rule.Description,
+		"enabled":      rule.Enabled,
+		"rule_order":   rule.Order,
+		"mode":         rule.Mode,
+		"trigger_type": rule.Trigger,
+		"updated_at":   rule.UpdatedAt,
+		"version":      squirrel.Expr("version + 1"),
+		// statistics are counted for the current version of the rule
+		"evaluations":     0,
+		"matches":         0,
+		"last_matched_at": nil,
+		"last_error":      "",
+		"last_error_at":   nil,
+		"stats_reset_at":  rule.UpdatedAt,
+	}).Where(squirrel.Eq{"user_id": userId, "id": rule.Id}).Suffix("RETURNING version")
 
 	sql, args, err := query.ToSql()
 	if err != nil {
 		return fmt.Errorf("build sql: %v", err)
 	}
 
-	_, err = tx.tx.Exec(sql, args...)
+	err = tx.tx.Get(&rule.Version, sql, args...)
 	if err != nil {
 		return getDatabaseError(err, s, "update")
 	}
@@ -355,8 +420,6 @@ func (s *RuleStore) UpdateRule(userId int, rule *models.Rule) error {
 	}
 
 	//TODO: handle changing rule_order
-
-	tx.ok = true
 	return nil
 }
 
@@ -384,6 +447,11 @@ func (s *RuleStore) DeleteRule(userId, ruleId int) error {
 	return nil
 }
 
+// ValidateRule validates the rule and checks the user owns the metadata that rule refers to.
+func (s *RuleStore) ValidateRule(userId int, rule *models.Rule) error {
+	return s.validateRule(userId, rule)
+}
+
 func (s *RuleStore) validateRule(userId int, rule *models.Rule) error {
 	err := rule.Validate()
 	if err != nil {
@@ -391,7 +459,13 @@ func (s *RuleStore) validateRule(userId int, rule *models.Rule) error {
 	}
 
 	metadata := make([]models.Metadata, 0, 5)
-	for _, v := range rule.Conditions {
+	// keys of actions that create metadata values
+	keys := make(map[int]bool)
+	tags := make([]int, 0)
+	for _, v := range rule.AllConditions() {
+		if v.TagId > 0 {
+			tags = append(tags, int(v.TagId))
+		}
 		if v.MetadataValue > 0 && v.MetadataKey > 0 {
 			m := models.Metadata{
 				KeyId:   int(v.MetadataKey),
@@ -399,14 +473,26 @@ func (s *RuleStore) validateRule(userId int, rule *models.Rule) error {
 			}
 			metadata = append(metadata, m)
 		}
+		if v.ConditionType == models.RuleConditionMetadataValueMoreThan ||
+			v.ConditionType == models.RuleConditionMetadataValueLessThan {
+			err := s.validateComparedKey(userId, v)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	for _, v := range rule.Actions {
+		if v.TagId > 0 {
+			tags = append(tags, int(v.TagId))
+		}
 		if v.MetadataValue > 0 && v.MetadataKey > 0 {
 			m := models.Metadata{
 				KeyId:   int(v.MetadataKey),
 				ValueId: int(v.MetadataValue),
 			}
 			metadata = append(metadata, m)
+		} else if v.Action == models.RuleActionExtractMetadata {
+			keys[int(v.MetadataKey)] = true
 		}
 	}
 
@@ -416,15 +502,59 @@ func (s *RuleStore) validateRule(userId int, rule *models.Rule) error {
 			return err
 		}
 	}
+	if len(keys) > 0 {
+		keyIds := make([]int, 0, len(keys))
+		for id := range keys {
+			keyIds = append(keyIds, id)
+		}
+		ok, err := s.metadata.UserHasKeys(userId, keyIds)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			e := errors.ErrRecordNotFound
+			e.ErrMsg = "metadata key not found"
+			return e
+		}
+	}
+	if len(tags) > 0 {
+		ok, err := s.metadata.UserHasTags(userId, tags)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			e := errors.ErrRecordNotFound
+			e.ErrMsg = "tag not found"
+			return e
+		}
+	}
 	return nil
 }
 
+// validateComparedKey checks that the key of the metadata comparison condition exists, can be compared
+// and that the value is valid for the key type.
+func (s *RuleStore) validateComparedKey(userId int, condition *models.RuleCondition) error {
+	key, err := s.metadata.GetKey(userId, int(condition.MetadataKey))
+	if err != nil {
+		return err
+	}
+	if !key.ValueType.Comparable() {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("metadata key %s of type %s cannot be compared", key.Key, key.ValueType)
+		return e
+	}
+	_, _, err = models.ParseMetadataValue(key.ValueType, condition.Value)
+	return err
+}
+
 func (s *RuleStore) addActionsToRule(tx *tx, ruleId int, actions []*models.RuleAction) error {
 	query := s.sq.Insert("rule_actions").
-		Columns("rule_id", "enabled", "on_condition", "action", "value", "metadata_key", "metadata_value")
+		Columns("rule_id", "enabled", "on_condition", "action", "value", "metadata_key", "metadata_value",
+			"text_source", "trim_value", "value_case", "collapse_whitespace", "tag_id")
 
 	for _, v := range actions {
-		query = query.Values(ruleId, v.Enabled, v.OnCondition, v.Action, v.Value, v.MetadataKey, v.MetadataValue)
+		query = query.Values(ruleId, v.Enabled, v.OnCondition, v.Action, v.Value, v.MetadataKey, v.MetadataValue,
+			v.TextSource, v.TrimValue, v.ValueCase, v.CollapseWhitespace, v.TagId)
 	}
 
 	sql, args, err := query.ToSql()
@@ -444,29 +574,47 @@ func (s *RuleStore) addActionsToRule(tx *tx, ruleId int, actions []*models.RuleA
 	return nil
 }
 
+// addConditionsToRule inserts conditions and their child conditions. Conditions are inserted one by one,
+// since child conditions need the id of their group.
 func (s *RuleStore) addConditionsToRule(tx *tx, ruleId int, conditions []*models.RuleCondition) error {
-	query := s.sq.Insert("rule_conditions").
-		Columns("rule_id", "enabled", "case_insensitive", "inverted_match", "condition_type",
-			"is_regex", "value", "date_fmt", "metadata_key", "metadata_value")
+	return s.addConditionsToGroup(tx, ruleId, 0, conditions)
+}
 
+func (s *RuleStore) addConditionsToGroup(tx *tx, ruleId int, parentId models.IntId, conditions []*models.RuleCondition) error {
 	for _, v := range conditions {
-		query = query.Values(ruleId, v.Enabled, v.CaseInsensitive, v.Inverted, v.ConditionType, v.IsRegex, v.Value, v.DateFmt,
-			v.MetadataKey, v.MetadataValue)
-	}
-
-	sql, args, err := query.ToSql()
-	if err != nil {
-		return fmt.Errorf("construct insert conditions sql: %v", err)
-	}
-
-	if tx != nil {
-		_, err = tx.tx.Exec(sql, args...)
-	} else {
-		_, err = s.db.Exec(sql, args...)
+		query := s.sq.Insert("rule_conditions").
+			Columns("rule_id", "parent_id", "enabled", "case_insensitive", "inverted_match", "condition_type",
+				"is_regex", "value", "date_fmt", "metadata_key", "metadata_value", "property_key", "field_name",
+				"match_mode", "match_max_distance", "match_min_similarity", "tag_id").
+			Values(ruleId, parentId, v.Enabled, v.CaseInsensitive, v.Inverted, v.ConditionType, v.IsRegex, v.Value, v.DateFmt,
+				v.MetadataKey, v.MetadataValue, v.PropertyKey, v.FieldName,
+				v.MatchMode, v.MatchMaxDistance, v.MatchMinSimilarity, v.TagId).
+			Suffix("RETURNING \"id\"")
+
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("construct insert conditions sql: %v", err)
+		}
 
-	}
-	if err != nil {
-		return getDatabaseError(err, s, "insert rule conditions")
+		var id int
+		if tx != nil {
+			err = tx.tx.Get(&id, sql, args...)
+		} else {
+			err = s.db.Get(&id, sql, args...)
+		}
+		if err != nil {
+			return getDatabaseError(err, s, "insert rule conditions")
+		}
+		v.Id = id
+		v.RuleId = ruleId
+		v.ParentId = parentId
+
+		if len(v.Conditions) > 0 {
+			err = s.addConditionsToGroup(tx, ruleId, models.IntId(id), v.Conditions)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -474,12 +622,13 @@ func (s *RuleStore) addConditionsToRule(tx *tx, ruleId int, conditions []*models
 func mapConditionsToRules(rules []*models.Rule, conditions *[]models.RuleCondition) {
 	for i, _ := range rules {
 		rule := rules[i]
-		rule.Conditions = make([]*models.RuleCondition, 0, 10)
+		ruleConditions := make([]*models.RuleCondition, 0, 10)
 		for conditionI, condition := range *conditions {
 			if condition.RuleId == rule.Id {
-				rule.Conditions = append(rule.Conditions, &(*conditions)[conditionI])
+				ruleConditions = append(ruleConditions, &(*conditions)[conditionI])
 			}
 		}
+		rule.Conditions = models.ConditionTree(ruleConditions)
 	}
 }
 
@@ -542,3 +691,179 @@ func (s *RuleStore) ReorderRules(userId int, ids []int) error {
 
 	return s.parseError(tx.Commit(), "reorder")
 }
+
+// AddRuleExecutions saves the audit records of rules run on a document and updates the rule statistics.
+func (s *RuleStore) AddRuleExecutions(executions []*models.RuleExecution) error {
+	if len(executions) == 0 {
+		return nil
+	}
+	tx, err := s.beginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	err = s.addRuleExecutions(tx, executions)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+func (s *RuleStore) addRuleExecutions(tx *tx, executions []*models.RuleExecution) error {
+	if len(executions) == 0 {
+		return nil
+	}
+	query := s.sq.Insert("rule_executions").Columns("document_id", "rule_id", "rule_name", "rule_version",
+		"trigger_type", "matched", "conditions", "actions", "error")
+	for _, v := range executions {
+		query = query.Values(v.DocumentId, v.RuleId, v.RuleName, v.RuleVersion, v.Trigger, v.Matched,
+			v.Conditions, v.Actions, v.Error)
+	}
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("build sql: %v", err)
+	}
+	_, err = tx.tx.Exec(sql, args...)
+	if err != nil {
+		return s.parseError(err, "add rule executions")
+	}
+
+	now := time.Now()
+	for _, v := range ruleExecutionStatistics(executions, now) {
+		// executions of older versions of the rule are not counted
+		_, err = tx.tx.Exec(`
+UPDATE rules SET
+evaluations = evaluations + $3,
+matches = matches + $4,
+last_matched_at = COALESCE($5, last_matched_at),
+last_error = CASE WHEN $6 = '' THEN last_error ELSE $6 END,
+last_error_at = COALESCE($7, last_error_at)
+WHERE id = $1 AND version = $2`,
+			v.ruleId, v.version, v.Evaluations, v.Matches, v.LastMatchedAt, v.LastError, v.LastErrorAt)
+		if err != nil {
+			return s.parseError(err, "update rule statistics")
+		}
+	}
+	return nil
+}
+
+// RuleChanges are the changes that rules made to a document.
+type RuleChanges struct {
+	Document *models.Document
+	// History is saved without user. Document is updated only if there is history.
+	History []models.DocumentHistory
+	// MetadataChanged replaces the document metadata with Document.Metadata.
+	MetadataChanged bool
+	// TagsChanged replaces the document tags with Document.Tags.
+	TagsChanged bool
+	Executions  []*models.RuleExecution
+}
+
+// SaveRuleChanges saves the document, its metadata and tags, history and rule executions in a single transaction.
+func (s *RuleStore) SaveRuleChanges(changes *RuleChanges) error {
+	tx, err := s.beginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	doc := changes.Document
+	if len(changes.History) > 0 {
+		err = updateDocument(tx.tx, doc)
+		if err != nil {
+			return s.parseError(err, "update document")
+		}
+		err = addDocumentHistoryAction(tx.tx, s.sq, changes.History, UserIdInternal)
+		if err != nil {
+			return err
+		}
+	}
+	if changes.MetadataChanged {
+		err = s.metadata.replaceDocumentMetadata(tx.tx, doc.Id, doc.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+	if changes.TagsChanged {
+		err = s.metadata.replaceDocumentTags(tx, doc.Id, models.TagIds(doc.Tags))
+		if err != nil {
+			return err
+		}
+	}
+	err = s.addRuleExecutions(tx, changes.Executions)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+type ruleStatisticsDelta struct {
+	ruleId  int
+	version int
+	models.RuleStatistics
+}
+
+// ruleExecutionStatistics sums up the executions per rule and version.
+func ruleExecutionStatistics(executions []*models.RuleExecution, now time.Time) []*ruleStatisticsDelta {
+	deltas := make([]*ruleStatisticsDelta, 0)
+	index := map[[2]int]*ruleStatisticsDelta{}
+	for _, v := range executions {
+		if v.RuleId == 0 {
+			continue
+		}
+		key := [2]int{int(v.RuleId), v.RuleVersion}
+		delta, ok := index[key]
+		if !ok {
+			delta = &ruleStatisticsDelta{ruleId: int(v.RuleId), version: v.RuleVersion}
+			index[key] = delta
+			deltas = append(deltas, delta)
+		}
+		delta.Evaluations += 1
+		if v.Matched {
+			delta.Matches += 1
+			delta.LastMatchedAt = sql.NullTime{Time: now, Valid: true}
+		}
+		if v.Error != "" {
+			delta.LastError = v.Error
+			delta.LastErrorAt = sql.NullTime{Time: now, Valid: true}
+		}
+	}
+	return deltas
+}
+
+// GetDocumentRuleExecutions returns the rule executions of the document, latest first.
+func (s *RuleStore) GetDocumentRuleExecutions(documentId string, paging Paging) (*[]models.RuleExecution, int, error) {
+	sql := `
+SELECT *
+FROM rule_executions
+WHERE document_id = $1
+ORDER BY created_at DESC, id DESC
+OFFSET $2
+LIMIT $3;`
+
+	executions := &[]models.RuleExecution{}
+	err := s.db.Select(executions, sql, documentId, paging.Offset, paging.Limit)
+	if err != nil {
+		return executions, 0, s.parseError(err, "get document rule executions")
+	}
+
+	total := 0
+	err = s.db.Get(&total, `SELECT count(id) FROM rule_executions WHERE document_id = $1`, documentId)
+	return executions, total, s.parseError(err, "count document rule executions")
+}
+
+// GetUsersWithActiveRules returns ids of users that have enabled rules with given trigger.
+func (s *RuleStore) GetUsersWithActiveRules(trigger models.RuleTrigger) ([]int, error) {
+	sql := `
+SELECT DISTINCT user_id
+FROM rules
+WHERE enabled = TRUE
+AND trigger_type = $1
+ORDER BY user_id;`
+
+	users := []int{}
+	err := s.db.Select(&users, sql, trigger)
+	return users, s.parseError(err, "get users with active rules")
+}
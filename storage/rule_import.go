@@ -0,0 +1,88 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// RuleImport creates metadata, tags and rules of the user in a single transaction.
+// Rules are not validated against the database, since they can refer to metadata that is created
+// in the same transaction. Caller must validate rules and only refer to metadata and tags of the user.
+type RuleImport struct {
+	tx     *tx
+	rules  *RuleStore
+	userId int
+}
+
+// Import runs fn in a transaction. If fn returns error, nothing is saved.
+func (s *RuleStore) Import(userId int, fn func(tx *RuleImport) error) error {
+	tx, err := s.beginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	err = fn(&RuleImport{tx: tx, rules: s, userId: userId})
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	s.metadata.flushCachedUserKeys(userId)
+	return nil
+}
+
+func (r *RuleImport) CreateKey(key *models.MetadataKey) error {
+	key.UserId = r.userId
+	return r.rules.metadata.createKey(r.tx.tx, r.userId, key)
+}
+
+// UpdateKeyComment updates the comment of the key.
+func (r *RuleImport) UpdateKeyComment(key *models.MetadataKey) error {
+	_, err := r.tx.tx.Exec("UPDATE metadata_keys SET comment = $1 WHERE id = $2 AND user_id = $3",
+		key.Comment, key.Id, r.userId)
+	return r.rules.metadata.parseError(err, "update key")
+}
+
+func (r *RuleImport) CreateValue(value *models.MetadataValue) error {
+	value.UserId = r.userId
+	return r.rules.metadata.createValue(r.tx, r.userId, value)
+}
+
+func (r *RuleImport) UpdateValue(value *models.MetadataValue) error {
+	value.UserId = r.userId
+	return r.rules.metadata.updateValue(r.tx, value)
+}
+
+func (r *RuleImport) CreateTag(tag *models.Tag) error {
+	return r.rules.metadata.createTag(r.tx.tx, r.userId, tag)
+}
+
+func (r *RuleImport) UpdateTag(tag *models.Tag) error {
+	return r.rules.metadata.updateTag(r.tx.tx, r.userId, tag)
+}
+
+func (r *RuleImport) AddRule(rule *models.Rule) error {
+	return r.rules.addRule(r.tx, r.userId, rule)
+}
+
+// UpdateRule updates existing rule of the user.
+func (r *RuleImport) UpdateRule(rule *models.Rule) error {
+	return r.rules.updateRule(r.tx, r.userId, rule)
+}
@@ -0,0 +1,103 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+func Test_ruleExecutionStatistics(t *testing.T) {
+	now := time.Now()
+	executions := []*models.RuleExecution{
+		{RuleId: 1, RuleVersion: 2, Matched: true},
+		{RuleId: 1, RuleVersion: 2, Matched: false},
+		{RuleId: 1, RuleVersion: 1, Matched: true},
+		{RuleId: 2, RuleVersion: 1, Error: "action 3: invalid template"},
+		{RuleId: 0, RuleVersion: 1, Matched: true},
+	}
+	deltas := ruleExecutionStatistics(executions, now)
+	if len(deltas) != 3 {
+		t.Fatalf("got %d deltas, want 3", len(deltas))
+	}
+
+	first := deltas[0]
+	if first.ruleId != 1 || first.version != 2 || first.Evaluations != 2 || first.Matches != 1 {
+		t.Errorf("rule 1 v2 = %d/%d, evaluations %d, matches %d", first.ruleId, first.version, first.Evaluations, first.Matches)
+	}
+	if !first.LastMatchedAt.Valid || !first.LastMatchedAt.Time.Equal(now) || first.LastErrorAt.Valid {
+		t.Errorf("rule 1 v2 last matched = %v, last error = %v", first.LastMatchedAt, first.LastErrorAt)
+	}
+	if deltas[1].version != 1 || deltas[1].Evaluations != 1 {
+		t.Errorf("rule 1 v1 = %v", deltas[1])
+	}
+	failed := deltas[2]
+	if failed.Matches != 0 || failed.LastMatchedAt.Valid || failed.LastError != "action 3: invalid template" || !failed.LastErrorAt.Valid {
+		t.Errorf("rule 2 = %v", failed)
+	}
+}
+
+func TestRuleStore_SaveRuleChanges(t *testing.T) {
+	db, mock, err := NewMockDatabase(sqlmock.QueryMatcherRegexp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	store := newRuleStore(db.conn, db.MetadataStore)
+	changes := &RuleChanges{
+		Document: &models.Document{Id: "doc", Metadata: []models.Metadata{{KeyId: 1, ValueId: 10}},
+			Tags: []models.Tag{{Id: 2}}},
+		History:         []models.DocumentHistory{{DocumentId: "doc", Action: models.DocumentHistoryActionTagAdd, RuleId: 1}},
+		MetadataChanged: true,
+		TagsChanged:     true,
+		Executions:      []*models.RuleExecution{{DocumentId: "doc", RuleId: 1, RuleVersion: 1, Matched: true}},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE documents SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO document_history").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM document_metadata").WithArgs("doc").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO document_metadata").WithArgs("doc", 1, 10).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM document_tags").WithArgs("doc").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO document_tags").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO rule_executions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE rules SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err = store.SaveRuleChanges(changes)
+	if err != nil {
+		t.Fatalf("SaveRuleChanges() error = %v", err)
+	}
+
+	// nothing is saved if any of the changes fail
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE documents SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO document_history").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM document_metadata").WillReturnError(fmt.Errorf("connection lost"))
+	mock.ExpectRollback()
+	err = store.SaveRuleChanges(changes)
+	if err == nil {
+		t.Errorf("SaveRuleChanges() error = nil, want error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+/*
+ * Virtualpaper is a service to manage users paper documents in virtual format.
+ * Copyright (C) 2023  Tero Vierimaa
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"tryffel.net/go/virtualpaper/config"
+	"tryffel.net/go/virtualpaper/errors"
+	"tryffel.net/go/virtualpaper/models"
+)
+
+// GetDocumentTags returns tags for given document.
+func (s *MetadataStore) GetDocumentTags(userId int, documentId string) (*[]models.Tag, error) {
+	sql := `
+select tags.id as id, tags.key as key, tags.comment as comment
+from tags
+LEFT JOIN document_tags dt on tags.id = dt.tag_id
+LEFT JOIN documents d on dt.document_id = d.id
+WHERE dt.document_id= $1
+and d.user_id = $2
+order by key asc
+limit 100;
+`
+	object := &[]models.Tag{}
+	err := s.db.Select(object, sql, documentId, userId)
+	return object, s.parseError(err, "get document tags")
+}
+
+// GetTags returns all tags for user.
+func (s *MetadataStore) GetTags(userid int, paging Paging) (*[]models.TagComposite, int, error) {
+
+	sql := `
+SELECT
+       tags.id AS id, COUNT(dt.document_id) AS document_count,
+       tags.key AS key, tags.comment AS comment,
+       tags.created_at AS created_at, tags.updated_at AS updated_at
+FROM tags
+LEFT JOIN document_tags dt on tags.id = dt.tag_id
+WHERE tags.user_id = $1
+GROUP BY (tags.id)
+ORDER BY tags.key asc
+OFFSET $2
+LIMIT $3;
+`
+
+	object := &[]models.TagComposite{}
+
+	err := s.db.Select(object, sql, userid, paging.Offset, paging.Limit)
+	if err != nil {
+		return object, len(*object), s.parseError(err, "get tags")
+	}
+
+	sql = `SELECT
+	COUNT(tags.id) AS count
+	FROM tags
+	WHERE tags.user_id = $1;
+	`
+
+	n := 0
+	row := s.db.QueryRow(sql, userid)
+	err = row.Scan(&n)
+	if err != nil {
+		return object, len(*object), s.parseError(err, "scan tags count")
+	}
+	return object, n, s.parseError(err, "get tags count")
+}
+
+// GetAllTags returns all tags of the user ordered by name.
+func (s *MetadataStore) GetAllTags(userId int) ([]models.TagComposite, error) {
+	tags := make([]models.TagComposite, 0)
+	paging := Paging{Offset: 0, Limit: config.MaxRows}
+	for {
+		page, total, err := s.GetTags(userId, paging)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, *page...)
+		if len(*page) < paging.Limit || len(tags) >= total {
+			return tags, nil
+		}
+		paging.Offset += paging.Limit
+	}
+}
+
+// GetTag returns tag with given id.
+func (s *MetadataStore) GetTag(userId, tagId int) (*models.TagComposite, error) {
+	sql := `
+SELECT 
+	tags.id AS id, 
+	tags.key AS key, 
+	tags.comment AS comment, 
+	COUNT(d.id) as document_count, 
+	tags.created_at AS created_at, 
+	tags.updated_at AS updated_at
+FROM tags
+LEFT JOIN document_tags dt ON tags.id = dt.tag_id
+LEFT JOIN documents d ON dt.document_id = d.id
+WHERE tags.id = $1
+AND tags.user_id = $2
+GROUP BY (tags.id);
+`
+
+	object := &models.TagComposite{}
+	err := s.db.Get(object, sql, tagId, userId)
+	return object, s.parseError(err, "get tag")
+}
+
+// CreateTag creates new tag.
+func (s *MetadataStore) CreateTag(userId int, tag *models.Tag) error {
+	return s.createTag(s.db, userId, tag)
+}
+
+func (s *MetadataStore) createTag(db sqlx.Queryer, userId int, tag *models.Tag) error {
+	sql := `
+INSERT INTO tags (user_id, key, comment, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5) RETURNING id;
+`
+
+	tag.CreatedAt = time.Now()
+	tag.UpdatedAt = time.Now()
+	err := sqlx.Get(db, &tag.Id, sql, userId, tag.Key, tag.Comment, tag.CreatedAt, tag.UpdatedAt)
+	return s.parseError(err, "create tag")
+}
+
+// UpdateTag updates key and comment of the tag.
+func (s *MetadataStore) UpdateTag(userId int, tag *models.Tag) error {
+	return s.updateTag(s.db, userId, tag)
+}
+
+func (s *MetadataStore) updateTag(db sqlx.Queryer, userId int, tag *models.Tag) error {
+	tag.UpdatedAt = time.Now()
+	sql := `
+UPDATE tags SET key = $3, comment = $4, updated_at = $5
+WHERE id = $1 AND user_id = $2
+RETURNING created_at;
+`
+	err := sqlx.Get(db, &tag.CreatedAt, sql, tag.Id, userId, tag.Key, tag.Comment, tag.UpdatedAt)
+	return s.parseError(err, "update tag")
+}
+
+// DeleteTag deletes the tag and removes it from documents.
+// Returns the ids of documents that had the tag. Tags that are used by rules cannot be deleted.
+func (s *MetadataStore) DeleteTag(userId, tagId int) ([]string, error) {
+	tx, err := s.beginTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	rules := make([]string, 0)
+	sql := `
+SELECT DISTINCT r.name FROM rules r
+WHERE r.user_id = $2 AND (
+	EXISTS (SELECT 1 FROM rule_conditions rc WHERE rc.rule_id = r.id AND rc.tag_id = $1)
+	OR EXISTS (SELECT 1 FROM rule_actions ra WHERE ra.rule_id = r.id AND ra.tag_id = $1))
+ORDER BY r.name;
+`
+	err = tx.tx.Select(&rules, sql, tagId, userId)
+	if err != nil {
+		return nil, s.parseError(err, "get tag rules")
+	}
+	if len(rules) > 0 {
+		e := errors.ErrInvalid
+		e.ErrMsg = fmt.Sprintf("tag is used by rules: %s", strings.Join(rules, ", "))
+		return nil, e
+	}
+
+	documents := make([]string, 0)
+	err = tx.tx.Select(&documents, `SELECT document_id FROM document_tags WHERE tag_id = $1`, tagId)
+	if err != nil {
+		return nil, s.parseError(err, "get tag documents")
+	}
+
+	res, err := tx.tx.Exec(`DELETE FROM tags WHERE id = $1 AND user_id = $2`, tagId, userId)
+	if err != nil {
+		return nil, s.parseError(err, "delete tag")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, s.parseError(err, "delete tag")
+	}
+	if affected == 0 {
+		e := errors.ErrRecordNotFound
+		e.ErrMsg = "tag not found"
+		return nil, e
+	}
+	tx.ok = true
+	return documents, nil
+}
+
+// GetTagDocumentIds returns ids of documents that have the tag.
+func (s *MetadataStore) GetTagDocumentIds(userId, tagId int) ([]string, error) {
+	sql := `
+SELECT dt.document_id
+FROM document_tags dt
+JOIN tags ON dt.tag_id = tags.id
+WHERE dt.tag_id = $1
+AND tags.user_id = $2;
+`
+	documents := make([]string, 0)
+	err := s.db.Select(&documents, sql, tagId, userId)
+	return documents, s.parseError(err, "get tag documents")
+}
+
+// getUserTags returns the tags of given ids that the user owns.
+func (s *MetadataStore) getUserTags(userId int, tagIds []int) ([]models.Tag, error) {
+	query := s.sq.Select("id", "key", "comment", "created_at", "updated_at").From("tags").
+		Where(squirrel.Eq{"user_id": userId, "id": tagIds}).OrderBy("key")
+	sql, args, err := query.ToSql()
+	if err != nil {
+		e := errors.ErrInternalError
+		e.Err = err
+		return nil, e
+	}
+	tags := make([]models.Tag, 0, len(tagIds))
+	err = s.db.Select(&tags, sql, args...)
+	return tags, s.parseError(err, "get user tags")
+}
+
+// getUserTagsExist returns the tags of given ids, or ErrRecordNotFound if user does not own all of them.
+func (s *MetadataStore) getUserTagsExist(userId int, tagIds []int) ([]models.Tag, error) {
+	unique := make(map[int]bool, len(tagIds))
+	for _, v := range tagIds {
+		unique[v] = true
+	}
+	if len(unique) == 0 {
+		return []models.Tag{}, nil
+	}
+	tags, err := s.getUserTags(userId, tagIds)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) != len(unique) {
+		e := errors.ErrRecordNotFound
+		e.ErrMsg = "tag not found"
+		return nil, e
+	}
+	return tags, nil
+}
+
+// UserHasTags returns true if user owns all the tags.
+func (s *MetadataStore) UserHasTags(userId int, tagIds []int) (bool, error) {
+	_, err := s.getUserTagsExist(userId, tagIds)
+	if errors.Is(err, errors.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UpdateDocumentTags sets the tags of the document and saves the changes to document history.
+// User must own the tags.
+func (s *MetadataStore) UpdateDocumentTags(userId int, documentId string, tagIds []int) error {
+	tags, err := s.getUserTagsExist(userId, tagIds)
+	if err != nil {
+		return err
+	}
+	original, err := s.GetDocumentTags(userId, documentId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.beginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	err = s.replaceDocumentTags(tx, documentId, tagIds)
+	if err != nil {
+		return err
+	}
+	err = addDocumentHistoryAction(tx.tx, s.sq, models.TagDiff(documentId, userId, *original, tags), userId)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+// ReplaceDocumentTags replaces document tags without checking ownership or saving document history.
+// Caller is responsible for saving the history.
+func (s *MetadataStore) ReplaceDocumentTags(documentId string, tagIds []int) error {
+	tx, err := s.beginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	err = s.replaceDocumentTags(tx, documentId, tagIds)
+	if err != nil {
+		return err
+	}
+	tx.ok = true
+	return nil
+}
+
+func (s *MetadataStore) replaceDocumentTags(tx *tx, documentId string, tagIds []int) error {
+	_, err := tx.tx.Exec(`DELETE FROM document_tags WHERE document_id = $1`, documentId)
+	if err != nil {
+		return s.parseError(err, "delete document tags")
+	}
+	if len(tagIds) == 0 {
+		return nil
+	}
+	sql := `
+INSERT INTO document_tags (document_id, tag_id)
+SELECT $1, unnest($2::INT[])
+ON CONFLICT DO NOTHING;
+`
+	_, err = tx.tx.Exec(sql, documentId, pq.Array(tagIds))
+	return s.parseError(err, "add document tags")
+}
+
+// documentTag is a tag added to or removed from a document.
+type documentTag struct {
+	DocumentId string `db:"document_id"`
+	TagId      int    `db:"tag_id"`
+}
+
+const addDocumentsTagsSql = `
+INSERT INTO document_tags (document_id, tag_id)
+SELECT documents.id, tags.id
+FROM documents CROSS JOIN tags
+WHERE documents.id = ANY($1)
+AND documents.user_id = $2
+AND tags.id = ANY($3)
+AND tags.user_id = $2
+ON CONFLICT DO NOTHING
+RETURNING document_id, tag_id;
+`
+
+const removeDocumentsTagsSql = `
+DELETE FROM document_tags
+WHERE document_id = ANY($1)
+AND document_id IN (SELECT id FROM documents WHERE user_id = $2)
+AND tag_id = ANY($3)
+RETURNING document_id, tag_id;
+`
+
+// updateDocumentsTags runs the query that adds or removes tags and saves a history item of each changed tag.
+func (s *MetadataStore) updateDocumentsTags(tx *tx, userId int, tags map[int]models.Tag, documents []string,
+	tagIds []int, sql string, action string) error {
+	changed := make([]documentTag, 0)
+	err := tx.tx.Select(&changed, sql, pq.Array(documents), userId, pq.Array(tagIds))
+	if err != nil {
+		return s.parseError(err, "update documents tags")
+	}
+
+	history := make([]models.DocumentHistory, 0, len(changed))
+	for _, v := range changed {
+		tag := []models.Tag{tags[v.TagId]}
+		if action == models.DocumentHistoryActionTagAdd {
+			history = append(history, models.TagDiff(v.DocumentId, userId, nil, tag)...)
+		} else {
+			history = append(history, models.TagDiff(v.DocumentId, userId, tag, nil)...)
+		}
+	}
+	return addDocumentHistoryAction(tx.tx, s.sq, history, userId)
+}
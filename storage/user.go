@@ -27,6 +27,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/patrickmn/go-cache"
+	"tryffel.net/go/virtualpaper/dateparse"
 	"tryffel.net/go/virtualpaper/errors"
 	"tryffel.net/go/virtualpaper/models"
 )
@@ -340,6 +341,8 @@ GROUP BY(s.id);`
 			return pref, fmt.Errorf("unmarshal synonyms: %v", err)
 		}
 	}
+
+	pref.DateOrder, pref.DateLanguages, err = s.GetDatePreferences(userid)
 	return pref, err
 
 }
@@ -349,6 +352,9 @@ type PreferenceKey string
 const (
 	PreferenceStopWords PreferenceKey = "stop_words"
 	PreferenceSynonyms  PreferenceKey = "synonyms"
+
+	PreferenceDateOrder     PreferenceKey = "date_order"
+	PreferenceDateLanguages PreferenceKey = "date_languages"
 )
 
 func (s *UserStore) GetPreferenceValue(userId int, key PreferenceKey) (string, error) {
@@ -402,6 +408,56 @@ func (s *UserStore) UpdatePreferences(userId int, stopWords []string, synonyms [
 	return nil
 }
 
+// GetDatePreferences returns user's date order and languages for parsing dates.
+// If user has not set them, return empty values.
+func (s *UserStore) GetDatePreferences(userId int) (string, []string, error) {
+	order, err := s.GetPreferenceValue(userId, PreferenceDateOrder)
+	if err != nil && !errors.Is(err, errors.ErrRecordNotFound) {
+		return "", nil, fmt.Errorf("get date order: %v", err)
+	}
+
+	languages := []string{}
+	value, err := s.GetPreferenceValue(userId, PreferenceDateLanguages)
+	if err != nil && !errors.Is(err, errors.ErrRecordNotFound) {
+		return "", nil, fmt.Errorf("get date languages: %v", err)
+	}
+	if value != "" {
+		err = json.Unmarshal([]byte(value), &languages)
+		if err != nil {
+			return "", nil, fmt.Errorf("unmarshal date languages: %v", err)
+		}
+	}
+	return order, languages, nil
+}
+
+// GetDateOptions returns options for parsing dates for user.
+func (s *UserStore) GetDateOptions(userId int) (dateparse.Options, error) {
+	order, languages, err := s.GetDatePreferences(userId)
+	if err != nil {
+		return dateparse.DefaultOptions(), err
+	}
+	pref := &models.UserPreferences{DateOrder: order, DateLanguages: languages}
+	return pref.DateOptions(), nil
+}
+
+// UpdateDatePreferences sets user's date order and languages.
+func (s *UserStore) UpdateDatePreferences(userId int, order string, languages []string) error {
+	languagesB, err := json.Marshal(languages)
+	if err != nil {
+		return fmt.Errorf("serialize date languages: %v", err)
+	}
+
+	err = s.SetPreferenceValue(userId, PreferenceDateOrder, order)
+	if err != nil {
+		return fmt.Errorf("save date order: %v", err)
+	}
+	err = s.SetPreferenceValue(userId, PreferenceDateLanguages, string(languagesB))
+	if err != nil {
+		return fmt.Errorf("save date languages: %v", err)
+	}
+	return nil
+}
+
 func (s *UserStore) AddPasswordResetToken(token *models.PasswordResetToken) error {
 	err := token.Validate()
 	if err != nil {